@@ -0,0 +1,161 @@
+// Annotations for CI: failures and compiler diagnostics in the syntax of the
+// platform running the build, so they show up on the changed lines.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// The --annotations option: auto, github, gitlab or none.
+	annotationsMode string
+
+	// The platform to annotate for, empty for none.
+	ciPlatform string
+
+	// Failed recipes, as problems at the location of their rule.
+	failureAnnotations []problem
+	annotationsMutex   sync.Mutex
+)
+
+// GitLab reads the report from the artifacts of the job, under this name by
+// convention.
+const gitlabReport = "gl-code-quality-report.json"
+
+// Find the platform to annotate for: the one given, or with auto the one
+// whose environment variables are set.
+func detectCI(mode string) (string, error) {
+	switch mode {
+	case "none":
+		return "", nil
+	case "github", "gitlab":
+		return mode, nil
+	case "auto":
+		if os.Getenv("GITHUB_ACTIONS") == "true" {
+			return "github", nil
+		}
+		if os.Getenv("GITLAB_CI") == "true" {
+			return "gitlab", nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown platform %q for --annotations, expected auto, github, gitlab or none", mode)
+}
+
+// Remember a failed recipe, to annotate its rule.
+func annotateFailure(r *rule, msg string) {
+	if ciPlatform == "" {
+		return
+	}
+	annotationsMutex.Lock()
+	failureAnnotations = append(failureAnnotations, problem{File: r.file, Line: r.line, Severity: "error",
+		Message: string(maskSecrets([]byte(msg)))})
+	annotationsMutex.Unlock()
+}
+
+// Escape a value of a GitHub workflow command. Properties need ':' and ','
+// escaped too.
+func githubEscape(s string, property bool) string {
+	s = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+	if property {
+		s = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(s)
+	}
+	return s
+}
+
+// The annotations: the failures, then the problems.
+func annotations() []problem {
+	annotationsMutex.Lock()
+	all := append([]problem(nil), failureAnnotations...)
+	annotationsMutex.Unlock()
+	problemsMutex.Lock()
+	all = append(all, problems...)
+	problemsMutex.Unlock()
+	return all
+}
+
+// Print the annotations as GitHub workflow commands.
+func writeGithubAnnotations(w io.Writer, all []problem) error {
+	for _, p := range all {
+		command := p.Severity
+		if command == "note" {
+			command = "notice"
+		}
+		props := fmt.Sprintf("file=%s,line=%d", githubEscape(p.File, true), p.Line)
+		if p.Col > 0 {
+			props += fmt.Sprintf(",col=%d", p.Col)
+		}
+		if _, err := fmt.Fprintf(w, "::%s %s::%s\n", command, props, githubEscape(p.Message, false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An issue in a GitLab code quality report.
+type gitlabIssue struct {
+	Description string `json:"description"`
+	CheckName   string `json:"check_name"`
+	Fingerprint string `json:"fingerprint"`
+	Severity    string `json:"severity"` // info, minor, major, critical or blocker
+	Location    struct {
+		Path  string `json:"path"`
+		Lines struct {
+			Begin int `json:"begin"`
+		} `json:"lines"`
+	} `json:"location"`
+}
+
+// Write the annotations as a GitLab code quality report.
+func writeGitlabReport(w io.Writer, all []problem) error {
+	issues := []gitlabIssue{}
+	for _, p := range all {
+		var issue gitlabIssue
+		issue.Description = p.Message
+		issue.CheckName = "mk"
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d:%s", p.File, p.Line, p.Col, p.Message)))
+		issue.Fingerprint = hex.EncodeToString(sum[:16])
+		switch p.Severity {
+		case "error":
+			issue.Severity = "major"
+		case "warning":
+			issue.Severity = "minor"
+		default:
+			issue.Severity = "info"
+		}
+		issue.Location.Path = p.File
+		issue.Location.Lines.Begin = p.Line
+		issues = append(issues, issue)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(issues)
+}
+
+// Emit the annotations for the platform, at the end of the build.
+func writeAnnotations() error {
+	all := annotations()
+	switch ciPlatform {
+	case "github":
+		return writeGithubAnnotations(os.Stdout, all)
+	case "gitlab":
+		f, err := os.Create(gitlabReport)
+		if err != nil {
+			return err
+		}
+		if err := writeGitlabReport(f, all); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
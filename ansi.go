@@ -0,0 +1,63 @@
+// Stripping ANSI escape sequences, such as colors, from the output of recipes,
+// with --strip-ansi: by default from the logs mk keeps in files, so they can be
+// searched, while the terminal keeps the colors.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+)
+
+// Where escape sequences are stripped: "logs", "terminal", or both.
+var stripANSI = []string{"logs"}
+
+// Control sequences, like colors, operating system commands, like titles and
+// links, and the other escapes, like those choosing a character set.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)|\x1b[ -/]*[0-~]")
+
+// Check the destinations given to --strip-ansi.
+func checkStripANSI() error {
+	for _, dest := range stripANSI {
+		if dest != "logs" && dest != "terminal" && dest != "none" {
+			return fmt.Errorf("unknown destination %q for --strip-ansi, expected logs, terminal or none", dest)
+		}
+	}
+	return nil
+}
+
+// Whether escape sequences are stripped from the output going to dest.
+func strippedFor(dest string) bool {
+	return slices.Contains(stripANSI, dest)
+}
+
+// The output without escape sequences, if they are stripped for dest.
+func stripFor(dest string, b []byte) []byte {
+	if !strippedFor(dest) {
+		return b
+	}
+	return ansiEscape.ReplaceAll(b, nil)
+}
+
+// A writer stripping escape sequences. A sequence split over two writes gets
+// through.
+type stripWriter struct {
+	w io.Writer
+}
+
+func (s stripWriter) Write(p []byte) (int, error) {
+	if _, err := s.w.Write(ansiEscape.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Strip the escape sequences written to w, if they are stripped for dest.
+func strippedWriter(dest string, w io.Writer) io.Writer {
+	if !strippedFor(dest) {
+		return w
+	}
+	return stripWriter{w}
+}
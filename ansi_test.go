@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestStripANSI(t *testing.T) {
+	defer func(dests []string) { stripANSI = dests }(stripANSI)
+
+	colored := "\x1b[1;31merror:\x1b[0m \x1b]8;;file:///a.c\x07a.c\x1b]8;;\x07:3: x\x1b(B\n"
+	stripANSI = []string{"logs"}
+	if got := string(stripFor("logs", []byte(colored))); got != "error: a.c:3: x\n" {
+		t.Errorf("stripped for the logs: %q", got)
+	}
+	if got := string(stripFor("terminal", []byte(colored))); got != colored {
+		t.Errorf("stripped for the terminal: %q", got)
+	}
+
+	stripANSI = []string{"none"}
+	if got := string(stripFor("logs", []byte(colored))); got != colored {
+		t.Errorf("stripped with none: %q", got)
+	}
+
+	stripANSI = []string{"logs", "files"}
+	if err := checkStripANSI(); err == nil {
+		t.Error("an unknown destination is accepted")
+	}
+}
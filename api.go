@@ -0,0 +1,329 @@
+// The HTTP API of mk serve, for editors and dashboards to list targets, start
+// builds and follow them without running mk themselves.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An event sent to the clients of /api/events.
+type apiEvent struct {
+	Type     string        `json:"type"` // "build", "start", "done", "problem" or "reload"
+	Build    int           `json:"build"`
+	BuildID  string        `json:"build_id"`      // $MKBUILDID
+	Seq      string        `json:"seq,omitempty"` // $MKSEQ of the recipe, once done
+	Target   string        `json:"target,omitempty"`
+	State    string        `json:"state,omitempty"` // of a build: "running", "done" or "failed"
+	Failed   bool          `json:"failed,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Problem  *problem      `json:"problem,omitempty"` // found in the output of the target's recipe
+	Targets  []string      `json:"targets,omitempty"` // out of date as their rules changed, on "reload"
+}
+
+// A build started through the API.
+type apiBuild struct {
+	ID       int       `json:"id"`
+	Targets  []string  `json:"targets"`
+	State    string    `json:"state"` // "running", "done" or "failed"
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitzero"`
+	Failed   []string  `json:"failed,omitempty"` // targets whose recipe failed
+	Running  []string  `json:"running,omitempty"`
+}
+
+// The state of the API: the rules, the current or last build, and the clients
+// following the events.
+type apiServer struct {
+	rs      *ruleSet
+	stamps  map[string]mkfileStamp // of the mkfiles rs was read from
+	mu      sync.Mutex
+	build   *apiBuild
+	builds  sync.WaitGroup // the build that is running
+	clients map[chan apiEvent]bool
+}
+
+// The API of a running mk serve, to which mkNode reports the recipes it runs,
+// or nil.
+var api *apiServer
+
+// Send an event to the clients of the API, if mk is serving it. The events of
+// recipes update the build too.
+func publishEvent(ev apiEvent) {
+	if api == nil {
+		return
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	ev.BuildID = buildID
+	if b := api.build; b != nil {
+		ev.Build = b.ID
+		switch ev.Type {
+		case "start":
+			b.Running = append(b.Running, ev.Target)
+		case "done":
+			b.Running = slices.DeleteFunc(b.Running, func(t string) bool { return t == ev.Target })
+			if ev.Failed {
+				b.Failed = append(b.Failed, ev.Target)
+			}
+		}
+	}
+	for ch := range api.clients {
+		// a client that does not keep up misses events, rather than
+		// holding up the build
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Start serving the API for the rule set.
+func newAPIServer(rs *ruleSet) *apiServer {
+	GlobalMkState = rs.vars
+	api = &apiServer{rs: rs, stamps: mkfileStamps(rs), clients: make(map[chan apiEvent]bool)}
+	return api
+}
+
+// The rules served, those of the mkfiles as they were last read.
+func (s *apiServer) rules() *ruleSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rs
+}
+
+// Start building the targets, or the default ones if none are given, unless
+// a build is running. Return the build as it started.
+func (s *apiServer) start(targets []string) (apiBuild, error) {
+	s.reportReload(s.reload())
+
+	s.mu.Lock()
+	if s.build != nil && s.build.State == "running" {
+		s.mu.Unlock()
+		return apiBuild{}, fmt.Errorf("build %d is running", s.build.ID)
+	}
+	if len(targets) == 0 {
+		targets = defaultTargets(s.rs)
+	}
+	id := 1
+	if s.build != nil {
+		id = s.build.ID + 1
+	}
+	b := &apiBuild{ID: id, Targets: targets, State: "running", Started: time.Now()}
+	s.build = b
+	started := *b
+	buildCancelled.Store(false)
+	buildStopped.Store(false)
+	s.mu.Unlock()
+
+	publishEvent(apiEvent{Type: "build", State: b.State})
+	s.builds.Add(1)
+	go s.run(b)
+	return started, nil
+}
+
+// Build the targets, one build at a time.
+func (s *apiServer) run(b *apiBuild) {
+	defer s.builds.Done()
+	heldMutex.Lock()
+	heldFailures = nil
+	heldMutex.Unlock()
+	problemsMutex.Lock()
+	problems, problemsSeen = nil, make(map[problem]bool)
+	problemsMutex.Unlock()
+
+	forgetStats()
+	hashes = newFileHasher(hashWorkers)
+	g := graphOf(s.rules(), b.Targets)
+	ok := g.checkPrereqs()
+	if ok {
+		prefetchHashes(g)
+		mkNode(g, g.root, false, true)
+		ok = g.root.status != nodeStatusFailed
+		if err := hashes.save(); err != nil {
+			mkPrintWarning(fmt.Sprintf("remembering the hashes of files: %v", err))
+		}
+	}
+	saveLockFiles()
+
+	s.mu.Lock()
+	b.State, b.Finished = "done", time.Now()
+	if !ok {
+		b.State = "failed"
+	}
+	s.mu.Unlock()
+	publishEvent(apiEvent{Type: "build", State: b.State})
+}
+
+// Add the routes of the API to the handler of mk serve.
+func (s *apiServer) routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/targets", func(w http.ResponseWriter, r *http.Request) {
+		type target struct {
+			Name string `json:"name"`
+			Doc  string `json:"doc,omitempty"`
+			File string `json:"file"`
+		}
+		targets := []target{}
+		keys, groups := groupTargets(s.rules(), "file")
+		for _, key := range keys {
+			for _, t := range groups[key] {
+				targets = append(targets, target{t.name, t.doc, t.rule.file})
+			}
+		}
+		writeJSON(w, http.StatusOK, targets)
+	})
+
+	mux.HandleFunc("POST /api/build", func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.start(r.URL.Query()["target"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, b)
+	})
+
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.build == nil {
+			writeJSON(w, http.StatusOK, struct{}{})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.build)
+	})
+
+	// Server-sent events, one for every build started or finished and every
+	// recipe started or done.
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ch := make(chan apiEvent, 64)
+		s.mu.Lock()
+		s.clients[ch] = true
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.clients, ch)
+			s.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-ch:
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// Write a value as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Require the token with every request, as a bearer token or as the token
+// parameter, which the page of --ui passes on.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("token")
+		if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			given = auth
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "a valid token is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Refuse requests made for another site: a Host or Origin other than the
+// address mk listens on, as with DNS rebinding or from a page of another
+// site, and requests changing anything without the Mk-Request header, which
+// a form of another site can't send.
+func checkOrigin(addr string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameHost(addr, r.Host) {
+			http.Error(w, fmt.Sprintf("%s is not the address of mk", r.Host), http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !sameHost(addr, u.Host) {
+				http.Error(w, fmt.Sprintf("requests from %s are not allowed", origin), http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get("Mk-Request") == "" {
+			http.Error(w, "the Mk-Request header is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether the host of a request is the address mk listens on. On all
+// interfaces any name of the machine is, on the loopback any name of it.
+func sameHost(addr, host string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// the default port of http
+		h, port = strings.Trim(host, "[]"), "80"
+	}
+	if port != listenPort {
+		return false
+	}
+	if listenHost == "" || net.ParseIP(listenHost) != nil && net.ParseIP(listenHost).IsUnspecified() {
+		return true
+	}
+	if isLoopbackHost(listenHost) {
+		return isLoopbackHost(h)
+	}
+	return strings.EqualFold(h, listenHost)
+}
+
+// Whether a host name or address is the loopback.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// A random token for the API.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
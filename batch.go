@@ -0,0 +1,220 @@
+// Batch rules: rules with the B attribute run their recipe once for all of
+// their targets that are out of date, rather than once for each.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The targets of a batch rule in a graph, reporting as mkNode gets to them.
+// The last to report runs the recipe for those that are out of date.
+type batch struct {
+	mutex    sync.Mutex
+	pending  int            // targets that did not report yet
+	reported map[*node]bool // targets that did
+	members  []batchMember  // targets that are out of date
+	changed  []string       // prerequisites putting the members out of date
+	done     chan struct{}  // closed once the recipe ran
+	ok       bool           // whether it succeeded
+}
+
+// A target of a batch, and the edge by which the rule makes it.
+type batchMember struct {
+	u *node
+	e *edge
+}
+
+type batchKey struct {
+	g *graph
+	r *rule
+}
+
+var (
+	batches      = make(map[batchKey]*batch)
+	batchesMutex sync.Mutex
+)
+
+// The nodes of the graph the rule makes, in the order mkNode finds them.
+func (g *graph) batchTargets(r *rule) []*node {
+	var targets []*node
+	seen := make(map[*node]bool)
+	var visit func(u *node)
+	visit = func(u *node) {
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		var made *edge
+		for _, e := range u.prereqs {
+			if e.r != nil {
+				made = e
+			}
+			if e.v != nil {
+				visit(e.v)
+			}
+		}
+		if made != nil && made.r == r {
+			targets = append(targets, u)
+		}
+	}
+	visit(g.root)
+	return targets
+}
+
+// The batch of a rule in a graph.
+func (g *graph) batchOf(r *rule) *batch {
+	batchesMutex.Lock()
+	defer batchesMutex.Unlock()
+	key := batchKey{g, r}
+	if b, ok := batches[key]; ok {
+		return b
+	}
+	b := &batch{pending: len(g.batchTargets(r)), reported: make(map[*node]bool), done: make(chan struct{})}
+	batches[key] = b
+	return b
+}
+
+// Report a target whose recipe needs to run, because of the causes, and wait
+// for the recipe of the batch. Return whether it succeeded.
+func (b *batch) join(u *node, e *edge, causes []string, dryrun bool) bool {
+	b.mutex.Lock()
+	if b.reported[u] && b.pending == 0 {
+		// skipped, and required after all once the batch ran
+		b.mutex.Unlock()
+		alone := &batch{members: []batchMember{{u, e}}}
+		alone.add(u, causes)
+		return alone.run(dryrun)
+	}
+	b.members = append(b.members, batchMember{u, e})
+	b.add(u, causes)
+	if b.reported[u] {
+		b.mutex.Unlock()
+	} else {
+		b.report(u, dryrun)
+	}
+	<-b.done
+	return b.ok
+}
+
+// Report a target that is up to date, or that can't be made.
+func (b *batch) skip(u *node, dryrun bool) {
+	b.mutex.Lock()
+	if b.reported[u] {
+		b.mutex.Unlock()
+		return
+	}
+	b.report(u, dryrun)
+}
+
+// Add the prerequisites of the target among the causes to those that changed.
+func (b *batch) add(u *node, causes []string) {
+	for _, e := range u.prereqs {
+		if e.v != nil && slices.Contains(causes, e.v.name) && !slices.Contains(b.changed, e.v.name) {
+			b.changed = append(b.changed, e.v.name)
+		}
+	}
+}
+
+// Count the report of a target, with the mutex held. The last one runs the
+// recipe.
+func (b *batch) report(u *node, dryrun bool) {
+	b.reported[u] = true
+	b.pending--
+	last := b.pending == 0
+	b.mutex.Unlock()
+	if !last {
+		return
+	}
+	if len(b.members) > 0 {
+		b.ok = b.run(dryrun)
+	}
+	close(b.done)
+}
+
+// Run the recipe once for all the members, in the order of their names.
+func (b *batch) run(dryrun bool) bool {
+	slices.SortFunc(b.members, func(x, y batchMember) int { return strings.Compare(x.u.name, y.u.name) })
+	slices.Sort(b.changed)
+	u, e := b.members[0].u, b.members[0].e
+	var targets, prereqs, stems []string
+	for _, m := range b.members {
+		targets = append(targets, m.u.name)
+		if m.e.stem != "" {
+			stems = append(stems, m.e.stem)
+		}
+		for _, p := range m.u.prereqs {
+			if p.r == e.r && p.v != nil && !p.discovered && !slices.Contains(prereqs, p.v.name) {
+				prereqs = append(prereqs, p.v.name)
+			}
+		}
+	}
+	vars := map[string][]string{
+		"target":  targets,
+		"targets": targets,
+		"prereq":  prereqs,
+		"changed": b.changed,
+	}
+	if e.r.ismeta && !e.r.attributes.regex {
+		vars["stem"] = stems
+	}
+
+	if e.r.attributes.exclusive {
+		reserveExclusiveSubproc()
+		defer finishExclusiveSubproc()
+	} else {
+		reserveSubproc(memoryEstimate(e.r))
+		defer finishSubproc(memoryEstimate(e.r))
+	}
+	return dorecipe(strings.Join(targets, " "), u, e, dryrun, vars)
+}
+
+// Batch rules whose targets depend on another target of the same rule: the
+// recipe could not run before itself.
+func (g *graph) batchCycles() []string {
+	rules := make(map[*rule]bool)
+	for _, u := range g.nodes {
+		for _, e := range u.prereqs {
+			if e.r != nil && e.r.attributes.batch && e.r.recipe != "" {
+				rules[e.r] = true
+			}
+		}
+	}
+
+	var cycles []string
+	for r := range rules {
+		members := make(map[*node]bool)
+		for _, u := range g.batchTargets(r) {
+			members[u] = true
+		}
+		// whether a node is, or depends on, a member
+		reaches := make(map[*node]bool)
+		var visit func(u *node) bool
+		visit = func(u *node) bool {
+			if reached, ok := reaches[u]; ok {
+				return reached
+			}
+			reaches[u] = members[u]
+			for _, e := range u.prereqs {
+				if e.v != nil && visit(e.v) {
+					reaches[u] = true
+				}
+			}
+			return reaches[u]
+		}
+		for u := range members {
+			for _, e := range u.prereqs {
+				if e.v != nil && visit(e.v) {
+					cycles = append(cycles, fmt.Sprintf("%s depends on another target of the batch rule at %s:%d",
+						u.name, r.file, r.line))
+					break
+				}
+			}
+		}
+	}
+	slices.Sort(cycles)
+	return cycles
+}
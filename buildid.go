@@ -0,0 +1,52 @@
+// The ID of the build, $MKBUILDID, and the sequence number of every recipe it
+// executes, $MKSEQ, to tell which run of mk made an artifact or wrote a line
+// of a log. mk running in a recipe keeps the ID of the mk running it, and
+// numbers its recipes after that recipe: 3.1, 3.2 and so on in recipe 3.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	// A random UUID, or that of the mk running this one.
+	buildID string
+
+	// The recipes executed so far.
+	recipeSeq atomic.Int64
+
+	// The $MKSEQ of the recipe running this mk and a dot, if any.
+	seqPrefix string
+)
+
+// Take the ID of the mk running this one, or make a new one.
+func initBuildID() {
+	if id := os.Getenv("MKBUILDID"); mkLevel > 0 && id != "" {
+		buildID = id
+		if seq := os.Getenv("MKSEQ"); seq != "" {
+			seqPrefix = seq + "."
+		}
+		return
+	}
+	buildID = newUUID()
+}
+
+// A random UUID, version 4.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// The sequence number of a recipe starting, from 1, after that of the recipe
+// running this mk.
+func nextSeq() string {
+	return seqPrefix + strconv.FormatInt(recipeSeq.Add(1), 10)
+}
@@ -0,0 +1,209 @@
+// A remote cache of targets, with --cache: before a recipe runs, the target is
+// fetched from an HTTP server by a key hashing everything the recipe makes it
+// from, and once the recipe made it, it is uploaded under that key.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Base URL of the cache, targets are at the URL followed by their key.
+	cacheURL string
+
+	// Fetch targets from the cache, but do not upload them.
+	cacheReadOnly bool
+
+	// Set once the cache failed, the build goes on without it.
+	cacheFailed atomic.Bool
+
+	cacheClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// First line of a target in the cache, followed by its mode.
+const cacheMagic = "mk-cache 1"
+
+// A target the cache does not have.
+var errCacheMiss = errors.New("not in the cache")
+
+// The key of a target in the cache, empty if its recipe can't be cached: it
+// has to make a single file, from files.
+func cacheKey(u *node, e *edge, prereqs []*node) (string, error) {
+	r := e.r
+	if cacheURL == "" || cacheFailed.Load() || r.attributes.virtual || r.attributes.batch || len(r.targets) > 1 ||
+		r.depfile != "" || r.delegate != "" || isTreeTarget(u.name, r) {
+		return "", nil
+	}
+
+	// the recipe as it runs, with the names of the target, its stem and its
+	// prerequisites
+	recipe := expandRecipeSigils(r.recipe, recipeVars(u.name, u, e, nil))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\n", hashAlgorithm, u.name, e.stem,
+		strings.Join(e.matches, "\x00"), strings.Join(r.shell, " "), recipe)
+	for _, name := range r.envdeps {
+		fmt.Fprintf(h, "$%s\x00%s\n", name, envHash(name))
+	}
+	hashRecipeEnv(h, recipe)
+	for _, v := range prereqs {
+		if v.virtual {
+			return "", nil
+		}
+		sum, err := hashes.hash(v.name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", v.name, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Variables a recipe refers to, like $CFLAGS or ${CFLAGS}.
+var recipeVarRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Hash the environment a recipe runs with: the variables of the mkfile, the
+// platform, and the variables of mk's own environment the recipe refers to.
+// The rest of the environment, which differs from one machine to the next,
+// is left out, for the cache to be shared.
+func hashRecipeEnv(h io.Writer, recipe string) {
+	referred := map[string]bool{"MKOS": true, "MKARCH": true}
+	for _, m := range recipeVarRef.FindAllStringSubmatch(recipe, -1) {
+		referred[m[1]] = true
+	}
+	for _, name := range slices.Sorted(maps.Keys(GlobalMkState)) {
+		value := strings.Join(GlobalMkState[name], " ")
+		if env, ok := os.LookupEnv(name); ok && env == value && !referred[name] {
+			continue
+		}
+		fmt.Fprintf(h, "$%s\x00%s\n", name, value)
+	}
+}
+
+// Fetch a target from the cache. Returns errCacheMiss if it is not there.
+func fetchCached(target, key string) error {
+	resp, err := cacheRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errCacheMiss
+	case resp.StatusCode != http.StatusOK:
+		return errors.New(resp.Status)
+	}
+
+	body := bufio.NewReader(resp.Body)
+	header, err := body.ReadString('\n')
+	var mode fs.FileMode
+	if n, _ := fmt.Sscanf(header, cacheMagic+" %o\n", &mode); n != 1 || err != nil {
+		return errors.New("not a target cached by mk")
+	}
+	err = writeFileAtomic(target, func(w io.Writer) error {
+		if f, ok := w.(*os.File); ok {
+			if err := f.Chmod(mode.Perm()); err != nil {
+				return err
+			}
+		}
+		_, err := io.Copy(w, body)
+		return err
+	})
+	return err
+}
+
+// Upload a target the recipe made to the cache.
+func storeCached(target, key string) error {
+	if cacheReadOnly {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	body := append(fmt.Appendf(nil, "%s %o\n", cacheMagic, info.Mode().Perm()), content...)
+	resp, err := cacheRequest(http.MethodPut, key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !slices.Contains([]int{http.StatusOK, http.StatusCreated, http.StatusNoContent}, resp.StatusCode) {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// A request to the cache, with the token of $MK_CACHE_TOKEN if it is set.
+func cacheRequest(method, key string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(cacheURL, "/")+"/"+key, body)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("MK_CACHE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	// the server may keep which build uploaded a target
+	req.Header.Set("Mk-Build-Id", buildID)
+	return cacheClient.Do(req)
+}
+
+// Print that a target was fetched instead of running its recipe.
+func mkPrintCached(target string) {
+	mkMsgMutex.Lock()
+	clearProgress()
+	fmt.Fprintf(buildOutput, "%s: fetched from the cache\n", target)
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// Fetch a target from the cache instead of running its recipe, returning
+// whether it was there.
+func fetchTarget(target string, e *edge, key string) bool {
+	err := fetchCached(target, key)
+	if errors.Is(err, errCacheMiss) {
+		return false
+	} else if err != nil {
+		giveUpCache(fmt.Sprintf("fetching %s from the cache: %v", target, err))
+		return false
+	}
+	if !e.r.attributes.quiet {
+		mkPrintCached(target)
+	}
+	return true
+}
+
+// Upload a target its recipe made to the cache.
+func storeTarget(target, key string) {
+	if err := storeCached(target, key); err != nil {
+		giveUpCache(fmt.Sprintf("uploading %s to the cache: %v", target, err))
+	}
+}
+
+// Report the first error of the cache, and stop using it.
+func giveUpCache(msg string) {
+	if !cacheFailed.Swap(true) {
+		mkPrintWarning(msg + ", building without the cache")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An HTTP cache keeping what is uploaded in memory.
+func newTestCache(t *testing.T) (*httptest.Server, map[string][]byte) {
+	var mutex sync.Mutex
+	stored := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			body, ok := stored[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			stored[r.URL.Path] = body
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, stored
+}
+
+// A target made in one tree is fetched in another with the same sources, and
+// made again once they differ.
+func TestCache(t *testing.T) {
+	server, stored := newTestCache(t)
+
+	mkfile := "prog: prog.c\n\techo ran >> log; cat prog.c > prog; chmod +x prog\n"
+	build := func(source string) (string, string, string) {
+		dir := t.TempDir()
+		for name, content := range map[string]string{"mkfile": mkfile, "prog.c": source} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out, _, err := startMk("-C", dir, "--cache", server.URL)
+		if err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		log, _ := os.ReadFile(filepath.Join(dir, "log"))
+		return dir, string(out), string(log)
+	}
+
+	if _, _, log := build("int main;\n"); log != "ran\n" {
+		t.Errorf("the recipe did not run with an empty cache: %q", log)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("the target was not uploaded: %d entries", len(stored))
+	}
+	dir, out, log := build("int main;\n")
+	if log != "" || !strings.Contains(out, "prog: fetched from the cache") {
+		t.Errorf("the target was not fetched: %q, log %q", out, log)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "prog")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("the fetched target lost its mode: %v", err)
+	}
+	if _, _, log := build("int main() {}\n"); log != "ran\n" {
+		t.Errorf("the recipe did not run with other sources: %q", log)
+	}
+}
+
+// The environment a recipe runs with is part of the key: the variables of the
+// mkfile, which scripts of the recipe may read, and the platform.
+func TestCacheKeyVariables(t *testing.T) {
+	server, _ := newTestCache(t)
+
+	var out []byte
+	build := func(mkfile string, env ...string) string {
+		dir := t.TempDir()
+		for name, content := range map[string]string{"mkfile": mkfile, "flags.sh": "echo $CFLAGS $MKOS\n"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd := exec.Command(os.Args[0], "-C", dir, "--cache", server.URL)
+		cmd.Env = append(append(os.Environ(), "TEST_MAIN=mk"), env...)
+		var err error
+		if out, err = cmd.CombinedOutput(); err != nil {
+			t.Fatalf("exec failed: %v\n%s", err, out)
+		}
+		content, _ := os.ReadFile(filepath.Join(dir, "prog"))
+		return string(content)
+	}
+
+	mkfile := "prog:\n\tsh flags.sh > prog\n"
+	build("CFLAGS=-g\n"+mkfile, "MKOS=linux")
+	if got := build("CFLAGS=-pg\n"+mkfile, "MKOS=linux"); got != "-pg linux\n" {
+		t.Errorf("with another $CFLAGS in the mkfile, prog was fetched as %q", got)
+	}
+	if got := build("CFLAGS=-pg\n"+mkfile, "MKOS=plan9"); got != "-pg plan9\n" {
+		t.Errorf("for another platform, prog was fetched as %q", got)
+	}
+	// the rest of the environment does not matter
+	build("CFLAGS=-pg\n"+mkfile, "MKOS=plan9", "UNRELATED=1")
+	if !strings.Contains(string(out), "prog: fetched from the cache") {
+		t.Errorf("prog was not fetched with another environment:\n%s", out)
+	}
+}
+
+// A target breaking its expectations is not uploaded.
+func TestCacheExpect(t *testing.T) {
+	server, stored := newTestCache(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("prog:expect=nonempty:\n\ttouch prog\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "--cache", server.URL); err == nil {
+		t.Error("prog breaks its expectations, but the build succeeded")
+	}
+	if len(stored) != 0 {
+		t.Errorf("prog was uploaded, although it breaks its expectations")
+	}
+}
@@ -0,0 +1,72 @@
+// The command log, with --log: every command a recipe executes is appended to
+// a file with its target, when it started, how long it took and its exit
+// status, to see what a CI build did and compare it with another.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// File the commands are appended to, none if empty.
+	commandLog string
+
+	// The log, opened with the first command, and whether that failed,
+	// guarded by commandLogMutex.
+	commandLogFile   *os.File
+	commandLogFailed bool
+	commandLogMutex  sync.Mutex
+)
+
+// The exit status of a command, -1 if it did not exit on its own.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Append a command of the recipe of a target to the log: a line with the
+// target, the time it started, its $MKBUILDID and $MKSEQ, how long it took
+// and its exit status, followed by the command, each line indented by a tab.
+func logCommand(target string, seq string, command string, start time.Time, status int) {
+	if commandLog == "" {
+		return
+	}
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "%s: started %s, build %s, seq %s, took %s, exit status %d\n", target,
+		start.Format(time.RFC3339), buildID, seq, time.Since(start).Round(time.Millisecond), status)
+	for line := range strings.Lines(strings.TrimRight(command, "\n")) {
+		entry.WriteString("\t" + line)
+	}
+	entry.WriteString("\n")
+
+	commandLogMutex.Lock()
+	defer commandLogMutex.Unlock()
+	if commandLogFailed {
+		return
+	}
+	if commandLogFile == nil {
+		f, err := os.OpenFile(commandLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			mkPrintWarning(fmt.Sprintf("opening the command log: %v", err))
+			commandLogFailed = true
+			return
+		}
+		commandLogFile = f
+	}
+	if _, err := commandLogFile.Write(maskSecrets([]byte(entry.String()))); err != nil {
+		mkPrintWarning(fmt.Sprintf("writing the command log: %v", err))
+	}
+}
@@ -0,0 +1,141 @@
+// Subcommands, like 'mk restore target'.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// A subcommand gets the parsed mkfile and its arguments, and returns the exit
+// status.
+type subcommand func(rs *ruleSet, args []string) int
+
+// Subcommands are the first argument. They take effect only if the mkfile
+// does not have a rule for a target with the same name.
+var subcommands map[string]subcommand
+
+func init() {
+	subcommands = map[string]subcommand{
+		"graph-diff": cmdGraphDiff,
+		"help":       cmdHelp,
+		"owns":       cmdOwns,
+		"restore":    cmdRestore,
+		"script":     cmdScript,
+		"serve":      cmdServe,
+		"stats":      cmdStats,
+		"version":    cmdVersion,
+	}
+}
+
+// Return the subcommand the arguments call for, if any.
+func findSubcommand(rs *ruleSet, args []string) (subcommand, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok || len(rs.targetrules[args[0]]) > 0 {
+		return nil, false
+	}
+	return cmd, true
+}
+
+// Check the number of arguments of a subcommand, which exits with status 2
+// if they are wrong.
+func checkArgs(name string, args []string, min, max int, usage string) bool {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		mkPrintError(fmt.Sprintf("usage: mk %s %s", name, usage))
+		return false
+	}
+	return true
+}
+
+// mk help: list the documented targets with their description. With targets,
+// show the rules that make them, with their description and comments.
+func cmdHelp(rs *ruleSet, args []string) int {
+	if !checkArgs("help", args, 0, -1, "[target ...]") {
+		return 2
+	}
+	if len(args) > 0 {
+		return helpTargets(rs, args)
+	}
+
+	var names, docs []string
+	width := 0
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.doc == "" {
+			continue
+		}
+		var targets []string
+		for _, t := range r.targets {
+			targets = append(targets, t.spat)
+		}
+		name := strings.Join(targets, " ")
+		names = append(names, name)
+		docs = append(docs, r.doc)
+		width = max(width, utf8.RuneCountInString(name))
+	}
+
+	if len(names) == 0 {
+		fmt.Println("mk: no documented targets, describe them with '##' comments")
+		return 0
+	}
+	for i := range names {
+		pad := strings.Repeat(" ", width-utf8.RuneCountInString(names[i]))
+		if color {
+			fmt.Printf("  %s%s%s%s  %s\n", ansiTermBlue+ansiTermBright, names[i], ansiTermDefault, pad, docs[i])
+		} else {
+			fmt.Printf("  %s%s  %s\n", names[i], pad, docs[i])
+		}
+	}
+	return 0
+}
+
+// Show the rules that make the given targets: the explicit rules, or else the
+// meta-rules matching them.
+func helpTargets(rs *ruleSet, targets []string) int {
+	status := 0
+	for _, target := range targets {
+		var rules []*rule
+		for _, k := range rs.targetrules[target] {
+			rules = append(rules, &rs.rules[k])
+		}
+		if len(rules) == 0 {
+			for i := range rs.rules {
+				r := &rs.rules[i]
+				if r.ismeta && !r.excluded(target) &&
+					slices.ContainsFunc(r.targets, func(p pattern) bool { return p.match(target) != nil }) {
+					rules = append(rules, r)
+				}
+			}
+		}
+		if len(rules) == 0 {
+			mkPrintError(fmt.Sprintf("no rule to make %s", target))
+			status = 1
+			continue
+		}
+
+		for _, r := range rules {
+			fmt.Printf("%s\n", r.describe())
+			if r.doc != "" {
+				fmt.Printf("    %s\n", r.doc)
+			}
+			if r.comment != "" {
+				fmt.Println(indentComment(r.comment, "    "))
+			}
+		}
+	}
+	return status
+}
+
+// Format the comment of a rule as it was written, every line indented.
+func indentComment(comment, indent string) string {
+	lines := strings.Split(comment, "\n")
+	for i := range lines {
+		lines[i] = indent + "# " + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,70 @@
+// Asking before recipes, with --interactive=each: mk shows every recipe it is
+// about to execute and asks whether to, instead of asking once for the whole
+// plan.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// How -i asks: once for the plan, or before each recipe. Empty if it
+	// does not.
+	interactiveMode string
+
+	// Set once the user answered to execute all the remaining recipes.
+	confirmedAll bool
+
+	// One question at a time, the answers read from standard input.
+	confirmMutex sync.Mutex
+	confirmInput = bufio.NewReader(os.Stdin)
+)
+
+// The answers to the question before a recipe.
+type confirmation int
+
+const (
+	confirmRun confirmation = iota
+	confirmSkip
+	confirmQuit
+)
+
+// Ask whether to execute the recipe of a target: yes, no to skip it and take
+// the target as made, all to stop asking, or quit to stop the build. The end
+// of the input quits.
+func confirmRecipe(u *node, e *edge) confirmation {
+	confirmMutex.Lock()
+	defer confirmMutex.Unlock()
+	if confirmedAll {
+		return confirmRun
+	}
+
+	mkMsgMutex.Lock()
+	clearProgress()
+	writeRecipe(os.Stdout, u.name, expandedRecipe(u.name, u, e), false)
+	mkMsgMutex.Unlock()
+	for {
+		fmt.Printf("Execute the recipe of %s? [y]es, [n]o, [a]ll, [q]uit ", u.name)
+		line, err := confirmInput.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			return confirmQuit
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return confirmRun
+		case "n", "no":
+			return confirmSkip
+		case "a", "all":
+			confirmedAll = true
+			return confirmRun
+		case "q", "quit":
+			return confirmQuit
+		}
+	}
+}
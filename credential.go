@@ -0,0 +1,104 @@
+// Secrets from a credential helper, with ${credential name}: the helper is run
+// once per name and the secret it prints is kept in memory for the run. The
+// secrets are masked wherever mk shows recipes and their output.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// Command printing the secret of the name it gets as its last argument,
+	// like 'pass show'.
+	credentialHelper string
+
+	// The secrets fetched so far by name, and their values, longest first,
+	// to mask. Guarded by credentialMutex.
+	credentials     = make(map[string]string)
+	secrets         [][]byte
+	credentialMutex sync.Mutex
+)
+
+// What a secret is replaced with in the output.
+const secretMask = "***"
+
+// ${credential name}: the secret the helper prints for name.
+func funcCredential(args [][]string) []string {
+	name := strings.Join(args[0], " ")
+	volatileRules.Store(true)
+	credentialMutex.Lock()
+	defer credentialMutex.Unlock()
+	if secret, ok := credentials[name]; ok {
+		return []string{secret}
+	}
+
+	secret, err := fetchCredential(name)
+	if err != nil {
+		mkError(fmt.Sprintf("${credential %s}: %v", name, err))
+	}
+	credentials[name] = secret
+	secrets = append(secrets, []byte(secret))
+	slices.SortFunc(secrets, func(a, b []byte) int { return len(b) - len(a) })
+	return []string{secret}
+}
+
+// Run the helper for a name, taking the first line it prints as the secret.
+func fetchCredential(name string) (string, error) {
+	helper := strings.Fields(credentialHelper)
+	if len(helper) == 0 {
+		return "", fmt.Errorf("no credential helper, set one with --credential-helper or $MK_CREDENTIAL_HELPER")
+	}
+	cmd := exec.Command(helper[0], append(helper[1:], name)...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", credentialHelper, name, err)
+	}
+	secret, _, _ := strings.Cut(string(output), "\n")
+	secret = strings.TrimSuffix(secret, "\r")
+	if secret == "" {
+		return "", fmt.Errorf("%s %s printed no secret", credentialHelper, name)
+	}
+	return secret, nil
+}
+
+// Replace the secrets in a text shown to the user.
+func maskSecrets(b []byte) []byte {
+	credentialMutex.Lock()
+	defer credentialMutex.Unlock()
+	for _, secret := range secrets {
+		b = bytes.ReplaceAll(b, secret, []byte(secretMask))
+	}
+	return b
+}
+
+// A writer masking the secrets in what it writes. A secret split over two
+// writes gets through, as recipes mostly write lines at once.
+type maskWriter struct {
+	w io.Writer
+}
+
+func (m maskWriter) Write(p []byte) (int, error) {
+	if _, err := m.w.Write(maskSecrets(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Mask the secrets written to w, if there are any.
+func maskedWriter(w io.Writer) io.Writer {
+	credentialMutex.Lock()
+	defer credentialMutex.Unlock()
+	if len(secrets) == 0 {
+		return w
+	}
+	return maskWriter{w}
+}
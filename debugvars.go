@@ -0,0 +1,66 @@
+// Logging the assignments and expansions of variables while parsing, with
+// --debug-vars, to find where a variable got its value through includes and
+// generators.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// The variables whose assignments and expansions are logged.
+	debugVars = make(map[string]bool)
+
+	// The file and line being parsed, empty once parsing is done.
+	parsingAt string
+)
+
+// Log an assignment to a variable, with its previous value.
+func debugAssign(name string, old []string, had bool, vals []string, note string) {
+	if parsingAt == "" || !debugVars[name] {
+		return
+	}
+	msg := fmt.Sprintf("%s: %s = %s (was %s)", parsingAt, name, formatValue(vals, true), formatValue(old, had))
+	if note != "" {
+		msg += ", " + note
+	}
+	debugLog(msg)
+}
+
+// Log a variable being unset, with its previous value.
+func debugUnset(name string, old []string, had bool, note string) {
+	if parsingAt == "" || !debugVars[name] {
+		return
+	}
+	debugLog(fmt.Sprintf("%s: %s unset (was %s), %s", parsingAt, name, formatValue(old, had), note))
+}
+
+// Log the expansion of a variable.
+func debugExpand(name string, vals []string, ok bool) {
+	if parsingAt == "" || !debugVars[name] {
+		return
+	}
+	debugLog(fmt.Sprintf("%s: $%s expands to %s", parsingAt, name, formatValue(vals, ok)))
+}
+
+// Log a message, with the secrets in values masked.
+func debugLog(msg string) {
+	msg = string(maskSecrets([]byte(msg)))
+	mkMsgMutex.Lock()
+	fmt.Fprintln(os.Stderr, msg)
+	mkMsgMutex.Unlock()
+}
+
+// A value as it is logged.
+func formatValue(vals []string, ok bool) string {
+	switch {
+	case !ok:
+		return "unset"
+	case len(vals) == 0:
+		return "empty"
+	}
+	return "'" + strings.Join(vals, " ") + "'"
+}
@@ -0,0 +1,173 @@
+// Depfiles: recipes naming the prerequisites they found, such as the headers
+// a C file includes, in a file like those of gcc -MD. mk reads it once the
+// recipe succeeds, and adds them to the prerequisites of the target on later
+// runs.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The prerequisites found in the depfile of every target.
+var depState = &lockFile{
+	path:   "deps",
+	header: "Generated by mk, the prerequisites found in depfiles.",
+	state:  true,
+}
+
+// The name of the depfile of a target, expanding the variables of its recipe
+// that are known by then.
+func depfileName(u *node, e *edge) string {
+	vars := maps.Clone(GlobalMkState)
+	if vars == nil {
+		vars = make(map[string][]string)
+	}
+	vars["target"] = []string{u.name}
+	if e.r.attributes.regex {
+		for i := range e.matches {
+			vars[fmt.Sprintf("stem%d", i)] = e.matches[i : i+1]
+		}
+	} else if e.r.ismeta {
+		vars["stem"] = []string{e.stem}
+	}
+	return strings.Join(expand(e.r.depfile, vars, false), " ")
+}
+
+// The prerequisites in a depfile: every name following a target and a colon,
+// on lines continued with a backslash. A blank or '#' in a name is escaped
+// with a backslash, a '$' is doubled.
+func parseDepfile(data string) []string {
+	data = strings.ReplaceAll(data, "\\\r\n", " ")
+	data = strings.ReplaceAll(data, "\\\n", " ")
+
+	var deps []string
+	for _, line := range strings.Split(data, "\n") {
+		// the colon after the targets, not that of a drive letter
+		colon := -1
+		for i := 0; i < len(line); i++ {
+			if line[i] == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t' || line[i+1] == '\r') {
+				colon = i
+				break
+			}
+		}
+		if colon < 0 {
+			continue
+		}
+
+		var name strings.Builder
+		rest := line[colon+1:]
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			switch {
+			case c == '\\' && i+1 < len(rest) && (rest[i+1] == ' ' || rest[i+1] == '#'):
+				i++
+				name.WriteByte(rest[i])
+			case c == '$' && i+1 < len(rest) && rest[i+1] == '$':
+				i++
+				name.WriteByte('$')
+			case c == ' ' || c == '\t' || c == '\r':
+				if name.Len() > 0 {
+					deps = append(deps, name.String())
+					name.Reset()
+				}
+			default:
+				name.WriteByte(c)
+			}
+		}
+		if name.Len() > 0 {
+			deps = append(deps, name.String())
+		}
+	}
+	return deps
+}
+
+// Read the depfile the recipe of a target wrote, and remember the
+// prerequisites it names that the rule does not.
+func recordDeps(u *node, e *edge) error {
+	name := depfileName(u, e)
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("the recipe did not write the depfile %s", name)
+	} else if err != nil {
+		return err
+	}
+
+	var deps []string
+	for _, dep := range parseDepfile(string(data)) {
+		known := dep == u.name || slices.Contains(deps, dep) || slices.ContainsFunc(u.prereqs,
+			func(f *edge) bool { return f.v != nil && f.v.name == dep && !f.discovered })
+		if !known {
+			deps = append(deps, dep)
+		}
+	}
+
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	if len(deps) == 0 {
+		return depState.remove(u.name)
+	}
+	return depState.set(u.name, strings.Join(deps, "\t"))
+}
+
+// The prerequisites found in the depfile of a target before.
+func discoveredDeps(target string) []string {
+	value, ok, err := depState.get(target)
+	if err != nil {
+		mkError(err.Error())
+	}
+	if !ok || value == "" {
+		return nil
+	}
+	return strings.Split(value, "\t")
+}
+
+// Add the prerequisites found in depfiles to the targets made by rules with
+// one. Those that no longer exist are left out: whatever included them
+// changed since.
+func (g *graph) addDiscoveredDeps(rs *ruleSet) {
+	var added []*node
+	for _, u := range slices.Collect(maps.Values(g.nodes)) {
+		var e *edge
+		for _, f := range u.prereqs {
+			if f.r != nil {
+				e = f
+			}
+		}
+		if e == nil || e.r.depfile == "" || e.r.attributes.virtual {
+			continue
+		}
+		for _, dep := range discoveredDeps(u.name) {
+			if v, ok := g.nodes[dep]; ok {
+				f := u.newedge(v, e.r)
+				f.stem, f.matches, f.discovered = e.stem, e.matches, true
+				continue
+			}
+			if !statName(dep).exists {
+				continue
+			}
+			v := applyrules(rs, g, dep, make([]int, len(rs.rules)))
+			f := u.newedge(v, e.r)
+			f.stem, f.matches, f.discovered = e.stem, e.matches, true
+			added = append(added, v)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	g.updateTimestamps()
+	g.cyclecheck(g.root)
+	for _, v := range added {
+		v.flags |= nodeFlagProbable
+		g.vacuous(v)
+		g.ambiguous(v)
+	}
+}
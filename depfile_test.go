@@ -0,0 +1,16 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDepfile(t *testing.T) {
+	data := "a.o: a.c /usr/include/stdio.h \\\n  my\\ header.h cost$$.h\n" +
+		"C:/src/b.h:\n" +
+		"/usr/include/stdio.h:\n"
+	want := []string{"a.c", "/usr/include/stdio.h", "my header.h", "cost$.h"}
+	if got := parseDepfile(data); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+// Dialects: bundles of defaults matching the mk of Plan 9, this mk, or make.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+type dialect struct {
+	shell        string // default shell
+	delimiter    string // how lists are joined in the environment, see --shell-delimiter
+	recipeprefix rune   // how recipe lines are recognized, see 'recipeprefix'
+	makeVars     bool   // expand $@ and the like, see --make-vars
+	perLineShell bool   // run every line of a recipe in its own shell
+	attributes   string // the attribute letters a rule may have, all if empty
+}
+
+var dialects = map[string]dialect{
+	"plan9": {
+		shell:        "rc",
+		delimiter:    "plan9",
+		recipeprefix: recipePrefixIndent,
+		attributes:   "DENnQRUV",
+	},
+	"mk9": {
+		shell:        "sh -c",
+		delimiter:    runtime.GOOS,
+		recipeprefix: recipePrefixIndent,
+	},
+	"gnu": {
+		shell:        "sh -c",
+		delimiter:    runtime.GOOS,
+		recipeprefix: recipePrefixTab,
+		makeVars:     true,
+		perLineShell: true,
+	},
+}
+
+var (
+	// Name of the dialect in effect.
+	dialectName = "mk9"
+
+	// How recipe lines are recognized, unless a mkfile says otherwise.
+	defaultRecipePrefix rune = recipePrefixIndent
+
+	// True if every line of a recipe is run in its own shell, as make does.
+	perLineShell bool
+
+	// The attribute letters a rule may have, all if empty.
+	attributeLetters string
+)
+
+// Apply the defaults of a dialect, leaving the flags given on the command line
+// alone.
+func applyDialect(name string, shellOS *string) error {
+	d, ok := dialects[name]
+	if !ok {
+		return fmt.Errorf("unknown dialect %q, expected one of %s", name,
+			strings.Join(slices.Sorted(maps.Keys(dialects)), ", "))
+	}
+
+	if !pflag.CommandLine.Changed("shell") {
+		defaultShell = d.shell
+	}
+	if !pflag.CommandLine.Changed("shell-delimiter") {
+		*shellOS = d.delimiter
+	}
+	if !pflag.CommandLine.Changed("make-vars") {
+		makeVars = d.makeVars
+	}
+	defaultRecipePrefix = d.recipeprefix
+	perLineShell = d.perLineShell
+	attributeLetters = d.attributes
+	return nil
+}
+
+// How lists are joined in the environment, for a --shell-delimiter.
+func listDelimiter(shellOS string) string {
+	switch shellOS {
+	case "plan9":
+		return "\x01"
+	default:
+		return ":"
+	}
+}
+
+// Whether every line of the rule's recipe is run in its own shell.
+func (r *rule) perLineShell() bool {
+	if r.dialect != nil {
+		return r.dialect.perLineShell
+	}
+	return perLineShell
+}
+
+// The attributes of a rule its dialect does not know, by their letters: those
+// of this mk alone, for the plan9 one.
+func (r *rule) foreignAttributes() string {
+	known := attributeLetters
+	if r.dialect != nil {
+		known = r.dialect.attributes
+	}
+	if known == "" {
+		return ""
+	}
+	var foreign strings.Builder
+	for _, c := range r.attributes.String() {
+		if !strings.ContainsRune(known, c) {
+			foreign.WriteRune(c)
+		}
+	}
+	return foreign.String()
+}
+
+// How lists are joined in the environment of the rule's recipe. Only rc
+// splits them on \x01, other shells get them joined with ':', unless
+// --shell-delimiter says otherwise.
+func (r *rule) delimiter() string {
+	if pflag.CommandLine.Changed("shell-delimiter") {
+		return shellDelimiter
+	}
+	if r.isRc() {
+		return "\x01"
+	}
+	return ":"
+}
+
+// Whether the rule's recipe is run by rc.
+func (r *rule) isRc() bool {
+	sh := defaultShell
+	if len(r.shell) > 0 {
+		sh = r.shell[0]
+	}
+	fields := strings.Fields(sh)
+	return len(fields) > 0 && filepath.Base(fields[0]) == "rc"
+}
@@ -0,0 +1,175 @@
+// Directories as prerequisites, written with a trailing slash like "src/": a
+// directory is as recent as the newest file in it, recursively, or as the
+// last time files were added to it or removed, whichever is later. The time
+// of a directory itself only changes with its own entries, which makes it
+// useless to compare with.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// The listing of every directory scanned, and when it was first seen,
+	// by "directory" or "directory glob...".
+	dirState = &lockFile{
+		path:   "dirs",
+		header: "Generated by mk, the listings of directories that are prerequisites.",
+		state:  true,
+	}
+
+	// Scans of directories, until a recipe changes their contents.
+	dirScans      = make(map[string]time.Time)
+	dirScansMutex sync.Mutex
+)
+
+// Whether a name is a directory whose contents count, rather than its time.
+func isDirPrereq(name string) bool {
+	return strings.HasSuffix(name, "/") && scheme(name) == ""
+}
+
+// Whether a file in a directory counts: it matches one of the globs, by its
+// name or its path in the directory, or there are none.
+func matchesContents(rel string, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, filepath.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.ToSlash(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The files in a directory that count, by their path in it, and the time of
+// the newest one. The state directory and .git are left out.
+func listDir(dir string, globs []string) ([]string, time.Time, error) {
+	var files []string
+	var newest time.Time
+	state, _ := filepath.Abs(stateDir)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if abs, _ := filepath.Abs(path); d.Name() == ".git" || abs == state {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || !matchesContents(rel, globs) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	slices.Sort(files)
+	return files, newest, err
+}
+
+// The time of a directory by its contents, scanning it once until a recipe
+// changes them. A listing that differs from the one of the last scan is as
+// recent as this scan. A dry run remembers the listing for itself only.
+func scanDir(dir string, globs []string) (time.Time, error) {
+	key := strings.Join(append([]string{filepath.Clean(dir)}, globs...), " ")
+	dirScansMutex.Lock()
+	t, ok := dirScans[key]
+	dirScansMutex.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	files, newest, err := listDir(dir, globs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sum := sha256.Sum256([]byte(strings.Join(files, "\n")))
+	listing := hex.EncodeToString(sum[:16])
+
+	seen := newest
+	old, ok, err := dirState.get(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	oldListing, oldSeen, _ := strings.Cut(old, " ")
+	if ok && oldListing == listing {
+		if ns, err := strconv.ParseInt(oldSeen, 10, 64); err == nil {
+			seen = time.Unix(0, ns)
+		}
+	} else {
+		if ok {
+			seen = clock()
+		}
+		if !dirState.dryRun {
+			if _, err := statePath(); err != nil {
+				return time.Time{}, err
+			}
+		}
+		if err := dirState.set(key, fmt.Sprintf("%s %d", listing, seen.UnixNano())); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	t = newest
+	if seen.After(t) {
+		t = seen
+	}
+	dirScansMutex.Lock()
+	dirScans[key] = t
+	dirScansMutex.Unlock()
+	return t, nil
+}
+
+// Forget the scans of directories whose contents a recipe changed, or all of
+// them without any.
+func forgetDirScans(dirs ...string) {
+	dirScansMutex.Lock()
+	defer dirScansMutex.Unlock()
+	if len(dirs) == 0 {
+		clear(dirScans)
+		return
+	}
+	for key := range dirScans {
+		for _, dir := range dirs {
+			if key == dir || strings.HasPrefix(key, dir+" ") {
+				delete(dirScans, key)
+				break
+			}
+		}
+	}
+}
+
+// The time of a prerequisite to compare a target with: that of its node,
+// unless it is a directory the rule filters with contents=.
+func prereqTime(r *rule, v *node) time.Time {
+	if len(r.contents) == 0 || !isDirPrereq(v.name) || !v.exists {
+		return v.t
+	}
+	t, err := scanDir(v.name, r.contents)
+	if err != nil {
+		mkError(err.Error())
+	}
+	return t
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A directory is as recent as the newest file in it, or as the scan that
+// found files added or removed.
+func TestScanDir(t *testing.T) {
+	defer func(d, path string) {
+		stateDir, dirState.path, dirState.entries, dirState.loaded = d, path, nil, false
+	}(stateDir, dirState.path)
+	defer forgetDirScans()
+	dir := t.TempDir()
+	stateDir = filepath.Join(dir, ".mk")
+	dirState.path = filepath.Join(stateDir, "dirs")
+
+	src := filepath.Join(dir, "src") + "/"
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"a.go", "sub/b.txt"} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		old = old.Add(-time.Minute)
+	}
+
+	scan := func(globs ...string) time.Time {
+		forgetDirScans()
+		ts, err := scanDir(src, globs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	newest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if got := scan(); !got.Equal(newest) {
+		t.Errorf("the directory is as recent as %v, expected %v", got, newest)
+	}
+	if got := scan("*.txt"); !got.Equal(newest.Add(-time.Minute)) {
+		t.Errorf("with *.txt, the directory is as recent as %v, expected %v", got, newest.Add(-time.Minute))
+	}
+
+	if err := os.Remove(filepath.Join(src, "sub/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if got := scan(); !got.After(newest) {
+		t.Errorf("a file was removed, but the directory is as recent as %v", got)
+	}
+	if got := scan("*.go"); !got.Equal(newest) {
+		t.Errorf("with *.go, the directory is as recent as %v, expected %v", got, newest)
+	}
+}
+
+// A dry run scans directories without writing what it found.
+func TestScanDirDryRun(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"mkfile": "out: src/\n\ttouch out\n", "src/a.c": ""} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "-n"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".mk")); err == nil {
+		t.Errorf("the dry run wrote the state directory")
+	}
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".mk", "dirs")); err != nil {
+		t.Errorf("the build did not remember the listing of src/: %v", err)
+	}
+}
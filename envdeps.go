@@ -0,0 +1,54 @@
+// Targets depending on variables, declared with 'depends-env': the values
+// their recipe was executed with are kept in the state directory, a target is
+// out of date once one of them changes.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// Values of the variables targets were last made with, by "target $NAME".
+var envState = &lockFile{
+	path:   "env",
+	header: "Generated by mk, the variables targets were made with.",
+	state:  true,
+}
+
+// Hash the value of a variable, the values can be long or secret.
+func envHash(name string) string {
+	sum := sha256.Sum256([]byte(strings.Join(GlobalMkState[name], "\x00")))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// Return the variables of a rule that changed since its target was made, as
+// causes of a rebuild. A target that was never made with them changed too.
+func changedEnv(target string, r *rule) ([]string, error) {
+	var changed []string
+	for _, name := range r.envdeps {
+		old, ok, err := envState.get(target + " $" + name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || old != envHash(name) {
+			changed = append(changed, "$"+name)
+		}
+	}
+	return changed, nil
+}
+
+// Remember the variables a target was made with.
+func recordEnv(target string, r *rule) error {
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	for _, name := range r.envdeps {
+		if err := envState.set(target+" $"+name, envHash(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -90,7 +90,8 @@ func expand(input string, vars map[string][]string, expandBackticks bool) []stri
 // Expand following a '\\'
 func expandEscape(input string) (string, int) {
 	c, w := utf8.DecodeRuneInString(input)
-	if c == '\t' || c == ' ' {
+	// an escaped '#' never starts a comment, it is a literal '#'
+	if c == '\t' || c == ' ' || c == '#' {
 		return string(c), w
 	}
 	if c == '\n' {
@@ -142,6 +143,15 @@ func expandSingleQuoted(input string) (string, int) {
 
 var namelistPattern = regexp.MustCompile(`^\s*([^:]+)\s*:\s*([^%]*)%([^=]*)\s*=\s*([^%]*)%([^%]*)\s*`)
 
+// Automatic variables of make and the variables of mk they stand for, used
+// with --make-vars.
+var makeAutomaticVars = map[rune]string{
+	'@': "target",
+	'<': "prereq", // the first one only
+	'^': "prereq",
+	'*': "stem",
+}
+
 // Expand something starting with at '$'.
 func expandSigil(input string, vars map[string][]string) ([]string, int) {
 	c, w := utf8.DecodeRuneInString(input)
@@ -149,7 +159,7 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 	var varname string
 
 	if c == '$' { // escaping of "$" with "$$"
-		return []string{"$"}, 2
+		return []string{"$"}, w
 	} else if c == '{' { // match bracketed expansions: ${foo}, or ${foo:a%b=c%d}
 		j := strings.IndexRune(input[w:], '}')
 		if j < 0 {
@@ -165,16 +175,31 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 			varname = mat[1]
 			a, b, c, d := mat[2], mat[3], mat[4], mat[5]
 			values, ok := vars[varname]
+			debugExpand(varname, values, ok)
 			if !ok {
 				return []string{}, offset
 			}
 
+			// the replacement may refer to variables, the stems are taken as they are
 			pat := regexp.MustCompile(strings.Join([]string{`^\Q`, a, `\E(.*)\Q`, b, `\E$`}, ""))
+			cs, ds := expand(c, vars, false), expand(d, vars, false)
 			expandedValues := make([]string, 0, len(values))
 			for _, value := range values {
 				valueMatch := pat.FindStringSubmatch(value)
 				if valueMatch != nil {
-					expandedValues = append(expandedValues, expand(strings.Join([]string{c, valueMatch[1], d}, ""), vars, false)...)
+					// the stem joins the last word of c and the first of d
+					word := valueMatch[1]
+					if len(cs) > 0 {
+						expandedValues = append(expandedValues, cs[:len(cs)-1]...)
+						word = cs[len(cs)-1] + word
+					}
+					if len(ds) > 0 {
+						word += ds[0]
+					}
+					expandedValues = append(expandedValues, word)
+					if len(ds) > 1 {
+						expandedValues = append(expandedValues, ds[1:]...)
+					}
 				} else {
 					// What case is this?
 					expandedValues = append(expandedValues, value)
@@ -183,6 +208,11 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 
 			return expandedValues, offset
 		}
+
+		// is this a function call? ${name args}
+		if values, ok := expandFuncCall(varname, vars); ok {
+			return values, offset
+		}
 	} else { // bare variables: $foo
 		// try to match a variable name
 		i := 0
@@ -198,6 +228,15 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 		if j > i {
 			varname = input[i:j]
 			offset = j
+		} else if name, ok := makeAutomaticVars[c]; ok && makeVars {
+			// $@, $< and the like, as in a Makefile
+			if vals, ok := vars[name]; ok {
+				if c == '<' && len(vals) > 1 {
+					vals = vals[:1]
+				}
+				return vals, w
+			}
+			return []string{"$" + input[:w]}, w
 		} else {
 			offset = j + 1
 			return []string{"$" + input[:offset]}, offset
@@ -208,14 +247,17 @@ func expandSigil(input string, vars map[string][]string) ([]string, int) {
 	if isValidVarName(varname) {
 		varvals, ok := vars[varname]
 		if ok {
+			debugExpand(varname, varvals, true)
 			return varvals, offset
 		}
 
 		// Find the subsitution in the environment.
 		if varval, ok := os.LookupEnv(varname); ok {
+			debugExpand(varname, []string{varval}, true)
 			return []string{varval}, offset
 		}
 
+		debugExpand(varname, nil, false)
 		return []string{"$" + input[:offset]}, offset
 	}
 
@@ -302,10 +344,8 @@ func expandBackQuoted(input string, vars map[string][]string) ([]string, int) {
 		return []string{input}, len(input)
 	}
 
-	env := os.Environ()
-	for key, values := range vars {
-		env = append(env, key+"="+strings.Join(values, " "))
-	}
+	volatileRules.Store(true)
+	env := environ(vars, " ")
 
 	// TODO - might have $shell available by now, but maybe not?
 	// It's not populated, regardless
@@ -168,6 +168,87 @@ func TestExpand(t *testing.T) {
 				"ruxpin bear.adventure",
 			},
 		},
+		{
+			input: "${files:%.c=%.o}",
+			vars: map[string][]string{
+				"files": {"a$b.c", "it's.c", "defs.h"},
+				"b":     {"not expanded"},
+			},
+			expandticks: false,
+			want:        []string{"a$b.o", "it's.o", "defs.h"},
+		},
+		{
+			input: "${shquote $files}",
+			vars: map[string][]string{
+				"files": {"plain.c", "two words.c", "it's.c", "$(rm -rf ~).c"},
+			},
+			expandticks: false,
+			want:        []string{"plain.c", "'two words.c'", `'it'\''s.c'`, "'$(rm -rf ~).c'"},
+		},
+		{
+			input: "${rcquote $files}",
+			vars: map[string][]string{
+				"files": {"plain.c", "a:b.c", "two words.c", "it's.c", "x=y"},
+			},
+			expandticks: false,
+			want:        []string{"plain.c", "a:b.c", "'two words.c'", "'it''s.c'", "'x=y'"},
+		},
+		{
+			input:       "${shquote $prereq}",
+			vars:        map[string][]string{},
+			expandticks: false,
+			want:        []string{"${shquote $prereq}"},
+		},
+		{
+			input: "${shquote}",
+			vars: map[string][]string{
+				"shquote": {"variable"},
+			},
+			expandticks: false,
+			want:        []string{"variable"},
+		},
+		{
+			input:       "${shquote 'two words' one}",
+			vars:        map[string][]string{},
+			expandticks: false,
+			want:        []string{"'two words'", "one"},
+		},
+		{
+			input: "${filter %.o %.a, $files}",
+			vars: map[string][]string{
+				"files": {"a.o", "b.c", "lib.a", "o"},
+			},
+			expandticks: false,
+			want:        []string{"a.o", "lib.a"},
+		},
+		{
+			input: "${filter-out %.c, $files}",
+			vars: map[string][]string{
+				"files": {"a.o", "b.c", "lib.a"},
+			},
+			expandticks: false,
+			want:        []string{"a.o", "lib.a"},
+		},
+		{
+			input: "${sort $words}",
+			vars: map[string][]string{
+				"words": {"b", "a", "c", "a"},
+			},
+			expandticks: false,
+			want:        []string{"a", "b", "c"},
+		},
+		{
+			input:       "${wildcard testdata/test1.mk*}",
+			vars:        map[string][]string{},
+			expandticks: false,
+			want:        []string{"testdata/test1.mk", "testdata/test1.mk.expected"},
+		},
+		{
+			input:       "a$$b",
+			vars:        map[string][]string{},
+			expandticks: false,
+			want:        []string{"a$b"},
+		},
 	}
 
 	//	failing := tests[11:]
@@ -219,6 +300,21 @@ func TestExpandRecipeSigils(t *testing.T) {
 			expandticks: false,
 			want:        []string{"mkdir -p $(dirname a)\necho a"},
 		},
+		{
+			input: "cat ${shquote $prereq} > $target",
+			vars: map[string][]string{
+				"prereq": {"a b", "c"},
+				"target": {"d"},
+			},
+			expandticks: false,
+			want:        []string{"cat 'a b' c > d"},
+		},
+		{
+			input:       "echo $$HOME",
+			vars:        map[string][]string{},
+			expandticks: false,
+			want:        []string{"echo $HOME"},
+		},
 	}
 
 	for i, tv := range tests {
@@ -258,3 +354,28 @@ func TestExpandBackQuoted(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandMakeVars(t *testing.T) {
+	recipe := "cc -o $@ $^ && echo $< $* \"$@\""
+	vars := map[string][]string{
+		"target": {"prog"},
+		"prereq": {"a.o", "b.o"},
+		"stem":   {"pro"},
+	}
+
+	if got := expandRecipeSigils(recipe, vars); got != recipe {
+		t.Errorf("without --make-vars: got %q, want it unchanged", got)
+	}
+
+	defer func() { makeVars = false }()
+	makeVars = true
+	want := "cc -o prog a.o b.o && echo a.o pro \"prog\""
+	if got := expandRecipeSigils(recipe, vars); got != want {
+		t.Errorf("with --make-vars: got %q, want %q", got, want)
+	}
+
+	// at parse time, the variables are not defined yet
+	if got := expandRecipeSigils(recipe, map[string][]string{}); got != recipe {
+		t.Errorf("without variables: got %q", got)
+	}
+}
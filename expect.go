@@ -0,0 +1,76 @@
+// What the targets of a rule must be once its recipe succeeded, from expect=:
+// a file or a directory, executable or not empty. A recipe breaking one fails,
+// instead of leaving, say, an empty file for the rules depending on it, and
+// the target is removed to be made again.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The expectations expect= takes.
+var expectations = []string{"file", "dir", "executable", "nonempty"}
+
+// Check the expectations of expect=, separated by commas.
+func parseExpect(s string) ([]string, error) {
+	var expect []string
+	for _, e := range strings.Split(s, ",") {
+		if !slices.Contains(expectations, e) {
+			return nil, fmt.Errorf("invalid expectation %q, expected %s", e, strings.Join(expectations, ", "))
+		}
+		expect = append(expect, e)
+	}
+	return expect, nil
+}
+
+// Check a target against the expectations of its rule, returning the first
+// it breaks, if any.
+func checkExpect(name string, expect []string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fmt.Errorf("%s does not exist", name)
+	}
+	for _, e := range expect {
+		switch e {
+		case "file":
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("%s is not a file (expect=file)", name)
+			}
+		case "dir":
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory (expect=dir)", name)
+			}
+		case "executable":
+			if info.Mode().Perm()&0111 == 0 {
+				return fmt.Errorf("%s is not executable (expect=executable)", name)
+			}
+		case "nonempty":
+			if info.IsDir() {
+				entries, err := os.ReadDir(name)
+				if err == nil && len(entries) == 0 {
+					return fmt.Errorf("%s is an empty directory (expect=nonempty)", name)
+				}
+			} else if info.Size() == 0 {
+				return fmt.Errorf("%s is empty (expect=nonempty)", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Remove a target that is not what its rule expects. A directory is only
+// removed if it is a tree mk makes, or empty.
+func discardTarget(name string, r *rule) error {
+	if isTreeTarget(name, r) {
+		if err := treeState.remove(filepath.Clean(name)); err != nil {
+			return err
+		}
+		return os.RemoveAll(name)
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,249 @@
+// The explain log, a record of every recipe mk executed and why.
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log is rotated once it grows beyond this size, keeping one old log.
+const explainLogMax = 8 << 20
+
+// Why a recipe was executed.
+const (
+	causeMissing = "(missing)" // the target did not exist
+	causeVirtual = "(virtual)" // the rule is virtual, so always executed
+	causeForced  = "(forced)"  // a rebuild was forced with --force-*
+	causeTree    = "(tree)"    // the tree was not made, or changed since
+	causeProject = "(project)" // made by mk in another project of the workspace
+)
+
+// A recipe that was executed. Causes are the prerequisites that were newer
+// than the target, or one of the causes above.
+type explainRecord struct {
+	Time     time.Time     `json:"time"`
+	BuildID  string        `json:"build_id,omitempty"`
+	Seq      string        `json:"seq,omitempty"`
+	Target   string        `json:"target"`
+	Rule     string        `json:"rule"`
+	Causes   []string      `json:"causes"`
+	Duration time.Duration `json:"duration"`
+	Failed   bool          `json:"failed,omitempty"`
+	Status   string        `json:"status,omitempty"`  // last line written to $MK_STATUS_FD
+	User     time.Duration `json:"user,omitempty"`    // CPU time in user mode
+	Sys      time.Duration `json:"sys,omitempty"`     // CPU time in the kernel
+	MaxRSS   int64         `json:"max_rss,omitempty"` // in bytes
+}
+
+// Appending to the log from concurrent recipes.
+var explainMutex sync.Mutex
+
+// Print why every recipe is executed, and append it to the explain log, with
+// --explain.
+var explainRebuilds bool
+
+// Print why the recipe of a target is executed.
+func mkPrintExplain(u *node, e *edge, prereqs []*node, causes []string) {
+	reasons := make([]string, len(causes))
+	for i, cause := range causes {
+		reasons[i] = explainCause(u, e, prereqs, cause)
+	}
+	mkMsgMutex.Lock()
+	clearProgress()
+	fmt.Fprintf(buildOutput, "%s is made: %s\n", u.name, strings.Join(reasons, "; "))
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// Describe a cause of executing the recipe of a target, with the timestamps
+// of a newer prerequisite.
+func explainCause(u *node, e *edge, prereqs []*node, cause string) string {
+	switch cause {
+	case causeMissing:
+		return "it is missing"
+	case causeVirtual:
+		return "it is virtual"
+	case causeForced:
+		return "it is forced"
+	case causeTree:
+		return "its tree changed, or was not finished"
+	case causeProject:
+		return "mk decides in its project"
+	}
+	if strings.HasPrefix(cause, "$") {
+		return cause + " changed"
+	}
+	i := slices.IndexFunc(prereqs, func(v *node) bool { return v.name == cause })
+	if i < 0 {
+		return cause
+	}
+	v := prereqs[i]
+	const layout = "2006-01-02 15:04:05.000"
+	switch {
+	case hashMode:
+		return v.name + " changed"
+	case isChangedSince(v.name):
+		return v.name + " changed since --since"
+	case u.t.Before(prereqTime(e.r, v)):
+		return fmt.Sprintf("%s (%s) is newer than it (%s)", v.name,
+			prereqTime(e.r, v).Format(layout), u.t.Format(layout))
+	}
+	return v.name + " was made again"
+}
+
+// Describe a rule for the log, by its location and targets.
+func (r *rule) describe() string {
+	targets := make([]string, len(r.targets))
+	for i := range r.targets {
+		targets[i] = r.targets[i].spat
+	}
+	return fmt.Sprintf("%s:%d: %s", r.file, r.line, strings.Join(targets, " "))
+}
+
+// Append a record to the explain log.
+func logExplain(rec explainRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	explainMutex.Lock()
+	defer explainMutex.Unlock()
+
+	path, err := statePath("explain.log")
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > explainLogMax {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// end a record a crash cut short, for the next one to be read
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read the explain log, the rotated one first.
+func readExplainLog() ([]explainRecord, error) {
+	path := filepath.Join(stateDir, "explain.log")
+	var records []explainRecord
+	for _, name := range []string{path + ".1", path} {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec explainRecord
+			// skip lines that were cut short, by a crash for example
+			if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+				records = append(records, rec)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// mk stats causes: which prerequisites trigger the most rebuilds, and which
+// rules take the most time and memory.
+func cmdStats(rs *ruleSet, args []string) int {
+	if !checkArgs("stats", args, 1, 1, "causes") {
+		return 2
+	}
+	if args[0] != "causes" {
+		mkPrintError(fmt.Sprintf("unknown statistics %q, expected causes", args[0]))
+		return 1
+	}
+
+	records, err := readExplainLog()
+	if err != nil {
+		mkPrintError(err.Error())
+		return 1
+	}
+	if len(records) == 0 {
+		fmt.Println("mk: no recipes recorded yet")
+		return 0
+	}
+
+	causes := make(map[string]int)
+	durations := make(map[string]time.Duration)
+	runs := make(map[string]int)
+	memory := make(map[string]int64) // largest resident set size
+	for _, rec := range records {
+		if rec.MaxRSS > 0 {
+			memory[rec.Rule] = max(memory[rec.Rule], rec.MaxRSS)
+		}
+		for _, cause := range rec.Causes {
+			causes[cause]++
+		}
+		durations[rec.Rule] += rec.Duration
+		runs[rec.Rule]++
+	}
+
+	const top = 10
+	names := slices.SortedFunc(maps.Keys(causes), func(a, b string) int {
+		return cmp.Or(cmp.Compare(causes[b], causes[a]), cmp.Compare(a, b))
+	})
+	fmt.Printf("causes of rebuilds, over %d recipes:\n", len(records))
+	for _, name := range names[:min(top, len(names))] {
+		fmt.Printf("%8d  %s\n", causes[name], name)
+	}
+
+	rules := slices.SortedFunc(maps.Keys(durations), func(a, b string) int {
+		return cmp.Or(cmp.Compare(durations[b], durations[a]), cmp.Compare(a, b))
+	})
+	fmt.Printf("\nrules taking the most time:\n")
+	for _, rule := range rules[:min(top, len(rules))] {
+		fmt.Printf("%8s  %s (%d runs)\n", durations[rule].Round(time.Millisecond), rule, runs[rule])
+	}
+
+	if len(memory) == 0 {
+		return 0
+	}
+	rules = slices.SortedFunc(maps.Keys(memory), func(a, b string) int {
+		return cmp.Or(cmp.Compare(memory[b], memory[a]), cmp.Compare(a, b))
+	})
+	total := totalMemory()
+	fmt.Printf("\nrules using the most memory:\n")
+	for _, rule := range rules[:min(top, len(rules))] {
+		fmt.Printf("%8s  %s", formatBytes(memory[rule]), rule)
+		if total > 0 && memory[rule]*int64(subprocsAllowed) > total {
+			fmt.Printf(" (times -j %d exceeds the %s of memory)", subprocsAllowed, formatBytes(total))
+		}
+		fmt.Println()
+	}
+	return 0
+}
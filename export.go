@@ -0,0 +1,211 @@
+// Exporting the dependency graph, and comparing exported graphs.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// A target in an exported graph.
+type exportedTarget struct {
+	Name    string   `json:"name"`
+	Rule    string   `json:"rule,omitempty"` // location and targets of the rule
+	Stem    string   `json:"stem,omitempty"`
+	Prereqs []string `json:"prereqs,omitempty"`
+	Recipe  string   `json:"recipe,omitempty"`
+	Virtual bool     `json:"virtual,omitempty"`
+	Owner   string   `json:"owner,omitempty"`
+}
+
+// An exported graph, the targets are sorted by name.
+type exportedGraph struct {
+	Targets []exportedTarget `json:"targets"`
+}
+
+// Collect the targets reachable from the root, leaving out the root itself.
+func exportGraph(g *graph) exportedGraph {
+	seen := make(map[*node]bool)
+	var targets []exportedTarget
+
+	var visit func(u *node)
+	visit = func(u *node) {
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+
+		t := exportedTarget{Name: u.name}
+		for _, e := range u.prereqs {
+			if e.r != nil && e.r.file != "" {
+				t.Rule = e.r.describe()
+				t.Stem = e.stem
+				t.Recipe = e.r.recipe
+				t.Virtual = e.r.attributes.virtual
+				t.Owner = e.r.owner
+			}
+			if e.v != nil {
+				t.Prereqs = append(t.Prereqs, e.v.name)
+				visit(e.v)
+			}
+		}
+		if u != g.root {
+			targets = append(targets, t)
+		}
+	}
+	visit(g.root)
+
+	slices.SortFunc(targets, func(a, b exportedTarget) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return exportedGraph{targets}
+}
+
+// Write the graph in the given format.
+func writeGraph(w io.Writer, g *graph, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exportGraph(g))
+	case "dot":
+		return writeDot(w, exportGraph(g))
+	default:
+		return fmt.Errorf("unknown graph format %q, expected json or dot", format)
+	}
+}
+
+// Quote a string for Graphviz.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// Write the graph as a Graphviz digraph, with an edge from every target to
+// each of its prerequisites. Targets made by a recipe are boxes, virtual ones
+// dashed, and those a meta-rule matched show its targets and the stem.
+func writeDot(w io.Writer, g exportedGraph) error {
+	var b strings.Builder
+	b.WriteString("digraph mk {\n\trankdir=LR;\n\tnode [fontname=monospace];\n")
+	for _, t := range g.Targets {
+		var attrs []string
+		label := t.Name
+		if t.Rule != "" {
+			attrs = append(attrs, "shape=box")
+			if t.Stem != "" {
+				_, pattern, _ := strings.Cut(t.Rule, ": ")
+				label += fmt.Sprintf("\n%s, stem %s", pattern, t.Stem)
+			}
+			attrs = append(attrs, "tooltip="+dotQuote(t.Rule))
+		} else {
+			attrs = append(attrs, "shape=plaintext")
+		}
+		if t.Virtual {
+			attrs = append(attrs, "style=dashed")
+		}
+		attrs = append([]string{"label=" + dotQuote(label)}, attrs...)
+		fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(t.Name), strings.Join(attrs, ", "))
+		for _, p := range t.Prereqs {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote(t.Name), dotQuote(p))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Read a graph exported as json.
+func readGraph(path string) (map[string]exportedTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g exportedGraph
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	targets := make(map[string]exportedTarget)
+	for _, t := range g.Targets {
+		targets[t.Name] = t
+	}
+	return targets, nil
+}
+
+// mk graph-diff old.json new.json: report the targets that were added or
+// removed, and the changed prerequisites and recipes. Like diff, the exit
+// status is 1 if the graphs differ.
+func cmdGraphDiff(rs *ruleSet, args []string) int {
+	if !checkArgs("graph-diff", args, 2, 2, "old.json new.json") {
+		return 2
+	}
+	before, err := readGraph(args[0])
+	if err != nil {
+		mkPrintError(err.Error())
+		return 2
+	}
+	after, err := readGraph(args[1])
+	if err != nil {
+		mkPrintError(err.Error())
+		return 2
+	}
+
+	names := slices.Collect(maps.Keys(before))
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	differ := false
+	for _, name := range names {
+		o, inold := before[name]
+		n, innew := after[name]
+		switch {
+		case !inold:
+			fmt.Printf("+ %s\n", name)
+			differ = true
+			continue
+		case !innew:
+			fmt.Printf("- %s\n", name)
+			differ = true
+			continue
+		}
+
+		var changes []string
+		for _, p := range n.Prereqs {
+			if !slices.Contains(o.Prereqs, p) {
+				changes = append(changes, "+prereq "+p)
+			}
+		}
+		for _, p := range o.Prereqs {
+			if !slices.Contains(n.Prereqs, p) {
+				changes = append(changes, "-prereq "+p)
+			}
+		}
+		if o.Recipe != n.Recipe {
+			changes = append(changes, "recipe changed")
+		}
+		if o.Virtual != n.Virtual {
+			changes = append(changes, fmt.Sprintf("virtual %v -> %v", o.Virtual, n.Virtual))
+		}
+
+		if len(changes) > 0 {
+			fmt.Printf("~ %s\n", name)
+			for _, c := range changes {
+				fmt.Printf("    %s\n", c)
+			}
+			differ = true
+		}
+	}
+
+	if differ {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+// Holding back the output of failed recipes, to show it after the build.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var (
+	// Capture the output of recipes, showing that of failed ones at the end.
+	failuresAtEnd bool
+
+	// Show the failures through $PAGER.
+	pageFailures bool
+
+	// The --output-sync option: target, none or auto.
+	outputSync = "auto"
+
+	// Failed recipes, in the order they failed.
+	heldFailures []recipeFailure
+	heldMutex    sync.Mutex
+)
+
+// A recipe that failed, with its output.
+type recipeFailure struct {
+	target string
+	rule   string // location and targets of the rule
+	owner  string
+	status int // exit status, -1 if the shell could not be run
+	output []byte
+}
+
+// Whether the output of a recipe is held back until it finished, and shown
+// in one piece with the recipe, so that of recipes running at the same time
+// does not interleave. With auto it is not when both go to a terminal, which
+// the recipes keep then.
+func syncOutput() bool {
+	auto := outputSync == "auto" && subprocsAllowed > 1 && !onTerminal()
+	return !failuresAtEnd && (statusLine || outputSync == "target" || auto)
+}
+
+// Whether the standard output and error of mk are both a terminal.
+func onTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// Hold back a failure until the build is done.
+func holdFailure(f recipeFailure) {
+	heldMutex.Lock()
+	heldFailures = append(heldFailures, f)
+	heldMutex.Unlock()
+}
+
+// Show the held back failures one after the other, through $PAGER if asked
+// for and set.
+func reportFailures() error {
+	if len(heldFailures) == 0 {
+		return nil
+	}
+
+	var report bytes.Buffer
+	for _, f := range heldFailures {
+		fmt.Fprintf(&report, "=== %s (%s), exit status %d", f.target, f.rule, f.status)
+		if f.owner != "" {
+			fmt.Fprintf(&report, ", maintained by %s", f.owner)
+		}
+		report.WriteString("\n")
+		report.Write(stripFor("terminal", maskSecrets(f.output)))
+		if len(f.output) > 0 && f.output[len(f.output)-1] != '\n' {
+			report.WriteString("\n")
+		}
+	}
+
+	if !pageFailures || os.Getenv("PAGER") == "" {
+		_, err := os.Stderr.Write(report.Bytes())
+		return err
+	}
+	return runPager(&report)
+}
@@ -0,0 +1,236 @@
+// Builtin functions, called in expansions as ${name args}.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A builtin function. The arguments are split on commas, and each of them is
+// split into words at blanks and expanded.
+type builtinFunc struct {
+	nargs int // number of arguments, or -1 for any
+	call  func(args [][]string) []string
+}
+
+var builtinFuncs map[string]builtinFunc
+
+func init() {
+	builtinFuncs = map[string]builtinFunc{
+		"shquote":    {1, funcShquote},
+		"rcquote":    {1, funcRcquote},
+		"wildcard":   {1, funcWildcard},
+		"filter":     {2, funcFilter},
+		"filter-out": {2, funcFilterOut},
+		"sort":       {1, funcSort},
+		"credential": {1, funcCredential},
+	}
+}
+
+// Runes that have a special meaning to sh when not quoted.
+const shellMetaRunes = " \t\n'\"`$\\|&;<>()*?[]#~{}!"
+
+// Runes that have a special meaning to rc when not quoted.
+const rcMetaRunes = " \t\n'`$\\|&;<>()*?[]#{}^="
+
+// Expand a function call, given the text between the braces. Return false if
+// this is not a call of a builtin function.
+//
+// A call is only evaluated if all variables in its arguments are defined.
+// Otherwise, like an undefined variable, it is left as is, to be expanded when
+// the recipe is executed.
+func expandFuncCall(call string, vars map[string][]string) ([]string, bool) {
+	i := strings.IndexFunc(call, unicode.IsSpace)
+	if i < 0 {
+		return nil, false
+	}
+	name, argstr := call[:i], call[i+1:]
+	fn, ok := builtinFuncs[name]
+	if !ok {
+		return nil, false
+	}
+
+	if !varsDefined(argstr, vars) {
+		return []string{"${" + call + "}"}, true
+	}
+
+	var args [][]string
+	for _, arg := range strings.Split(argstr, ",") {
+		var words []string
+		for _, word := range splitWords(arg) {
+			words = append(words, expand(word, vars, false)...)
+		}
+		args = append(args, words)
+	}
+	if fn.nargs >= 0 && len(args) != fn.nargs {
+		mkError(fmt.Sprintf("${%s}: %s expects %d argument(s), got %d", call, name, fn.nargs, len(args)))
+	}
+
+	return fn.call(args), true
+}
+
+// Split an argument into words at the blanks outside of quotes.
+func splitWords(arg string) []string {
+	var words []string
+	var quote rune
+	start := -1
+	for i, c := range arg {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case unicode.IsSpace(c):
+			if start >= 0 {
+				words = append(words, arg[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, arg[start:])
+	}
+	return words
+}
+
+// Return true if every variable referenced in the string is defined.
+func varsDefined(input string, vars map[string][]string) bool {
+	for {
+		i := strings.IndexRune(input, '$')
+		if i < 0 {
+			return true
+		}
+		input = input[i+1:]
+
+		var varname string
+		if strings.HasPrefix(input, "$") {
+			input = input[1:]
+			continue
+		} else if strings.HasPrefix(input, "{") {
+			j := strings.IndexAny(input, ":}")
+			if j < 0 {
+				return true
+			}
+			varname = input[1:j]
+		} else {
+			j := 0
+			for j < len(input) {
+				c, w := utf8.DecodeRuneInString(input[j:])
+				if !(unicode.IsLetter(c) || c == '_' || (j > 0 && unicode.IsDigit(c))) {
+					break
+				}
+				j += w
+			}
+			varname = input[:j]
+		}
+
+		if varname == "" {
+			continue
+		}
+		if _, ok := vars[varname]; ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(varname); !ok {
+			return false
+		}
+	}
+}
+
+// Quote a word for sh, if necessary.
+func shquote(word string) string {
+	if word != "" && !strings.ContainsAny(word, shellMetaRunes) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// Quote every word for sh, if necessary.
+func funcShquote(args [][]string) []string {
+	quoted := make([]string, 0, len(args[0]))
+	for _, word := range args[0] {
+		quoted = append(quoted, shquote(word))
+	}
+	return quoted
+}
+
+// Quote a word for rc, if necessary. A quote inside quotes is doubled.
+func rcquote(word string) string {
+	if word != "" && !strings.ContainsAny(word, rcMetaRunes) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", "''") + "'"
+}
+
+// Quote every word for rc, if necessary.
+func funcRcquote(args [][]string) []string {
+	quoted := make([]string, 0, len(args[0]))
+	for _, word := range args[0] {
+		quoted = append(quoted, rcquote(word))
+	}
+	return quoted
+}
+
+// The files matching each of the globs, in the order of the globs and sorted
+// for each.
+func funcWildcard(args [][]string) []string {
+	volatileRules.Store(true)
+	var files []string
+	for _, glob := range args[0] {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			mkError(fmt.Sprintf("${wildcard %s}: %v", glob, err))
+		}
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// Whether a word matches a pattern, in which a '%' matches any string.
+func matchPercent(pattern, word string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "%")
+	if !ok {
+		return pattern == word
+	}
+	return len(word) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(word, prefix) && strings.HasSuffix(word, suffix)
+}
+
+// The words of the second argument matching one of the patterns of the first.
+func funcFilter(args [][]string) []string {
+	var kept []string
+	for _, word := range args[1] {
+		if slices.ContainsFunc(args[0], func(p string) bool { return matchPercent(p, word) }) {
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// The words of the second argument matching none of the patterns of the
+// first.
+func funcFilterOut(args [][]string) []string {
+	var kept []string
+	for _, word := range args[1] {
+		if !slices.ContainsFunc(args[0], func(p string) bool { return matchPercent(p, word) }) {
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// The words sorted, without duplicates.
+func funcSort(args [][]string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(args[0])))
+}
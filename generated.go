@@ -0,0 +1,162 @@
+// Which files are generated by the build, for editors and other tools that
+// should leave them alone.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Build the graph of every target of a non-meta rule, on a copy of the rule
+// set.
+func fullGraph(rs *ruleSet) *graph {
+	var targets []string
+	for i := range rs.rules {
+		if rs.rules[i].ismeta {
+			continue
+		}
+		for _, t := range rs.rules[i].targets {
+			targets = append(targets, t.spat)
+		}
+	}
+	return graphOf(rs, targets)
+}
+
+// Build the graph of the given targets, with a virtual root depending on all
+// of them, on a copy of the rule set.
+func graphOf(rs *ruleSet, targets []string) *graph {
+	all := *rs
+	all.rules = slices.Clone(rs.rules)
+	all.targetrules = make(map[string][]int)
+	for k, v := range rs.targetrules {
+		all.targetrules[k] = slices.Clone(v)
+	}
+
+	root := rule{targets: []pattern{{spat: ""}}, prereqs: targets}
+	root.attributes.virtual = true
+	all.add(root)
+	return buildgraph(&all, "")
+}
+
+// List the files a recipe makes: the targets of the full graph, except
+// virtual ones, sorted.
+func generatedFiles(rs *ruleSet) []string {
+	g := fullGraph(rs)
+	var files []string
+	for name, u := range g.nodes {
+		if u == g.root || u.virtual {
+			continue
+		}
+		for _, e := range u.prereqs {
+			if e.r.recipe != "" {
+				files = append(files, name)
+				break
+			}
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// Write the generated files, one per line, to a file or to stdout for "-".
+func writeGeneratedManifest(path string, rs *ruleSet) error {
+	var b strings.Builder
+	for _, name := range generatedFiles(rs) {
+		fmt.Fprintln(&b, name)
+	}
+	if path == "-" {
+		_, err := os.Stdout.WriteString(b.String())
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// The names a path may have in the mkfile, most likely first: those with a
+// rule of their own, then relative to the working directory, cleaned, as
+// given, and absolute.
+func pathNames(rs *ruleSet, path string) []string {
+	var names []string
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, abs); err == nil {
+				add(rel)
+			}
+		}
+	}
+	add(filepath.Clean(path))
+	add(path)
+	if err == nil {
+		add(abs)
+	}
+
+	slices.SortStableFunc(names, func(a, b string) int {
+		return cmp.Compare(len(rs.targetrules[b]), len(rs.targetrules[a]))
+	})
+	return names
+}
+
+// mk owns path: which rules make the file, directly or through a meta-rule?
+// The exit status is 0 if it is made by a recipe, 1 if not, for other tools
+// to ask.
+func cmdOwns(rs *ruleSet, args []string) int {
+	if !checkArgs("owns", args, 1, 1, "path") {
+		return 2
+	}
+
+	for _, name := range pathNames(rs, args[0]) {
+		u := buildgraph(rs, name).root
+		if u.virtual || !slices.ContainsFunc(u.prereqs, func(e *edge) bool { return e.r.recipe != "" }) {
+			continue
+		}
+
+		fmt.Printf("%s: made by\n", args[0])
+		var rules []*rule
+		for _, e := range u.prereqs {
+			if !slices.Contains(rules, e.r) {
+				rules = append(rules, e.r)
+			}
+		}
+		for _, r := range rules {
+			fmt.Printf("  %s\n", r.describe())
+			if r.comment != "" {
+				fmt.Println(indentComment(r.comment, "    "))
+			}
+			var prereqs []string
+			var stem string
+			for _, e := range u.prereqs {
+				if e.r == r && e.v != nil {
+					prereqs = append(prereqs, e.v.name)
+				}
+				if e.r == r {
+					stem = e.stem
+				}
+			}
+			if r.ismeta && stem != "" {
+				fmt.Printf("    stem: %s\n", stem)
+			}
+			if attribs := r.attributes.String(); attribs != "" {
+				fmt.Printf("    attributes: %s\n", attribs)
+			}
+			if len(prereqs) > 0 {
+				fmt.Printf("    prereqs: %s\n", strings.Join(prereqs, " "))
+			}
+			if r.recipe == "" {
+				fmt.Printf("    no recipe\n")
+			}
+		}
+		return 0
+	}
+	fmt.Printf("%s: not a build output\n", args[0])
+	return 1
+}
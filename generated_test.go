@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The generated files are the targets of recipes, including those of
+// meta-rules, but not virtual targets or sources.
+func TestGeneratedFiles(t *testing.T) {
+	defer forgetStats()
+	dir := t.TempDir()
+	for _, name := range []string{"a.c", "b.c", "a.h"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkfile := "D=" + dir + "\n" +
+		"all:V: $D/prog doc\n" +
+		"$D/prog: $D/a.o $D/b.o\n\tcc -o $target $prereq\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n" +
+		"$D/a.o: $D/a.h\n" +
+		"doc:V:\n\techo\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfile), "mkfile", "/mkfile", env)
+
+	want := []string{filepath.Join(dir, "a.o"), filepath.Join(dir, "b.o"), filepath.Join(dir, "prog")}
+	if got := generatedFiles(rs); !reflect.DeepEqual(got, want) {
+		t.Errorf("the generated files are %q, expected %q", got, want)
+	}
+	if n := len(rs.rules); n != 5 {
+		t.Errorf("the rule set was changed, it has %d rules", n)
+	}
+}
@@ -6,10 +6,13 @@ require (
 	github.com/aws/aws-sdk-go v1.55.7
 	github.com/sanity-io/litter v1.5.8
 	github.com/spf13/pflag v1.0.6
+	github.com/zeebo/xxh3 v1.1.0
 	golang.org/x/term v0.32.0
+	lukechampine.com/blake3 v1.4.1
 )
 
 require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 )
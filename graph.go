@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"net/url"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,8 +12,10 @@ import (
 
 // A dependency graph
 type graph struct {
-	root  *node            // the intial target's node
-	nodes map[string]*node // map targets to their nodes
+	root    *node            // the intial target's node
+	nodes   map[string]*node // map targets to their nodes
+	chain   []string         // targets being matched to rules while building, outermost first
+	limited map[string]*rule // rules not applied to targets, as they were applied -d times already
 }
 
 // An edge in the graph.
@@ -23,6 +25,9 @@ type edge struct {
 	matches []string // regular expression matches
 	togo    bool     // this edge is going to be pruned
 	r       *rule
+	// the prerequisite was found in the depfile of the target, it is not
+	// in $prereq
+	discovered bool
 }
 
 // Current status of a node in the build.
@@ -43,6 +48,8 @@ const (
 	nodeFlagReady
 	nodeFlagProbable
 	nodeFlagVacuous
+	nodeFlagKeepGoing // in the prerequisites of a rule with the K attribute
+	nodeFlagUnchanged // made by mk in its project, which found it up to date
 )
 
 // A node in the dependency graph
@@ -56,51 +63,67 @@ type node struct {
 	mutex     sync.Mutex        // exclusivity for the status variable
 	listeners []chan nodeStatus // channels to notify of completion
 	flags     nodeFlag          // bitwise combination of node flags
+	version   string            // ETag or Last-Modified of a URL
+	virtual   bool              // target of a V rule, distinct from any file
+	progress  string            // last status line reported by the recipe
+	usage     resourceUsage     // resources used by the recipe
+	seq       string            // $MKSEQ of the recipe
 }
 
-// Update a node's timestamp and 'exists' flag.
+// Update a node's timestamp and 'exists' flag. Virtual nodes never exist, and
+// their timestamp is set when they are built.
 func (u *node) updateTimestamp() {
-	if strings.HasPrefix(u.name, "s3://") || strings.HasPrefix(u.name, "https://") || strings.HasPrefix(u.name, "http://") {
-		up, err := url.Parse(u.name)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if up.Scheme == "http" || up.Scheme == "https" {
-			updateHTTPTimestamp(u)
-		} else if up.Scheme == "s3" {
-			updateS3Timestamp(u, up)
-		}
-	} else {
-		info, err := os.Stat(u.name)
-		if err == nil {
-			u.t = info.ModTime()
-			u.exists = true
-			u.flags |= nodeFlagProbable
-		} else {
-			_, ok := err.(*os.PathError)
-			if ok {
-				u.t = time.Unix(0, 0)
-				u.exists = false
-			} else {
-				mkError(err.Error())
-			}
-		}
+	if u.virtual {
+		return
 	}
-
-	if rebuildall {
+	st := statName(u.name)
+	u.t = st.t
+	u.exists = st.exists
+	if t, ok := plannedTime(u.name); ok {
+		u.t, u.exists = t, true
+	}
+	if st.version != "" {
+		u.version = st.version
+	}
+	if u.exists || rebuildall {
 		u.flags |= nodeFlagProbable
 	}
 }
 
-// Create a new node
-func (g *graph) newnode(name string) *node {
-	u := &node{name: name}
-	u.updateTimestamp()
+// Create a new node. A file of the same name as a virtual node is ignored.
+// The timestamp of other nodes is set once the graph is built.
+func (g *graph) newnode(name string, virtual bool) *node {
+	u := &node{name: name, virtual: virtual, t: time.Unix(0, 0)}
 	g.nodes[name] = u
 	return u
 }
 
+// Set the timestamps of all nodes, looking them up in batches.
+func (g *graph) updateTimestamps() {
+	var names []string
+	for name, u := range g.nodes {
+		if !u.virtual {
+			names = append(names, name)
+		}
+	}
+	if err := statNames(names); err != nil {
+		mkError(err.Error())
+	}
+	for _, u := range g.nodes {
+		u.updateTimestamp()
+	}
+}
+
+// Is the target virtual, the target of a rule with the V attribute?
+func (rs *ruleSet) isVirtual(target string) bool {
+	for _, k := range rs.targetrules[target] {
+		if rs.rules[k].attributes.virtual {
+			return true
+		}
+	}
+	return false
+}
+
 // Create a new arc.
 func (u *node) newedge(v *node, r *rule) *edge {
 	e := &edge{v: v, r: r}
@@ -110,15 +133,17 @@ func (u *node) newedge(v *node, r *rule) *edge {
 
 // Create a dependency graph for the given target.
 func buildgraph(rs *ruleSet, target string) *graph {
-	g := &graph{nil, make(map[string]*node)}
+	g := &graph{nil, make(map[string]*node), nil, make(map[string]*rule)}
 
 	// keep track of how many times each rule is visited, to avoid cycles.
 	rulecnt := make([]int, len(rs.rules))
 	g.root = applyrules(rs, g, target, rulecnt)
+	g.updateTimestamps()
 	g.cyclecheck(g.root)
 	g.root.flags |= nodeFlagProbable
 	g.vacuous(g.root)
 	g.ambiguous(g.root)
+	g.addDiscoveredDeps(rs)
 
 	return g
 }
@@ -130,7 +155,12 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 	if ok {
 		return u
 	}
-	u = g.newnode(target)
+	u = g.newnode(target, rs.isVirtual(target))
+	if target != "" {
+		g.chain = append(g.chain, target)
+		defer func() { g.chain = g.chain[:len(g.chain)-1] }()
+	}
+	g.checkLimits()
 
 	// does the target match a concrete rule?
 
@@ -139,6 +169,9 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 		for ki := range ks {
 			k := ks[ki]
 			if rulecnt[k] > maxRuleCnt {
+				if !rs.rules[k].ismeta {
+					g.limited[target] = &rs.rules[k]
+				}
 				continue
 			}
 
@@ -170,6 +203,10 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 	// find applicable metarules
 	for k := range rs.rules {
 		if rulecnt[k] >= maxRuleCnt {
+			if r := &rs.rules[k]; r.ismeta && !r.excluded(target) &&
+				slices.ContainsFunc(r.targets, func(p pattern) bool { return p.match(target) != nil }) {
+				g.limited[target] = r
+			}
 			continue
 		}
 
@@ -186,7 +223,7 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 
 		for j := range r.targets {
 			mat := r.targets[j].match(target)
-			if mat == nil {
+			if mat == nil || r.excluded(target) {
 				continue
 			}
 
@@ -292,13 +329,28 @@ func (g *graph) vacuous(u *node) bool {
 
 // Check for cycles
 func (g *graph) cyclecheck(u *node) {
+	g.cyclecheckChain(u, nil)
+}
+
+// Check for cycles through the prerequisites of a target, reached through a
+// chain of targets, each with the rule making it a prerequisite of the one
+// before, which may be in other mkfiles.
+func (g *graph) cyclecheckChain(u *node, chain []string) {
 	if u.flags&nodeFlagCycle != 0 && len(u.prereqs) > 0 {
-		mkError(fmt.Sprintf("cycle in the graph detected at target %s", u.name))
+		start := slices.IndexFunc(chain, func(s string) bool {
+			return s == u.name || strings.HasPrefix(s, u.name+" (")
+		})
+		mkError(fmt.Sprintf("cycle in the graph detected at target %s:\n\t%s",
+			u.name, formatChain(append(chain[max(start, 0):], u.name))))
 	}
 	u.flags |= nodeFlagCycle
 	for i := range u.prereqs {
 		if u.prereqs[i].v != nil {
-			g.cyclecheck(u.prereqs[i].v)
+			link := u.name
+			if r := u.prereqs[i].r; r != nil && r.file != "" {
+				link = fmt.Sprintf("%s (%s:%d)", u.name, r.file, r.line)
+			}
+			g.cyclecheckChain(u.prereqs[i].v, append(chain, link))
 		}
 	}
 	u.flags &= ^nodeFlagCycle
@@ -348,6 +400,84 @@ func (g *graph) ambiguous(u *node) {
 	g.togo(u)
 }
 
+// Find the prereqs that neither exist nor have a rule to make them, grouped
+// by the rules requiring them.
+func (g *graph) missingPrereqs() map[string][]string {
+	missing := make(map[string][]string)
+	seen := make(map[*node]bool)
+
+	var visit func(u *node)
+	visit = func(u *node) {
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		for _, e := range u.prereqs {
+			v := e.v
+			if v == nil {
+				continue
+			}
+			if len(v.prereqs) == 0 && !v.virtual && !v.exists {
+				where := "the command line"
+				if e.r.file != "" {
+					where = e.r.describe()
+				}
+				if !slices.Contains(missing[where], v.name) {
+					missing[where] = append(missing[where], v.name)
+				}
+			}
+			visit(v)
+		}
+	}
+	visit(g.root)
+	return missing
+}
+
+// Report all missing prereqs at once, before anything is executed. Returns
+// false if there are any.
+func (g *graph) checkPrereqs() bool {
+	if conflicts := g.conflictingTrees(); len(conflicts) > 0 {
+		mkPrintError("targets are made inside trees made by other recipes")
+		for _, conflict := range conflicts {
+			fmt.Fprintf(os.Stderr, "\t%s\n", conflict)
+		}
+		return false
+	}
+	if cycles := g.batchCycles(); len(cycles) > 0 {
+		mkPrintError("batch rules can't make targets depending on each other")
+		for _, cycle := range cycles {
+			fmt.Fprintf(os.Stderr, "\t%s\n", cycle)
+		}
+		return false
+	}
+	missing := g.missingPrereqs()
+	if len(missing) == 0 {
+		return true
+	}
+
+	wd, _ := os.Getwd()
+	mkPrintError(fmt.Sprintf("don't know how to make these prerequisites in %s", wd))
+	for _, where := range slices.Sorted(maps.Keys(missing)) {
+		fmt.Fprintf(os.Stderr, "\t%s\n", where)
+		for _, name := range missing[where] {
+			fmt.Fprintf(os.Stderr, "\t\t%s\n", name)
+		}
+	}
+
+	// rules left out by -d are the likely cause
+	if len(g.limited) > 0 {
+		fmt.Fprintf(os.Stderr, "rules applied -d %d times in a row already were not applied to:\n", maxRuleCnt)
+		names := slices.Sorted(maps.Keys(g.limited))
+		for _, name := range names[:min(len(names), 5)] {
+			fmt.Fprintf(os.Stderr, "\t%s (%s)\n", name, g.limited[name].describe())
+		}
+		if len(names) > 5 {
+			fmt.Fprintf(os.Stderr, "\tand %d more\n", len(names)-5)
+		}
+	}
+	return false
+}
+
 // Print a trace of rules, k
 func (g *graph) trace(name string, e *edge) {
 	fmt.Fprintf(os.Stderr, "\t%s", name)
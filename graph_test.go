@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// All missing prerequisites are found at once, grouped by the rules requiring
+// them.
+func TestMissingPrereqs(t *testing.T) {
+	mkfileAsString := "all:V: a.out b.out\n" +
+		"a.out: x.missing y.missing\n\techo $target\n" +
+		"b.out: x.missing made.out\n\techo $target\n" +
+		"made.out:\n\techo $target\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	g := buildgraph(rs, "all")
+	want := map[string][]string{
+		"mkfile:2: a.out": {"x.missing", "y.missing"},
+		"mkfile:4: b.out": {"x.missing"},
+	}
+	if got := g.missingPrereqs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("missing prereqs are %v, expected %v", got, want)
+	}
+}
+
+// Targets matching an exclusion of a meta-rule fall through to other rules.
+func TestMetaRuleExclusions(t *testing.T) {
+	mkfileAsString := "all:V: a.o gen/b.o\n" +
+		"%.o: !gen/%\n\tcc -c $stem.c\n" +
+		"gen/%.o:\n\tgenerate $target\n"
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", make(map[string][]string))
+	if got := rs.rules[1].prereqs; len(got) > 0 {
+		t.Errorf("prereqs are %v, expected the exclusion to be left out", got)
+	}
+
+	g := buildgraph(rs, "all")
+	for name, line := range map[string]int{"a.o": 2, "gen/b.o": 4} {
+		u := g.nodes[name]
+		if u == nil || len(u.prereqs) == 0 {
+			t.Errorf("no rule makes %s", name)
+			continue
+		}
+		if r := u.prereqs[len(u.prereqs)-1].r; r.line != line {
+			t.Errorf("%s is made by the rule on line %d, expected %d", name, r.line, line)
+		}
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	g := exportedGraph{Targets: []exportedTarget{
+		{Name: "a.c"},
+		{Name: "a.o", Rule: "mkfile:4: %.o", Stem: "a", Prereqs: []string{"a.c"}},
+		{Name: "all", Rule: "mkfile:1: all", Virtual: true, Prereqs: []string{`say "hi".o`}},
+	}}
+	var b strings.Builder
+	if err := writeDot(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"a.c" [label="a.c", shape=plaintext];`,
+		`"a.o" [label="a.o\n%.o, stem a", shape=box, tooltip="mkfile:4: %.o"];`,
+		`"a.o" -> "a.c";`,
+		`"all" [label="all", shape=box, tooltip="mkfile:1: all", style=dashed];`,
+		`"all" -> "say \"hi\".o";`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("%q is missing from\n%s", want, b.String())
+		}
+	}
+}
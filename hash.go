@@ -0,0 +1,362 @@
+// Hash mode, --hash: a target is out of date once the contents of one of its
+// prerequisites changed since it was made, rather than once a prerequisite is
+// newer. The hashes it was made from are kept in the state directory.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+// Number of files hashed at the same time, reading ahead of the build.
+const hashWorkers = 8
+
+var (
+	// Compare the contents of prerequisites instead of their timestamps.
+	hashMode bool
+
+	// The --hash-algorithm option.
+	hashAlgorithm string
+
+	// Hashes of the prerequisites targets were last made from, by
+	// "target < prerequisite". The header names the algorithm.
+	hashState = &lockFile{
+		path:   "hashes",
+		header: prereqsHeader("sha256"),
+		state:  true,
+	}
+
+	// Hashes of files, with the modification time, size and inode they had
+	// then, by name.
+	fileState = &lockFile{
+		path:   "files",
+		header: filesHeader("sha256"),
+		state:  true,
+	}
+
+	newHash = sha256.New
+
+	hashes = newFileHasher(hashWorkers)
+)
+
+// The algorithms files can be hashed with: sha256 as caches use it, blake3 and
+// xxh3 for speed on large files.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"xxh3":   func() hash.Hash { return xxh3.New() },
+}
+
+// Files modified this recently may be modified again within the resolution
+// of their timestamp, their hash is not kept.
+const racyWindow = 2 * time.Second
+
+func prereqsHeader(algorithm string) string {
+	return fmt.Sprintf("Generated by mk, the prerequisites targets were made from, hashed with %s.", algorithm)
+}
+
+func filesHeader(algorithm string) string {
+	return fmt.Sprintf("Generated by mk, the files last hashed with %s, by time, size and inode.", algorithm)
+}
+
+// Hash files with an algorithm. Hashes kept with another one are forgotten,
+// so prerequisites are hashed again.
+func useHashAlgorithm(algorithm string) error {
+	h, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q, expected one of %s", algorithm,
+			strings.Join(slices.Sorted(maps.Keys(hashAlgorithms)), ", "))
+	}
+	newHash = h
+	if err := useHeader(hashState, prereqsHeader(algorithm)); err != nil {
+		return err
+	}
+	if err := useHeader(fileState, filesHeader(algorithm)); err != nil {
+		return err
+	}
+	return useHeader(treeState, treesHeader(algorithm))
+}
+
+// Set the header of a state file, forgetting its entries if it was written
+// with another one.
+func useHeader(l *lockFile, header string) error {
+	l.header = header
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	first, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(first) != "# "+header {
+		l.mutex.Lock()
+		l.entries, l.loaded = make(map[string]string), true
+		l.mutex.Unlock()
+	}
+	return nil
+}
+
+// A hash being computed, or computed.
+type hashResult struct {
+	done chan struct{}
+	sum  string // empty for a missing file
+	err  error
+}
+
+// The hashes of files in this build, each computed once, by at most a number
+// of workers at a time.
+type fileHasher struct {
+	mutex   sync.Mutex
+	results map[string]*hashResult
+	workers chan struct{}
+	known   map[string]string // entries of fileState still to be written
+}
+
+func newFileHasher(workers int) *fileHasher {
+	return &fileHasher{
+		results: make(map[string]*hashResult),
+		workers: make(chan struct{}, workers),
+		known:   make(map[string]string),
+	}
+}
+
+// Hash a file, or wait for its hash if it is being computed already.
+func (h *fileHasher) hash(name string) (string, error) {
+	res, started := h.start(name)
+	if started {
+		h.compute(name, res)
+	}
+	<-res.done
+	return res.sum, res.err
+}
+
+// Start hashing files in the background, so their hashes are known by the
+// time targets are compared with them.
+func (h *fileHasher) prefetch(names []string) {
+	for _, name := range names {
+		if res, started := h.start(name); started {
+			go h.compute(name, res)
+		}
+	}
+}
+
+// Claim the hash of a file, returning whether the caller has to compute it.
+func (h *fileHasher) start(name string) (*hashResult, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if res, ok := h.results[name]; ok {
+		return res, false
+	}
+	res := &hashResult{done: make(chan struct{})}
+	h.results[name] = res
+	return res, true
+}
+
+func (h *fileHasher) compute(name string, res *hashResult) {
+	h.workers <- struct{}{}
+	res.sum, res.err = h.hashChanged(name)
+	<-h.workers
+	close(res.done)
+}
+
+// Forget the hash of a file whose recipe ran, it has to be read again.
+func (h *fileHasher) forget(name string) {
+	h.mutex.Lock()
+	delete(h.results, name)
+	h.mutex.Unlock()
+}
+
+// Hash a file, unless it has the modification time, size and inode it had
+// when it was last hashed: the hash did not change then, and reading large
+// files again would take most of a build with nothing to do.
+func (h *fileHasher) hashChanged(name string) (string, error) {
+	stat := os.Stat
+	if symlinkMode == "link" {
+		stat = os.Lstat
+	}
+	info, err := stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return h.hashDir(name)
+	}
+	stamp := fmt.Sprintf("%d %d %d", info.ModTime().UnixNano(), info.Size(), inode(info))
+	old, ok, err := fileState.get(name)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.LastIndexByte(old, ' '); ok && i >= 0 && old[:i] == stamp {
+		return old[i+1:], nil
+	}
+
+	sum, err := hashFile(name)
+	if err != nil || sum == "" {
+		return sum, err
+	}
+	if time.Since(info.ModTime()) > racyWindow {
+		h.mutex.Lock()
+		h.known[name] = stamp + " " + sum
+		h.mutex.Unlock()
+	}
+	return sum, nil
+}
+
+// Hash the files in a directory, recursively, with their paths in it.
+func (h *fileHasher) hashDir(dir string) (string, error) {
+	files, _, err := listDir(dir, nil)
+	if err != nil {
+		return "", err
+	}
+	sum := newHash()
+	for _, file := range files {
+		fileSum, err := h.hashChanged(filepath.Join(dir, file))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(sum, "%s\x00%s\n", file, fileSum)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Write the hashes of the files hashed in this build, with their
+// modification time, size and inode.
+func (h *fileHasher) save() error {
+	h.mutex.Lock()
+	known := h.known
+	h.known = make(map[string]string)
+	h.mutex.Unlock()
+	if len(known) == 0 {
+		return nil
+	}
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	return fileState.setAll(known)
+}
+
+// Hash the contents of a file, a missing file has an empty hash. With
+// --symlinks=link, that of a symbolic link is where it points to.
+func hashFile(name string) (string, error) {
+	if symlinkMode == "link" {
+		if dest, err := os.Readlink(name); err == nil {
+			h := newHash()
+			io.WriteString(h, dest)
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash the sources in the graph, the files no rule makes, while the build
+// goes on. Targets are hashed once their recipe ran, if it has to.
+func prefetchHashes(g *graph) {
+	if !hashMode {
+		return
+	}
+	var names []string
+	for name, u := range g.nodes {
+		if !u.virtual && u.exists && len(u.prereqs) == 0 {
+			names = append(names, name)
+		}
+	}
+	hashes.prefetch(names)
+}
+
+// Return the prerequisites whose contents changed since the target was made
+// from them. A target made before hashes were kept is compared by timestamp,
+// and the hashes of prerequisites it is found up to date with are kept.
+func changedPrereqs(u *node, prereqs []*node) ([]string, error) {
+	var changed []string
+	unknown := make(map[string]string)
+	for _, v := range prereqs {
+		if v.virtual {
+			if v.status == nodeStatusDone {
+				changed = append(changed, v.name)
+			}
+			continue
+		}
+		sum, err := hashes.hash(v.name)
+		if err != nil {
+			return nil, err
+		}
+		old, ok, err := hashState.get(u.name + " < " + v.name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ok && old != sum:
+			changed = append(changed, v.name)
+		case !ok && u.t.Before(v.t):
+			changed = append(changed, v.name)
+		case !ok:
+			unknown[u.name+" < "+v.name] = sum
+		}
+	}
+	if len(changed) == 0 && len(unknown) > 0 {
+		if _, err := statePath(); err != nil {
+			return nil, err
+		}
+		if err := hashState.setAll(unknown); err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// Remember the hashes of the prerequisites a target was made from.
+func recordHashes(u *node, prereqs []*node) error {
+	entries := make(map[string]string)
+	for _, v := range prereqs {
+		if v.virtual {
+			continue
+		}
+		sum, err := hashes.hash(v.name)
+		if err != nil {
+			return err
+		}
+		entries[u.name+" < "+v.name] = sum
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	return hashState.setAll(entries)
+}
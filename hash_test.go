@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Hashes kept with another algorithm are forgotten.
+func TestHashAlgorithm(t *testing.T) {
+	defer func(path, files string) {
+		hashState.path, hashState.entries, hashState.loaded = path, nil, false
+		fileState.path, fileState.entries, fileState.loaded = files, nil, false
+		useHashAlgorithm("sha256")
+	}(hashState.path, fileState.path)
+	dir := t.TempDir()
+	hashState.path = filepath.Join(dir, "hashes")
+	fileState.path = filepath.Join(dir, "files")
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sums := make(map[string]string)
+	for _, algorithm := range []string{"sha256", "blake3", "xxh3"} {
+		if err := useHashAlgorithm(algorithm); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := hashFile(filepath.Join(dir, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[algorithm] = sum
+	}
+	if len(sums["sha256"]) != 64 || len(sums["blake3"]) != 64 || len(sums["xxh3"]) != 16 || sums["sha256"] == sums["blake3"] {
+		t.Errorf("unexpected hashes %v", sums)
+	}
+
+	if err := hashState.setAll(map[string]string{"b < a": sums["xxh3"]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hashState.flush(); err != nil {
+		t.Fatal(err)
+	}
+	hashState.entries, hashState.loaded = nil, false
+	if err := useHashAlgorithm("xxh3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := hashState.get("b < a"); !ok {
+		t.Errorf("the hash was forgotten, although the algorithm is the same")
+	}
+	if err := useHashAlgorithm("blake3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := hashState.get("b < a"); ok {
+		t.Errorf("the hash was kept, although the algorithm changed")
+	}
+	if err := useHashAlgorithm("md5"); err == nil {
+		t.Errorf("expected an error for an unknown algorithm")
+	}
+}
+
+// A file with the time, size and inode it had is not read again.
+func TestHashFastPath(t *testing.T) {
+	defer func(files string) {
+		fileState.path, fileState.entries, fileState.loaded = files, nil, false
+	}(fileState.path)
+	dir := t.TempDir()
+	defer func(d string) { stateDir = d }(stateDir)
+	stateDir = dir
+	fileState.path = filepath.Join(dir, "files")
+	name := filepath.Join(dir, "a")
+	old := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		f.Close()
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a\n")
+	h := newFileHasher(1)
+	first, err := h.hash(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same time, size and inode: taken for the same file
+	write("b\n")
+	if sum, _ := newFileHasher(1).hash(name); sum != first {
+		t.Errorf("the file was hashed again, although its time, size and inode did not change")
+	}
+	old = old.Add(time.Second)
+	write("b\n")
+	if sum, _ := newFileHasher(1).hash(name); sum == first {
+		t.Errorf("the file was not hashed again after its time changed")
+	}
+}
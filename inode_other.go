@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Files have no inode here.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,110 @@
+// --jobs=auto: as many jobs as there are CPUs, unless the memory the recipes
+// used before says fewer fit in memory at once.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+var (
+	// Estimate the memory of recipes, limiting jobs to what fits.
+	jobsAuto bool
+
+	// Percentage of the memory of the system the recipes may use, with
+	// --jobs=auto.
+	jobsMemoryPercent int
+
+	// Memory the recipes executing at once may use, 0 for no limit.
+	memoryBudget int64
+
+	// Estimated memory of the recipes executing now.
+	memoryRunning int64
+
+	// Largest resident set size of every rule in the explain log.
+	ruleMemory = make(map[string]int64)
+
+	// The process slots taken by the recipes executing now.
+	slots      []bool
+	slotsMutex sync.Mutex
+)
+
+// Take the lowest process slot that is free, $nproc in the recipe. As no more
+// than -j recipes execute at once, it is less than -j.
+func takeSlot() int {
+	slotsMutex.Lock()
+	defer slotsMutex.Unlock()
+	for i := range slots {
+		if !slots[i] {
+			slots[i] = true
+			return i
+		}
+	}
+	slots = append(slots, true)
+	return len(slots) - 1
+}
+
+// Free the process slot of a recipe that is done.
+func freeSlot(n int) {
+	slotsMutex.Lock()
+	slots[n] = false
+	slotsMutex.Unlock()
+}
+
+// The value of --jobs: a number, or auto.
+type jobsValue struct{}
+
+func (jobsValue) String() string {
+	if jobsAuto {
+		return "auto"
+	}
+	return strconv.Itoa(subprocsAllowed)
+}
+
+func (jobsValue) Set(s string) error {
+	if s == "auto" {
+		jobsAuto = true
+		subprocsAllowed = runtime.NumCPU()
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return fmt.Errorf("expected a positive number or auto")
+	}
+	jobsAuto = false
+	subprocsAllowed = n
+	return nil
+}
+
+func (jobsValue) Type() string {
+	return "int|auto"
+}
+
+// Load the memory the rules used before, and set the budget.
+func loadMemoryEstimates() error {
+	total := totalMemory()
+	if total == 0 {
+		return nil
+	}
+	memoryBudget = total / 100 * int64(jobsMemoryPercent)
+
+	records, err := readExplainLog()
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		ruleMemory[rec.Rule] = max(ruleMemory[rec.Rule], rec.MaxRSS)
+	}
+	return nil
+}
+
+// The memory a recipe of the rule is expected to use, 0 if unknown.
+func memoryEstimate(r *rule) int64 {
+	if memoryBudget == 0 {
+		return 0
+	}
+	return ruleMemory[r.describe()]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobsValue(t *testing.T) {
+	defer func(n int, auto bool) { subprocsAllowed, jobsAuto = n, auto }(subprocsAllowed, jobsAuto)
+
+	var v jobsValue
+	if err := v.Set("3"); err != nil || subprocsAllowed != 3 || v.String() != "3" {
+		t.Errorf("-j 3 sets %d jobs: %v", subprocsAllowed, err)
+	}
+	if err := v.Set("auto"); err != nil || !jobsAuto || v.String() != "auto" {
+		t.Errorf("-j auto is not set: %v", err)
+	}
+	for _, bad := range []string{"0", "-1", "many"} {
+		if err := v.Set(bad); err == nil {
+			t.Errorf("-j %s is accepted", bad)
+		}
+	}
+}
+
+// A recipe waits for the memory it is expected to use, unless nothing else
+// runs.
+func TestMemoryBudget(t *testing.T) {
+	defer func(n int, budget int64) { subprocsAllowed, memoryBudget = n, budget }(subprocsAllowed, memoryBudget)
+	subprocsAllowed = 4
+	memoryBudget = 100
+
+	reserveSubproc(60)
+	started := make(chan bool)
+	go func() {
+		reserveSubproc(60)
+		started <- true
+		finishSubproc(60)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("the second recipe started, although both do not fit in memory")
+	case <-time.After(50 * time.Millisecond):
+	}
+	finishSubproc(60)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the second recipe did not start once the first one finished")
+	}
+
+	// too large for the budget, but nothing else runs
+	reserveSubproc(1000)
+	finishSubproc(1000)
+}
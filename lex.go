@@ -15,9 +15,16 @@ const nonBareRunes = " \t\n\r\\=:#'\"$"
 
 // Return true if the string contains whitespace only.
 func onlyWhitespace(s []rune) bool {
-	return !slices.ContainsFunc(s, unicode.IsSpace)
+	return !slices.ContainsFunc(s, func(c rune) bool { return !unicode.IsSpace(c) })
 }
 
+// Recipe prefixes with a special meaning, any other rune is an explicit prefix
+// that has to start every recipe line.
+const (
+	recipePrefixIndent rune = 0    // any leading whitespace starts a recipe
+	recipePrefixTab    rune = '\t' // only a leading tab starts a recipe
+)
+
 const (
 	tokenError tokenType = iota
 	tokenNewline
@@ -27,6 +34,7 @@ const (
 	tokenColon
 	tokenAssign
 	tokenRecipe
+	tokenComment
 )
 
 func (typ tokenType) String() string {
@@ -47,6 +55,8 @@ func (typ tokenType) String() string {
 		return "[Assign]"
 	case tokenRecipe:
 		return "[Recipe]"
+	case tokenComment:
+		return "[Comment]"
 	}
 	return "[MysteryToken]"
 }
@@ -69,12 +79,14 @@ func (t *token) String() string {
 }
 
 type lexer struct {
-	*reader           // input string to be lexed
-	output    []token // channel on which tokens are sent
-	startcol  int     // column on which the token begins
-	errmsg    string  // set to an appropriate error message when necessary
-	barewords bool    // lex only a sequence of words
-	state     lexerStateFun
+	*reader                     // input string to be lexed
+	output       []token        // channel on which tokens are sent
+	startcol     int            // column on which the token begins
+	errmsg       string         // set to an appropriate error message when necessary
+	barewords    bool           // lex only a sequence of words
+	recipeprefix rune           // how recipe lines are recognized
+	docs         map[int]string // '##' doc comments by line
+	state        lexerStateFun
 }
 
 // A lexerStateFun is simultaneously the the state of the lexer and the next
@@ -167,9 +179,27 @@ func (l *lexer) skipUntil(invalid string) {
 	}
 }
 
+// Skip a backslash-newline sequence (or backslash-CRLF) if one is next, and
+// return true if so. The following line continues the current one, so it never
+// counts as indented.
+func (l *lexer) skipContinuation() bool {
+	n := 1
+	if l.peekN(n) == '\r' {
+		n++
+	}
+	if l.peek() != '\\' || l.peekN(n) != '\n' {
+		return false
+	}
+	for range n + 1 {
+		l.skip()
+	}
+	l.indented = false
+	return true
+}
+
 // Start a new lexer to lex the given input.
 func lex(r io.Reader, barewords bool) *lexer {
-	return &lexer{reader: newReader(r), barewords: barewords, state: lexTopLevel}
+	return &lexer{reader: newReader(r), barewords: barewords, recipeprefix: defaultRecipePrefix, state: lexTopLevel}
 }
 
 func (l *lexer) nextToken() (token, bool) {
@@ -192,26 +222,35 @@ func lexTopLevel(l *lexer) lexerStateFun {
 			l.next()
 			if l.barewords {
 				return nil
-			} else {
-				l.emit(tokenNewline)
 			}
+			// the parser may change how the next line is lexed, so don't look
+			// at it yet
+			l.emit(tokenNewline)
+			return lexTopLevel
 		}
 		l.skipRun(" \t\r\n")
 
-		if l.peek() == '\\' && l.peekN(1) == '\n' {
-			l.next()
-			l.next()
-			l.indented = false
-		} else {
+		if !l.skipContinuation() {
 			break
 		}
 	}
 
-	if l.indented && l.col > 0 {
-		return lexRecipe
+	c := l.peek()
+	switch l.recipeprefix {
+	case recipePrefixIndent, recipePrefixTab:
+		if l.indented && l.col > 0 {
+			if l.recipeprefix == recipePrefixTab && l.linestart != '\t' {
+				l.lexerror("recipe lines have to begin with a tab.")
+				return nil
+			}
+			return lexRecipe
+		}
+	default:
+		if l.indented && c == l.recipeprefix {
+			return lexPrefixedRecipe
+		}
 	}
 
-	c := l.peek()
 	switch c {
 	case utf8.RuneError:
 		return nil
@@ -248,7 +287,22 @@ func lexAssign(l *lexer) lexerStateFun {
 
 func lexComment(l *lexer) lexerStateFun {
 	l.skip() // '#'
-	l.skipUntil("\n")
+	if l.peek() == '#' {
+		// a doc comment, kept for the rule on this or the next line
+		l.acceptUntil("\n")
+		if l.docs == nil {
+			l.docs = make(map[int]string)
+		}
+		l.docs[l.line] = strings.TrimSpace(strings.TrimLeft(string(l.value), "#"))
+		l.value = l.value[:0]
+		return lexTopLevel
+	}
+	if l.barewords {
+		l.skipUntil("\n")
+		return lexTopLevel
+	}
+	l.acceptUntil("\n")
+	l.emit(tokenComment)
 	return lexTopLevel
 }
 
@@ -300,6 +354,9 @@ func lexRecipe(l *lexer) lexerStateFun {
 		if !l.indented || l.col == 0 {
 			break
 		}
+		if l.recipeprefix == recipePrefixTab && l.linestart != '\t' {
+			break
+		}
 	}
 
 	if !onlyWhitespace(l.value) {
@@ -308,6 +365,42 @@ func lexRecipe(l *lexer) lexerStateFun {
 	return lexTopLevel
 }
 
+// Lex a recipe of which every line begins with the explicit recipe prefix. The
+// prefix is dropped, and so is the indentation of the first line from every
+// line, like with indented recipes.
+func lexPrefixedRecipe(l *lexer) lexerStateFun {
+	indent := -1
+	for {
+		l.next() // prefix
+		l.value = l.value[:len(l.value)-1]
+		if n := l.acceptRun(" \t"); indent < 0 {
+			indent = n
+		}
+		l.acceptUntilOrEOF("\n")
+
+		mark := len(l.value)
+		l.acceptRun(" \t\n\r")
+		if !l.indented || l.peek() != l.recipeprefix {
+			break
+		}
+
+		// keep blank lines, but not the whitespace in front of the prefix
+		space := slices.Clone(l.value[mark:])
+		l.value = l.value[:mark]
+		for _, c := range space {
+			if c == '\n' {
+				l.value = append(l.value, c)
+			}
+		}
+	}
+
+	if !onlyWhitespace(l.value) {
+		l.startcol = indent
+		l.emit(tokenRecipe)
+	}
+	return lexTopLevel
+}
+
 func lexBareWord(l *lexer) lexerStateFun {
 	l.acceptUntil(nonBareRunes)
 	c := l.peek()
@@ -319,12 +412,12 @@ func lexBareWord(l *lexer) lexerStateFun {
 		return lexBackQuotedWord
 	} else if c == '\\' {
 		c1 := l.peekN(1)
-		if c1 == '\n' || c1 == '\r' {
+		if c1 == '\n' || (c1 == '\r' && l.peekN(2) == '\n') {
+			// a continuation separates words, it never joins them
 			if len(l.value) > 0 {
 				l.emit(tokenWord)
 			}
-			l.skip()
-			l.skip()
+			l.skipContinuation()
 			return lexTopLevel
 		} else {
 			l.next()
@@ -339,6 +432,10 @@ func lexBareWord(l *lexer) lexerStateFun {
 			l.next()
 			return lexBareWord
 		}
+	} else if c == ':' && ws != nil && isProjectRef(string(l.value)) && !strings.ContainsRune(" \t\r\n:", l.peekN(1)) {
+		// the colon of //project:target, with -W
+		l.next()
+		return lexBareWord
 	}
 
 	if len(l.value) > 0 {
@@ -0,0 +1,71 @@
+// Limits on the graph and on mk running itself, so that runaway meta-rules
+// and recipes running mk end with an error instead of exhausting the machine.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Longest chain of targets, each a prerequisite of the one before.
+	maxDepth int
+
+	// Most targets in the graph.
+	maxNodes int
+
+	// Most levels of mk running in the recipes of another mk.
+	maxRecursion int
+
+	// The level this mk runs at, from $MKLEVEL.
+	mkLevel int
+)
+
+// Fail if the chain of targets being added to the graph, or the graph, grew
+// past the limits.
+func (g *graph) checkLimits() {
+	if maxDepth > 0 && len(g.chain) > maxDepth {
+		mkError(fmt.Sprintf("prerequisites nest more than %d deep (see --max-depth):\n\t%s",
+			maxDepth, formatChain(g.chain)))
+	}
+	if maxNodes > 0 && len(g.nodes) > maxNodes {
+		mkError(fmt.Sprintf("the graph has more than %d targets (see --max-nodes), the last added by:\n\t%s",
+			maxNodes, formatChain(g.chain)))
+	}
+}
+
+// A chain of targets, leaving out the middle of a long one.
+func formatChain(chain []string) string {
+	if len(chain) > 12 {
+		elided := fmt.Sprintf("... (%d more)", len(chain)-8)
+		chain = append(append(chain[:3:3], elided), chain[len(chain)-5:]...)
+	}
+	return strings.Join(chain, " -> ")
+}
+
+// The level of mk running in the recipes of other mks, 0 for one that does
+// not, failing if it is deeper than the limit. The recipes of this mk run at
+// the next level, in $MKLEVEL.
+func recursionLevel() int {
+	level, _ := strconv.Atoi(os.Getenv("MKLEVEL"))
+	if maxRecursion > 0 && level >= maxRecursion {
+		mkError(fmt.Sprintf("mk runs in recipes of mk %d levels deep (see --max-recursion), "+
+			"does a recipe run mk on its own target?", level))
+	}
+	return level
+}
+
+// Drop the variables the recipe running this mk got from the mk running it,
+// $target, $prereq and $MKSEQ name those of this mk's recipes.
+func unsetRecipeVars() {
+	for _, elem := range os.Environ() {
+		name, _, _ := strings.Cut(elem, "=")
+		if name == "target" || name == "MKSEQ" || strings.TrimRight(name, "0123456789") == "prereq" ||
+			strings.TrimRight(name, "0123456789") == "stem" {
+			os.Unsetenv(name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// The lock file, mk.lock, pins the exact versions of things mk fetches, so
+// that every checkout of a project builds with the same inputs.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Name of the lock file, it lives next to the top-level mkfile.
+const lockFileName = "mk.lock"
+
+type lockFile struct {
+	path    string            // where the lock file is read from and written to
+	header  string            // comment written at the top
+	entries map[string]string // pinned value of every key
+	loaded  bool              // have the entries been read yet
+	frozen  bool              // fail instead of changing an entry
+	dirty   bool              // entries changed since the file was written
+	dryRun  bool              // changes are only kept in memory, with -n
+	state   bool              // a file of the state directory, started over if it can't be read
+	mutex   sync.Mutex        // entries are pinned by concurrent builds
+}
+
+// The lock file of the current build.
+var lock = &lockFile{
+	path:   lockFileName,
+	header: "Generated by mk, commit this file along with the mkfile.",
+}
+
+// Read the lock file, if this hasn't happened yet. A missing lock file is
+// empty, and so is a state file that can't be read: what it remembered is
+// lost, rather than failing every run after.
+func (l *lockFile) load() error {
+	if l.loaded {
+		return nil
+	}
+	l.loaded = true
+	err := l.read()
+	if err != nil && l.state {
+		mkPrintWarning(fmt.Sprintf("%v, starting over", err))
+		l.entries = make(map[string]string)
+		return nil
+	}
+	return err
+}
+
+// Read the entries of the lock file.
+func (l *lockFile) read() error {
+	l.entries = make(map[string]string)
+
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// keys and values may contain blanks, they are separated by a tab
+		key, value, ok := strings.Cut(line, "\t")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected a key and a value separated by a tab", l.path, n)
+		}
+		l.entries[key] = value
+	}
+	return scanner.Err()
+}
+
+// Look up the value pinned for a key.
+func (l *lockFile) get(key string) (string, bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return "", false, err
+	}
+	value, ok := l.entries[key]
+	return value, ok, nil
+}
+
+// Pin a value for a key, written with saveLockFiles. A frozen lock file is
+// never changed, this is an error instead.
+func (l *lockFile) set(key, value string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+
+	old, ok := l.entries[key]
+	if ok && old == value {
+		return nil
+	}
+	if l.frozen && !ok {
+		return fmt.Errorf("%s is frozen, but %s is not pinned in it", l.path, key)
+	} else if l.frozen {
+		return fmt.Errorf("%s is frozen, but %s changed from %s to %s", l.path, key, old, value)
+	}
+
+	l.entries[key] = value
+	l.dirty = true
+	return nil
+}
+
+// Pin the values of several keys.
+func (l *lockFile) setAll(entries map[string]string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+
+	var changed []string
+	for key, value := range entries {
+		if old, ok := l.entries[key]; !ok || old != value {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if l.frozen {
+		return fmt.Errorf("%s is frozen, but %s changed", l.path, changed[0])
+	}
+	for _, key := range changed {
+		l.entries[key] = entries[key]
+	}
+	l.dirty = true
+	return nil
+}
+
+// Unpin a key, if it was pinned.
+func (l *lockFile) remove(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+	if _, ok := l.entries[key]; !ok {
+		return nil
+	}
+	if l.frozen {
+		return fmt.Errorf("%s is frozen, but %s would be removed", l.path, key)
+	}
+	delete(l.entries, key)
+	l.dirty = true
+	return nil
+}
+
+// Write the lock file, replacing it atomically.
+func (l *lockFile) save() error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", l.header)
+	for _, key := range slices.Sorted(maps.Keys(l.entries)) {
+		fmt.Fprintf(&b, "%s\t%s\n", key, l.entries[key])
+	}
+
+	return writeFileAtomic(l.path, func(w io.Writer) error {
+		_, err := io.WriteString(w, b.String())
+		return err
+	})
+}
+
+// Write the lock file if its entries changed, unless in a dry run.
+func (l *lockFile) flush() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.dirty || l.dryRun {
+		return nil
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// The lock file and the files of the state directory.
+func lockFiles() []*lockFile {
+	return []*lockFile{lock, envState, hashState, fileState, dirState, treeState, depState}
+}
+
+// Write the lock file and the files of the state directory that changed.
+// They are kept in memory during a build, rather than rewritten whole on
+// every change, and written once it is done or mk exits.
+func saveLockFiles() {
+	for _, l := range lockFiles() {
+		if err := l.flush(); err != nil {
+			mkPrintWarning(fmt.Sprintf("writing %s: %v", l.path, err))
+		}
+	}
+}
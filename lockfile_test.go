@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockFileName)
+	l := &lockFile{path: path}
+	if err := l.set("<|gen rules.mk", "sha256:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.set("http://example.com/data.csv", "Mon, 02 Jan 2006 15:04:05 GMT"); err != nil {
+		t.Fatal(err)
+	}
+	// changes are kept until the lock file is flushed
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("the lock file was written before it was flushed")
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new lock file reads back what was written
+	l = &lockFile{path: path, frozen: true}
+	for key, want := range map[string]string{
+		"<|gen rules.mk":              "sha256:1234",
+		"http://example.com/data.csv": "Mon, 02 Jan 2006 15:04:05 GMT",
+	} {
+		got, ok, err := l.get(key)
+		if err != nil || !ok || got != want {
+			t.Errorf("%s: got %q, %v, %v, want %q", key, got, ok, err, want)
+		}
+	}
+
+	// a frozen lock file accepts the same values, but nothing else
+	before, _ := os.ReadFile(path)
+	if err := l.set("<|gen rules.mk", "sha256:1234"); err != nil {
+		t.Errorf("setting an unchanged value failed: %v", err)
+	}
+	if err := l.set("<|gen rules.mk", "sha256:5678"); err == nil {
+		t.Errorf("a frozen lock file changed a value")
+	}
+	if err := l.set("use@v1", "abcd"); err == nil {
+		t.Errorf("a frozen lock file added a value")
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("a frozen lock file was written: %q", after)
+	}
+}
+
+// A dry run writes neither the lock file nor the state, the build does.
+func TestDryRunLockFile(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "reproducible <|printf 'out:\\n\\ttouch out\\n'\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "-n", "--hash"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for _, name := range []string{lockFileName, ".mk/hashes"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was written by a dry run", name)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "--hash"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockFileName)); err != nil {
+		t.Errorf("the build did not pin the include: %v", err)
+	}
+}
+
+// A state file that can't be read starts over, the lock file is an error.
+// Temporary files of killed runs are removed once they are old enough.
+func TestStateRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hashes")
+	if err := os.WriteFile(path, []byte("# cut short\nno tab here"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := (&lockFile{path: path}).get("a"); err == nil {
+		t.Errorf("a broken lock file is read")
+	}
+	l := &lockFile{path: path, state: true}
+	if _, ok, err := l.get("a"); err != nil || ok {
+		t.Errorf("a broken state file does not start over: %v", err)
+	}
+	if err := l.set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "# \na\t1\n" {
+		t.Errorf("the state file is %q after starting over", content)
+	}
+
+	defer func(dir, path string) { stateDir, hashState.path = dir, path }(stateDir, hashState.path)
+	stateDir, hashState.path = dir, path
+	stale, fresh := filepath.Join(dir, ".hashes123"), filepath.Join(dir, ".hashes456")
+	for _, name := range []string{stale, fresh} {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	removeStaleTemps()
+	if _, err := os.Stat(stale); err == nil {
+		t.Errorf("a stale temporary file was kept")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("a temporary file that may still be written was removed")
+	}
+}
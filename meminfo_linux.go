@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// The memory of the system, in bytes.
+func totalMemory() int64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return int64(info.Totalram) * int64(info.Unit)
+}
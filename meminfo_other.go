@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// The memory of the system is not known here.
+func totalMemory() int64 {
+	return 0
+}
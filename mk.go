@@ -3,11 +3,19 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/spf13/pflag"
 	"golang.org/x/term"
@@ -21,6 +29,11 @@ var (
 	// Default shell to use if none specified via $shell.
 	defaultShell string
 
+	// Where the recipes, their output and the messages of the build are
+	// shown: stdout, except with --stdin-protocol, where stdout carries the
+	// messages to the editor.
+	buildOutput io.Writer = os.Stdout
+
 	// Do not drop shell arguments when calling with no further arguments
 	// This works around `sh -c commands...` being a thing, but allows the `rc -v commands...` argument-less pflags
 	dontDropArgs bool
@@ -28,6 +41,19 @@ var (
 	// True if we are ignoring timestamps and rebuilding everything.
 	rebuildall bool = false
 
+	// True if targets and prerequisites containing shell metacharacters are
+	// an error.
+	strictNames bool
+
+	// True if missing intermediate targets are always made.
+	forceIntermediates bool
+
+	// True if make's automatic variables, like $@, are expanded.
+	makeVars bool
+
+	// True if recipes may overwrite files tracked by git.
+	allowSourceOverwrite bool
+
 	// Set of targets for which we are forcing rebuild
 	rebuildtargets map[string]bool = make(map[string]bool)
 
@@ -43,6 +69,14 @@ var (
 	// Wakeup on a free subprocess slot.
 	subprocsRunningCond *sync.Cond = sync.NewCond(&sync.Mutex{})
 
+	// Set once a target fails outside the prerequisites of a rule with the K
+	// attribute: recipes that did not start yet are not executed.
+	buildStopped atomic.Bool
+
+	// Never stop the build on a failure, with -k: only the targets depending
+	// on a failed one are not made.
+	keepGoing bool
+
 	// Prevent more than one recipe at a time from trying to take over
 	exclusiveSubproc = sync.Mutex{}
 
@@ -55,21 +89,35 @@ var (
 	shellDelimiter string
 )
 
-// Wait until there is an available subprocess slot.
-func reserveSubproc() {
+// Wait until there is an available subprocess slot, and the memory the
+// subprocess is expected to use fits in the budget. A subprocess runs anyway
+// if no other does.
+func reserveSubproc(memory int64) {
 	subprocsRunningCond.L.Lock()
-	for subprocsRunning >= subprocsAllowed {
+	for subprocsRunning >= subprocsAllowed ||
+		(memoryBudget > 0 && subprocsRunning > 0 && memoryRunning+memory > memoryBudget) {
 		subprocsRunningCond.Wait()
 	}
 	subprocsRunning++
+	memoryRunning += memory
 	subprocsRunningCond.L.Unlock()
 }
 
+// Stop the build once a target failed, unless with -k or among the
+// prerequisites of a rule with the K attribute.
+func stopOnFailure(u *node, status nodeStatus, dryrun bool) {
+	if status == nodeStatusFailed && !dryrun && !keepGoing && u.flags&nodeFlagKeepGoing == 0 {
+		buildStopped.Store(true)
+	}
+}
+
 // Free up another subprocess to run.
-func finishSubproc() {
+func finishSubproc(memory int64) {
 	subprocsRunningCond.L.Lock()
 	subprocsRunning--
-	subprocsRunningCond.Signal()
+	memoryRunning -= memory
+	// waiters expect different amounts of memory, let them all check
+	subprocsRunningCond.Broadcast()
 	subprocsRunningCond.L.Unlock()
 }
 
@@ -88,6 +136,24 @@ func reserveExclusiveSubproc() {
 	}
 }
 
+// Take the subprocess slots that are free, for a recipe running jobs of its
+// own. Returns how many it took.
+func claimFreeSubprocs() int {
+	subprocsRunningCond.L.Lock()
+	defer subprocsRunningCond.L.Unlock()
+	n := max(subprocsAllowed-subprocsRunning, 0)
+	subprocsRunning += n
+	return n
+}
+
+// Give back the slots taken by claimFreeSubprocs.
+func releaseSubprocs(n int) {
+	subprocsRunningCond.L.Lock()
+	subprocsRunning -= n
+	subprocsRunningCond.Broadcast()
+	subprocsRunningCond.L.Unlock()
+}
+
 func finishExclusiveSubproc() {
 	subprocsRunning = 0
 	subprocsRunningCond.Broadcast()
@@ -114,9 +180,21 @@ func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node, dryrun bool,
 	prereqstat := make(chan nodeStatus)
 	pending := 0
 
+	if shuffle {
+		prereqs = shuffled(u.name, prereqs)
+	}
+
+	// the prerequisites of a K rule, and theirs, fail without stopping the build
+	u.mutex.Lock()
+	keepgoing := e.r.attributes.keepgoing || u.flags&nodeFlagKeepGoing != 0
+	u.mutex.Unlock()
+
 	// build prereqs that need building
 	for i := range prereqs {
 		prereqs[i].mutex.Lock()
+		if keepgoing {
+			prereqs[i].flags |= nodeFlagKeepGoing
+		}
 		switch prereqs[i].status {
 		case nodeStatusReady, nodeStatusNop:
 			go mkNode(g, prereqs[i], dryrun, required)
@@ -167,6 +245,7 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 	defer func() {
 		u.mutex.Lock()
 		u.status = finalstatus
+		stopOnFailure(u, finalstatus, dryrun)
 		for i := range u.listeners {
 			u.listeners[i] <- u.status
 		}
@@ -176,10 +255,16 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 
 	// there's no rules.
 	if len(u.prereqs) == 0 {
-		if !(u.r != nil && u.r.attributes.virtual) && !u.exists {
+		if !u.virtual && !u.exists {
 			wd, _ := os.Getwd()
 			mkError(fmt.Sprintf("don't know how to make %s in %s\n", u.name, wd))
 		}
+		// pin the version of URLs that are sources, not built
+		if u.version != "" {
+			if err := lock.set(u.name, u.version); err != nil {
+				mkError(err.Error())
+			}
+		}
 		finalstatus = nodeStatusNop
 		return
 	}
@@ -203,54 +288,293 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 	}
 
 	prereqsRequired := required && (e.r.attributes.virtual || !u.exists)
-	mkNodePrereqs(g, u, e, prereqs, dryrun, prereqsRequired)
+	if mkNodePrereqs(g, u, e, prereqs, dryrun, prereqsRequired) == nodeStatusFailed {
+		finalstatus = nodeStatusFailed
+	}
 
 	uptodate := true
+	var causes []string
 	if !e.r.attributes.virtual {
 		u.updateTimestamp()
-		if !u.exists && required {
+		if !u.exists && (required || forceIntermediates) {
 			uptodate = false
-		} else if u.exists || required {
+			causes = append(causes, causeMissing)
+		} else if u.exists && hashMode && !dryrun {
+			// a prerequisite that was made again may well be the same
+			changed, err := changedPrereqs(u, prereqs)
+			if err != nil {
+				mkError(err.Error())
+			}
 			for i := range prereqs {
-				if u.t.Before(prereqs[i].t) || prereqs[i].status == nodeStatusDone {
+				if isChangedSince(prereqs[i].name) && !slices.Contains(changed, prereqs[i].name) {
+					changed = append(changed, prereqs[i].name)
+				}
+			}
+			if len(changed) > 0 {
+				uptodate = false
+				causes = append(causes, changed...)
+			}
+			changed, err = changedEnv(u.name, e.r)
+			if err != nil {
+				mkError(err.Error())
+			}
+			if len(changed) > 0 {
+				uptodate = false
+				causes = append(causes, changed...)
+			}
+		} else if u.exists {
+			for i := range prereqs {
+				if u.t.Before(prereqTime(e.r, prereqs[i])) || isChangedSince(prereqs[i].name) ||
+					prereqs[i].status == nodeStatusDone && prereqs[i].flags&nodeFlagUnchanged == 0 {
 					uptodate = false
+					causes = append(causes, prereqs[i].name)
+				}
+			}
+			changed, err := changedEnv(u.name, e.r)
+			if err != nil {
+				mkError(err.Error())
+			}
+			if len(changed) > 0 {
+				uptodate = false
+				causes = append(causes, changed...)
+			}
+		} else {
+			// A missing intermediate is as recent as its most recent prereq.
+			// It is made only if this puts the targets depending on it out
+			// of date, they will require it then.
+			for i := range prereqs {
+				if u.t.Before(prereqs[i].t) {
+					u.t = prereqs[i].t
 				}
 			}
-		} else if required {
-			uptodate = false
 		}
 	} else {
 		uptodate = false
+		causes = append(causes, causeVirtual)
+	}
+
+	// a tree its recipe did not finish making, or that changed since
+	if u.exists && isTreeTarget(u.name, e.r) && !treeStamped(u.name) {
+		uptodate = false
+		causes = append(causes, causeTree)
 	}
 
 	_, isrebuildtarget := rebuildtargets[u.name]
 	if isrebuildtarget || rebuildall {
 		uptodate = false
+		causes = append(causes, causeForced)
+	}
+
+	// mk in the project of the target decides whether it is out of date
+	if e.r.delegate != "" {
+		uptodate = false
+		causes = append(causes, causeProject)
 	}
 
 	// make another pass on the prereqs, since we know we need them now
 	if !uptodate {
-		mkNodePrereqs(g, u, e, prereqs, dryrun, true)
+		if mkNodePrereqs(g, u, e, prereqs, dryrun, true) == nodeStatusFailed {
+			finalstatus = nodeStatusFailed
+		}
+	}
+
+	// a virtual target is as recent as its most recent prereq
+	if u.virtual {
+		for i := range prereqs {
+			if prereqs[i].t.After(u.t) {
+				u.t = prereqs[i].t
+			}
+		}
+	}
+
+	// once a target failed, recipes that did not start yet are not executed
+	if !uptodate && !dryrun && len(e.r.recipe) > 0 && buildStopped.Load() {
+		finalstatus = nodeStatusFailed
+	}
+
+	// the targets of a batch rule wait for each other, and run the recipe once
+	batched := e.r.attributes.batch && len(e.r.recipe) > 0
+	if batched && (uptodate || finalstatus == nodeStatusFailed) {
+		g.batchOf(e.r).skip(u, dryrun)
 	}
 
 	// execute the recipe, unless the prereqs failed
 	if !uptodate && finalstatus != nodeStatusFailed && len(e.r.recipe) > 0 {
-		if e.r.attributes.exclusive {
+		switch {
+		case batched:
+			// the batch reserves a subprocess once it runs
+		case e.r.attributes.exclusive:
 			reserveExclusiveSubproc()
-		} else {
-			reserveSubproc()
+		default:
+			reserveSubproc(memoryEstimate(e.r))
+		}
+
+		// another target may have failed while this one waited for a job
+		stopped := !batched && !dryrun && buildStopped.Load()
+
+		// with --interactive=each, the recipe may be skipped, or the build
+		// stopped
+		skipped := false
+		if !stopped && !batched && !dryrun && interactiveMode == "each" {
+			switch confirmRecipe(u, e) {
+			case confirmSkip:
+				skipped = true
+			case confirmQuit:
+				buildStopped.Store(true)
+				stopped = true
+			}
 		}
 
-		if !dorecipe(u.name, u, e, dryrun) {
+		// the key of the target in the cache, made from its prerequisites
+		var key string
+		if !stopped && !skipped && !batched && !dryrun {
+			var err error
+			if key, err = cacheKey(u, e, prereqs); err != nil {
+				mkPrintWarning(fmt.Sprintf("hashing the prerequisites of %s for the cache: %v", u.name, err))
+			}
+		}
+
+		before, existed := u.t, u.exists
+		start := time.Now()
+		if !stopped {
+			if explainRebuilds {
+				mkPrintExplain(u, e, prereqs, causes)
+			}
+			publishEvent(apiEvent{Type: "start", Target: u.name})
+		}
+		var ok, made bool
+		switch {
+		case stopped:
+		case skipped:
+			ok = true
+		case batched:
+			ok = g.batchOf(e.r).join(u, e, causes, dryrun)
+		case key != "" && fetchTarget(u.name, e, key):
+			ok = true
+		default:
+			ok = dorecipe(u.name, u, e, dryrun, nil)
+			made = ok
+		}
+		if ok && dryrun {
+			planTargets(u, e)
+		}
+		if stopped {
 			finalstatus = nodeStatusFailed
+		} else if !ok {
+			if e.r.attributes.nonstop {
+				mkPrintWarning(fmt.Sprintf("recipe for %s failed, continuing (E attribute)", u.name))
+			} else {
+				finalstatus = nodeStatusFailed
+				recordFailure(u.name)
+			}
 		}
+		if mode := e.r.targetMode(); mode != "" && !e.r.attributes.virtual && !dryrun && finalstatus != nodeStatusFailed {
+			if err := chmodTarget(u.name, mode); err != nil && !os.IsNotExist(err) {
+				mkPrintWarning(fmt.Sprintf("changing the mode of %s: %v", u.name, err))
+			}
+		}
+		// the recipe succeeded, but the target is not what the rule expects:
+		// it is removed, to be made again
+		if len(e.r.expect) > 0 && ok && !e.r.attributes.virtual && !dryrun && !skipped && finalstatus != nodeStatusFailed {
+			if err := checkExpect(u.name, e.r.expect); err != nil {
+				mkPrintError(fmt.Sprintf("recipe for %s succeeded, but %v", u.name, err))
+				if err := discardTarget(u.name, e.r); err != nil && !os.IsNotExist(err) {
+					mkPrintWarning(fmt.Sprintf("removing %s: %v", u.name, err))
+				}
+				finalstatus = nodeStatusFailed
+				recordFailure(u.name)
+			}
+		}
+		// only what passed the checks is uploaded
+		if made && key != "" && finalstatus != nodeStatusFailed {
+			storeTarget(u.name, key)
+		}
+		if !stopped {
+			publishEvent(apiEvent{Type: "done", Target: u.name, Failed: finalstatus == nodeStatusFailed,
+				Duration: time.Since(start), Seq: u.seq})
+		}
+		if isTreeTarget(u.name, e.r) && !dryrun && finalstatus != nodeStatusFailed {
+			if err := stampTree(u.name); err != nil {
+				mkPrintWarning(fmt.Sprintf("keeping the stamp of %s: %v", u.name, err))
+			}
+		}
+		forgetStats(recipeTargets(u, e)...)
 		u.updateTimestamp()
 
-		if e.r.attributes.exclusive {
+		if hashMode && !dryrun {
+			hashes.forget(u.name)
+			if finalstatus != nodeStatusFailed {
+				if err := recordHashes(u, prereqs); err != nil {
+					mkPrintWarning(fmt.Sprintf("remembering the prerequisites of %s: %v", u.name, err))
+				}
+			}
+		}
+
+		if !dryrun && finalstatus != nodeStatusFailed && e.r.depfile != "" {
+			if err := recordDeps(u, e); err != nil {
+				mkPrintWarning(fmt.Sprintf("remembering the prerequisites of %s: %v", u.name, err))
+			}
+		}
+
+		if !dryrun && finalstatus != nodeStatusFailed && len(e.r.envdeps) > 0 {
+			if err := recordEnv(u.name, e.r); err != nil {
+				mkPrintWarning(fmt.Sprintf("remembering the variables of %s: %v", u.name, err))
+			}
+		}
+
+		if !dryrun && !stopped {
+			recordUsage(e.r, u.usage)
+		}
+		if !dryrun && !stopped && explainRebuilds {
+			err := logExplain(explainRecord{
+				Time:     start,
+				BuildID:  buildID,
+				Seq:      u.seq,
+				Target:   u.name,
+				Rule:     e.r.describe(),
+				Causes:   causes,
+				Duration: time.Since(start),
+				Failed:   finalstatus == nodeStatusFailed,
+				Status:   u.progress,
+				User:     u.usage.user,
+				Sys:      u.usage.sys,
+				MaxRSS:   u.usage.maxRSS,
+			})
+			if err != nil {
+				mkPrintWarning(fmt.Sprintf("writing the explain log: %v", err))
+			}
+		}
+
+		// catch recipes that claim a target they never write
+		if !dryrun && !skipped && finalstatus != nodeStatusFailed && !e.r.attributes.virtual &&
+			!e.r.attributes.update && !e.r.attributes.forcedTimestamp && e.r.delegate == "" {
+			if !u.exists {
+				mkPrintWarning(fmt.Sprintf("recipe for %s did not create it", u.name))
+			} else if existed && u.t.Equal(before) {
+				mkPrintWarning(fmt.Sprintf("recipe for %s did not update it", u.name))
+			}
+		}
+
+		// mk in the project found the target up to date, so are those depending on it
+		if !dryrun && finalstatus != nodeStatusFailed && e.r.delegate != "" && existed && u.t.Equal(before) {
+			u.mutex.Lock()
+			u.flags |= nodeFlagUnchanged
+			u.mutex.Unlock()
+		}
+
+		// stop the build before another recipe takes the job
+		stopOnFailure(u, finalstatus, dryrun)
+		switch {
+		case batched:
+			// the batch freed its subprocess already
+		case e.r.attributes.exclusive:
 			finishExclusiveSubproc()
-		} else {
-			finishSubproc()
+		default:
+			finishSubproc(memoryEstimate(e.r))
 		}
+	} else if !uptodate && finalstatus != nodeStatusFailed && e.r.attributes.forcedTimestamp {
+		// without a recipe, the N attribute still counts the target as made
+		u.t = clock()
 	} else if finalstatus != nodeStatusFailed {
 		finalstatus = nodeStatusNop
 	}
@@ -258,10 +582,34 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 
 func mkError(msg string) {
 	mkPrintError(msg)
-	os.Exit(1)
+	mkExit(1)
+}
+
+// Exit, writing the lock file and the state first.
+func mkExit(status int) {
+	saveLockFiles()
+	os.Exit(status)
+}
+
+// Write the lock file and the state when mk is interrupted or terminated too,
+// exiting as the signal would have.
+func exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		if n, ok := s.(syscall.Signal); ok {
+			mkExit(128 + int(n))
+		}
+		mkExit(1)
+	}()
 }
 
 func mkPrintError(msg string) {
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+	clearProgress()
+	defer drawProgress()
 	if color {
 		os.Stderr.WriteString(ansiTermRed)
 	}
@@ -271,64 +619,191 @@ func mkPrintError(msg string) {
 	}
 }
 
+func mkPrintWarning(msg string) {
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+	clearProgress()
+	defer drawProgress()
+	if color {
+		os.Stderr.WriteString(ansiTermYellow)
+	}
+	fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+	if color {
+		os.Stderr.WriteString(ansiTermDefault)
+	}
+}
+
 func mkPrintRecipe(target string, recipe string, quiet bool) {
 	mkMsgMutex.Lock()
+	writeRecipe(buildOutput, target, recipe, quiet)
+	mkMsgMutex.Unlock()
+}
+
+// Write a recipe as it is printed before it runs.
+func writeRecipe(out io.Writer, target string, recipe string, quiet bool) {
+	recipe = string(maskSecrets([]byte(recipe)))
 	if !color {
-		fmt.Printf("%s: ", target)
+		fmt.Fprintf(out, "%s: ", target)
 	} else {
-		fmt.Printf("%s%s%s → %s",
+		fmt.Fprintf(out, "%s%s%s → %s",
 			ansiTermBlue+ansiTermBright+ansiTermUnderline, target,
 			ansiTermDefault, ansiTermBlue)
 	}
 	if quiet {
 		if !color {
-			fmt.Println("...")
+			fmt.Fprintln(out, "...")
 		} else {
-			fmt.Println("…")
+			fmt.Fprintln(out, "…")
 		}
 	} else {
-		printIndented(os.Stdout, recipe, len(target)+3)
+		printIndented(out, recipe, utf8.RuneCountInString(target)+3)
 		if len(recipe) == 0 {
-			os.Stdout.WriteString("\n")
+			io.WriteString(out, "\n")
 		}
 	}
 	if color {
-		os.Stdout.WriteString(ansiTermDefault)
+		io.WriteString(out, ansiTermDefault)
 	}
-	mkMsgMutex.Unlock()
 }
 
 func main() {
 	var directory string
 	var mkfilepath string
-	var interactive bool
 	var dryrun bool
 	var shallowrebuild bool
 	var quiet bool
 	var shellOS string
+	var presetname string
+	var graphformat string
+	var since string
+	var manifest string
+	var listtargets string
+	var groupby string
+	var debugVarNames []string
+	var workspaceMode bool
 
 	pflag.StringVarP(&directory, "directory", "C", "", "directory to change in to")
 	pflag.StringVarP(&mkfilepath, "file", "f", "mkfile", "use the given file as mkfile")
+	pflag.BoolVarP(&workspaceMode, "workspace", "W", false, "resolve //project:target to the targets of the projects in mkwork")
+	pflag.BoolVarP(&explainRebuilds, "explain", "e", false, "print why the recipe of every target is executed, and record it in the explain log")
+	pflag.BoolVarP(&keepGoing, "keep-going", "k", false, "go on making the targets that do not depend on a failed one")
 	pflag.BoolVarP(&dryrun, "dry-run", "n", false, "print commands without actually executing")
 	pflag.BoolVar(&shallowrebuild, "force-target", false, "force building of just targets")
 	pflag.BoolVar(&rebuildall, "force-all", false, "force building of all dependencies")
-	pflag.IntVarP(&subprocsAllowed, "jobs", "j", runtime.NumCPU(), "maximum number of jobs to execute in parallel")
+	pflag.BoolVar(&forceIntermediates, "force-intermediates", false, "force building of missing intermediate targets")
+	subprocsAllowed = runtime.NumCPU()
+	pflag.VarP(jobsValue{}, "jobs", "j", "maximum number of jobs to execute in parallel, or auto to limit them by the memory recipes used before")
+	pflag.IntVar(&jobsMemoryPercent, "jobs-memory", 80, "percentage of the memory recipes may use with --jobs=auto")
+	pflag.Var(shuffleValue{}, "shuffle", "start the prerequisites of targets in a random order, or that of the given seed")
+	pflag.Lookup("shuffle").NoOptDefVal = "random"
 	pflag.IntVarP(&maxRuleCnt, "depth", "d", 1, "maximum number of times a specific rule can be applied (recursion)")
-	pflag.BoolVarP(&interactive, "interactive", "i", false, "ask before executing rules")
+	pflag.IntVar(&maxDepth, "max-depth", 1000, "maximum depth of nested prerequisites, 0 for no limit")
+	pflag.IntVar(&maxNodes, "max-nodes", 1000000, "maximum number of targets in the graph, 0 for no limit")
+	pflag.IntVar(&maxRecursion, "max-recursion", 32, "maximum levels of mk running in recipes, 0 for no limit")
+	pflag.StringVarP(&interactiveMode, "interactive", "i", "", "show what would be executed and ask before executing it: once, or before each recipe")
+	pflag.Lookup("interactive").NoOptDefVal = "once"
 	pflag.BoolVarP(&quiet, "quiet", "q", false, "don't print recipes before executing them")
 	pflag.BoolVar(&color, "color", term.IsTerminal(int(os.Stdout.Fd())), "turn color on/off")
 	pflag.StringVar(&defaultShell, "shell", "sh -c", "default shell to use if none are specified via $shell")
 	pflag.BoolVar(&dontDropArgs, "drop-shell-arg", false, "don't drop shell arguments when no further arguments are specified")
+	pflag.BoolVar(&strictNames, "strict-names", false, "fail on targets and prerequisites containing shell metacharacters")
+	pflag.BoolVar(&allowSourceOverwrite, "allow-source-overwrite", false, "allow recipes to overwrite files tracked by git")
+	pflag.BoolVar(&trash, "trash", false, "keep the previous version of targets in .mk/trash")
+	pflag.Int64Var(&trashSize, "trash-size", 256, "maximum size of .mk/trash in megabytes")
+	pflag.StringVar(&notify, "notify", "", "command to run, or webhook:URL to post to, when a build is slow or fails")
+	pflag.DurationVar(&notifyAfter, "notify-after", time.Minute, "duration after which a successful build notifies")
+	pflag.StringVar(&symlinkMode, "symlinks", "follow", "look up symbolic links by the file they point to (follow) or by themselves (link)")
+	pflag.StringVar(&defaultUmask, "umask", "", "run recipes with this umask, like 022")
+	pflag.StringVar(&defaultTargetMode, "target-mode", "", "change the mode of targets after their recipe, like a-w or 0444")
+	pflag.BoolVar(&hashMode, "hash", false, "rebuild targets when the contents of their prerequisites change, not their timestamps")
+	pflag.StringVar(&hashAlgorithm, "hash-algorithm", "sha256", "with --hash, hash files with sha256, blake3 or xxh3")
+	pflag.StringVar(&credentialHelper, "credential-helper", os.Getenv("MK_CREDENTIAL_HELPER"), "command printing the secret of ${credential name}, given the name")
+	pflag.StringVar(&cacheURL, "cache", "", "fetch targets from, and upload them to, the HTTP cache at the given URL")
+	pflag.BoolVar(&cacheReadOnly, "cache-read-only", false, "with --cache, fetch targets but do not upload them")
+	pflag.BoolVar(&warmStart, "warm-start", false, "reuse the rules and the graph of the previous run, if the mkfiles did not change")
+	pflag.StringVar(&since, "since", "", "consider files changed in git since a time or ref newer than their targets")
+	pflag.BoolVar(&jsonOutput, "json", false, "print JSON rather than text, where supported")
+	pflag.BoolVar(&serveUI, "ui", false, "with serve, also serve a page rendering the graph")
+	pflag.StringVar(&listenAddr, "listen", "localhost:8080", "address serve listens on")
+	pflag.BoolVar(&stdinProtocol, "stdin-protocol", false, "take build requests from an editor on stdin instead of building")
+	pflag.StringVar(&problemsFormat, "problems", "", "show the diagnostics in the output of recipes at the end, as gcc, go or json")
+	pflag.StringVar(&annotationsMode, "annotations", "none", "annotate failures and diagnostics for CI: auto, github, gitlab or none")
+	pflag.BoolVar(&parseOnly, "parse-only", false, "check the mkfiles, reporting all syntax errors, instead of building")
+	pflag.StringVar(&listtargets, "targets", "", "list the targets instead of building, grouped, or one per line: all, meta or phony")
+	pflag.Lookup("targets").NoOptDefVal = "grouped"
+	pflag.StringVar(&groupby, "group-by", "file", "group the listed targets by file or dir")
+	pflag.StringVar(&manifest, "emit-generated-manifest", "", "write the files generated by the build to the given file (- for stdout) instead of building")
+	pflag.StringVar(&graphformat, "graph", "", "print the dependency graph in the given format (json or dot) instead of building")
+	pflag.BoolVar(&statusLine, "status-line", term.IsTerminal(int(os.Stdout.Fd())), "show a line counting the recipes instead of the recipes, on a terminal")
+	pflag.StringVarP(&outputSync, "output-sync", "O", "auto", "show the output of each recipe in one piece once it finished: target, none, or auto for target with more than one job")
+	pflag.Var(sizeValue{&maxRecipeOutput}, "max-output-per-recipe", "cut the output of a recipe after this size, like 1MB, keeping all of it in .mk/output")
+	pflag.StringSliceVar(&stripANSI, "strip-ansi", stripANSI, "strip escape sequences, like colors, from the output of recipes kept in logs, shown on the terminal, or none")
+	pflag.StringVar(&commandLog, "log", "", "append every command executed, with its target, time, duration and exit status, to the given file")
+	pflag.StringVar(&traceFile, "trace", "", "write the start, duration and job of every recipe to the given file, as a Chrome trace")
+	pflag.BoolVar(&unusedPrereqs, "unused-prereqs", false, "run recipes under strace and, after the build, list the prerequisites each never read")
+	pflag.IntVar(&showTimes, "times", 0, "after the build, show how long the given number of slowest recipes took")
+	pflag.Lookup("times").NoOptDefVal = "10"
+	pflag.BoolVar(&failuresAtEnd, "failures-at-end", false, "capture the output of recipes, showing that of failed ones after the build")
+	pflag.BoolVar(&pageFailures, "page-failures", false, "show the failures after the build through $PAGER")
+	pflag.StringSliceVar(&debugVarNames, "debug-vars", nil, "log the assignments and expansions of the given variables while parsing")
+	pflag.BoolVar(&makeVars, "make-vars", false, "expand make's automatic variables $@ $< $^ $* in recipes")
+	pflag.BoolVar(&lock.frozen, "frozen", false, "fail instead of changing "+lockFileName)
+	pflag.StringVar(&presetname, "preset", "", "build the targets of a preset, with its variables")
+	pflag.StringVar(&dialectName, "dialect", dialectName, "defaults of the plan9 mk, this mk (mk9), or make (gnu)")
 	pflag.StringVar(&shellOS, "shell-delimiter", runtime.GOOS, "delimiter in a list in the environment")
 	pflag.Parse()
+	mkLevel = recursionLevel()
+	initBuildID()
+	if mkLevel > 0 {
+		unsetRecipeVars()
+	}
+	if shuffle {
+		fmt.Fprintf(os.Stderr, "mk: shuffling with --shuffle=%d\n", shuffleSeed)
+	}
+	for _, name := range debugVarNames {
+		debugVars[name] = true
+	}
 
-	switch shellOS {
-	case "plan9":
-		shellDelimiter = "\x01"
-	default:
-		shellDelimiter = ":"
+	if err := applyDialect(dialectName, &shellOS); err != nil {
+		mkError(err.Error())
+	}
+	if problemsFormat != "" && !slices.Contains(problemFormats, problemsFormat) {
+		mkError(fmt.Sprintf("unknown format %q for --problems, expected one of %s",
+			problemsFormat, strings.Join(problemFormats, ", ")))
+	}
+	if defaultUmask != "" {
+		if _, err := parseUmask(defaultUmask); err != nil {
+			mkError(err.Error())
+		}
+	}
+	if defaultTargetMode != "" {
+		if _, err := parseMode(defaultTargetMode); err != nil {
+			mkError(err.Error())
+		}
+	}
+	if err := checkStripANSI(); err != nil {
+		mkError(err.Error())
+	}
+	if symlinkMode != "follow" && symlinkMode != "link" {
+		mkError(fmt.Sprintf("unknown mode %q for --symlinks, expected follow or link", symlinkMode))
+	}
+	if interactiveMode != "" && interactiveMode != "once" && interactiveMode != "each" {
+		mkError(fmt.Sprintf("unknown mode %q for --interactive, expected once or each", interactiveMode))
+	}
+	if interactiveMode != "" || dryrun || stdinProtocol || failuresAtEnd {
+		statusLine = false
+	}
+	if !slices.Contains([]string{"auto", "target", "none"}, outputSync) {
+		mkError(fmt.Sprintf("unknown mode %q for --output-sync, expected auto, target or none", outputSync))
+	}
+	if platform, err := detectCI(annotationsMode); err != nil {
+		mkError(err.Error())
+	} else {
+		ciPlatform = platform
 	}
 
+	shellDelimiter = listDelimiter(shellOS)
+
 	if directory != "" {
 		err := os.Chdir(directory)
 		if err != nil {
@@ -336,7 +811,29 @@ func main() {
 		}
 	}
 
+	if since != "" {
+		if err := loadChangedFiles(since); err != nil {
+			mkError(err.Error())
+		}
+	}
+
+	if workspaceMode {
+		w, err := loadWorkspace()
+		if err != nil {
+			mkError(err.Error())
+		}
+		ws = w
+	}
+
+	// the root of a workspace needs no mkfile, it makes the targets of every project
+	atWorkspaceRoot := false
 	input, err := os.Open(mkfilepath)
+	if err != nil && ws != nil && filepath.Dir(mkfilepath) == "." {
+		if wd, _ := os.Getwd(); wd == ws.root {
+			atWorkspaceRoot = true
+			input, err = os.Open(os.DevNull)
+		}
+	}
 	if err != nil {
 		mkError("no mkfile found")
 	}
@@ -347,31 +844,111 @@ func main() {
 		mkError("unable to find mkfile's absolute path")
 	}
 
-	env := make(map[string][]string)
-	for _, elem := range os.Environ() {
-		vals := strings.SplitN(elem, "=", 2)
-		env[vals[0]] = append(env[vals[0]], vals[1])
+	lock.path = filepath.Join(filepath.Dir(abspath), lockFileName)
+	stateDir = filepath.Join(filepath.Dir(abspath), ".mk")
+	envState.path = filepath.Join(stateDir, "env")
+	hashState.path = filepath.Join(stateDir, "hashes")
+	fileState.path = filepath.Join(stateDir, "files")
+	dirState.path = filepath.Join(stateDir, "dirs")
+	treeState.path = filepath.Join(stateDir, "trees")
+	depState.path = filepath.Join(stateDir, "deps")
+	// a dry run changes neither the pins nor the state
+	for _, l := range lockFiles() {
+		l.dryRun = dryrun
+	}
+	removeStaleTemps()
+	defer saveLockFiles()
+	exitOnSignal()
+	if err := useHashAlgorithm(hashAlgorithm); err != nil {
+		mkError(err.Error())
+	}
+	if jobsAuto {
+		if err := loadMemoryEstimates(); err != nil {
+			mkPrintWarning(fmt.Sprintf("reading the memory used by recipes: %v", err))
+		}
+	}
+
+	rs := parseOrLoadRules(input, mkfilepath, abspath, dryrun)
+	readMkfiles = func() (*ruleSet, error) {
+		input, err := os.Open(abspath)
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		return parse(input, mkfilepath, abspath, environVars()), nil
+	}
+
+	targets := pflag.Args()
+	if atWorkspaceRoot {
+		targets = ws.projectTargets(targets)
+	}
+
+	if parseOnly {
+		mkExit(checkMkfiles(rs, targets))
+	}
+
+	if cmd, ok := findSubcommand(rs, targets); ok {
+		mkExit(cmd(rs, targets[1:]))
+	}
+
+	if listtargets == "grouped" && jsonOutput {
+		listtargets = "all"
+	}
+	if listtargets == "grouped" {
+		if err := listTargets(rs, groupby); err != nil {
+			mkError(err.Error())
+		}
+		return
+	} else if listtargets != "" {
+		if err := printTargets(os.Stdout, rs, listtargets, jsonOutput); err != nil {
+			mkError(err.Error())
+		}
+		return
+	}
+
+	if manifest != "" {
+		if err := writeGeneratedManifest(manifest, rs); err != nil {
+			mkError(err.Error())
+		}
+		return
+	}
+
+	if presetname != "" {
+		pr, ok := rs.presets[presetname]
+		if !ok {
+			names := slices.Sorted(maps.Keys(rs.presets))
+			mkError(fmt.Sprintf("no preset %s in %s, the presets are: %s",
+				presetname, mkfilepath, strings.Join(names, " ")))
+		}
+
+		// the variables of the preset have to be in effect while parsing
+		if len(pr.vars) > 0 {
+			if _, err := input.Seek(0, io.SeekStart); err != nil {
+				mkError(err.Error())
+			}
+			rs = parseWithOverrides(input, mkfilepath, abspath, environVars(), pr.vars)
+		}
+		if len(targets) == 0 {
+			targets = pr.targets
+		}
 	}
 
-	rs := parse(input, mkfilepath, abspath, env)
 	if quiet {
 		for i := range rs.rules {
 			rs.rules[i].attributes.quiet = true
 		}
 	}
 
-	targets := pflag.Args()
+	if stdinProtocol {
+		// stdout carries the messages, everything else goes to stderr
+		buildOutput = os.Stderr
+		failuresAtEnd = true
+		mkExit(serveProtocol(rs, os.Stdin, os.Stdout))
+	}
 
 	// build the first non-meta rule in the makefile, if none are given explicitly
 	if len(targets) == 0 {
-		for i := range rs.rules {
-			if !rs.rules[i].ismeta {
-				for j := range rs.rules[i].targets {
-					targets = append(targets, rs.rules[i].targets[j].spat)
-				}
-				break
-			}
-		}
+		targets = defaultTargets(rs)
 	}
 
 	if len(targets) == 0 {
@@ -379,6 +956,17 @@ func main() {
 		return
 	}
 
+	if ws != nil {
+		for i := range targets {
+			if targets[i], err = ws.resolve(targets[i]); err != nil {
+				mkError(err.Error())
+			}
+		}
+		if err := ws.addRules(rs); err != nil {
+			mkError(err.Error())
+		}
+	}
+
 	if shallowrebuild {
 		for i := range targets {
 			rebuildtargets[targets[i]] = true
@@ -388,16 +976,31 @@ func main() {
 	// Create a dummy virtual rule that depends on every target
 	root := rule{}
 	root.targets = []pattern{{false, "", nil}}
-	root.attributes = attribSet{false, false, false, false, false, false, false, true, false}
+	root.attributes = attribSet{virtual: true}
 	root.prereqs = targets
 	rs.add(root)
 
 	// Keep a global reference to the total state of mk variables.
 	GlobalMkState = rs.vars
 
-	if interactive {
-		g := buildgraph(rs, "")
+	if graphformat != "" {
+		g := buildOrLoadGraph(rs)
+		if err := writeGraph(os.Stdout, g, graphformat); err != nil {
+			mkError(err.Error())
+		}
+		return
+	}
+
+	if interactiveMode == "once" {
+		if !runSetup(rs, true) {
+			mkExit(1)
+		}
+		g := buildOrLoadGraph(rs)
+		if !g.checkPrereqs() {
+			mkExit(1)
+		}
 		mkNode(g, g.root, true, true)
+		forgetPlanned()
 		fmt.Print("Proceed? ")
 		in := bufio.NewReader(os.Stdin)
 		for {
@@ -414,8 +1017,106 @@ func main() {
 		}
 	}
 
-	g := buildgraph(rs, "")
+	start := time.Now()
+	if !runSetup(rs, dryrun) {
+		mkExit(1)
+	}
+	g := buildOrLoadGraph(rs)
+	if !g.checkPrereqs() {
+		mkExit(1)
+	}
+	prefetchHashes(g)
 	mkNode(g, g.root, dryrun, true)
+	endProgress()
+	failed := g.root.status == nodeStatusFailed
+	if !dryrun {
+		if err := hashes.save(); err != nil {
+			mkPrintWarning(fmt.Sprintf("remembering the hashes of files: %v", err))
+		}
+	}
+	saveLockFiles()
+	if warmStart && !dryrun {
+		if err := saveWarmStart(g, rs); err != nil {
+			mkPrintWarning(fmt.Sprintf("saving the graph: %v", err))
+		}
+	}
+	if traceFile != "" && !dryrun {
+		if err := saveTrace(); err != nil {
+			mkPrintWarning(fmt.Sprintf("writing the trace: %v", err))
+		}
+	}
+	if showTimes > 0 && !dryrun {
+		writeTimes(os.Stdout)
+	}
+	if unusedPrereqs && !dryrun {
+		writeUnusedPrereqs(os.Stdout)
+	}
+	if err := reportFailures(); err != nil {
+		mkPrintWarning(fmt.Sprintf("showing the failures: %v", err))
+	}
+	if keepGoing && len(failedTargets) > 0 {
+		mkPrintError("failed targets: " + strings.Join(failedTargets, " "))
+	}
+	if problemsFormat != "" {
+		if err := writeProblems(os.Stdout, problemsFormat); err != nil {
+			mkPrintWarning(fmt.Sprintf("showing the problems: %v", err))
+		}
+	}
+	if ciPlatform != "" && !dryrun {
+		if err := writeAnnotations(); err != nil {
+			mkPrintWarning(fmt.Sprintf("writing the annotations: %v", err))
+		}
+	}
+
+	if notify != "" && !dryrun && (failed || time.Since(start) >= notifyAfter) {
+		wd, _ := os.Getwd()
+		summary := buildSummary{
+			Status:    "done",
+			Directory: wd,
+			Mkfile:    abspath,
+			Targets:   targets,
+			Failed:    failedTargets,
+			Duration:  time.Since(start).Seconds(),
+			CPU:       (totalUsage.user + totalUsage.sys).Seconds(),
+			MaxRSS:    totalUsage.maxRSS,
+		}
+		if failed {
+			summary.Status = "failed"
+		}
+		if err := notifyBuild(summary); err != nil {
+			mkPrintWarning(fmt.Sprintf("sending the notification: %v", err))
+		}
+	}
+
+	if failed {
+		mkExit(1)
+	}
 }
 
 var GlobalMkState map[string][]string
+
+// The targets of the first rule that is not a meta-rule.
+func defaultTargets(rs *ruleSet) []string {
+	var targets []string
+	for i := range rs.rules {
+		// the rules of other projects are read while a rule refers to them,
+		// and setup rules are made anyway
+		if !rs.rules[i].ismeta && rs.rules[i].dir == "" && !rs.rules[i].attributes.setup {
+			for j := range rs.rules[i].targets {
+				targets = append(targets, rs.rules[i].targets[j].spat)
+			}
+			break
+		}
+	}
+	return targets
+}
+
+// The environment of mk as variables.
+func environVars() map[string][]string {
+	env := make(map[string][]string)
+	for _, elem := range os.Environ() {
+		vals := strings.SplitN(elem, "=", 2)
+		env[vals[0]] = append(env[vals[0]], vals[1])
+	}
+	return env
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testvector struct {
@@ -160,6 +169,71 @@ func TestBasicMaking(t *testing.T) {
 	}
 }
 
+// A dry run prints the recipes with their variables expanded, without
+// executing them.
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "prog: a.o\n\tcc -o $target $prereq\n%.o: %.c\n\tcc -c $stem.c\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, _, err := startMk("-C", dir, "-n", "prog")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if want := "a.o: cc -c a.c\nprog: cc -o prog a.o\n"; string(out) != want {
+		t.Errorf("got %q, expected %q", out, want)
+	}
+	for _, name := range []string{"a.o", "prog"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was made in a dry run", name)
+		}
+	}
+}
+
+// A dry run plans the recipe of a rule with several targets once, as the
+// other targets would exist after it.
+func TestDryRunPlannedTargets(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "prog: y.tab.c y.tab.h\n\tcc -o $target y.tab.c\n" +
+		"y.tab.c y.tab.h: gram.y\n\tyacc -d gram.y\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "gram.y": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, _, err := startMk("-C", dir, "-n", "-j", "1", "prog")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if n := strings.Count(string(out), "yacc -d gram.y"); n != 1 {
+		t.Errorf("the recipe of y.tab.c and y.tab.h is planned %d times:\n%s", n, out)
+	}
+}
+
+// A dry run takes the files in a tree a setup rule would make to exist, as
+// the graph of the build depends on them.
+func TestDryRunPlannedTree(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "tools/:I:\n\tmkdir -p tools && touch tools/cc\n" +
+		"prog: tools/cc\n\ttools/cc -o prog\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := startMk("-C", dir, "-n")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "prog: tools/cc -o prog") {
+		t.Errorf("the recipe of prog is not planned:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tools")); err == nil {
+		t.Errorf("the dry run made tools/")
+	}
+}
+
 // Make sure that recipes get mk variables as environment.
 func TestRecipesHaveEnv(t *testing.T) {
 	input := "testdata/test12.mk"
@@ -190,30 +264,1881 @@ outer:
 	}
 }
 
-func TestMain(m *testing.M) {
-	switch os.Getenv("TEST_MAIN") {
-	case "mk":
-		main()
-	default:
-		e := m.Run()
-		os.Exit(e)
+// Warn about recipes that don't write their target.
+func TestUnwrittenTarget(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: made missing\n" +
+		"made:\n\ttouch made\n" +
+		"missing:\n\techo not writing $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, errs, err := startMk("-C", dir, "--color=false")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !bytes.Contains(errs, []byte("warning: recipe for missing did not create it")) {
+		t.Errorf("no warning for missing, got: %s", errs)
+	}
+	if bytes.Contains(errs, []byte("made")) {
+		t.Errorf("unexpected warning for made, got: %s", errs)
 	}
 }
 
-func startMk(args ...string) ([]byte, []byte, error) {
-	outbuffy := new(bytes.Buffer)
-	errbuffy := new(bytes.Buffer)
+// Refuse to overwrite files tracked by git.
+func TestSourceOverwrite(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
 
-	mkcmd := exec.Command(os.Args[0], args...)
-	mkcmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	dir := t.TempDir()
+	mkfile := "all:V: main.c prog\n" +
+		"%.c: %.y\n\techo generated > $target\n" +
+		"prog:\n\techo built > $target\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "main.c": "source\n", "main.y": "", "prog": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := exec.Command("git", "-C", dir, "init", "--quiet").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	if out, err := exec.Command("git", "-C", dir, "add", "main.c", "prog").CombinedOutput(); err != nil {
+		t.Fatalf("git add: %v: %s", err, out)
+	}
 
-	mkcmd.Stdout = outbuffy
-	mkcmd.Stderr = errbuffy
+	// a tracked file a rule names is generated, like a committed binary
+	if _, _, err := startMk("-C", dir, "--force-all", "prog"); err != nil {
+		t.Errorf("prog, which a rule names, was not made: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "prog")); string(content) != "built\n" {
+		t.Errorf("prog was not made: %q", content)
+	}
 
-	// log.Println("mkcmd", mkcmd)
-	if err := mkcmd.Run(); err != nil {
-		return nil, nil, err
+	var errs bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-C", dir, "--color=false", "--force-all")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	cmd.Stderr = &errs
+	if err := cmd.Run(); err == nil {
+		t.Errorf("overwriting main.c did not fail")
+	}
+	if !bytes.Contains(errs.Bytes(), []byte("refusing to overwrite main.c")) {
+		t.Errorf("no error for main.c, got: %s", errs.Bytes())
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "main.c")); string(content) != "source\n" {
+		t.Errorf("main.c was overwritten: %q", content)
+	}
+
+	if _, _, err := startMk("-C", dir, "--force-all", "--allow-source-overwrite"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "main.c")); string(content) != "generated\n" {
+		t.Errorf("main.c was not overwritten with --allow-source-overwrite: %q", content)
+	}
+}
+
+// Keep the previous version of a target with --trash, and restore it.
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "out:\n\techo $MKVERSION > $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"one", "two"} {
+		t.Setenv("MKVERSION", version)
+		if _, _, err := startMk("-C", dir, "--trash", "--force-all"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "two\n" {
+		t.Fatalf("out is %q after building", content)
+	}
+
+	if _, _, err := startMk("-C", dir, "restore", "out"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "one\n" {
+		t.Errorf("out is %q after restoring", content)
+	}
+}
+
+// Notify about failed builds, and exit with an error.
+func TestNotifyFailure(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: ok broken\n" +
+		"ok:V:\n\ttrue\n" +
+		"broken:V:\n\texit 3\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := filepath.Join(dir, "payload.json")
+	_, _, err := startMk("-C", dir, "--notify", "cat > "+payload)
+	if err == nil {
+		t.Errorf("a failed build exited successfully")
+	}
+
+	content, err := os.ReadFile(payload)
+	if err != nil {
+		t.Fatalf("no notification was sent: %v", err)
+	}
+	var summary buildSummary
+	if err := json.Unmarshal(content, &summary); err != nil {
+		t.Fatalf("invalid payload %q: %v", content, err)
+	}
+	if summary.Status != "failed" || !reflect.DeepEqual(summary.Failed, []string{"broken"}) {
+		t.Errorf("payload is %+v", summary)
+	}
+}
+
+// Export graphs, and compare them.
+func TestGraphDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.c", "")
+	write("b.c", "")
+
+	write("mkfile", "prog: a.o\n\tcc -o $target $prereq\n%.o: %.c\n\tcc -c $stem.c\n")
+	old, _, err := startMk("-C", dir, "--graph", "json")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	write("old.json", string(old))
+
+	write("mkfile", "prog: a.o b.o\n\tcc -o $target $prereq\n%.o: %.c\n\tcc -c $stem.c\n")
+	updated, _, err := startMk("-C", dir, "--graph", "json")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	write("new.json", string(updated))
+
+	if _, _, err := startMk("-C", dir, "graph-diff", "old.json", "old.json"); err != nil {
+		t.Errorf("equal graphs differ: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir, "graph-diff", "old.json", "new.json")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	got, err := cmd.Output()
+	if err == nil {
+		t.Errorf("different graphs are equal")
+	}
+	want := "+ b.c\n+ b.o\n~ prog\n    +prereq b.o\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// Virtual targets are distinct from files of the same name.
+func TestVirtualIgnoresFiles(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "out: sources\n\techo built > out\n" +
+		"sources:V: src.c\n" +
+		"clean:V:\n\techo cleaned > clean.log\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "src.c": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// out is newer than src.c, while files named like the virtual targets
+	// are newer still
+	for name, age := range map[string]time.Duration{"src.c": 2 * time.Hour, "out": time.Hour, "sources": 0, "clean": 0} {
+		path := filepath.Join(dir, name)
+		if name != "src.c" {
+			if err := os.WriteFile(path, []byte("file\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir, "out", "clean"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "file\n" {
+		t.Errorf("out was rebuilt because of the file named sources")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "clean.log")); err != nil {
+		t.Errorf("clean was not run, although it is virtual: %v", err)
+	}
+}
+
+func TestMissingIntermediates(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "prog: prog.o\n\techo linked > prog\n" +
+		"prog.o: prog.c\n\techo compiled > prog.o\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "prog.c": "", "prog": "old\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAge := func(name string, age time.Duration) {
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAge("prog.c", 2*time.Hour)
+	setAge("prog", time.Hour)
+
+	// prog.o is missing, but prog is newer than prog.c
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prog.o")); err == nil {
+		t.Errorf("the missing intermediate prog.o was made")
+	}
+
+	if _, _, err := startMk("-C", dir, "--force-intermediates"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prog.o")); err != nil {
+		t.Errorf("prog.o was not made with --force-intermediates: %v", err)
+	}
+
+	// once prog.c changes, the chain is made again
+	os.Remove(filepath.Join(dir, "prog.o"))
+	setAge("prog", time.Hour)
+	setAge("prog.c", 0)
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "prog")); string(content) != "linked\n" {
+		t.Errorf("prog was not rebuilt after prog.c changed")
+	}
+}
+
+func TestFailuresAtEnd(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a b\n" +
+		"a:V:\n\techo a failed; exit 3\n" +
+		"b:V:\n\techo b built\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := filepath.Join(dir, "report")
+	t.Setenv("PAGER", "cat > "+report)
+
+	if _, _, err := startMk("-C", dir, "--failures-at-end", "--page-failures"); err == nil {
+		t.Errorf("the build did not fail")
+	}
+	content, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("the failures were not paged: %v", err)
+	}
+	if want := "=== a (mkfile:2: a), exit status 3\na failed\n"; string(content) != want {
+		t.Errorf("the failures are %q, expected %q", content, want)
+	}
+}
+
+func TestSince(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		args = append([]string{"-C", dir, "-c", "user.name=mk", "-c", "user.email=mk@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("mkfile", "out: src.c\n\techo built > out\n")
+	write("src.c", "one\n")
+	run("init", "--quiet")
+	run("add", "mkfile", "src.c")
+	run("commit", "--quiet", "-m", "one")
+	run("tag", "one")
+	write("src.c", "two\n")
+	run("commit", "--quiet", "-am", "two")
+
+	// a checkout that flattened the timestamps
+	write("out", "old\n")
+	mtime := time.Now().Add(-time.Hour)
+	for _, name := range []string{"src.c", "out"} {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "old\n" {
+		t.Fatalf("out was rebuilt without --since")
+	}
+	if _, _, err := startMk("-C", dir, "--since", "one"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "built\n" {
+		t.Errorf("out was not rebuilt, although src.c changed since the ref")
+	}
+}
+
+func TestDependsEnv(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "depends-env CFLAGS\nout: src.c\n\techo $CFLAGS > out\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "src.c": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func(cflags string) string {
+		t.Setenv("CFLAGS", cflags)
+		if _, _, err := startMk("-C", dir); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		content, _ := os.ReadFile(filepath.Join(dir, "out"))
+		return string(content)
+	}
+
+	if got := build("-O0"); got != "-O0\n" {
+		t.Fatalf("out is %q after the first build", got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "out"), []byte("kept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := build("-O0"); got != "kept\n" {
+		t.Errorf("out was rebuilt, although CFLAGS did not change")
+	}
+	if got := build("-O2"); got != "-O2\n" {
+		t.Errorf("out was not rebuilt after CFLAGS changed, it is %q", got)
+	}
+}
+
+func TestHashMode(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "out: gen\n\techo built >> out\ngen: src\n\tcut -c1 src > gen\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "src": "ab\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func() string {
+		if _, _, err := startMk("-C", dir, "--hash"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		content, _ := os.ReadFile(filepath.Join(dir, "out"))
+		return string(content)
+	}
+
+	if got := build(); got != "built\n" {
+		t.Fatalf("out is %q after the first build", got)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "src"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(); got != "built\n" {
+		t.Errorf("out was rebuilt, although src is only newer")
+	}
+	// gen is made again, but comes out the same
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("ac\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(); got != "built\n" {
+		t.Errorf("out was rebuilt, although gen did not change")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("bc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(); got != "built\nbuilt\n" {
+		t.Errorf("out was not rebuilt after gen changed, it is %q", got)
+	}
+}
+
+func TestTreeTarget(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "dist/: src\n\tmkdir -p dist/sub && cp src dist/sub/x && echo built >> log\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "src": "a\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func() string {
+		if _, _, err := startMk("-C", dir, "dist/"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		content, _ := os.ReadFile(filepath.Join(dir, "log"))
+		return string(content)
+	}
+
+	if got := build(); got != "built\n" {
+		t.Fatalf("the log is %q after the first build", got)
+	}
+	if got := build(); got != "built\n" {
+		t.Errorf("dist/ was made again, although it did not change")
+	}
+	// the tree is made again as a whole, without the stray file
+	if err := os.WriteFile(filepath.Join(dir, "dist/stray"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(); got != "built\nbuilt\n" {
+		t.Errorf("dist/ was not made again after it changed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dist/stray")); err == nil {
+		t.Errorf("dist/stray was kept, although the tree was made again")
+	}
+
+	mkfile += "dist/extra:\n\ttouch dist/extra\nall:V: dist/ dist/extra\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "-j", "4", "all"); err == nil {
+		t.Errorf("a target inside the tree dist/ was accepted")
+	}
+}
+
+// A directory mk did not make, or outside the project, is never removed.
+func TestTreeTargetNotMade(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	mkfile := "dist/:\n\tmkdir -p dist\n" +
+		"$DEST/:\n\ttouch $DEST/out\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "dist/keep": "", "keep": ""} {
+		target := filepath.Join(dir, name)
+		if name == "keep" {
+			target = filepath.Join(dest, name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, target := range []string{"dist/", dest + "/"} {
+		cmd := exec.Command(os.Args[0], "-C", dir, target)
+		cmd.Env = append(os.Environ(), "TEST_MAIN=mk", "DEST="+dest)
+		if out, err := cmd.CombinedOutput(); err == nil {
+			t.Errorf("the recipe of %s ran, although mk did not make it:\n%s", target, out)
+		}
 	}
+	for _, name := range []string{filepath.Join(dir, "dist/keep"), filepath.Join(dest, "keep")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestRecipeTempDir(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "ok:\n\ttest -d $MKTMP && echo $MKTMP > ok\n" +
+		"failing:\n\techo $MKTMP > failing; false\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpOf := func(target string) string {
+		content, err := os.ReadFile(filepath.Join(dir, target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(content))
+	}
+
+	if _, _, err := startMk("-C", dir, "ok"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if tmp := tmpOf("ok"); tmp == "" {
+		t.Errorf("$MKTMP is not set")
+	} else if _, err := os.Stat(tmp); err == nil {
+		t.Errorf("%s was kept, although the recipe succeeded", tmp)
+	}
+
+	startMk("-C", dir, "failing")
+	tmp := tmpOf("failing")
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("%s was removed, although the recipe failed", tmp)
+	}
+	os.RemoveAll(tmp)
+}
+
+func TestTargetMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there are no umasks or modes on windows")
+	}
+	dir := t.TempDir()
+	mkfile := "set umask=077\nout:mode=a-w: src\n\tcp src out\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "src": "a\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		if _, _, err := startMk("-C", dir, "--force-all"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		info, err := os.Stat(filepath.Join(dir, "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != 0400 {
+			t.Errorf("out has mode %o, expected 400", got)
+		}
+	}
+}
+
+// Recipes running at the same time each have their own umask.
+func TestRecipeUmask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there are no umasks on windows")
+	}
+	dir := t.TempDir()
+	mkfile := "all:V: a b\na:umask=077:\n\tsleep 0.2; umask > a\nb:umask=002:\n\tsleep 0.2; umask > b\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "-j", "2"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for name, want := range map[string]string{"a": "0077", "b": "0002"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(got)) != want {
+			t.Errorf("the recipe of %s ran with umask %s, expected %s", name, got, want)
+		}
+	}
+}
+
+func TestExpect(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there are no executable bits on windows")
+	}
+	dir := t.TempDir()
+	mkfile := "prog:expect=file,executable,nonempty:\n\techo '#!/bin/sh' > $target; chmod +x $target\n" +
+		"empty:expect=nonempty:\n\ttouch $target\n" +
+		"script:expect=executable mode=a+x:\n\techo true > $target\n" +
+		"out:expect=dir:\n\ttouch $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"prog", "script"} {
+		if _, _, err := startMk("-C", dir, target); err != nil {
+			t.Errorf("%s breaks its expectations: %v", target, err)
+		}
+	}
+	for target, want := range map[string]string{"empty": "empty is empty (expect=nonempty)",
+		"out": "out is not a directory (expect=dir)"} {
+		cmd := exec.Command(os.Args[0], "-C", dir, target)
+		cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Errorf("%s breaks its expectations, but the build succeeded", target)
+		}
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the output does not contain %q:\n%s", want, out)
+		}
+		// removed, so that the next run does not take it as made
+		if _, err := os.Stat(filepath.Join(dir, target)); err == nil {
+			t.Errorf("%s was kept, although it breaks its expectations", target)
+		}
+		if _, _, err := startMk("-C", dir, target); err == nil {
+			t.Errorf("%s breaks its expectations, but the next build succeeded", target)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("a:expect=big:\n\ttouch a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "a"); err == nil {
+		t.Error("an unknown expectation was accepted")
+	}
+}
+
+func TestRecipeStdin(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "out:stdin=$prereq1: in.txt\n\ttr a-z A-Z > $target\n" +
+		"missing:stdin=nothing.txt:\n\tcat > $target\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "in.txt": "hello\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "out"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "HELLO\n" {
+		t.Errorf("out is %q, expected the input in upper case", content)
+	}
+	if _, _, err := startMk("-C", dir, "missing"); err == nil {
+		t.Errorf("the recipe ran, although its stdin does not exist")
+	}
+}
+
+// The recipe of stdin= is given to a shell run with -c as its command, and to
+// one run with other flags as a file.
+func TestRecipeStdinShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	for _, test := range []struct {
+		shell string
+		args  []string
+	}{
+		{"shell=bash -c\n", nil},
+		{"shell=bash -e -u\n", nil},
+		{"", []string{"--drop-shell-arg"}},
+	} {
+		dir := t.TempDir()
+		mkfile := test.shell + "out:stdin=in.txt: in.txt\n\ttr a-z A-Z > $target\n"
+		for name, content := range map[string]string{"mkfile": mkfile, "in.txt": "hello\n"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := startMk(append([]string{"-C", dir}, test.args...)...); err != nil {
+			t.Errorf("%q %v: exec failed: %v", test.shell, test.args, err)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "HELLO\n" {
+			t.Errorf("%q %v: out is %q, expected the input in upper case", test.shell, test.args, content)
+		}
+	}
+}
 
-	return outbuffy.Bytes(), errbuffy.Bytes(), nil
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "out:capture: in\n\techo one; echo two\n" +
+		"failing:C:\n\techo partial; false\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "in": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "out"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "one\ntwo\n" {
+		t.Errorf("out is %q, expected the output of the recipe", content)
+	}
+
+	startMk("-C", dir, "failing")
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "failing") {
+			t.Errorf("%s was left by a failed recipe", entry.Name())
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a.fmt b.fmt c.fmt\n" +
+		"%.fmt:B: %.src\n\techo $targets, $changed >> runs; touch $targets\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.src": "", "b.src": "", "c.src": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "-j", "1"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	future := time.Now().Add(time.Hour)
+	for _, name := range []string{"a.src", "c.src"} {
+		if err := os.Chtimes(filepath.Join(dir, name), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "-j", "4"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+	if want := "a.fmt b.fmt c.fmt,\na.fmt c.fmt, a.src c.src\n"; string(runs) != want {
+		t.Errorf("the recipe ran as %q, expected %q", runs, want)
+	}
+
+	mkfile = "all:V: a.fmt b.fmt\nb.fmt: a.fmt\n" +
+		"%.fmt:B: %.src\n\ttouch $targets\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "--force-all"); err == nil {
+		t.Error("expected batch targets depending on each other to be refused")
+	}
+}
+
+// The builtin variables are the same for recipes of every mkfile, and those
+// of the mkfile name the one defining the rule.
+func TestBuiltinVars(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"mkfile":     "all:V: a b\n<sub/inc.mk\na:V:\n\techo $MKOS $MKARCH $numcpu $nproc $NPROC $mkfile > a.out\n",
+		"sub/inc.mk": "b:V:\n\techo $MKOS $MKARCH $numcpu $nproc $NPROC $mkfiledir > b.out\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "-j", "2"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+
+	for out, file := range map[string]string{"a.out": filepath.Join(dir, "mkfile"), "b.out": filepath.Join(dir, "sub")} {
+		content, _ := os.ReadFile(filepath.Join(dir, out))
+		fields := strings.Fields(string(content))
+		if len(fields) != 6 {
+			t.Errorf("%s is %q, expected 6 values", out, content)
+			continue
+		}
+		want := []string{runtime.GOOS, runtime.GOARCH, strconv.Itoa(runtime.NumCPU())}
+		if !reflect.DeepEqual(fields[:3], want) || fields[4] != "2" || fields[5] != file {
+			t.Errorf("%s is %q, expected %q, 2 jobs and %s", out, content, want, file)
+		}
+		if fields[3] != "0" && fields[3] != "1" {
+			t.Errorf("$nproc is %s in %s, expected 0 or 1", fields[3], out)
+		}
+	}
+}
+
+// The prerequisites a recipe names in its depfile make the target out of date
+// once they change.
+func TestDepfile(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "%.o:depfile=$stem.d: %.c\n\techo $target: $prereq a.h > $stem.d; echo $prereq >> runs; touch $target\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": "", "a.h": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		if _, _, err := startMk("-C", dir, "a.o"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "a.h"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "a.o"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if runs, _ := os.ReadFile(filepath.Join(dir, "runs")); string(runs) != "a.c\na.c\n" {
+		t.Errorf("the recipe ran with %q, expected twice with a.c alone", runs)
+	}
+}
+
+// A recipe with the J attribute takes the job slots no other recipe uses.
+func TestRecipeJobs(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "b.out:J: a.out\n\techo $MKJOBS > b.out\n" +
+		"a.out:\n\techo $MKJOBS > a.out\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "-j", "4"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for name, want := range map[string]string{"a.out": "1\n", "b.out": "4\n"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("$MKJOBS is %q in the recipe of %s, expected %q", got, name, want)
+		}
+	}
+}
+
+// Runaway meta-rules and recipes running mk end with an error.
+func TestLimits(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a\n%: %.x\n\tcp $prereq $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "-d", "100000", "--max-depth", "50"); err == nil {
+		t.Error("expected prerequisites nesting past --max-depth to fail")
+	}
+	if _, _, err := startMk("-C", dir, "-d", "100000", "--max-depth", "0", "--max-nodes", "100"); err == nil {
+		t.Error("expected a graph past --max-nodes to fail")
+	}
+
+	t.Setenv("MKLEVEL", "3")
+	if _, _, err := startMk("-C", dir, "--max-recursion", "3", "-n"); err == nil {
+		t.Error("expected mk nested past --max-recursion to fail")
+	}
+}
+
+// Shuffle the order prerequisites start in, the same for the same seed.
+func TestShuffle(t *testing.T) {
+	var prereqs []*node
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		prereqs = append(prereqs, &node{name: name})
+	}
+	shuffleSeed = 7
+	first, second := shuffled("all", prereqs), shuffled("all", prereqs)
+	if !slices.Equal(first, second) {
+		t.Errorf("the same seed shuffles differently")
+	}
+	if slices.Equal(first, prereqs) {
+		t.Errorf("the prerequisites are not shuffled")
+	}
+
+	dir := t.TempDir()
+	mkfile := "all:V: a b c\na b c:\n\ttouch $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, err := startMk("-C", dir, "--shuffle=7")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(errs), "--shuffle=7") {
+		t.Errorf("the seed is not printed: %s", errs)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was not made", name)
+		}
+	}
+}
+
+// A file included twice is read twice, but one that includes itself is an
+// error.
+func TestIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":  "<lib.mk NAME=a\n<lib.mk NAME=b\nall:V: a b\n",
+		"lib.mk":  "$NAME:V:\n\techo $target\n",
+		"loop.mk": "all:V:\n\ttrue\n<a.mk\n",
+		"a.mk":    "<b.mk\n",
+		"b.mk":    "<a.mk\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir, "-n"); err != nil {
+		t.Errorf("a file included twice is an error: %v", err)
+	}
+	if _, _, err := startMk("-C", dir, "-f", "loop.mk", "-n"); err == nil {
+		t.Errorf("files including each other are accepted")
+	}
+}
+
+// Report the syntax errors of all the mkfiles, without building.
+func TestParseOnly(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":    "all:V: out\nbad:Z: x\n\techo\n<inc.mk\nout:\n\ttouch out\n",
+		"inc.mk":    "worse:: :\n",
+		"second.mk": "all:V: out\nout:\n\ttouch out\n",
+		"commands.mk": "all:V: gen\n<|sh -c 'touch piped; echo gen:V:'\n" +
+			"env <|sh -c 'touch env; echo A=1'\nreproducible <|sh -c 'touch reproducible'\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, errs, err := startMk("-C", dir, "--parse-only")
+	if err == nil {
+		t.Errorf("mkfiles with errors are accepted")
+	}
+	for _, want := range []string{"mkfile:2:", "inc.mk:1:"} {
+		if !strings.Contains(string(errs), want) {
+			t.Errorf("the error at %s is not reported:\n%s", want, errs)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir, "-f", "second.mk", "--parse-only"); err != nil {
+		t.Errorf("a correct mkfile is rejected: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Errorf("out was made with --parse-only")
+	}
+
+	// the commands of includes are not run
+	if _, _, err := startMk("-C", dir, "-f", "commands.mk", "--parse-only"); err != nil {
+		t.Errorf("a mkfile with commands is rejected: %v", err)
+	}
+	for _, name := range []string{"piped", "env", "reproducible"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("the command of %s was run with --parse-only", name)
+		}
+	}
+}
+
+// Log where a variable is assigned and expanded while parsing.
+func TestDebugVars(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":    "CFLAGS=-O2\n<config.mk\nall:V:\n\techo $CFLAGS\n",
+		"config.mk": "CFLAGS=$CFLAGS -g\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, errs, err := startMk("-C", dir, "-n", "--debug-vars", "CFLAGS")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	want := "mkfile:1: CFLAGS = '-O2' (was unset)\n" +
+		"config.mk:1: $CFLAGS expands to '-O2'\n" +
+		"config.mk:1: CFLAGS = '-O2 -g' (was '-O2')\n" +
+		"mkfile:3: $CFLAGS expands to '-O2 -g'\n"
+	if string(errs) != want {
+		t.Errorf("got %q, expected %q", errs, want)
+	}
+}
+
+// Variables printed by the command of 'env <|' are assigned, and -debug-vars
+// logs the command they come from.
+func TestEnvImport(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile": "env <| sh ./configure.sh --print-env\nall:VQ:\n\techo $CC $CFLAGS $PREFIX\n",
+		"configure.sh": "echo '# detected'\necho CC=cc\necho \"export CFLAGS='-O2 -g'\"\n" +
+			"echo 'PREFIX=\"/usr/local\"'\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, _, err := startMk("-C", dir)
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "\ncc -O2 -g /usr/local\n") {
+		t.Errorf("got %q, expected the imported variables", out)
+	}
+
+	_, errs, err := startMk("-C", dir, "-n", "--debug-vars", "CFLAGS")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if want := "CFLAGS = '-O2 -g' (was unset), from mkfile:1: env <| sh ./configure.sh --print-env\n"; !strings.Contains(string(errs), want) {
+		t.Errorf("got %q, expected %q", errs, want)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "configure.sh"), []byte("echo not a variable\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-C", dir)
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "line 1: expected NAME=value") {
+		t.Errorf("bad output of the command was accepted: %q", out)
+	}
+
+	// a failing command stops mk, with '<|' as with 'env <|'
+	for _, mkfile := range []string{"env <| sh -c 'exit 3'\n", "<| sh -c 'exit 3'\n"} {
+		if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, errs, err := startMk("-C", dir)
+		if err == nil || !strings.Contains(string(errs), "sh -c exit 3: exit status 3") {
+			t.Errorf("%q: the failure of the command was not reported: %q", mkfile, errs)
+		}
+	}
+}
+
+// A parameter set in the environment is used, and one that is not is an
+// error without a terminal.
+func TestParam(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "param RELEASE_TAG \"Tag to release\"\nrelease:VQ:\n\techo tagging $RELEASE_TAG\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir)
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk", "RELEASE_TAG=v1.2")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "tagging v1.2\n") {
+		t.Errorf("got %q, expected the parameter", out)
+	}
+
+	cmd = exec.Command(os.Args[0], "-C", dir)
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	cmd.Stdin = strings.NewReader("v2\n")
+	out, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "RELEASE_TAG (Tag to release) is not set") {
+		t.Errorf("an unset parameter was not reported: %q", out)
+	}
+
+	// a rule making a target named param asks for nothing
+	parseKeywordRule(t, "param x:V: y\n\techo $target\n", "param")
+}
+
+// A credential is fetched from the helper, and masked in the recipe and its
+// output.
+func TestCredential(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":    "TOKEN=${credential deploy}\nall:V:\n\techo token $TOKEN ${credential deploy}\n",
+		"helper.sh": "echo \"s3cret-$1\"\necho second line\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, _, err := startMk("-C", dir, "--credential-helper", "sh ./helper.sh")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if strings.Contains(string(out), "s3cret") || !strings.Contains(string(out), "token *** ***\n") {
+		t.Errorf("the credential was not masked: %q", out)
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir)
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk", "MK_CREDENTIAL_HELPER=")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "no credential helper") {
+		t.Errorf("a credential without a helper was not reported: %q", out)
+	}
+}
+
+// A credential is masked wherever else mk shows or keeps values and output.
+func TestCredentialMasked(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile": "TOKEN=${credential deploy}\n" +
+			"all:VQ:\n\techo a.c:1:2: error: bad $TOKEN; for i in 1 2 3 4; do echo line $i; done\n",
+		"helper.sh": "echo s3cret\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		file string // where the output is kept, stdout and stderr if empty
+	}{
+		{args: []string{"-n", "--debug-vars", "TOKEN"}},
+		{args: []string{"script"}},
+		{args: []string{"--max-output-per-recipe", "10"}, file: ".mk/output/all.log"},
+		{args: []string{"--annotations", "gitlab"}, file: "gl-code-quality-report.json"},
+	} {
+		args := append([]string{"-C", dir, "--credential-helper", "sh ./helper.sh"}, tc.args...)
+		out, errs, err := startMk(args...)
+		if err != nil {
+			t.Fatalf("%s: exec failed: %v", strings.Join(tc.args, " "), err)
+		}
+		out = append(out, errs...)
+		if tc.file != "" {
+			if out, err = os.ReadFile(filepath.Join(dir, tc.file)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Contains(string(out), "s3cret") || !strings.Contains(string(out), "***") {
+			t.Errorf("%s: the credential was not masked:\n%s", strings.Join(tc.args, " "), out)
+		}
+	}
+}
+
+// Annotations are only written when asked for, even under CI.
+func TestAnnotationsOptIn(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:VQ:\n\techo a.c:1:2: error: bad\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("GITLAB_CI", "true")
+	report := filepath.Join(dir, "gl-code-quality-report.json")
+
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(report); err == nil {
+		t.Errorf("the report was written without --annotations")
+	}
+	if _, _, err := startMk("-C", dir, "--annotations", "auto"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(report); err != nil {
+		t.Errorf("the report was not written with --annotations auto: %v", err)
+	}
+}
+
+// --explain tells why recipes are executed, and only then records it in the
+// explain log.
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "prog: a.c\n\tcp a.c prog\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(dir, "a.c")
+	if err := os.WriteFile(source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := startMk("-C", dir, "-n"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".mk", "explain.log")); err == nil {
+		t.Errorf("the explain log was written without --explain")
+	}
+	if err := os.Remove(filepath.Join(dir, "prog")); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := startMk("-C", dir, "-e")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "prog is made: it is missing\n") {
+		t.Errorf("got %q, expected the target missing", out)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(source, later, later); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err = startMk("-C", dir, "-e")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "prog is made: a.c ("+later.Format("2006-01-02 15:04:05")) {
+		t.Errorf("got %q, expected a.c newer", out)
+	}
+}
+
+// Recipes of a run get the same $MKBUILDID, mk in a recipe too, and
+// different $MKSEQ, those of mk in a recipe numbered after it; another run
+// gets another ID.
+func TestBuildID(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile": "all:VQ: a b\na:VQ:\n\techo build $MKBUILDID $MKSEQ\n" +
+			"b:VQ:\n\techo build $MKBUILDID $MKSEQ\n\techo parent $MKSEQ\n\tTEST_MAIN=mk " + os.Args[0] + " -f sub.mk\n",
+		"sub.mk": "c:VQ:\n\techo build $MKBUILDID $MKSEQ\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var parent string
+	run := func() (ids []string, seqs []string) {
+		out, _, err := startMk("-C", dir)
+		if err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if seq, ok := strings.CutPrefix(line, "parent "); ok {
+				parent = seq
+			}
+			line, ok := strings.CutPrefix(line, "build ")
+			if !ok {
+				continue
+			}
+			id, seq, _ := strings.Cut(line, " ")
+			ids = append(ids, id)
+			seqs = append(seqs, seq)
+		}
+		if len(ids) != 3 || ids[0] != ids[1] || ids[1] != ids[2] || len(ids[0]) != 36 {
+			t.Fatalf("expected the same build ID in every recipe, got %q", out)
+		}
+		return ids, seqs
+	}
+	ids, seqs := run()
+	if seqs[0] == seqs[1] || seqs[0] == seqs[2] || seqs[1] == seqs[2] {
+		t.Errorf("recipes have the same sequence number: %q", seqs)
+	}
+	if !slices.Contains(seqs, parent+".1") {
+		t.Errorf("the recipe of mk run by recipe %s is not %s.1: %q", parent, parent, seqs)
+	}
+	if again, _ := run(); again[0] == ids[0] {
+		t.Errorf("two runs have the same build ID %s", ids[0])
+	}
+}
+
+// A setup rule is made before any other recipe starts, and stops the build if
+// it fails.
+func TestSetup(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a b\na b:V:\n\ttest -f toolchain\n" +
+		"toolchain:I:\n\tsleep 0.2\n\ttouch toolchain\n\ttest -z \"$FAIL\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := startMk("-C", dir, "-j", "4"); err != nil {
+		t.Fatalf("a recipe started before the setup rule was done: %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "toolchain"))
+	cmd := exec.Command(os.Args[0], "-C", dir, "-j", "4")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk", "FAIL=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || strings.Contains(string(out), "a: ") || strings.Contains(string(out), "b: ") {
+		t.Errorf("the build went on after the setup rule failed:\n%s", out)
+	}
+}
+
+// With --interactive=each, a recipe the user says no to is skipped, and quit
+// stops the build. The recipe is shown as it is executed.
+func TestInteractiveEach(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "b: a\n\ttouch $target\na:\n\ttouch $target\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	run := func(answers string) error {
+		cmd := exec.Command(os.Args[0], "-C", dir, "--interactive=each")
+		cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+		cmd.Stdin = strings.NewReader(answers)
+		cmd.Stdout = &out
+		return cmd.Run()
+	}
+
+	if err := run("n\nyes\n"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "b: touch b\nExecute the recipe of b?") {
+		t.Errorf("the recipe of b is not shown expanded:\n%s", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Error("the recipe of a was executed, after answering no")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); err != nil {
+		t.Errorf("the recipe of b was not executed: %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "b"))
+	if err := run("q\n"); err == nil {
+		t.Error("a build the user quit exited successfully")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Error("the recipe of a was executed, after quitting")
+	}
+}
+
+// The output of a recipe is cut after --max-output-per-recipe, and kept in
+// full in .mk/output.
+func TestMaxOutput(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:VQ:\n\tfor i in 1 2 3 4 5 6 7 8 9; do echo line $i; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sync := range []string{"none", "target"} {
+		out, _, err := startMk("-C", dir, "-O", sync, "--max-output-per-recipe", "14")
+		if err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+		if !strings.Contains(string(out), "line 1\nline 2\n\n[mk: the output of all is cut after 14B") ||
+			strings.Contains(string(out), "line 3") {
+			t.Errorf("with -O %s, the output was not cut: %q", sync, out)
+		}
+		log, err := os.ReadFile(filepath.Join(dir, ".mk", "output", "all.log"))
+		if err != nil || !strings.HasSuffix(string(log), "line 9\n") {
+			t.Errorf("with -O %s, the whole output was not kept: %q, %v", sync, log, err)
+		}
+	}
+}
+
+// Every target has a log of its own, with its secrets masked, also those
+// split over two writes.
+func TestMaxOutputLogs(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile": "TOKEN=${credential deploy}\nall:VQ: a/b a_b\n" +
+			"a/b:VQ:\n\techo a/b a/b a/b; printf s3c; sleep 0.1; echo ret-deploy\n" +
+			"a_b:VQ:\n\techo a_b a_b a_b a_b\n",
+		"helper.sh": "echo \"s3cret-$1\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "--credential-helper", "sh ./helper.sh", "--max-output-per-recipe", "4"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for name, want := range map[string]string{"a%2Fb.log": "a/b a/b a/b\n***\n", "a_b.log": "a_b a_b a_b a_b\n"} {
+		log, err := os.ReadFile(filepath.Join(dir, ".mk", "output", name))
+		if err != nil || string(log) != want {
+			t.Errorf("%s is %q, expected %q: %v", name, log, want, err)
+		}
+	}
+}
+
+// A failed recipe stops the build, but not among the prerequisites of a rule
+// with the K attribute.
+func TestKeepGoing(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: fast late\n" +
+		"tests:VK: fast late\n" +
+		"fast:V:\n\texit 1\n" +
+		"late: slow\n\ttouch late\n" +
+		"slow:V:\n\tsleep 0.5\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := startMk("-C", dir, "-j", "4", "all"); err == nil {
+		t.Error("a failed build exited successfully")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "late")); err == nil {
+		t.Error("a recipe was executed after another one failed")
+	}
+
+	if _, _, err := startMk("-C", dir, "-j", "4", "tests"); err == nil {
+		t.Error("a failed build exited successfully")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "late")); err != nil {
+		t.Error("a failed prerequisite of a K rule stopped the others")
+	}
+}
+
+// Without -k, a failure stops the build. With it, a failure only stops the
+// targets depending on it, and the failed targets are listed at the end.
+func TestKeepGoingFlag(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a b c\n" +
+		"a: x\n\ttouch a\n" +
+		"x:V:\n\texit 1\n" +
+		"b:V:\n\texit 2\n" +
+		"c: slow\n\ttouch c\n" +
+		"slow:V:\n\tsleep 0.2\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := startMk("-C", dir, "-j", "4"); err == nil {
+		t.Error("a failed build exited successfully")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); err == nil {
+		t.Error("c was made after x failed, without -k")
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir, "-k")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("a failed build exited successfully")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); err != nil {
+		t.Errorf("c, which does not depend on a failure, was not made: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err == nil {
+		t.Error("a was made, though x failed")
+	}
+	_, listed, _ := strings.Cut(string(out), "failed targets: ")
+	listed, _, _ = strings.Cut(listed, "\n")
+	if names := strings.Fields(listed); len(names) != 2 || !slices.Contains(names, "x") || !slices.Contains(names, "b") {
+		t.Errorf("the failed targets were not listed:\n%s", out)
+	}
+}
+
+func TestOwns(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "prog: a.o\n\tcc -o prog a.o\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n" +
+		"a.o: a.h\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": "", "a.h": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, _, err := startMk("-C", dir, "owns", "./a.o")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for _, want := range []string{"mkfile:5: a.o\n    prereqs: a.h\n    no recipe\n",
+		"mkfile:3: %.o\n    stem: a\n    prereqs: a.c\n"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir, "owns", "a.c"); err == nil {
+		t.Errorf("a.c is reported as a build output")
+	}
+}
+
+func TestVersionJSON(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("all:V:\n\ttrue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := startMk("-C", dir, "--dialect", "gnu", "version", "--json")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	var info versionInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		t.Fatalf("the output is not JSON: %v\n%s", err, out)
+	}
+	if info.Dialect != "gnu" || info.Dialects["gnu"].RecipePrefix != "tab" {
+		t.Errorf("the dialects are reported wrong: %s", out)
+	}
+	if !slices.Contains(info.Subcommands, "version") || !slices.Contains(info.Directives, "depends-env") {
+		t.Errorf("the features are reported wrong: %s", out)
+	}
+}
+
+// The plan9 dialect only allows the attributes of the mk of Plan 9, also when
+// a mkfile sets it.
+func TestDialectPlan9Attributes(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		mkfile string
+		args   []string
+		ok     bool
+	}{
+		{"all:VQ:\n\techo all\n", []string{"--dialect", "plan9"}, true},
+		{"all:VX:\n\techo all\n", []string{"--dialect", "plan9"}, false},
+		{"all:virtual,setup:\n\techo all\n", []string{"--dialect", "plan9"}, false},
+		{"all:VX:\n\techo all\n", nil, true},
+		{"set dialect=plan9\nall:VX:\n\techo all\n", nil, false},
+		{"set dialect=plan9\nall:VX:\n\techo all\n", []string{"--dialect", "gnu"}, false},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(test.mkfile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, errs, err := startMk(append([]string{"-C", dir, "-n"}, test.args...)...)
+		if test.ok && err != nil {
+			t.Errorf("%q %q: unexpected failure: %v\n%s", test.mkfile, test.args, err, errs)
+		}
+		if !test.ok && (err == nil || !strings.Contains(string(errs), "not known to the plan9 mk")) {
+			t.Errorf("%q %q: the attributes are not rejected: %v\n%s", test.mkfile, test.args, err, errs)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	dir := t.TempDir()
+	mkfile := "MSG='it is built'\n" +
+		"out: a.tmp\n\tcat a.tmp > $target\n\techo $MSG >> $target\n" +
+		"%.tmp: %.c\n\techo $stem > $target\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script, _, err := startMk("-C", dir, "script")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Fatalf("mk script executed the recipes")
+	}
+
+	cmd := exec.Command("sh")
+	cmd.Stdin = bytes.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("the script failed: %v: %s\n%s", err, out, script)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "a\nit is built\n" {
+		t.Errorf("the script made out as %q\n%s", content, script)
+	}
+}
+
+// The script changes to the directory of another project for its recipes,
+// and back.
+func TestScriptDirectory(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":     "all:V: app\napp: lib//lib.a\n\tcat $prereq > $target\n\tpwd >> $target\n",
+		"lib/mkfile": "lib.a:\n\tpwd > $target\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script, _, err := startMk("-C", dir, "script")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	cmd := exec.Command("sh")
+	cmd.Dir = t.TempDir()
+	cmd.Stdin = bytes.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("the script failed: %v: %s\n%s", err, out, script)
+	}
+	real, _ := filepath.EvalSymlinks(dir)
+	want := filepath.Join(real, "lib") + "\n" + real + "\n"
+	if content, _ := os.ReadFile(filepath.Join(dir, "app")); string(content) != want {
+		t.Errorf("the script made app as %q, want %q\n%s", content, want, script)
+	}
+}
+
+func TestStatusFD(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V:\n\techo compiling >&$MK_STATUS_FD\n\techo linking >&$MK_STATUS_FD\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := startMk("-C", dir, "--color=false", "--explain")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if !strings.Contains(string(out), "all: status: compiling\nall: status: linking\n") {
+		t.Errorf("the status lines are not shown:\n%s", out)
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, ".mk", "explain.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), `"status":"linking"`) {
+		t.Errorf("the last status line is not in the explain log: %s", log)
+	}
+}
+
+func TestResourceUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the resident set size is only checked on linux")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("out:\n\techo > out\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", dir, "--explain"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, ".mk", "explain.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec explainRecord
+	if err := json.Unmarshal(content, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MaxRSS <= 0 {
+		t.Errorf("the memory used by the recipe is not recorded: %s", content)
+	}
+}
+
+// Targets of the projects of a workspace refer to each other, the ones they
+// share are made once, and each project keeps its variables.
+func TestWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkwork":      "# name directory\nlib lib\napp app\ntool tool\n",
+		"lib/mkfile":  "FLAGS=lib\nall:V: lib.a\nlib.a:\n\techo $FLAGS > lib.a; echo lib.a >> ../made\n",
+		"app/mkfile":  "FLAGS=app\nall:V: app\napp: //lib:lib.a\n\tcat $prereq > app; echo $FLAGS >> app\n",
+		"tool/mkfile": "all:V: tool\ntool: //lib:lib.a //app:app\n\tcat $prereq > tool\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir, "-W", "-j", "4", "all"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	made, err := os.ReadFile(filepath.Join(dir, "made"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(made) != "lib.a\n" {
+		t.Errorf("the shared target is not made once: %q", made)
+	}
+	tool, err := os.ReadFile(filepath.Join(dir, "tool", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tool) != "lib\nlib\napp\n" {
+		t.Errorf("the projects do not keep their variables: %q", tool)
+	}
+
+	before, err := os.Stat(filepath.Join(dir, "tool", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := startMk("-C", filepath.Join(dir, "tool"), "-W"); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if after, err := os.Stat(filepath.Join(dir, "tool", "tool")); err != nil || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("a target is made again though the projects it depends on are up to date")
+	}
+
+	if _, _, err := startMk("-C", filepath.Join(dir, "app"), "-W", "//nope:x"); err == nil {
+		t.Errorf("a project missing from mkwork is accepted")
+	}
+}
+
+// The output of recipes running at the same time does not interleave, each
+// is shown with its recipe once it finished. Their standard error stays apart.
+func TestOutputSync(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: x y\nx y:V:\n\techo ${target}1; sleep 0.2; echo ${target}2; echo ${target}3 >&2\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, errs, err := startMk("-C", dir, "-j", "4")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	for _, target := range []string{"x", "y"} {
+		want := strings.ReplaceAll("x: echo x1; sleep 0.2; echo x2; echo x3 >&2\nx1\nx2\n", "x", target)
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the output of %s is not in one piece:\n%s", target, out)
+		}
+		if !strings.Contains(string(errs), target+"3\n") || strings.Contains(string(out), target+"3\n") {
+			t.Errorf("the standard error of %s is not on standard error:\n%s", target, errs)
+		}
+	}
+}
+
+// A prerequisite dir//target reads the mkfile of the directory into the same
+// graph, its recipes running in the directory with variables of their own.
+func TestDirReference(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile":      "FLAGS=app\napp: lib//lib.a\n\tcat $prereq > app; echo $FLAGS >> app\ngen.h:\n\techo gen > gen.h\n",
+		"lib/mkfile":  "FLAGS=lib\nlib.a: lib.o ..//gen.h\n\techo $FLAGS $prereq > $target\n%.o: %.c\n\tcat $stem.c > $target\n",
+		"lib/lib.c":   "",
+		"loop.mk":     "a: lib2//b\n\ttouch a\n",
+		"lib2/mkfile": "b: ..//a\n\ttouch b\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := startMk("-C", dir); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	app, err := os.ReadFile(filepath.Join(dir, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "lib lib.o ../gen.h\napp\n"; string(app) != want {
+		t.Errorf("got %q, expected %q", app, want)
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir, "-f", "loop.mk")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "a (loop.mk:1) -> lib2/b (lib2/mkfile:1) -> a") {
+		t.Errorf("the cycle between the mkfiles is not reported: %s", out)
+	}
+}
+
+// The status line counts the recipes instead of showing them, except those
+// that failed, with their output.
+func TestStatusLine(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a b\na:\n\techo made a; touch a\nb: a\n\techo broken; exit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-C", dir, "--status-line", "--color=false")
+	cmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+	out, _ := cmd.Output()
+	for _, want := range []string{"[0/1] echo made a; touch a", "made a\n", "[1/2] echo broken; exit 1",
+		"b: echo broken; exit 1\nbroken\n", "[2/2]"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%q is not in the output: %q", want, out)
+		}
+	}
+	if strings.Contains(string(out), "a: echo made a") {
+		t.Errorf("the recipe that succeeded is shown: %q", out)
+	}
+}
+
+// Recipes running at the same time are traced in different job slots.
+func TestTrace(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: a b\na b:V:\n\tsleep 0.2\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := filepath.Join(dir, "trace.json")
+	if _, _, err := startMk("-C", dir, "-j", "4", "--trace", trace); err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	content, err := os.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatal(err)
+	}
+	slots := make(map[string]int)
+	for _, event := range got.TraceEvents {
+		if event.Ph == "X" {
+			slots[event.Name] = event.Tid
+			if event.Dur < 200000 {
+				t.Errorf("%s lasted %dµs, expected at least 0.2s", event.Name, event.Dur)
+			}
+		}
+	}
+	if len(slots) != 2 || slots["a"] == slots["b"] {
+		t.Errorf("expected a and b in different slots, got %v", slots)
+	}
+}
+
+// --log appends the commands executed with their target and exit status.
+func TestCommandLog(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: ok failed\nok:VQ:\n\techo fine\nfailed:VQ:\n\texit 3\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "mk.log")
+	for range 2 {
+		if _, _, err := startMk("-C", dir, "--log", log, "ok"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+	}
+	if _, _, err := startMk("-C", dir, "--log", log, "failed"); err == nil {
+		t.Fatal("a failed recipe exited successfully")
+	}
+	content, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(string(content), "\n")
+	if len(entries) != 7 || !strings.HasPrefix(entries[0], "ok: started ") || entries[1] != "\techo fine" ||
+		!strings.HasSuffix(entries[4], ", exit status 3") || entries[5] != "\texit 3" {
+		t.Errorf("unexpected log:\n%s", content)
+	}
+}
+
+// --times shows the slowest recipes, slowest first, up to the given number.
+func TestTimes(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "all:V: fast slow slowest\nfast:VQ:\n\ttrue\nslow:VQ:\n\tsleep 0.1\nslowest:VQ:\n\tsleep 0.2\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := startMk("-C", dir, "--times=2")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	_, table, _ := strings.Cut(string(out), "slowest recipes, of 3:\n")
+	var targets []string
+	for _, line := range strings.Split(strings.TrimSpace(table), "\n") {
+		fields := strings.Fields(line)
+		targets = append(targets, fields[len(fields)-1])
+	}
+	if !slices.Equal(targets, []string{"slowest", "slow"}) {
+		t.Errorf("got %q, expected slowest and slow", out)
+	}
+}
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("TEST_MAIN") {
+	case "mk":
+		main()
+	default:
+		// failed recipes keep their $MKTMP, keep them out of the way
+		tmp, err := os.MkdirTemp("", "mktest")
+		if err != nil {
+			panic(err)
+		}
+		os.Setenv("TMPDIR", tmp)
+		e := m.Run()
+		os.RemoveAll(tmp)
+		os.Exit(e)
+	}
+}
+
+func startMk(args ...string) ([]byte, []byte, error) {
+	outbuffy := new(bytes.Buffer)
+	errbuffy := new(bytes.Buffer)
+
+	mkcmd := exec.Command(os.Args[0], args...)
+	mkcmd.Env = append(os.Environ(), "TEST_MAIN=mk")
+
+	mkcmd.Stdout = outbuffy
+	mkcmd.Stderr = errbuffy
+
+	// log.Println("mkcmd", mkcmd)
+	err := mkcmd.Run()
+	return outbuffy.Bytes(), errbuffy.Bytes(), err
+}
+
+// Every subcommand exits with status 2 on a wrong number of arguments.
+func TestSubcommandUsage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("all:V:\n\ttrue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"stats"}, {"graph-diff", "old.json"}, {"owns"}, {"serve", "extra"}, {"restore"}, {"version", "extra"},
+	} {
+		_, errs, err := startMk(append([]string{"-C", dir}, args...)...)
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != 2 || !strings.Contains(string(errs), "usage: mk "+args[0]) {
+			t.Errorf("mk %s: got %v, expected the usage and status 2:\n%s", strings.Join(args, " "), err, errs)
+		}
+	}
+}
+
+func TestHelpTarget(t *testing.T) {
+	dir := t.TempDir()
+	mkfile := "# Links against libfoo,\n# build that first.\nprog:V:\n\tfalse\n"
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := startMk("-C", dir, "help", "prog")
+	if err != nil {
+		t.Fatalf("exec failed: %v", err)
+	}
+	if want := "mkfile:3: prog\n    # Links against libfoo,\n    # build that first.\n"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
 }
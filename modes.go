@@ -0,0 +1,149 @@
+// The umask recipes run with and the mode of the targets they make: from the
+// umask= and mode= attributes of a rule, 'set umask=' and 'set mode=' for the
+// rules of a file, or --umask and --target-mode for all.
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// The --umask and --target-mode options.
+	defaultUmask      string
+	defaultTargetMode string
+)
+
+// Parse an octal umask like 022.
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q, expected an octal number like 022", s)
+	}
+	return int(mask), nil
+}
+
+// Parse a mode like chmod(1) takes: an octal number, or a list of symbolic
+// modes like u+x,go-w separated by commas.
+func parseMode(s string) (func(os.FileMode) os.FileMode, error) {
+	if mode, err := strconv.ParseUint(s, 8, 32); err == nil && mode <= 07777 {
+		return func(old os.FileMode) os.FileMode {
+			return old&^os.ModePerm | os.FileMode(mode)&os.ModePerm
+		}, nil
+	}
+
+	type change struct {
+		op        byte
+		who, perm os.FileMode
+	}
+	var changes []change
+	for _, clause := range strings.Split(s, ",") {
+		i := strings.IndexAny(clause, "+-=")
+		if i < 0 || i == len(clause)-1 && clause[i] != '=' {
+			return nil, fmt.Errorf("invalid mode %q, expected an octal number or one like u+x,go-w", s)
+		}
+		var who os.FileMode
+		for _, c := range clause[:i] {
+			switch c {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				return nil, fmt.Errorf("invalid mode %q, unknown class %q", s, c)
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		var perm os.FileMode
+		for _, c := range clause[i+1:] {
+			switch c {
+			case 'r':
+				perm |= 0444
+			case 'w':
+				perm |= 0222
+			case 'x':
+				perm |= 0111
+			default:
+				return nil, fmt.Errorf("invalid mode %q, unknown permission %q", s, c)
+			}
+		}
+		changes = append(changes, change{clause[i], who, perm & who})
+	}
+	return func(old os.FileMode) os.FileMode {
+		for _, c := range changes {
+			switch c.op {
+			case '+':
+				old |= c.perm
+			case '-':
+				old &^= c.perm
+			case '=':
+				old = old&^c.who | c.perm
+			}
+		}
+		return old
+	}, nil
+}
+
+// The umask of a recipe of the rule, or -1 to keep that of mk.
+func (r *rule) recipeUmask() int {
+	s := r.umask
+	if s == "" {
+		s = defaultUmask
+	}
+	if s == "" {
+		return -1
+	}
+	// checked when it was read
+	mask, _ := parseUmask(s)
+	return mask
+}
+
+// The mode given to the targets of the rule, empty for none.
+func (r *rule) targetMode() string {
+	if r.mode != "" {
+		return r.mode
+	}
+	return defaultTargetMode
+}
+
+// Change the mode of a target, or of every file and directory in a tree.
+func chmodTarget(name string, mode string) error {
+	change, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != name && !isDirPrereq(name) {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, change(info.Mode()))
+	})
+}
+
+// Let the recipe of a target write it again, if an earlier one took the
+// permission away.
+func makeWritable(name string) error {
+	info, err := os.Stat(name)
+	if err != nil || info.Mode().Perm()&0200 != 0 && !isDirPrereq(name) {
+		return nil
+	}
+	return chmodTarget(name, "u+w")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		old, new os.FileMode
+	}{
+		{"0444", 0644, 0444},
+		{"a-w", 0755, 0555},
+		{"u+x,go-w", 0666, 0744},
+		{"go=", 0755, 0700},
+		{"+x", 0644, 0755},
+	} {
+		change, err := parseMode(test.mode)
+		if err != nil {
+			t.Errorf("%s: %v", test.mode, err)
+			continue
+		}
+		if got := change(test.old); got != test.new {
+			t.Errorf("%s on %o: got %o, expected %o", test.mode, test.old, got, test.new)
+		}
+	}
+	for _, mode := range []string{"", "u+q", "z-w", "u+"} {
+		if _, err := parseMode(mode); err == nil {
+			t.Errorf("%q: expected an error", mode)
+		}
+	}
+}
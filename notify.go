@@ -0,0 +1,76 @@
+// Notifications at the end of long or failed builds.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Command to run, or 'webhook:URL' to post to, when a build is done.
+	notify string
+
+	// Builds taking at least this long notify, failed builds always do.
+	notifyAfter time.Duration
+
+	// Targets whose recipe failed.
+	failedTargets []string
+	failedMutex   sync.Mutex
+)
+
+// Remember that the recipe of a target failed.
+func recordFailure(target string) {
+	failedMutex.Lock()
+	failedTargets = append(failedTargets, target)
+	failedMutex.Unlock()
+}
+
+// The payload of a notification.
+type buildSummary struct {
+	Status    string   `json:"status"` // "failed" or "done"
+	Directory string   `json:"directory"`
+	Mkfile    string   `json:"mkfile"`
+	Targets   []string `json:"targets"`
+	Failed    []string `json:"failed,omitempty"`
+	Duration  float64  `json:"duration"`          // in seconds
+	CPU       float64  `json:"cpu"`               // CPU time of all recipes, in seconds
+	MaxRSS    int64    `json:"max_rss,omitempty"` // of the largest recipe, in bytes
+}
+
+// Send a notification: post it to a webhook, or feed it to a command on
+// stdin.
+func notifyBuild(summary buildSummary) error {
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	if url, ok := strings.CutPrefix(notify, "webhook:"); ok {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s", url, resp.Status)
+		}
+		return nil
+	}
+
+	sh, args := expandShell(defaultShell, []string{notify})
+	cmd := exec.Command(sh, args...)
+	cmd.Env = append(os.Environ(), "MKSTATUS="+summary.Status)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
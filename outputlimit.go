@@ -0,0 +1,123 @@
+// Limiting the output of a recipe, with --max-output-per-recipe: past the
+// limit, the output is cut with a line telling so, and the whole of it is kept
+// in .mk/output, so that a chatty recipe neither floods the log of a CI build
+// nor fills the memory holding its output back.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bytes of output shown per recipe, no limit if 0.
+var maxRecipeOutput int64
+
+// The value of --max-output-per-recipe: a size in bytes, with an optional
+// suffix K, M or G, like 1MB.
+type sizeValue struct{ n *int64 }
+
+func (v sizeValue) String() string {
+	if *v.n == 0 {
+		return ""
+	}
+	return formatBytes(*v.n)
+}
+
+func (v sizeValue) Set(s string) error {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	unit := int64(1)
+	if i := strings.IndexAny(number, "KMG"); i >= 0 && i == len(number)-1 {
+		unit = int64(1) << (10 * (strings.IndexByte("KMG", number[i]) + 1))
+		number = number[:i]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a size like 512K or 1MB")
+	}
+	*v.n = n * unit
+	return nil
+}
+
+func (sizeValue) Type() string {
+	return "size"
+}
+
+// The output of a recipe so far, shared by its standard output and error.
+type outputLimit struct {
+	mutex     sync.Mutex
+	target    string
+	written   int64    // bytes shown
+	truncated bool     // once the limit was reached
+	log       *os.File // the whole output
+}
+
+// Start limiting the output of the recipe of a target. Its log is named after
+// the target escaped like a path element in a URL, so every target has its
+// own: a/b is a%2Fb.log and a_b is a_b.log. Only the user can read it until
+// the secrets in it are masked.
+func newOutputLimit(target string) (*outputLimit, error) {
+	path, err := statePath("output", url.PathEscape(target)+".log")
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &outputLimit{target: target, log: log}, nil
+}
+
+// A writer showing the output on w, up to the limit.
+func (l *outputLimit) writer(w io.Writer) io.Writer {
+	return limitedWriter{l, w}
+}
+
+// Close the whole output, removing it if it was shown in full. The secrets in
+// it are masked once it is complete, also those split over two writes.
+func (l *outputLimit) close() {
+	defer l.log.Close()
+	if !l.truncated {
+		os.Remove(l.log.Name())
+		return
+	}
+	output, err := os.ReadFile(l.log.Name())
+	if err == nil {
+		err = os.WriteFile(l.log.Name(), maskSecrets(output), 0600)
+	}
+	if err != nil {
+		mkPrintWarning(fmt.Sprintf("masking the secrets in %s: %v", l.log.Name(), err))
+		os.Remove(l.log.Name())
+	}
+}
+
+type limitedWriter struct {
+	l *outputLimit
+	w io.Writer
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	l := lw.l
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.log.Write(stripFor("logs", p))
+	if l.truncated {
+		return len(p), nil
+	}
+	n := min(int64(len(p)), maxRecipeOutput-l.written)
+	if _, err := lw.w.Write(p[:n]); err != nil {
+		return 0, err
+	}
+	l.written += n
+	if n < int64(len(p)) {
+		l.truncated = true
+		fmt.Fprintf(lw.w, "\n[mk: the output of %s is cut after %s, all of it is in %s]\n",
+			l.target, formatBytes(maxRecipeOutput), l.log.Name())
+	}
+	return len(p), nil
+}
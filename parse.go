@@ -4,21 +4,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
 )
 
 type parser struct {
-	l        *lexer   // underlying lexer
-	name     string   // name of the file being parsed
-	path     string   // full path of the file being parsed
-	tokenbuf []token  // tokens consumed on the current statement
-	rules    *ruleSet // current ruleSet
+	l        *lexer         // underlying lexer
+	name     string         // name of the file being parsed
+	path     string         // full path of the file being parsed
+	tokenbuf []token        // tokens consumed on the current statement
+	rules    *ruleSet       // current ruleSet
+	envdeps  []string       // variables from 'depends-env', for the next rule
+	comments map[int]string // '#' comments on lines of their own, by line
 }
 
 // Pretty errors.
@@ -26,7 +37,11 @@ func (p *parser) parseError(context string, expected string, found token) {
 	mkPrintError(fmt.Sprintf("%s:%d: syntax error: ", p.name, found.line))
 	mkPrintError(fmt.Sprintf("while %s, expected %s but found '%s'.\n",
 		context, expected, found.String()))
-	mkError("")
+	if !recoverSyntaxErrors() {
+		mkError("")
+	}
+	syntaxErrors++
+	panic(syntaxError{})
 }
 
 // More basic errors.
@@ -35,7 +50,60 @@ func (p *parser) basicErrorAtToken(what string, found token) {
 }
 
 func (p *parser) basicErrorAtLine(what string, line int) {
-	mkError(fmt.Sprintf("%s:%d: syntax error: %s\n", p.name, line, what))
+	p.errorAtLine(what, line)
+	panic(syntaxError{})
+}
+
+// Report an error, and go on with --parse-only or when mk serve reads the
+// mkfiles again.
+func (p *parser) errorAtLine(what string, line int) {
+	msg := fmt.Sprintf("%s:%d: syntax error: %s\n", p.name, line, what)
+	if !recoverSyntaxErrors() {
+		mkError(msg)
+	}
+	mkPrintError(msg)
+	syntaxErrors++
+}
+
+// Unwinds the parsing of a statement with a syntax error, with --parse-only
+// or when mk serve reads the mkfiles again.
+type syntaxError struct{}
+
+// Feed a token to the state of the parser. With --parse-only, or when mk
+// serve reads the mkfiles again, a syntax error skips the rest of the
+// statement, to report those in the following ones.
+func (p *parser) step(state parserStateFun, t token) (next parserStateFun) {
+	if recoverSyntaxErrors() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(syntaxError); !ok {
+					panic(r)
+				}
+				p.clear()
+				if t.typ == tokenNewline || t.typ == tokenRecipe {
+					next = parseTopLevel
+				} else {
+					next = parseSkipStatement
+				}
+			}
+		}()
+	}
+	return state(p, t)
+}
+
+// Skip the rest of a statement with a syntax error, and its recipe.
+func parseSkipStatement(p *parser, t token) parserStateFun {
+	if t.typ == tokenNewline {
+		return parseSkipRecipe
+	}
+	return parseSkipStatement
+}
+
+func parseSkipRecipe(p *parser, t token) parserStateFun {
+	if t.typ == tokenRecipe {
+		return parseTopLevel
+	}
+	return parseTopLevel(p, t)
 }
 
 // Accept a token for use in the current statement being parsed.
@@ -52,11 +120,45 @@ func (p *parser) clear() {
 // state function, or nil if there was a parse error.
 type parserStateFun func(*parser, token) parserStateFun
 
+// A directive is a statement starting with one of these keywords, it receives
+// all tokens up to the end of the line, the keyword included. A line whose
+// first ':' comes before any '=' is still a rule, see isRuleLine.
+var directives map[string]func(*parser, []token)
+
+func init() {
+	directives = map[string]func(*parser, []token){
+		"recipeprefix": parseRecipePrefix,
+		"namespace":    parseNamespace,
+		"}":            parseNamespaceEnd,
+		"use":          parseUse,
+		"reproducible": parseReproducible,
+		"preset":       parsePreset,
+		"depends-env":  parseDependsEnv,
+		"param":        parseParam,
+		"set":          parseSet,
+	}
+}
+
 // Parse a mkfile, returning a new ruleSet.
 func parse(input io.Reader, name string, path string, env map[string][]string) *ruleSet {
-	rules := &ruleSet{env,
-		make([]rule, 0),
-		make(map[string][]int)}
+	return parseWithOverrides(input, name, path, env, nil)
+}
+
+// Parse a mkfile, returning a new ruleSet. The variables in overrides keep
+// their value, whatever the mkfile assigns to them.
+func parseWithOverrides(input io.Reader, name string, path string, env map[string][]string,
+	overrides map[string][]string) *ruleSet {
+	for k, v := range overrides {
+		env[k] = v
+	}
+	setBuiltinVars(env)
+	wd, _ := filepath.Abs(".")
+	rules := &ruleSet{vars: env,
+		rules:       make([]rule, 0),
+		targetrules: make(map[string][]int),
+		presets:     make(map[string]*preset),
+		overrides:   overrides,
+		projects:    map[string]bool{wd: true}}
 	parseInto(input, name, rules, path)
 	return rules
 }
@@ -64,28 +166,62 @@ func parse(input io.Reader, name string, path string, env map[string][]string) *
 // Parse a mkfile inserting rules and variables into a given ruleSet.
 func parseInto(input io.Reader, name string, rules *ruleSet, path string) {
 	l := lex(input, false)
-	p := &parser{l, name, path, []token{}, rules}
-	oldmkfiledir := p.rules.vars["mkfiledir"]
+	if rules.settings.dialect != nil {
+		l.recipeprefix = rules.settings.dialect.recipeprefix
+	}
+	p := &parser{l, name, path, []token{}, rules, nil, make(map[int]string)}
+	oldsettings := p.rules.settings
+	oldmkfile, oldmkfiledir := p.rules.vars["mkfile"], p.rules.vars["mkfiledir"]
+	p.rules.vars["mkfile"] = []string{path}
 	p.rules.vars["mkfiledir"] = []string{filepath.Dir(path)}
+	oldParsingAt := parsingAt
+	p.rules.including = append(p.rules.including, path)
+	if !slices.Contains(p.rules.mkfiles, path) {
+		p.rules.mkfiles = append(p.rules.mkfiles, path)
+	}
 	state := parseTopLevel
+	lastline := 0 // line of the last token other than a comment or newline
 	for {
 		t, ok := l.nextToken()
 		if !ok {
 			break
 		}
 		if t.typ == tokenError {
-			p.basicErrorAtLine(l.errmsg, t.line)
+			p.errorAtLine(l.errmsg, t.line)
 			break
 		}
 
-		state = state(p, t)
+		// comments are kept for the rule that follows them, if they are on
+		// lines of their own
+		if t.typ == tokenComment {
+			if t.line != lastline {
+				p.comments[t.line] = strings.TrimSpace(t.val)
+			}
+			continue
+		}
+		if t.typ != tokenNewline {
+			lastline = t.line
+			// a recipe is logged at its rule
+			if len(debugVars) > 0 && t.typ != tokenRecipe {
+				parsingAt = fmt.Sprintf("%s:%d", name, t.line)
+			}
+		}
+
+		state = p.step(state, t)
 	}
 
 	// insert a dummy newline to allow parsing of any assignments or recipeless
 	// rules to finish.
-	state = state(p, token{tokenNewline, "\n", l.line, l.col})
+	state = p.step(state, token{tokenNewline, "\n", l.line, l.col})
 
-	p.rules.vars["mkfiledir"] = oldmkfiledir
+	p.rules.vars["mkfile"], p.rules.vars["mkfiledir"] = oldmkfile, oldmkfiledir
+	p.rules.settings = oldsettings
+	parsingAt = oldParsingAt
+	p.rules.including = p.rules.including[:len(p.rules.including)-1]
+
+	if len(p.rules.namespaces) > 0 && p.rules.namespaces[len(p.rules.namespaces)-1].opener == p {
+		p.errorAtLine("namespace block is not closed", l.line)
+	}
 
 	// TODO: Error when state != parseTopLevel
 }
@@ -121,6 +257,15 @@ func prettyPipeIncludeName(args []string) string {
 	return nb.String()
 }
 
+// Run the command of '<|', 'env <|' or 'reproducible <|', the words that
+// follow it after expansion, returning its output. Its standard input is
+// empty, and its errors go to those of mk.
+func runIncludeCommand(args []string) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
 // Consumed a '<|'
 func parsePipeInclude(p *parser, t token) parserStateFun {
 	switch t.typ {
@@ -128,6 +273,10 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 		if len(p.tokenbuf) == 0 {
 			p.basicErrorAtToken("empty pipe include", t)
 		}
+		if skipCommand() {
+			p.clear()
+			return parseTopLevel
+		}
 		args := make([]string, 0, len(p.tokenbuf))
 		for _, tk := range p.tokenbuf {
 			// TODO(rjk): Do we need to expand backticks here?
@@ -136,25 +285,14 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 
 		// TODO(rjk): determine what env should be in comparison with p9p.
 
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdin = nil
-		cmd.Stderr = os.Stderr
-		output, err := cmd.StdoutPipe()
+		name := prettyPipeIncludeName(args)
+		volatileRules.Store(true)
+		output, err := runIncludeCommand(args)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "unable to create pipe: %v", err)
-			return nil
+			p.basicErrorAtToken(fmt.Sprintf("%s: %v", name, err), p.tokenbuf[0])
 		}
-		if err := cmd.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "unable to start process: %v", err)
-			return nil
-		}
-
-		parseInto(output, prettyPipeIncludeName(args), p.rules, p.path)
 		p.clear()
-		if err := cmd.Wait(); err != nil {
-			fmt.Fprintf(os.Stderr, "unable to wait for process: %v", err)
-			return nil
-		}
+		parseInto(bytes.NewReader(output), name, p.rules, p.path)
 		return parseTopLevel
 	// Almost anything goes. Let the shell sort it out.
 	case tokenPipeInclude:
@@ -179,8 +317,20 @@ func parsePipeInclude(p *parser, t token) parserStateFun {
 func parseRedirInclude(p *parser, t token) parserStateFun {
 	switch t.typ {
 	case tokenNewline:
-		var filenameraw strings.Builder
+		// the file name may be followed by parameters, 'NAME=value ...'
+		nameend := len(p.tokenbuf)
 		for i := range p.tokenbuf {
+			if p.tokenbuf[i].typ == tokenAssign {
+				nameend = i - 1
+				break
+			}
+		}
+		if nameend <= 0 {
+			p.basicErrorAtToken("include without a file name", t)
+		}
+
+		var filenameraw strings.Builder
+		for i := range p.tokenbuf[:nameend] {
 			filenameraw.WriteString(p.tokenbuf[i].val)
 		}
 
@@ -203,13 +353,19 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 		if err != nil {
 			mkError("unable to find mkfile's absolute path")
 		}
+		if i := slices.Index(p.rules.including, path); i >= 0 {
+			p.basicErrorAtToken(fmt.Sprintf("%s includes itself: %s", filename,
+				formatChain(append(relativePaths(p.rules.including[i:]), filename))), p.tokenbuf[0])
+		}
 
+		restore := p.bindParameters(p.tokenbuf[nameend:])
 		parseInto(input, filename, p.rules, path)
+		restore()
 
 		p.clear()
 		return parseTopLevel
 
-	case tokenWord:
+	case tokenWord, tokenAssign:
 		p.tokenbuf = append(p.tokenbuf, t)
 
 	default:
@@ -219,6 +375,64 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 	return parseRedirInclude
 }
 
+// The paths relative to the current directory, where they are under it.
+func relativePaths(paths []string) []string {
+	wd, _ := os.Getwd()
+	rel := make([]string, len(paths))
+	for i, path := range paths {
+		rel[i] = path
+		if r, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(r, "..") {
+			rel[i] = r
+		}
+	}
+	return rel
+}
+
+// Assign the parameters of an include, 'NAME=value ...', returning a function
+// that gives the variables back their previous values.
+func (p *parser) bindParameters(ts []token) func() {
+	old := make(map[string][]string)
+	unset := make(map[string]bool)
+	for len(ts) > 0 {
+		if len(ts) < 2 || ts[0].typ != tokenWord || ts[1].typ != tokenAssign {
+			p.basicErrorAtToken("expected a parameter 'NAME=value'", ts[0])
+		}
+
+		// the value ends where the name of the next parameter begins
+		end := 2
+		for end < len(ts) && !(end+1 < len(ts) && ts[end+1].typ == tokenAssign) {
+			end++
+		}
+
+		name := ts[0].val
+		if _, saved := old[name]; !saved && !unset[name] {
+			if vals, ok := p.rules.vars[name]; ok {
+				old[name] = vals
+			} else {
+				unset[name] = true
+			}
+		}
+		assignment := append([]token{ts[0]}, ts[2:end]...)
+		if err := p.rules.executeAssignment(assignment); err != nil {
+			p.basicErrorAtToken(err.what, err.where)
+		}
+		ts = ts[end:]
+	}
+
+	return func() {
+		for name, vals := range old {
+			cur, had := p.rules.vars[name]
+			debugAssign(name, cur, had, vals, "restored after the include")
+			p.rules.vars[name] = vals
+		}
+		for name := range unset {
+			cur, had := p.rules.vars[name]
+			debugUnset(name, cur, had, "after the include")
+			delete(p.rules.vars, name)
+		}
+	}
+}
+
 // Encountered a bare string at the beginning of the line.
 func parseAssignmentOrTarget(p *parser, t token) parserStateFun {
 	p.push(t)
@@ -227,6 +441,14 @@ func parseAssignmentOrTarget(p *parser, t token) parserStateFun {
 
 // Consumed one bare string ot the beginning of the line.
 func parseEqualsOrTarget(p *parser, t token) parserStateFun {
+	if p.tokenbuf[0].val == "env" && t.typ == tokenPipeInclude {
+		p.push(t)
+		return parseEnvImport
+	}
+	if _, ok := directives[p.tokenbuf[0].val]; ok && t.typ != tokenAssign && t.typ != tokenColon {
+		return parseDirective(p, t)
+	}
+
 	switch t.typ {
 	case tokenAssign:
 		return parseAssignment
@@ -247,6 +469,449 @@ func parseEqualsOrTarget(p *parser, t token) parserStateFun {
 	return parseTopLevel // unreachable
 }
 
+// Consumed a directive keyword. Everything up to the end of the line are its
+// arguments.
+func parseDirective(p *parser, t token) parserStateFun {
+	switch t.typ {
+	case tokenNewline:
+		if isRuleLine(p.tokenbuf) {
+			// a rule whose first target is the keyword, parsed again
+			ts := append(slices.Clone(p.tokenbuf[1:]), t)
+			p.tokenbuf = p.tokenbuf[:1]
+			var state parserStateFun = parseTargets
+			for _, tk := range ts {
+				state = state(p, tk)
+			}
+			return state
+		}
+		directives[p.tokenbuf[0].val](p, p.tokenbuf)
+		p.clear()
+		return parseTopLevel
+
+	case tokenRecipe:
+		p.parseError("reading a directive", "a newline", t)
+
+	default:
+		p.push(t)
+	}
+
+	return parseDirective
+}
+
+// Whether a line starting with a directive keyword is a rule, as a line is
+// whose first ':' comes before any '=' or '<|'. A preset has a ':' of its own:
+// its line is a rule only with a second ':', or nothing after the first one.
+func isRuleLine(ts []token) bool {
+	colons := 0
+	for i, tk := range ts {
+		switch tk.typ {
+		case tokenColon:
+			colons++
+			if ts[0].val != "preset" || colons == 2 || i == len(ts)-1 {
+				return true
+			}
+		case tokenAssign, tokenPipeInclude:
+			return false
+		}
+	}
+	return false
+}
+
+// Consumed 'recipeprefix'. Select how recipe lines are recognized in the rest
+// of the file: 'indent' for any leading whitespace, 'tab' for a leading tab
+// only, or a single character every recipe line has to start with.
+func parseRecipePrefix(p *parser, ts []token) {
+	if len(ts) != 2 {
+		p.basicErrorAtToken("recipeprefix expects exactly one argument", ts[0])
+	}
+
+	switch arg := ts[1].val; arg {
+	case "indent":
+		p.l.recipeprefix = recipePrefixIndent
+	case "tab":
+		p.l.recipeprefix = recipePrefixTab
+	default:
+		c, w := utf8.DecodeRuneInString(arg)
+		if w != len(arg) || unicode.IsSpace(c) {
+			p.basicErrorAtToken(fmt.Sprintf("invalid recipe prefix %q, expected 'indent', 'tab' or a single character", arg), ts[1])
+		}
+		p.l.recipeprefix = c
+	}
+}
+
+// Consumed 'namespace name {'. Open a namespace block.
+func parseNamespace(p *parser, ts []token) {
+	if len(ts) != 3 || ts[2].val != "{" {
+		p.basicErrorAtToken("expected 'namespace name {'", ts[0])
+	}
+
+	parts := expand(ts[1].val, p.rules.vars, true)
+	if len(parts) != 1 || strings.ContainsAny(parts[0], "%/") {
+		p.basicErrorAtToken(fmt.Sprintf("invalid namespace name %q", ts[1].val), ts[1])
+	}
+
+	p.rules.namespaces = append(p.rules.namespaces, &namespace{
+		prefix:   p.rules.namespacePrefix() + parts[0] + "/",
+		opener:   p,
+		first:    len(p.rules.rules),
+		declared: make(map[string]bool),
+		vars:     maps.Clone(p.rules.vars),
+	})
+}
+
+// Consumed '}'. Close the innermost namespace block, which has to be opened in
+// the same file. Prerequisites naming a target of the block are prefixed now
+// that all of them are known.
+func parseNamespaceEnd(p *parser, ts []token) {
+	n := len(p.rules.namespaces)
+	if len(ts) != 1 || n == 0 || p.rules.namespaces[n-1].opener != p {
+		p.basicErrorAtToken("'}' without a namespace block to close", ts[0])
+	}
+	ns := p.rules.namespaces[n-1]
+	p.rules.namespaces = p.rules.namespaces[:n-1]
+
+	for k := ns.first; k < len(p.rules.rules); k++ {
+		r := &p.rules.rules[k]
+		for i := range r.prereqs {
+			// those of a project are prefixed with its directory already
+			name, ok := strings.CutPrefix(r.prereqs[i], p.rules.project)
+			if ok && ns.declared[name] {
+				r.prereqs[i] = ns.prefix + name
+			}
+		}
+	}
+
+	p.rules.vars = ns.vars
+}
+
+// Consumed 'use module@version [file] [NAME=value ...]'. Fetch a rule library
+// and include its mkfile, or the given file in it.
+func parseUse(p *parser, ts []token) {
+	nameend := len(ts)
+	for i := range ts {
+		if ts[i].typ == tokenAssign {
+			nameend = i - 1
+			break
+		}
+	}
+	if nameend != 2 && nameend != 3 {
+		p.basicErrorAtToken("expected 'use module@version [file]'", ts[0])
+	}
+
+	parts := expand(ts[1].val, p.rules.vars, false)
+	module, version, ok := "", "", len(parts) == 1
+	if ok {
+		module, version, ok = strings.Cut(parts[0], "@")
+	}
+	if !ok || module == "" || version == "" {
+		p.basicErrorAtToken(fmt.Sprintf("invalid library %q, expected module@version", ts[1].val), ts[1])
+	}
+
+	file := "mkfile"
+	if nameend == 3 {
+		parts := expand(ts[2].val, p.rules.vars, false)
+		if len(parts) != 1 {
+			mkError("filename variables need to be a single value")
+		}
+		file = parts[0]
+	}
+
+	dir, err := fetchLibrary(module, version)
+	if err != nil {
+		p.basicErrorAtToken(fmt.Sprintf("cannot fetch %s@%s: %v", module, version, err), ts[1])
+	}
+
+	path := filepath.Join(dir, file)
+	input, err := os.Open(path)
+	if err != nil {
+		p.basicErrorAtToken(fmt.Sprintf("cannot open %s in %s@%s", file, module, version), ts[1])
+	}
+	defer input.Close()
+
+	restore := p.bindParameters(ts[nameend:])
+	parseInto(input, module+"@"+version+"/"+file, p.rules, path)
+	restore()
+}
+
+// Consumed 'preset name: targets [NAME=value ...]'. Declare a preset, which
+// selects the targets and variables to build with.
+func parsePreset(p *parser, ts []token) {
+	if len(ts) < 3 || ts[1].typ != tokenWord || ts[2].typ != tokenColon {
+		p.basicErrorAtToken("expected 'preset name: targets'", ts[0])
+	}
+	name := ts[1].val
+	if _, ok := p.rules.presets[name]; ok {
+		p.basicErrorAtToken(fmt.Sprintf("preset %s is already declared", name), ts[1])
+	}
+
+	targetend := len(ts)
+	for i := 3; i < len(ts); i++ {
+		if ts[i].typ == tokenAssign {
+			targetend = i - 1
+			break
+		}
+	}
+
+	pr := &preset{vars: make(map[string][]string)}
+	for _, tk := range ts[3:targetend] {
+		if tk.typ != tokenWord {
+			p.parseError("reading a preset", "a target", tk)
+		}
+		pr.targets = append(pr.targets, expand(tk.val, p.rules.vars, true)...)
+	}
+
+	// evaluate the variables like include parameters, and take them back
+	restore := p.bindParameters(ts[targetend:])
+	for i := targetend; i+1 < len(ts); i++ {
+		if ts[i+1].typ == tokenAssign {
+			pr.vars[ts[i].val] = p.rules.vars[ts[i].val]
+		}
+	}
+	restore()
+
+	p.rules.presets[name] = pr
+}
+
+// Consumed 'depends-env NAME...'. The targets of the next rule depend on the
+// values of these variables.
+func parseDependsEnv(p *parser, ts []token) {
+	if len(ts) < 2 {
+		p.basicErrorAtToken("expected 'depends-env' followed by variable names", ts[0])
+	}
+	for _, tk := range ts[1:] {
+		if tk.typ != tokenWord || !isValidVarName(tk.val) {
+			p.parseError("reading 'depends-env'", "a variable name", tk)
+		}
+		p.envdeps = append(p.envdeps, tk.val)
+	}
+}
+
+// Consumed 'env <|'. The rest of the line is a command printing NAME=value
+// lines, which are assigned to variables remembering the command.
+func parseEnvImport(p *parser, t token) parserStateFun {
+	switch t.typ {
+	case tokenNewline:
+		if len(p.tokenbuf) < 3 {
+			p.basicErrorAtToken("expected a command after 'env <|'", p.tokenbuf[1])
+		}
+		if skipCommand() {
+			p.clear()
+			return parseTopLevel
+		}
+		var args []string
+		for _, tk := range p.tokenbuf[2:] {
+			args = append(args, expand(tk.val, p.rules.vars, false)...)
+		}
+		origin := fmt.Sprintf("%s:%d: env <| %s", p.name, p.tokenbuf[0].line, strings.Join(args, " "))
+
+		volatileRules.Store(true)
+		output, err := runIncludeCommand(args)
+		if err != nil {
+			p.basicErrorAtToken(fmt.Sprintf("env <| %s: %v", strings.Join(args, " "), err), p.tokenbuf[0])
+		}
+		vars, err := parseEnvOutput(output)
+		if err != nil {
+			p.basicErrorAtToken(fmt.Sprintf("env <| %s: %v", strings.Join(args, " "), err), p.tokenbuf[0])
+		}
+		for _, kv := range vars {
+			p.rules.importVar(kv[0], kv[1], origin)
+		}
+		p.clear()
+		return parseTopLevel
+
+	case tokenRecipe:
+		p.parseError("reading 'env <|'", "a newline", t)
+
+	default:
+		p.push(t)
+	}
+	return parseEnvImport
+}
+
+// Parse the output of a command of 'env <|': NAME=value lines, possibly
+// following 'export', with blank lines and '#' comments. A value in single
+// or double quotes is taken without them, the way the shell would.
+func parseEnvOutput(output []byte) ([][2]string, error) {
+	var vars [][2]string
+	for n, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || !isValidVarName(name) {
+			return nil, fmt.Errorf("line %d: expected NAME=value, found %q", n+1, line)
+		}
+		if len(value) >= 2 && value[0] == value[len(value)-1] {
+			switch value[0] {
+			case '\'':
+				value = value[1 : len(value)-1]
+			case '"':
+				value = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\$`, `$`, "\\`", "`").
+					Replace(value[1 : len(value)-1])
+			}
+		}
+		vars = append(vars, [2]string{name, value})
+	}
+	return vars, nil
+}
+
+// Consumed 'param NAME description...'. A variable that is not set is asked
+// for on the terminal, and is an error without one.
+func parseParam(p *parser, ts []token) {
+	if len(ts) < 2 || ts[1].typ != tokenWord || !isValidVarName(ts[1].val) {
+		p.basicErrorAtToken("expected 'param' followed by a variable name and a description", ts[0])
+	}
+	name := ts[1].val
+	var words []string
+	for _, tk := range ts[2:] {
+		words = append(words, expand(tk.val, p.rules.vars, false)...)
+	}
+	if _, ok := p.rules.vars[name]; ok || parseOnly {
+		return
+	}
+
+	volatileRules.Store(true)
+	value, err := promptParam(name, strings.Join(words, " "))
+	if err != nil {
+		p.basicErrorAtToken(err.Error(), ts[1])
+	}
+	debugAssign(name, nil, false, []string{value}, "asked for by 'param'")
+	p.rules.vars[name] = []string{value}
+}
+
+// Ask for the value of a parameter on the terminal. Elsewhere, as in CI, tell
+// how to set it instead.
+func promptParam(name, description string) (string, error) {
+	what := name
+	if description != "" {
+		what += " (" + description + ")"
+	}
+	if stdinProtocol || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("%s is not set, set it in the environment, as in '%s=value mk'", what, name)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", what)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading %s: %v", name, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Consumed 'set name=value ...'. Set the shell or the dialect of the rules
+// that follow, up to the end of the current mkfile.
+func parseSet(p *parser, ts []token) {
+	ts = ts[1:]
+	if len(ts) == 0 {
+		p.basicErrorAtToken("expected 'set shell=...', 'set dialect=...', 'set umask=...' or 'set mode=...'", p.tokenbuf[0])
+	}
+	for len(ts) > 0 {
+		if len(ts) < 2 || ts[0].typ != tokenWord || ts[1].typ != tokenAssign {
+			p.basicErrorAtToken("expected 'set shell=...', 'set dialect=...', 'set umask=...' or 'set mode=...'", ts[0])
+		}
+
+		// the value ends where the next setting begins
+		end := 2
+		for end < len(ts) && !(end+1 < len(ts) && ts[end+1].typ == tokenAssign) {
+			end++
+		}
+		var value []string
+		for _, tk := range ts[2:end] {
+			value = append(value, expand(tk.val, p.rules.vars, true)...)
+		}
+
+		switch key := ts[0].val; key {
+		case "shell":
+			if len(value) == 0 {
+				p.basicErrorAtToken("set shell= expects a command", ts[0])
+			}
+			p.rules.settings.shell = value
+		case "dialect":
+			name := strings.Join(value, " ")
+			d, ok := dialects[name]
+			if !ok {
+				p.basicErrorAtToken(fmt.Sprintf("unknown dialect %q, expected one of %s", name,
+					strings.Join(slices.Sorted(maps.Keys(dialects)), ", ")), ts[0])
+			}
+			p.rules.settings.dialect = &d
+			p.rules.settings.shell = []string{d.shell}
+			p.l.recipeprefix = d.recipeprefix
+		case "umask":
+			p.rules.settings.umask = strings.Join(value, " ")
+			if _, err := parseUmask(p.rules.settings.umask); err != nil {
+				p.basicErrorAtToken(err.Error(), ts[0])
+			}
+		case "mode":
+			p.rules.settings.mode = strings.Join(value, " ")
+			if _, err := parseMode(p.rules.settings.mode); err != nil {
+				p.basicErrorAtToken(err.Error(), ts[0])
+			}
+		default:
+			p.basicErrorAtToken(fmt.Sprintf("unknown setting %q, expected shell, dialect, umask or mode", key), ts[0])
+		}
+		ts = ts[end:]
+	}
+}
+
+// Consumed 'reproducible <|command'. Like a pipe include, but the output is
+// expected to be the same on every run: its hash is pinned in the lock file.
+func parseReproducible(p *parser, ts []token) {
+	if len(ts) < 3 || ts[1].typ != tokenPipeInclude {
+		p.basicErrorAtToken("expected 'reproducible <|command'", ts[0])
+	}
+	if skipCommand() {
+		return
+	}
+
+	args := make([]string, 0, len(ts)-2)
+	for _, tk := range ts[2:] {
+		args = append(args, expand(tk.val, p.rules.vars, false)...)
+	}
+	name := prettyPipeIncludeName(args)
+
+	output, err := runIncludeCommand(args)
+	if err != nil {
+		p.basicErrorAtToken(fmt.Sprintf("%s: %v", name, err), ts[1])
+	}
+
+	sum := sha256.Sum256(output)
+	if err := lock.set(name, "sha256:"+hex.EncodeToString(sum[:])); err != nil {
+		p.basicErrorAtToken(err.Error(), ts[1])
+	}
+
+	parseInto(bytes.NewReader(output), name, p.rules, p.path)
+}
+
+// Return the documentation of a statement on the given line: a '##' comment
+// at the end of the line, or else the '##' comments on the lines right above.
+func (p *parser) docFor(line int) string {
+	if doc, ok := p.l.docs[line]; ok {
+		return doc
+	}
+	return strings.Join(linesAbove(p.l.docs, line), " ")
+}
+
+// Return the '#' comments on the lines right above the given line.
+func (p *parser) commentFor(line int) string {
+	return strings.Join(linesAbove(p.comments, line), "\n")
+}
+
+// Collect the entries for the lines right above the given one, up to the
+// first line without an entry.
+func linesAbove(entries map[int]string, line int) []string {
+	var lines []string
+	for n := line - 1; ; n-- {
+		entry, ok := entries[n]
+		if !ok {
+			break
+		}
+		lines = append(lines, entry)
+	}
+	slices.Reverse(lines)
+	return lines
+}
+
 // Consumed 'foo='. Everything else is a value being assigned to foo.
 func parseAssignment(p *parser, t token) parserStateFun {
 	switch t.typ {
@@ -290,7 +955,7 @@ func parseAttributesOrPrereqs(p *parser, t token) parserStateFun {
 	case tokenColon:
 		p.push(t)
 		return parsePrereqs
-	case tokenWord:
+	case tokenWord, tokenAssign:
 		p.push(t)
 	default:
 		p.parseError("reading a rule's attributes or prerequisites",
@@ -319,7 +984,8 @@ func parsePrereqs(p *parser, t token) parserStateFun {
 // An entire rule has been consumed.
 func parseRecipe(p *parser, t token) parserStateFun {
 	// Assemble the rule!
-	r := rule{}
+	r := rule{file: p.name, line: p.tokenbuf[0].line, mkfile: p.path,
+		dir: strings.TrimSuffix(p.rules.project, "/")}
 
 	// find one or two colons
 	i := 0
@@ -329,22 +995,106 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	for ; j < len(p.tokenbuf) && p.tokenbuf[j].typ != tokenColon; j++ {
 	}
 
+	// a platform guard before the targets, the rule is left out on other
+	// platforms
+	first := 0
+	if i > 1 && isGuard(p.tokenbuf[0].val) {
+		first = 1
+		if !guardMatches(p.tokenbuf[0].val, p.rules.vars) {
+			p.envdeps = nil
+			p.clear()
+			if t.typ != tokenRecipe {
+				return parseTopLevel(p, t)
+			}
+			return parseTopLevel
+		}
+	}
+
 	// rule has attributes
 	if j < len(p.tokenbuf) {
 		var attribs []string
 		for k := i + 1; k < j; k++ {
+			if k+1 < j && p.tokenbuf[k+1].typ == tokenAssign {
+				// key=value attributes
+				var value []string
+				next := k + 2
+				if next < j && p.tokenbuf[next].typ == tokenWord {
+					value = expand(p.tokenbuf[next].val, p.rules.vars, true)
+					next++
+				}
+				switch key := p.tokenbuf[k].val; key {
+				case "owner":
+					r.owner = strings.Join(value, " ")
+				case "shell":
+					// the long form of S
+					r.shell = value
+				case "compare":
+					// the long form of P
+					r.command = value
+				case "contents":
+					r.contents = value
+				case "stdin":
+					// $prereq1 and the like are only known when the recipe runs
+					if k+2 < j && p.tokenbuf[k+2].typ == tokenWord {
+						r.stdin = p.tokenbuf[k+2].val
+					}
+					if r.stdin == "" {
+						p.basicErrorAtToken("stdin= expects a file", p.tokenbuf[k])
+					}
+				case "depfile":
+					// named after the target, like stdin=
+					if k+2 < j && p.tokenbuf[k+2].typ == tokenWord {
+						r.depfile = p.tokenbuf[k+2].val
+					}
+					if r.depfile == "" {
+						p.basicErrorAtToken("depfile= expects a file", p.tokenbuf[k])
+					}
+				case "umask":
+					r.umask = strings.Join(value, " ")
+					if _, err := parseUmask(r.umask); err != nil {
+						p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+					}
+				case "mode":
+					r.mode = strings.Join(value, " ")
+					if _, err := parseMode(r.mode); err != nil {
+						p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+					}
+				case "expect":
+					expect, err := parseExpect(strings.Join(value, " "))
+					if err != nil {
+						p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+					}
+					r.expect = expect
+				default:
+					p.basicErrorAtToken(fmt.Sprintf("unknown attribute %q", key), p.tokenbuf[k])
+				}
+				k = next - 1
+				continue
+			} else if p.tokenbuf[k].typ == tokenAssign {
+				p.parseError("reading a rule's attributes", "an attribute", p.tokenbuf[k])
+			}
 			exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
 			attribs = append(attribs, exparts...)
 		}
 		err := r.parseAttribs(attribs)
 		if err != nil {
-			msg := fmt.Sprintf("while reading a rule's attributes expected an attribute but found \"%c\".", err.found)
+			msg := fmt.Sprintf("unknown attribute %q in %q", err.found, strings.Join(attribs, " "))
+			if err.suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", err.suggestion)
+			}
 			p.basicErrorAtToken(msg, p.tokenbuf[i+1])
 		}
+		r.dialect = p.rules.settings.dialect
+		if foreign := r.foreignAttributes(); foreign != "" {
+			p.basicErrorAtToken(fmt.Sprintf("the attributes %q are not known to the plan9 mk", foreign), p.tokenbuf[i+1])
+		}
 
-		// If we don't have a shell set, check vars, check default shell
+		// If we don't have a shell set, check the file's settings, vars,
+		// default shell
 		if r.shell == nil {
-			if len(p.rules.vars["shell"]) > 0 {
+			if p.rules.settings.shell != nil {
+				r.shell = p.rules.settings.shell
+			} else if len(p.rules.vars["shell"]) > 0 {
 				r.shell = p.rules.vars["shell"]
 			} else {
 				r.shell = []string{defaultShell}
@@ -356,45 +1106,34 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		}
 	} else {
 		j = i
+		r.shell = p.rules.settings.shell
+	}
+	r.dialect = p.rules.settings.dialect
+	if r.umask == "" {
+		r.umask = p.rules.settings.umask
+	}
+	if r.mode == "" {
+		r.mode = p.rules.settings.mode
 	}
 
 	// targets
 	// TODO: fact-check, required to be resetted?
 	r.targets = r.targets[:0]
-	for k := 0; k < i; k++ {
+	prefix := p.rules.namespacePrefix()
+	for k := first; k < i; k++ {
 		exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
 		for i := range exparts {
 			targetstr := exparts[i]
-			r.targets = append(r.targets, pattern{spat: targetstr})
-
-			if r.attributes.regex {
-				rpat, err := regexp.Compile("^" + targetstr + "$")
-				if err != nil {
-					msg := fmt.Sprintf("invalid regular expression: %q", err)
-					p.basicErrorAtToken(msg, p.tokenbuf[k])
-				}
-				r.targets[len(r.targets)-1].rpat = rpat
-			} else {
-				idx := strings.IndexRune(targetstr, '%')
-				if idx >= 0 {
-					var left, right string
-					if idx > 0 {
-						left = regexp.QuoteMeta(targetstr[:idx])
-					}
-					if idx < len(targetstr)-1 {
-						right = regexp.QuoteMeta(targetstr[idx+1:])
-					}
-
-					patstr := fmt.Sprintf("^%s(.*)%s$", left, right)
-					rpat, err := regexp.Compile(patstr)
-					if err != nil {
-						msg := fmt.Sprintf("error compiling suffix rule. This is a bug. Error: %s", err)
-						p.basicErrorAtToken(msg, p.tokenbuf[k])
-					}
-					r.targets[len(r.targets)-1].rpat = rpat
-					r.targets[len(r.targets)-1].issuffix = true
-					r.ismeta = true
-				}
+			for _, ns := range p.rules.namespaces {
+				ns.declared[strings.TrimPrefix(prefix, ns.prefix)+targetstr] = true
+			}
+			pat, err := newPattern(prefix, targetstr, r.attributes.regex)
+			if err != nil {
+				p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+			}
+			r.targets = append(r.targets, pat)
+			if pat.issuffix {
+				r.ismeta = true
 			}
 		}
 	}
@@ -403,14 +1142,47 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	// TODO: fact-check, required to be resetted?
 	r.prereqs = r.prereqs[:0]
 	for k := j + 1; k < len(p.tokenbuf); k++ {
+		if p.tokenbuf[k].typ != tokenWord {
+			p.parseError("reading a rule's prerequisites",
+				"filename or pattern", p.tokenbuf[k])
+		}
 		exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
-		r.prereqs = append(r.prereqs, exparts...)
+		for _, prereq := range exparts {
+			// targets the meta-rule does not make
+			if excluded, ok := strings.CutPrefix(prereq, "!"); ok && r.ismeta && excluded != "" {
+				pat, err := newPattern(prefix, excluded, r.attributes.regex)
+				if err != nil {
+					p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+				}
+				r.exclusions = append(r.exclusions, pat)
+				continue
+			}
+			dir, target, isRef := cutDirRef(prereq)
+			switch {
+			case ws != nil && strings.HasPrefix(prereq, "//"):
+				// targets of another project of the workspace
+				resolved, err := ws.resolve(prereq)
+				if err != nil {
+					p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+				}
+				prereq = resolved
+			case isRef && !r.ismeta:
+				prereq = p.importProject(dir, target, p.tokenbuf[k])
+			case p.rules.project != "" && !filepath.IsAbs(prereq) && !strings.Contains(prereq, "://"):
+				prereq = p.rules.project + prereq
+			}
+			r.prereqs = append(r.prereqs, prereq)
+		}
 	}
 
 	if t.typ == tokenRecipe {
 		r.recipe = expandRecipeSigils(stripIndentation(t.val, t.col), p.rules.vars)
 	}
 
+	r.doc = p.docFor(r.line)
+	r.comment = p.commentFor(r.line)
+	r.envdeps, p.envdeps = p.envdeps, nil
+
 	p.rules.add(r)
 	p.clear()
 
@@ -2,9 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func ruleAttributesNotSet(t *testing.T, r *rule) {
@@ -18,6 +25,11 @@ func ruleAttributesNotSet(t *testing.T, r *rule) {
 		update:          false,
 		virtual:         false,
 		exclusive:       false,
+		capture:         false,
+		batch:           false,
+		parallel:        false,
+		keepgoing:       false,
+		setup:           false,
 	}
 	if r.attributes != noAttributes {
 		t.Error("rule attributes are not all false", r.attributes)
@@ -252,3 +264,610 @@ func TestParseS3Prereq(t *testing.T) {
 		t.Error("The rule does not have the right prerequisite")
 	}
 }
+
+// A '#' starts a comment only outside of recipes, quotes and escapes.
+func TestParseCommentHandling(t *testing.T) {
+	mkfileAsString := "x = a\\#b # comment\n" +
+		"foo: bar\\#baz \"q#q\" 'r#r' # comment\n" +
+		"\techo '#' \"a # b\" # shell comment\n" +
+		"\techo done\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if !reflect.DeepEqual(ruleSet.vars["x"], []string{"a#b"}) {
+		t.Errorf("escaped '#' in assignment, got %q", ruleSet.vars["x"])
+	}
+	if len(ruleSet.rules) != 1 {
+		t.Fatalf("There should be 1 rule")
+	}
+	rule := ruleSet.rules[0]
+	want := []string{"bar#baz", "q#q", "r#r"}
+	if !reflect.DeepEqual(rule.prereqs, want) {
+		t.Errorf("The prerequesites are %q, want %q", rule.prereqs, want)
+	}
+	recipe := "echo '#' \"a # b\" # shell comment\necho done\n"
+	if rule.recipe != recipe {
+		t.Errorf("The recipe is %q, want %q", rule.recipe, recipe)
+	}
+}
+
+// A '\' at the end of a line continues the line in targets, attributes,
+// prerequisites and assignments alike, and always separates words.
+func TestParseContinuation(t *testing.T) {
+	tests := []struct {
+		input   string
+		targets []string
+		prereqs []string
+	}{
+		{"prog: a.o \\\n      b.o\n\techo $prereq\n", []string{"prog"}, []string{"a.o", "b.o"}},
+		{"prog: a.o\\\n      b.o\n\techo $prereq\n", []string{"prog"}, []string{"a.o", "b.o"}},
+		{"prog: a.o\\\r\nb.o\r\n\techo $prereq\n", []string{"prog"}, []string{"a.o", "b.o"}},
+		{"prog\\\n  prog2:V\\\n  Q: a\n\techo\n", []string{"prog", "prog2"}, []string{"a"}},
+		{"x = a\\\n  b\nprog: $x\n\techo\n", []string{"prog"}, []string{"a", "b"}},
+	}
+
+	for i, tv := range tests {
+		env := make(map[string][]string)
+		ruleSet := parse(strings.NewReader(tv.input), "mkfile", "/mkfile", env)
+		if len(ruleSet.rules) != 1 {
+			t.Errorf("%d: there should be 1 rule, got %d", i, len(ruleSet.rules))
+			continue
+		}
+		rule := ruleSet.rules[0]
+		var targets []string
+		for _, p := range rule.targets {
+			targets = append(targets, p.spat)
+		}
+		if !reflect.DeepEqual(targets, tv.targets) {
+			t.Errorf("%d: targets are %q, want %q", i, targets, tv.targets)
+		}
+		if !reflect.DeepEqual(rule.prereqs, tv.prereqs) {
+			t.Errorf("%d: prerequisites are %q, want %q", i, rule.prereqs, tv.prereqs)
+		}
+		if rule.recipe == "" {
+			t.Errorf("%d: continuation line was lexed as the recipe", i)
+		}
+	}
+}
+
+// Wrap a prerequisite list long enough to span several read buffers.
+func TestParseLongWrappedPrereqs(t *testing.T) {
+	var mkfile strings.Builder
+	var want []string
+	mkfile.WriteString("prog:")
+	for i := range 500 {
+		name := fmt.Sprintf("obj/file%03d.o", i)
+		want = append(want, name)
+		if i%3 == 0 {
+			fmt.Fprintf(&mkfile, " %s \\\n\t", name)
+		} else if i%3 == 1 {
+			fmt.Fprintf(&mkfile, "%s\\\n", name)
+		} else {
+			fmt.Fprintf(&mkfile, "    %s ", name)
+		}
+	}
+	mkfile.WriteString("\n\tld -o $target $prereq\n")
+
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfile.String()), "mkfile", "/mkfile", env)
+	if len(ruleSet.rules) != 1 {
+		t.Fatalf("There should be 1 rule, got %d", len(ruleSet.rules))
+	}
+	rule := ruleSet.rules[0]
+	if !reflect.DeepEqual(rule.prereqs, want) {
+		t.Errorf("got %d prerequisites, want %d", len(rule.prereqs), len(want))
+	}
+	if rule.recipe != "ld -o $target $prereq\n" {
+		t.Errorf("The recipe is %q", rule.recipe)
+	}
+}
+
+// A byte order mark is skipped, and non-ASCII names work as targets,
+// prerequisites and variables even when multibyte runes are split across
+// reads.
+func TestParseUTF8(t *testing.T) {
+	mkfileAsString := "\uFEFFgröße = ü\nbüro.o: ärger.c $größe\n\techo $target\n"
+	for _, input := range []io.Reader{
+		strings.NewReader(mkfileAsString),
+		iotest.OneByteReader(strings.NewReader(mkfileAsString)),
+	} {
+		env := make(map[string][]string)
+		ruleSet := parse(input, "mkfile", "/mkfile", env)
+		if !reflect.DeepEqual(ruleSet.vars["größe"], []string{"ü"}) {
+			t.Errorf("variable größe is %q", ruleSet.vars["größe"])
+		}
+		if len(ruleSet.rules) != 1 {
+			t.Errorf("There should be 1 rule, got %d", len(ruleSet.rules))
+			continue
+		}
+		rule := ruleSet.rules[0]
+		if rule.targets[0].spat != "büro.o" {
+			t.Errorf("The target is %q, want büro.o", rule.targets[0].spat)
+		}
+		if !reflect.DeepEqual(rule.prereqs, []string{"ärger.c", "ü"}) {
+			t.Errorf("The prerequesites are %q", rule.prereqs)
+		}
+	}
+}
+
+// The recipeprefix directive selects how recipe lines are recognized.
+func TestParseRecipePrefix(t *testing.T) {
+	tests := []struct {
+		input   string
+		recipes []string
+		vars    map[string][]string
+	}{
+		{
+			"recipeprefix tab\na:\n\techo a\n\n\techo b\nb:\n\techo c",
+			[]string{"echo a\necho b\n", "echo c"},
+			nil,
+		},
+		{
+			"recipeprefix >\na:\n> if true:\n>     print(1)\n\n> print(2)\n  x = 1\nb:\n>echo c\n",
+			[]string{"if true:\n    print(1)\nprint(2)\n", "echo c\n"},
+			map[string][]string{"x": {"1"}},
+		},
+		{
+			"recipeprefix >\nrecipeprefix indent\na:\n  echo a\n",
+			[]string{"echo a\n"},
+			nil,
+		},
+	}
+
+	for i, tv := range tests {
+		env := make(map[string][]string)
+		ruleSet := parse(strings.NewReader(tv.input), "mkfile", "/mkfile", env)
+		var recipes []string
+		for _, r := range ruleSet.rules {
+			recipes = append(recipes, strings.TrimRight(r.recipe, " \t"))
+		}
+		if !reflect.DeepEqual(recipes, tv.recipes) {
+			t.Errorf("%d: recipes are %q, want %q", i, recipes, tv.recipes)
+		}
+		for k, v := range tv.vars {
+			if !reflect.DeepEqual(ruleSet.vars[k], v) {
+				t.Errorf("%d: variable %s is %q, want %q", i, k, ruleSet.vars[k], v)
+			}
+		}
+	}
+}
+
+// Targets declared in a namespace block are prefixed with its name, and so are
+// prerequisites referring to them. Assignments don't leak out of the block.
+func TestParseNamespace(t *testing.T) {
+	component := filepath.Join(t.TempDir(), "component.mk")
+	err := os.WriteFile(component, []byte("lib.a: foo.o\n\tar r $target $prereq\nfoo.o: $SRC/foo.c util.h\n\tcc -c $prereq\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkfileAsString := "SRC = src\n" +
+		"namespace a {\n" +
+		"SRC = src/a\n" +
+		"<" + component + "\n" +
+		"}\n" +
+		"namespace b {\n" +
+		"SRC = src/b\n" +
+		"<" + component + "\n" +
+		"namespace test {\n" +
+		"%.ok: lib.a %.sh\n" +
+		"\tsh $stem.sh\n" +
+		"}\n" +
+		"}\n" +
+		"all:V: a/lib.a b/lib.a\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	want := map[string][]string{
+		"a/lib.a":     {"a/foo.o"},
+		"a/foo.o":     {"src/a/foo.c", "util.h"},
+		"b/lib.a":     {"b/foo.o"},
+		"b/foo.o":     {"src/b/foo.c", "util.h"},
+		"b/test/%.ok": {"b/lib.a", "%.sh"},
+		"all":         {"a/lib.a", "b/lib.a"},
+	}
+	if len(ruleSet.rules) != len(want) {
+		t.Errorf("There should be %d rules, got %d", len(want), len(ruleSet.rules))
+	}
+	for _, r := range ruleSet.rules {
+		target := r.targets[0].spat
+		if !reflect.DeepEqual(r.prereqs, want[target]) {
+			t.Errorf("%s: prerequisites are %q, want %q", target, r.prereqs, want[target])
+		}
+	}
+	if m := ruleSet.rules[4].targets[0].match("b/test/x.ok"); m == nil || m[1] != "x" {
+		t.Errorf("meta-rule in namespace does not match b/test/x.ok: %q", m)
+	}
+	if !reflect.DeepEqual(ruleSet.vars["SRC"], []string{"src"}) {
+		t.Errorf("SRC is %q after the namespace blocks", ruleSet.vars["SRC"])
+	}
+
+	ruleSet = parseKeywordRule(t, "namespace x:V: y\n\techo $target\nnamespace a {\nb:V:\n\techo\n}\n", "namespace")
+	if ruleSet.rules[1].targets[0].spat != "a/b" {
+		t.Errorf("the namespace after the rule is not opened: %v", ruleSet.rules[1].targets)
+	}
+}
+
+// Parameters of an include are only bound while the included file is parsed.
+func TestParseIncludeParameters(t *testing.T) {
+	template := filepath.Join(t.TempDir(), "template.mk")
+	err := os.WriteFile(template, []byte("$NAME.a: ${SRC:%=%.o}\n\tar r $target $prereq\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkfileAsString := "NAME = app\n" +
+		"<" + template + " NAME=libfoo SRC=foo1 foo2\n" +
+		"<" + template + " NAME=libbar SRC = bar\n" +
+		"app: libfoo.a libbar.a\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	want := map[string][]string{
+		"libfoo.a": {"foo1.o", "foo2.o"},
+		"libbar.a": {"bar.o"},
+		"app":      {"libfoo.a", "libbar.a"},
+	}
+	if len(ruleSet.rules) != len(want) {
+		t.Errorf("There should be %d rules, got %d", len(want), len(ruleSet.rules))
+	}
+	for _, r := range ruleSet.rules {
+		target := r.targets[0].spat
+		if !reflect.DeepEqual(r.prereqs, want[target]) {
+			t.Errorf("%s: prerequisites are %q, want %q", target, r.prereqs, want[target])
+		}
+	}
+	if !reflect.DeepEqual(ruleSet.vars["NAME"], []string{"app"}) {
+		t.Errorf("NAME is %q after the includes", ruleSet.vars["NAME"])
+	}
+	if _, ok := ruleSet.vars["SRC"]; ok {
+		t.Errorf("SRC is still set after the includes")
+	}
+}
+
+func TestParseUse(t *testing.T) {
+	// a rule making a target named use fetches nothing
+	parseKeywordRule(t, "use x:V: y\n\techo $target\n", "use")
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := t.TempDir()
+	t.Setenv("MKCACHE", t.TempDir())
+	defer func(path string) { lock = &lockFile{path: path} }(lock.path)
+	lock = &lockFile{path: filepath.Join(t.TempDir(), lockFileName)}
+
+	gitcmd := func(args ...string) string {
+		t.Helper()
+		args = append([]string{"-C", repo, "-c", "user.name=mk", "-c", "user.email=mk@localhost"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %q: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(content, tag string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(repo, "mkfile"), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gitcmd("add", "mkfile")
+		gitcmd("commit", "--quiet", "-m", tag)
+		gitcmd("tag", "--force", tag)
+	}
+
+	gitcmd("init", "--quiet")
+	commit("%.o: %.c\n\tcc -c $stem.c\n", "v1.0.0")
+	head := gitcmd("rev-parse", "HEAD")
+
+	mkfileAsString := "use " + repo + "@v1.0.0\n" +
+		"app: main.o\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if len(ruleSet.rules) != 2 || ruleSet.rules[0].targets[0].spat != "%.o" {
+		t.Fatalf("the rules of the library were not included: %v", ruleSet.rules)
+	}
+
+	if err := lock.flush(); err != nil {
+		t.Fatal(err)
+	}
+	lockfile, err := os.ReadFile(lock.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := repo + "@v1.0.0\t" + head + "\n"; !strings.HasSuffix(string(lockfile), want) {
+		t.Errorf("lock file is %q, want it to end in %q", lockfile, want)
+	}
+
+	// the pinned commit is used from the cache, even though the tag moved
+	commit("%.o: %.c\n\tgcc -c $stem.c\n", "v1.0.0")
+	ruleSet = parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if !strings.Contains(ruleSet.rules[0].recipe, "cc -c") || strings.Contains(ruleSet.rules[0].recipe, "gcc") {
+		t.Errorf("the library changed after it was pinned: %q", ruleSet.rules[0].recipe)
+	}
+
+	// and fetched again into an empty cache
+	t.Setenv("MKCACHE", t.TempDir())
+	ruleSet = parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if !strings.Contains(ruleSet.rules[0].recipe, "cc -c") || strings.Contains(ruleSet.rules[0].recipe, "gcc") {
+		t.Errorf("the pinned commit was not checked out: %q", ruleSet.rules[0].recipe)
+	}
+
+	// a key leaving the cache
+	for _, version := range []string{"../../escape", "v1/../../x"} {
+		if _, err := fetchLibrary(repo, version); err == nil || !strings.Contains(err.Error(), "'..'") {
+			t.Errorf("%s: got %v, want an error", version, err)
+		}
+	}
+}
+
+func TestParseReproducible(t *testing.T) {
+	defer func(path string) { lock = &lockFile{path: path} }(lock.path)
+	lock = &lockFile{path: filepath.Join(t.TempDir(), lockFileName)}
+
+	mkfileAsString := "reproducible <|echo 'all: a b'\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if len(ruleSet.rules) != 1 || !reflect.DeepEqual(ruleSet.rules[0].prereqs, []string{"a", "b"}) {
+		t.Fatalf("the output of the command was not included: %v", ruleSet.rules)
+	}
+
+	// sha256 of "all: a b\n"
+	want := "sha256:e5c824ce273e393f75e73c5219a95ba7c43aad3b19282fdbddac0ec877a771cc"
+	got, ok, err := lock.get("<|echo all: a b")
+	if err != nil || !ok || got != want {
+		t.Errorf("pinned %q, %v, %v, want %q", got, ok, err, want)
+	}
+
+	ruleSet = parseKeywordRule(t, "reproducible x:V: y\n\techo $target\nreproducible <|echo 'all: a b'\n", "reproducible")
+	if len(ruleSet.rules) != 2 {
+		t.Errorf("the command after the rule was not included: %v", ruleSet.rules)
+	}
+}
+
+func TestParsePreset(t *testing.T) {
+	mkfileAsString := "MODE = debug\n" +
+		"preset ci: lint test MODE=release CFLAGS=-O2 -g\n" +
+		"preset docs: doc\n" +
+		"CFLAGS = -O0\n" +
+		"build: out/$MODE/prog\n"
+
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	ci := ruleSet.presets["ci"]
+	if ci == nil || ruleSet.presets["docs"] == nil {
+		t.Fatalf("presets are %v", ruleSet.presets)
+	}
+	if !reflect.DeepEqual(ci.targets, []string{"lint", "test"}) {
+		t.Errorf("targets of ci are %q", ci.targets)
+	}
+	wantVars := map[string][]string{"MODE": {"release"}, "CFLAGS": {"-O2", "-g"}}
+	if !reflect.DeepEqual(ci.vars, wantVars) {
+		t.Errorf("variables of ci are %q, want %q", ci.vars, wantVars)
+	}
+	if !reflect.DeepEqual(ruleSet.vars["MODE"], []string{"debug"}) {
+		t.Errorf("MODE is %q after the preset", ruleSet.vars["MODE"])
+	}
+
+	// the variables of a preset take precedence over assignments
+	env = make(map[string][]string)
+	ruleSet = parseWithOverrides(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env, ci.vars)
+	if got := ruleSet.rules[0].prereqs; !reflect.DeepEqual(got, []string{"out/release/prog"}) {
+		t.Errorf("prerequisites with ci are %q", got)
+	}
+	if got := ruleSet.vars["CFLAGS"]; !reflect.DeepEqual(got, []string{"-O2", "-g"}) {
+		t.Errorf("CFLAGS with ci is %q", got)
+	}
+
+	// a second ':', or none after the first one, make a rule
+	ruleSet = parseKeywordRule(t, "preset x:V: lint\n\techo $target\npreset y:\npreset ci: lint\n", "preset")
+	if len(ruleSet.rules) != 2 || len(ruleSet.presets) != 1 || ruleSet.presets["ci"] == nil {
+		t.Errorf("the rules are %v, the presets %v", ruleSet.rules, ruleSet.presets)
+	}
+}
+
+func TestParseOwnerAttribute(t *testing.T) {
+	mkfileAsString := "TEAM = team-x\n" +
+		"lib.a:V owner=$TEAM: a.o\n\tar r $target $prereq\n" +
+		"b.o:owner=team-y: b.c\n\tcc -c b.c\n" +
+		"c.o: c.c\n\tcc -c c.c\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if len(ruleSet.rules) != 3 {
+		t.Fatalf("There should be 3 rules, got %d", len(ruleSet.rules))
+	}
+
+	for i, want := range []string{"team-x", "team-y", ""} {
+		if got := ruleSet.rules[i].owner; got != want {
+			t.Errorf("%s: owner is %q, want %q", ruleSet.rules[i].targets[0].spat, got, want)
+		}
+	}
+	if !ruleSet.rules[0].attributes.virtual {
+		t.Errorf("the V attribute next to owner= was not set")
+	}
+	if !reflect.DeepEqual(ruleSet.rules[1].prereqs, []string{"b.c"}) {
+		t.Errorf("prerequisites are %q", ruleSet.rules[1].prereqs)
+	}
+}
+
+func TestParseDocComments(t *testing.T) {
+	mkfileAsString := "## Build everything.\n" +
+		"all:V: prog\n" +
+		"\n" +
+		"## Link the program,\n" +
+		"## with all objects.\n" +
+		"prog: a.o\n\tcc -o prog a.o ## not a doc comment\n" +
+		"clean:V: ## Remove built files.\n\trm -f prog\n" +
+		"## Not attached, an assignment follows.\n" +
+		"X = 1\n" +
+		"# a plain comment\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	want := []string{"Build everything.", "Link the program, with all objects.", "Remove built files.", ""}
+	if len(ruleSet.rules) != len(want) {
+		t.Fatalf("There should be %d rules, got %d", len(want), len(ruleSet.rules))
+	}
+	for i := range want {
+		if got := ruleSet.rules[i].doc; got != want[i] {
+			t.Errorf("%s: doc is %q, want %q", ruleSet.rules[i].targets[0].spat, got, want[i])
+		}
+	}
+	if !strings.Contains(ruleSet.rules[1].recipe, "## not a doc comment") {
+		t.Errorf("the comment in the recipe was removed: %q", ruleSet.rules[1].recipe)
+	}
+}
+
+func TestParseDependsEnv(t *testing.T) {
+	mkfileAsString := "depends-env CC CFLAGS\n" +
+		"%.o: %.c\n\t$CC $CFLAGS -c $stem.c\n" +
+		"prog: a.o\n\t$CC -o prog a.o\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	if got := ruleSet.rules[0].envdeps; !reflect.DeepEqual(got, []string{"CC", "CFLAGS"}) {
+		t.Errorf("the variables of %%.o are %q", got)
+	}
+	if got := ruleSet.rules[1].envdeps; got != nil {
+		t.Errorf("depends-env applies to the rule after the next one: %q", got)
+	}
+
+	ruleSet = parseKeywordRule(t, "depends-env x:V: y\n\techo $target\ndepends-env CC\na:\n\t$CC a.c\n", "depends-env")
+	if ruleSet.rules[0].envdeps != nil || !reflect.DeepEqual(ruleSet.rules[1].envdeps, []string{"CC"}) {
+		t.Errorf("the variables are %q and %q", ruleSet.rules[0].envdeps, ruleSet.rules[1].envdeps)
+	}
+}
+
+func TestParseSet(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub.mk")
+	if err := os.WriteFile(sub, []byte("set dialect=plan9\nb:\n\techo b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mkfileAsString := "set shell=bash -c\n" +
+		"a:\n\techo a\n" +
+		"<" + sub + "\n" +
+		"c:\n\techo c\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", filepath.Join(dir, "mkfile"), env)
+
+	for i, want := range []struct {
+		shell   []string
+		dialect bool
+	}{
+		{[]string{"bash", "-c"}, false},
+		{[]string{"rc"}, true},
+		{[]string{"bash", "-c"}, false},
+	} {
+		r := &ruleSet.rules[i]
+		if !reflect.DeepEqual(r.shell, want.shell) || (r.dialect != nil) != want.dialect {
+			t.Errorf("%s: the shell is %q, with a dialect %v", r.describe(), r.shell, r.dialect != nil)
+		}
+	}
+
+	ruleSet = parseKeywordRule(t, "set x:V: y\n\techo $target\nset shell=bash -c\na:\n\techo a\n", "set")
+	if !reflect.DeepEqual(ruleSet.rules[1].shell, []string{"bash", "-c"}) {
+		t.Errorf("the shell after the rule is %q", ruleSet.rules[1].shell)
+	}
+}
+
+// A rule whose first target is a directive keyword is a rule, with or
+// without attributes and prerequisites.
+func TestParseDirectiveTargets(t *testing.T) {
+	for _, keyword := range slices.Sorted(maps.Keys(directives)) {
+		for _, line := range []string{keyword + " x:V:", keyword + " x:", keyword + " x:V: y z"} {
+			env := make(map[string][]string)
+			ruleSet := parse(strings.NewReader(line+"\n\techo $target\n"), "mkfile", "/mkfile", env)
+			if len(ruleSet.rules) != 1 {
+				t.Errorf("%q: got %d rules", line, len(ruleSet.rules))
+				continue
+			}
+			r := &ruleSet.rules[0]
+			if len(r.targets) != 2 || r.targets[0].spat != keyword || r.targets[1].spat != "x" {
+				t.Errorf("%q: the targets are %v", line, r.targets)
+			}
+			if r.recipe != "echo $target\n" {
+				t.Errorf("%q: the recipe is %q", line, r.recipe)
+			}
+		}
+	}
+}
+
+// Parse a mkfile using a directive next to a rule whose first target is its
+// keyword, checking the rule is there.
+func parseKeywordRule(t *testing.T, mkfileAsString, keyword string) *ruleSet {
+	t.Helper()
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	if !slices.ContainsFunc(ruleSet.rules, func(r rule) bool { return r.targets[0].spat == keyword }) {
+		t.Errorf("%q: no rule makes %s", mkfileAsString, keyword)
+	}
+	return ruleSet
+}
+
+// Rules guarded by another platform are left out.
+func TestParseGuard(t *testing.T) {
+	mkfileAsString := "[linux] a.o: a.c\n\tcc -c a.c\n" +
+		"[windows,darwin] b.o: b.c\n\tcl b.c\n" +
+		"[!linux/amd64] c.o: c.c\n\tcc -c c.c\n" +
+		"[arm64] d.o: d.c\n\tcc -c d.c\n" +
+		"[a-z].x:R:\n\ttouch $target\n"
+	env := map[string][]string{"MKOS": {"linux"}, "MKARCH": {"arm64"}}
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	var targets []string
+	for _, r := range ruleSet.rules {
+		targets = append(targets, r.targets[0].spat)
+	}
+	if want := []string{"a.o", "c.o", "d.o", "[a-z].x"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("the rules are for %q, expected %q", targets, want)
+	}
+}
+
+// Attributes spelled out, separated by blanks, and the long forms of S and P.
+func TestParseLongAttributes(t *testing.T) {
+	mkfileAsString := "somefile.txt:virtual quiet shell='bash -e' compare='cmp -s': a_prereq.csv\n\techo $target"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	rule := ruleSet.rules[0]
+	if got := rule.attributes.String(); got != "QV" {
+		t.Errorf("the attributes are %q, want QV", got)
+	}
+	if !reflect.DeepEqual(rule.shell, []string{"bash -e"}) {
+		t.Errorf("the shell is %q", rule.shell)
+	}
+	if !reflect.DeepEqual(rule.command, []string{"cmp -s"}) {
+		t.Errorf("the comparison command is %q", rule.command)
+	}
+	if !reflect.DeepEqual(rule.prereqs, []string{"a_prereq.csv"}) {
+		t.Errorf("the prerequisites are %q", rule.prereqs)
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	mkfileAsString := "# Links against the vendored libfoo,\n" +
+		"# which has to be built first.\n" +
+		"prog: a.o # not on a line of its own\n\tcc -o prog a.o\n" +
+		"a.o: a.h\n" +
+		"# after a rule without a recipe\n" +
+		"b.o: b.h\n" +
+		"# not attached, a blank line follows\n" +
+		"\n" +
+		"X = 1 # trailing\n" +
+		"c.o: c.h\n"
+	env := make(map[string][]string)
+	ruleSet := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	want := []string{"Links against the vendored libfoo,\nwhich has to be built first.", "",
+		"after a rule without a recipe", ""}
+	if len(ruleSet.rules) != len(want) {
+		t.Fatalf("There should be %d rules, got %d", len(want), len(ruleSet.rules))
+	}
+	for i := range want {
+		if got := ruleSet.rules[i].comment; got != want[i] {
+			t.Errorf("%s: comment is %q, want %q", ruleSet.rules[i].targets[0].spat, got, want[i])
+		}
+	}
+}
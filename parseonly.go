@@ -0,0 +1,60 @@
+// Parse-only mode: read the mkfiles and their includes and check the graph,
+// without building, reporting every syntax error rather than the first. It
+// suits a pre-commit hook for changes to mkfiles, so it runs no commands: the
+// output of '<|' includes is not read.
+
+package main
+
+import "fmt"
+
+var (
+	// Check the mkfiles instead of building.
+	parseOnly bool
+
+	// The syntax errors reported so far.
+	syntaxErrors int
+
+	// The commands of '<|', 'env <|' and 'reproducible <|' not run.
+	skippedCommands int
+)
+
+// Whether to skip running the command of an include: with --parse-only, so
+// that checking the mkfiles runs nothing.
+func skipCommand() bool {
+	if parseOnly {
+		skippedCommands++
+	}
+	return parseOnly
+}
+
+// Whether a syntax error is reported and parsing goes on, instead of ending
+// mk: with --parse-only, and when mk serve reads changed mkfiles again.
+func recoverSyntaxErrors() bool {
+	return parseOnly || reparsing
+}
+
+// Check the graph of the targets, or of the default ones, once the mkfiles
+// are parsed. Return the exit status.
+func checkMkfiles(rs *ruleSet, targets []string) int {
+	// the rules after an error are missing, the graph would be wrong
+	if syntaxErrors > 0 {
+		return 1
+	}
+	// and so are those the commands not run would have added
+	if skippedCommands > 0 {
+		mkPrintWarning(fmt.Sprintf("not checking the graph, the output of %d commands was not read", skippedCommands))
+		return 0
+	}
+
+	if len(targets) == 0 {
+		targets = defaultTargets(rs)
+	}
+	if len(targets) == 0 {
+		return 0
+	}
+	GlobalMkState = rs.vars
+	if !graphOf(rs, targets).checkPrereqs() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+// Dry runs: the targets recipes would make, so that the targets depending on
+// them, and the other targets of the same recipe, are planned as they would
+// be built. The files in a tree a recipe would make would exist too, so the
+// graph built after the setup rules can depend on what they generate.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// When the targets made by the recipes of the dry run would have been
+	// made.
+	planned      = make(map[string]time.Time)
+	plannedTrees []string // the targets planned that are trees
+	plannedMutex sync.Mutex
+)
+
+// Plan the targets of the recipe that made a target in a dry run.
+func planTargets(u *node, e *edge) {
+	plannedMutex.Lock()
+	defer plannedMutex.Unlock()
+	now := clock()
+	for _, name := range recipeTargets(u, e) {
+		planned[name] = now
+		if isTreeTarget(name, e.r) {
+			plannedTrees = append(plannedTrees, name)
+		}
+	}
+}
+
+// The targets of the recipe that made a target: the target, and the other
+// targets of its rule.
+func recipeTargets(u *node, e *edge) []string {
+	names := []string{u.name}
+	if e.r.attributes.virtual || e.r.attributes.regex {
+		return names
+	}
+	for _, p := range e.r.targets {
+		if e.r.ismeta && !p.issuffix {
+			continue
+		}
+		name := p.spat
+		if p.issuffix {
+			name = expandSuffixes(p.spat, e.stem)
+		}
+		if name != u.name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// When a target, or the tree holding a file, would have been made in the dry
+// run, if it would.
+func plannedTime(name string) (time.Time, bool) {
+	plannedMutex.Lock()
+	defer plannedMutex.Unlock()
+	if t, ok := planned[name]; ok {
+		return t, ok
+	}
+	for _, tree := range plannedTrees {
+		if isWithin(name, tree) {
+			return planned[tree], true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Forget the targets of a dry run, before building them for real.
+func forgetPlanned() {
+	plannedMutex.Lock()
+	planned, plannedTrees = make(map[string]time.Time), nil
+	plannedMutex.Unlock()
+}
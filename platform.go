@@ -0,0 +1,55 @@
+// The builtin variables describing the platform, and platform guards: rules
+// preceded by [os], [arch] or [os/arch] are only read on the platforms they
+// name.
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Set the builtin variables of the platform. The environment may set $MKOS,
+// $MKARCH and $MKHOST already, to build for another platform.
+func setBuiltinVars(vars map[string][]string) {
+	if len(vars["MKOS"]) == 0 {
+		vars["MKOS"] = []string{runtime.GOOS}
+	}
+	if len(vars["MKARCH"]) == 0 {
+		vars["MKARCH"] = []string{runtime.GOARCH}
+	}
+	if len(vars["MKHOST"]) == 0 {
+		if host, err := os.Hostname(); err == nil {
+			vars["MKHOST"] = []string{host}
+		}
+	}
+	vars["numcpu"] = []string{strconv.Itoa(runtime.NumCPU())}
+}
+
+// Whether a word is a platform guard, such as [linux] or [!windows,darwin].
+func isGuard(word string) bool {
+	return len(word) > 2 && strings.HasPrefix(word, "[") && strings.HasSuffix(word, "]") &&
+		!strings.ContainsAny(word[1:len(word)-1], "[]")
+}
+
+// Whether the platform of the variables satisfies a guard: one of the
+// platforms it names, separated by commas, is the one of the variables, and
+// none of those it negates with '!' is.
+func guardMatches(guard string, vars map[string][]string) bool {
+	goos, arch := strings.Join(vars["MKOS"], " "), strings.Join(vars["MKARCH"], " ")
+	matched, positive := false, false
+	for _, platform := range strings.Split(guard[1:len(guard)-1], ",") {
+		platform, negated := strings.CutPrefix(strings.TrimSpace(platform), "!")
+		is := platform == goos || platform == arch || platform == goos+"/"+arch
+		if negated && is {
+			return false
+		}
+		if !negated {
+			positive = true
+			matched = matched || is
+		}
+	}
+	return matched || !positive
+}
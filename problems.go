@@ -0,0 +1,127 @@
+// Compiler diagnostics in the output of recipes, collected with --problems
+// and shown again at the end of the build in one format.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// How to show the problems: gcc, go or json. Empty to not look for them.
+	problemsFormat string
+
+	// Problems found so far, in the order they were reported, each once.
+	problems      []problem
+	problemsSeen  = make(map[problem]bool)
+	problemsMutex sync.Mutex
+)
+
+// The formats of --problems.
+var problemFormats = []string{"gcc", "go", "json"}
+
+// A diagnostic reported by a recipe.
+type problem struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col,omitempty"`
+	Severity string `json:"severity"` // error, warning or note
+	Message  string `json:"message"`
+}
+
+// file:line:col: severity: message, as gcc, clang, go and many others print
+// them. The column and the severity are optional.
+var problemPattern = regexp.MustCompile(`^([^\s:]+):(\d+):(?:(\d+):)?\s*(?:(fatal error|error|warning|note):\s*)?(\S.*)$`)
+
+// Whether to look for problems in the output of recipes, to show them or to
+// annotate them.
+func lookForProblems() bool {
+	return problemsFormat != "" || ciPlatform != ""
+}
+
+// Parse a line of output, returning false if it is not a diagnostic.
+func parseProblem(line string) (problem, bool) {
+	m := problemPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+	if m == nil {
+		return problem{}, false
+	}
+	p := problem{File: filepath.Clean(m[1]), Severity: m[4], Message: m[5]}
+	p.Line, _ = strconv.Atoi(m[2])
+	p.Col, _ = strconv.Atoi(m[3])
+	switch p.Severity {
+	case "":
+		p.Severity = "error"
+	case "fatal error":
+		p.Severity = "error"
+	}
+
+	// names relative to the directory of the build, like those in the
+	// mkfile
+	if filepath.IsAbs(p.File) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, p.File); err == nil && !strings.HasPrefix(rel, "..") {
+				p.File = rel
+			}
+		}
+	}
+	return p, true
+}
+
+// Collect the problems in the output of a target's recipe, those that were
+// not reported before.
+func collectProblems(target string, output []byte) {
+	// compilers color their diagnostics on a terminal
+	output = maskSecrets(ansiEscape.ReplaceAll(output, nil))
+	for _, line := range strings.Split(string(output), "\n") {
+		p, ok := parseProblem(line)
+		if !ok {
+			continue
+		}
+		problemsMutex.Lock()
+		seen := problemsSeen[p]
+		if !seen {
+			problemsSeen[p] = true
+			problems = append(problems, p)
+		}
+		problemsMutex.Unlock()
+		if !seen {
+			publishEvent(apiEvent{Type: "problem", Target: target, Problem: &p})
+		}
+	}
+}
+
+// Write the problems in the given format.
+func writeProblems(w io.Writer, format string) error {
+	problemsMutex.Lock()
+	defer problemsMutex.Unlock()
+
+	enc := json.NewEncoder(w)
+	for _, p := range problems {
+		pos := fmt.Sprintf("%s:%d", p.File, p.Line)
+		if p.Col > 0 {
+			pos += fmt.Sprintf(":%d", p.Col)
+		}
+
+		var err error
+		switch format {
+		case "gcc":
+			_, err = fmt.Fprintf(w, "%s: %s: %s\n", pos, p.Severity, p.Message)
+		case "go":
+			_, err = fmt.Fprintf(w, "%s: %s\n", pos, p.Message)
+		case "json":
+			err = enc.Encode(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestProblems(t *testing.T) {
+	defer func() { problems, problemsSeen = nil, make(map[problem]bool) }()
+
+	output := "cc -c a.c\n" +
+		"a.c:3:5: error: 'x' undeclared\n" +
+		"./b.go:7:2: undefined: y\n" +
+		"a.c:9: warning: unused variable\n" +
+		"In file included from a.c:1:\n" +
+		"a.c:3:5: error: 'x' undeclared\n"
+	collectProblems("a.o", []byte(output))
+
+	for format, want := range map[string]string{
+		"gcc": "a.c:3:5: error: 'x' undeclared\nb.go:7:2: error: undefined: y\na.c:9: warning: unused variable\n",
+		"go":  "a.c:3:5: 'x' undeclared\nb.go:7:2: undefined: y\na.c:9: unused variable\n",
+		"json": `{"file":"a.c","line":3,"col":5,"severity":"error","message":"'x' undeclared"}` + "\n" +
+			`{"file":"b.go","line":7,"col":2,"severity":"error","message":"undefined: y"}` + "\n" +
+			`{"file":"a.c","line":9,"severity":"warning","message":"unused variable"}` + "\n",
+	} {
+		var b bytes.Buffer
+		if err := writeProblems(&b, format); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", format, b.String(), want)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	all := []problem{
+		{File: "mkfile", Line: 4, Severity: "error", Message: "recipe for a.o failed: exit status 1"},
+		{File: "a,b.c", Line: 3, Col: 5, Severity: "warning", Message: "100% wrong\nreally"},
+		{File: "a.c", Line: 9, Severity: "note", Message: "declared here"},
+	}
+	var b bytes.Buffer
+	if err := writeGithubAnnotations(&b, all); err != nil {
+		t.Fatal(err)
+	}
+	want := "::error file=mkfile,line=4::recipe for a.o failed: exit status 1\n" +
+		"::warning file=a%2Cb.c,line=3,col=5::100%25 wrong%0Areally\n" +
+		"::notice file=a.c,line=9::declared here\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	b.Reset()
+	if err := writeGitlabReport(&b, all); err != nil {
+		t.Fatal(err)
+	}
+	var issues []gitlabIssue
+	if err := json.Unmarshal(b.Bytes(), &issues); err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 3 || issues[0].Severity != "major" || issues[1].Severity != "minor" ||
+		issues[1].Location.Path != "a,b.c" || issues[1].Location.Lines.Begin != 3 || issues[0].Fingerprint == issues[1].Fingerprint {
+		t.Errorf("unexpected report %s", b.String())
+	}
+}
+
+func TestDetectCI(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "")
+	t.Setenv("GITLAB_CI", "true")
+	if p, _ := detectCI("auto"); p != "gitlab" {
+		t.Errorf("auto with GITLAB_CI: got %q", p)
+	}
+	if p, _ := detectCI("none"); p != "" {
+		t.Errorf("none: got %q", p)
+	}
+	if _, err := detectCI("jenkins"); err == nil {
+		t.Error("expected an error for an unknown platform")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// There are no process groups here.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Kill a process, the commands it started survive.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,96 @@
+// The status line, with --status-line: on a terminal, a single line counts the
+// recipes that finished and those that were started, and shows the last one
+// that started, ninja style. The output of recipes is printed above it once
+// they finished, the recipe itself only if it failed.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+var (
+	// Show the status line instead of the recipes.
+	statusLine bool
+
+	// The recipes started and finished, and what the line shows. Guarded by
+	// mkMsgMutex.
+	progressStarted  int
+	progressFinished int
+	progressLast     string
+	progressShown    bool
+)
+
+// Count a recipe as started, showing its first line.
+func progressStart(target, recipe string) {
+	if !statusLine {
+		return
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(recipe), "\n")
+	if line == "" {
+		line = target
+	}
+	mkMsgMutex.Lock()
+	progressStarted++
+	progressLast = line
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// Count a recipe as finished.
+func progressDone() {
+	if !statusLine {
+		return
+	}
+	mkMsgMutex.Lock()
+	progressFinished++
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// Show a status line a recipe reported as the line, until the next one.
+func progressStatus(target, status string) {
+	mkMsgMutex.Lock()
+	progressLast = target + ": " + status
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// Draw the status line over the previous one, cut to the width of the
+// terminal. Has to be called with mkMsgMutex held.
+func drawProgress() {
+	if !statusLine || progressStarted == 0 {
+		return
+	}
+	line := fmt.Sprintf("[%d/%d] %s", progressFinished, progressStarted, progressLast)
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 &&
+		utf8.RuneCountInString(line) >= width {
+		line = string([]rune(line)[:width-1])
+	}
+	fmt.Printf("\r\x1b[K%s", line)
+	progressShown = true
+}
+
+// Erase the status line, to print a message in its place. Has to be called
+// with mkMsgMutex held, and followed by drawProgress.
+func clearProgress() {
+	if progressShown {
+		os.Stdout.WriteString("\r\x1b[K")
+		progressShown = false
+	}
+}
+
+// Leave the last status line once the build is done.
+func endProgress() {
+	mkMsgMutex.Lock()
+	if progressShown {
+		os.Stdout.WriteString("\n")
+		progressShown = false
+	}
+	mkMsgMutex.Unlock()
+}
@@ -0,0 +1,189 @@
+// --stdin-protocol: builds driven by an editor over stdin and stdout. Messages
+// are framed as in the language server protocol: a Content-Length header, an
+// empty line and the JSON.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Speak the protocol instead of building.
+	stdinProtocol bool
+
+	// Set when the build is cancelled, recipes that did not start yet fail.
+	buildCancelled atomic.Bool
+
+	// Whether recipes run in a process group of their own, for a cancel to
+	// kill the commands they started. Only when the build can be
+	// cancelled, to leave them in that of the terminal otherwise.
+	recipeGroups bool
+
+	// The processes of the recipes that are running.
+	runningProcs = make(map[*os.Process]bool)
+	procsMutex   sync.Mutex
+)
+
+// A request from the editor.
+type protocolRequest struct {
+	ID      int      `json:"id"`
+	Method  string   `json:"method"`            // "build", "cancel" or "diagnostics"
+	Targets []string `json:"targets,omitempty"` // to build, the default ones if empty
+}
+
+// A message to the editor: the response to a request, or an event of the
+// build.
+type protocolMessage struct {
+	ID          int                  `json:"id,omitempty"` // of the request answered
+	Build       *apiBuild            `json:"build,omitempty"`
+	Diagnostics []protocolDiagnostic `json:"diagnostics,omitempty"`
+	Problems    []problem            `json:"problems,omitempty"` // with --problems
+	Event       *apiEvent            `json:"event,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+// A recipe that failed in the last build, with its output.
+type protocolDiagnostic struct {
+	Target string `json:"target"`
+	Rule   string `json:"rule"`
+	Status int    `json:"status"` // exit status, -1 if the shell could not be run
+	Output string `json:"output"`
+}
+
+// Remember the process of a recipe, to kill it on cancel. The returned
+// function forgets it.
+func trackProcess(p *os.Process) func() {
+	procsMutex.Lock()
+	runningProcs[p] = true
+	procsMutex.Unlock()
+	return func() {
+		procsMutex.Lock()
+		delete(runningProcs, p)
+		procsMutex.Unlock()
+	}
+}
+
+// Cancel the build: kill the recipes that are running, and fail those that
+// were still to run.
+func cancelBuild() {
+	buildCancelled.Store(true)
+	procsMutex.Lock()
+	defer procsMutex.Unlock()
+	for p := range runningProcs {
+		killProcessGroup(p)
+	}
+}
+
+// Read a message framed by its Content-Length.
+func readMessage(r *bufio.Reader, v any) error {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Write a message framed by its Content-Length.
+func writeMessage(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// Answer the requests read from in until it ends, writing the responses and
+// the events of the builds to out. Anything else mk or the recipes print has
+// to go elsewhere.
+func serveProtocol(rs *ruleSet, in io.Reader, out io.Writer) int {
+	s := newAPIServer(rs)
+	recipeGroups = true
+	defer func() { api, recipeGroups = nil, false }()
+
+	var outMutex sync.Mutex
+	send := func(m protocolMessage) {
+		outMutex.Lock()
+		defer outMutex.Unlock()
+		if err := writeMessage(out, m); err != nil {
+			mkPrintError(fmt.Sprintf("writing a message: %v", err))
+		}
+	}
+
+	events := make(chan apiEvent, 256)
+	s.mu.Lock()
+	s.clients[events] = true
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		for ev := range events {
+			send(protocolMessage{Event: &ev})
+		}
+		close(done)
+	}()
+
+	r := bufio.NewReader(in)
+	for {
+		var req protocolRequest
+		if err := readMessage(r, &req); err == io.EOF {
+			break
+		} else if err != nil {
+			mkPrintError(fmt.Sprintf("reading a request: %v", err))
+			break
+		}
+
+		switch req.Method {
+		case "build":
+			b, err := s.start(req.Targets)
+			if err != nil {
+				send(protocolMessage{ID: req.ID, Error: err.Error()})
+				continue
+			}
+			send(protocolMessage{ID: req.ID, Build: &b})
+		case "cancel":
+			cancelBuild()
+			send(protocolMessage{ID: req.ID})
+		case "diagnostics":
+			heldMutex.Lock()
+			diagnostics := []protocolDiagnostic{}
+			for _, f := range heldFailures {
+				diagnostics = append(diagnostics, protocolDiagnostic{f.target, f.rule, f.status, string(f.output)})
+			}
+			heldMutex.Unlock()
+			problemsMutex.Lock()
+			found := slices.Clone(problems)
+			problemsMutex.Unlock()
+			send(protocolMessage{ID: req.ID, Diagnostics: diagnostics, Problems: found})
+		default:
+			send(protocolMessage{ID: req.ID, Error: fmt.Sprintf("unknown method %q", req.Method)})
+		}
+	}
+
+	// let a running build finish, the editor may be waiting for it
+	s.builds.Wait()
+
+	s.mu.Lock()
+	delete(s.clients, events)
+	s.mu.Unlock()
+	close(events)
+	<-done
+	return 0
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run mk with the requests, returning the messages it sent back.
+func runProtocol(t *testing.T, mkfile string, requests ...protocolRequest) []protocolMessage {
+	t.Helper()
+	var in bytes.Buffer
+	for _, req := range requests {
+		if err := writeMessage(&in, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return runProtocolFrom(t, mkfile, &in)
+}
+
+// Run mk with the requests read from in.
+func runProtocolFrom(t *testing.T, mkfile string, in io.Reader) []protocolMessage {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	defer func(d string) { stateDir = d }(stateDir)
+	stateDir = filepath.Join(dir, ".mk")
+	defer func(n int, sh string, held bool) {
+		subprocsAllowed, defaultShell, failuresAtEnd = n, sh, held
+	}(subprocsAllowed, defaultShell, failuresAtEnd)
+	subprocsAllowed, defaultShell, failuresAtEnd = 1, "sh -c", true
+
+	if err := os.WriteFile("mkfile", []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs := parse(strings.NewReader(mkfile), "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string))
+
+	var out bytes.Buffer
+	if status := serveProtocol(rs, in, &out); status != 0 {
+		t.Errorf("the exit status is %d", status)
+	}
+
+	var messages []protocolMessage
+	r := bufio.NewReader(&out)
+	for {
+		var m protocolMessage
+		if err := readMessage(r, &m); err != nil {
+			break
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestProtocolBuild(t *testing.T) {
+	messages := runProtocol(t, "bad:V:\n\techo oops; exit 3\n",
+		protocolRequest{ID: 1, Method: "build", Targets: []string{"bad"}},
+		protocolRequest{ID: 2, Method: "nonsense"})
+
+	var started, failed, unknown bool
+	for _, m := range messages {
+		switch {
+		case m.ID == 1 && m.Build != nil:
+			started = true
+		case m.ID == 2 && m.Error != "":
+			unknown = true
+		case m.Event != nil && m.Event.Type == "build" && m.Event.State == "failed":
+			failed = true
+		}
+	}
+	if !started || !failed || !unknown {
+		t.Errorf("started %v, failed %v, unknown method reported %v: %+v", started, failed, unknown, messages)
+	}
+	if len(heldFailures) != 1 || string(heldFailures[0].output) != "oops\n" {
+		t.Errorf("the failure is not kept for the diagnostics: %+v", heldFailures)
+	}
+}
+
+// Requests read once a file exists, like one a recipe creates when it starts.
+type readerAfter struct {
+	name string
+	r    io.Reader
+}
+
+func (ra readerAfter) Read(p []byte) (int, error) {
+	for range 500 {
+		if _, err := os.Stat(ra.name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ra.r.Read(p)
+}
+
+// Cancelling kills the recipe with the commands it started, which would keep
+// its output open.
+func TestProtocolCancel(t *testing.T) {
+	var build, cancel bytes.Buffer
+	writeMessage(&build, protocolRequest{ID: 1, Method: "build", Targets: []string{"slow"}})
+	writeMessage(&cancel, protocolRequest{ID: 2, Method: "cancel"})
+
+	start := time.Now()
+	messages := runProtocolFrom(t, "slow:V:\n\ttouch started; sleep 10; echo slept\n",
+		io.MultiReader(&build, readerAfter{"started", &cancel}))
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the build was not cancelled")
+	}
+	last := messages[len(messages)-1]
+	if last.Event == nil || last.Event.Type != "build" || last.Event.State != "failed" {
+		t.Errorf("the last message is %+v", last)
+	}
+}
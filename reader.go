@@ -15,15 +15,26 @@ type reader struct {
 	begin int
 	end   int
 
-	value    []rune // token beginning
-	pos      int    // position within input
-	line     int    // line within input
-	col      int    // column within input
-	indented bool   // true if the only whitespace so far on this line
+	value     []rune // token beginning
+	pos       int    // position within input
+	line      int    // line within input
+	col       int    // column within input
+	indented  bool   // true if the only whitespace so far on this line
+	linestart rune   // first character of the current line
 }
 
 func newReader(rd io.Reader) *reader {
-	return &reader{rd: rd, buf: make([]byte, 1024), line: 1, indented: true}
+	l := &reader{rd: rd, buf: make([]byte, 1024), line: 1, indented: true}
+	l.skipBOM()
+	return l
+}
+
+// Skip a UTF-8 byte order mark at the beginning of the input.
+func (l *reader) skipBOM() {
+	if l.peek() == '\uFEFF' {
+		_, w := utf8.DecodeRune(l.window())
+		l.begin += w
+	}
 }
 
 // Return the nth character without advancing.
@@ -56,6 +67,10 @@ func (l *reader) next() rune {
 	l.pos++
 	l.value = append(l.value, c)
 
+	if l.col == 0 {
+		l.linestart = c
+	}
+
 	if c == '\n' {
 		l.col = 0
 		l.line++
@@ -74,14 +89,24 @@ func (l *reader) window() []byte {
 	return l.buf[l.begin:l.end]
 }
 
-func (l *reader) runecount() int {
-	return utf8.RuneCount(l.window())
+/* returns if the window holds at least count complete runes, a multibyte sequence
+ * cut off at the end of the window is not counted */
+func (l *reader) buffered(count int) bool {
+	win := l.window()
+	for ; count > 0; count-- {
+		if !utf8.FullRune(win) {
+			return false
+		}
+		_, w := utf8.DecodeRune(win)
+		win = win[w:]
+	}
+	return true
 }
 
 /* ensures at least n runes in the window, returns if it were possible to fill the buffer */
 func (l *reader) ensure(count int) bool {
 	/* if the buffer is big enough, that will do */
-	for l.runecount() < count && l.end-l.begin < len(l.buf) {
+	for !l.buffered(count) && l.end-l.begin < len(l.buf) {
 		if l.begin > 0 {
 			copy(l.buf, l.window())
 			l.end -= l.begin
@@ -96,5 +121,5 @@ func (l *reader) ensure(count int) bool {
 		}
 		l.end += n
 	}
-	return l.runecount() >= count
+	return l.buffered(count)
 }
@@ -4,11 +4,18 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -59,10 +66,26 @@ func printIndented(out io.Writer, s string, ind int) {
 	}
 }
 
-// Execute a recipe.
-func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
+// Construct the environment of a command: the environment of mk followed by
+// the variables, sorted by name so that it is the same on every run. Lists are
+// joined with sep.
+func environ(vars map[string][]string, sep string) []string {
+	env := os.Environ()
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		env = append(env, k+"="+strings.Join(vars[k], sep))
+	}
+	return env
+}
+
+// The variables naming the target of a recipe, its stem and its prerequisites.
+// The variables of a batch, if not nil, override those of the target.
+func recipeVars(target string, u *node, e *edge, batch map[string][]string) map[string][]string {
 	vars := make(map[string][]string)
 	vars["target"] = []string{target}
+	if e.r.mkfile != "" {
+		vars["mkfile"] = []string{e.r.mkfile}
+		vars["mkfiledir"] = []string{filepath.Dir(e.r.mkfile)}
+	}
 	if e.r.ismeta {
 		if e.r.attributes.regex {
 			for i := range e.matches {
@@ -79,27 +102,164 @@ func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
 
 	var prereqs []string
 	for i := range u.prereqs {
-		if u.prereqs[i].r == e.r && u.prereqs[i].v != nil {
+		if u.prereqs[i].r == e.r && u.prereqs[i].v != nil && !u.prereqs[i].discovered {
 			prereqs = append(prereqs, u.prereqs[i].v.name)
 			vars[fmt.Sprintf("prereq%d", i+1)] = []string{u.prereqs[i].v.name}
 		}
 	}
 	vars["prereq"] = prereqs
+	maps.Copy(vars, batch)
+	return vars
+}
+
+// Set the variables a recipe is expanded with past those of recipeVars: the
+// names from the directory of another project, whose recipe runs there, and
+// the shell, which is returned with its arguments.
+func finishRecipeVars(r *rule, vars map[string][]string) (string, []string) {
+	if r.dir != "" {
+		for k := range vars {
+			if k == "target" || strings.TrimRight(k, "0123456789") == "prereq" {
+				vars[k] = projectPaths(r.dir, vars[k])
+			}
+		}
+	}
 
-	// Setup the shell in vars.
 	sh, args := expandShell(defaultShell, []string{})
-	if len(e.r.shell) > 0 {
-		sh, args = expandShell(e.r.shell[0], e.r.shell[1:])
+	if len(r.shell) > 0 {
+		sh, args = expandShell(r.shell[0], r.shell[1:])
 	}
 	vars["shell"] = append([]string{sh}, args...)
+	return sh, args
+}
+
+// The recipe of a target as dorecipe executes it.
+func expandedRecipe(target string, u *node, e *edge) string {
+	vars := recipeVars(target, u, e, nil)
+	finishRecipeVars(e.r, vars)
+	return expandRecipeSigils(e.r.recipe, vars)
+}
+
+// Execute a recipe. The variables of a batch, if not nil, override those of
+// the target: its recipe makes all of the targets of the batch at once.
+func dorecipe(target string, u *node, e *edge, dryrun bool, batch map[string][]string) bool {
+	vars := recipeVars(target, u, e, batch)
+	targets := vars["target"]
+
+	if strictNames {
+		for _, name := range append(slices.Clone(targets), vars["prereq"]...) {
+			if strings.ContainsAny(name, shellMetaRunes) {
+				mkPrintError(fmt.Sprintf("%s: name %q contains shell metacharacters", target, name))
+				return false
+			}
+		}
+	}
+
+	// A target that is a source, which only a meta-rule matches, is most
+	// likely a typo, don't clobber it. Nor a tree holding sources.
+	for _, name := range targets {
+		if !allowSourceOverwrite && !e.r.attributes.virtual &&
+			((u.exists || batch != nil) && !listedAsGenerated(name, u, e) && isTrackedByGit(name) ||
+				isTreeTarget(name, e.r) && isTreeTrackedByGit(name)) {
+			mkPrintError(fmt.Sprintf("refusing to overwrite %s, which is tracked by git "+
+				"(use --allow-source-overwrite if this is intended)", name))
+			return false
+		}
+	}
+
+	sh, args := finishRecipeVars(e.r, vars)
 
 	// Build the command.
 	input := expandRecipeSigils(e.r.recipe, vars)
 
-	mkPrintRecipe(target, input, e.r.attributes.quiet)
+	if scriptOut != nil {
+		writeScriptRecipe(scriptOut, e.r, sh, args, vars, input)
+		return true
+	}
+
+	// the standard output and error of the recipe, held back apart with
+	// that of failures or --output-sync, and the recipe, shown with them
+	// unless the status line stands for it and the recipe succeeded
+	var output, errors, header bytes.Buffer
+	synced := !dryrun && syncOutput()
+	succeeded, flushed := false, false
+	flush := func() {
+		if synced && !flushed {
+			if !succeeded || !statusLine {
+				header.Write(output.Bytes())
+				output = header
+			}
+			showOutput(buildOutput, output.Bytes())
+			showOutput(os.Stderr, errors.Bytes())
+			flushed = true
+		}
+	}
+	if synced {
+		writeRecipe(&header, target, input, e.r.attributes.quiet)
+		progressStart(target, input)
+		defer progressDone()
+		defer flush()
+	} else {
+		mkPrintRecipe(target, input, e.r.attributes.quiet)
+	}
 	if dryrun {
 		return true
 	}
+	if buildCancelled.Load() {
+		mkPrintError(fmt.Sprintf("recipe for %s not executed, the build was cancelled", target))
+		return false
+	}
+
+	for _, name := range targets {
+		if trash && !e.r.attributes.virtual {
+			if err := trashTarget(name); err != nil {
+				mkPrintError(fmt.Sprintf("keeping the previous version of %s: %v", name, err))
+				return false
+			}
+		}
+
+		if e.r.targetMode() != "" && !e.r.attributes.virtual {
+			if err := makeWritable(name); err != nil {
+				mkPrintError(fmt.Sprintf("making %s writable: %v", name, err))
+				return false
+			}
+		}
+		if isTreeTarget(name, e.r) {
+			if err := clearTree(name); err != nil {
+				mkPrintError(fmt.Sprintf("removing the tree %s: %v", name, err))
+				return false
+			}
+		}
+	}
+
+	slot := takeSlot()
+	defer freeSlot(slot)
+	start, exitStatus := time.Now(), -1
+	defer func() {
+		if succeeded {
+			exitStatus = 0
+		}
+		traceRecipe(slot, target, e.r, u.seq, start, !succeeded)
+		recordTime(target, time.Since(start), exitStatus)
+	}()
+	vars["nproc"] = []string{strconv.Itoa(slot)}
+	vars["NPROC"] = []string{strconv.Itoa(subprocsAllowed)}
+	vars["MKLEVEL"] = []string{strconv.Itoa(mkLevel + 1)}
+	u.seq = nextSeq()
+	vars["MKBUILDID"] = []string{buildID}
+	vars["MKSEQ"] = []string{u.seq}
+
+	// the jobs the recipe may run itself: all of them for an exclusive
+	// recipe, those that are free with the J attribute, or one
+	jobs := 1
+	if e.r.attributes.exclusive {
+		jobs = subprocsAllowed
+	} else if e.r.attributes.parallel {
+		claimed := claimFreeSubprocs()
+		defer releaseSubprocs(claimed)
+		jobs += claimed
+	}
+	vars["MKJOBS"] = []string{strconv.Itoa(jobs)}
+	vars["pid"] = []string{strconv.Itoa(os.Getpid())}
 
 	// Merge and construct the execution environment for this recipe.
 	for k, v := range GlobalMkState {
@@ -108,20 +268,261 @@ func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
 		}
 	}
 
-	env := os.Environ()
-	for k, v := range vars {
-		env = append(env, k+"="+strings.Join(v, shellDelimiter))
+	// the file given by stdin=, checked before anything runs
+	var stdin string
+	if e.r.stdin != "" {
+		stdin = strings.Join(expand(e.r.stdin, vars, false), " ")
+		if e.r.dir != "" && !filepath.IsAbs(stdin) {
+			stdin = filepath.Join(e.r.dir, stdin)
+		}
+		if info, err := os.Stat(stdin); err != nil || info.IsDir() {
+			mkPrintError(fmt.Sprintf("recipe for %s reads %s, which is not a file", target, stdin))
+			return false
+		}
 	}
 
-	cmd := exec.Command(sh, args...)
-	cmd.Env = env
-	cmd.Stdin = strings.NewReader(input)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		//fmt.Fprintf(os.Stderr, "command failed: %v\n", err)
+	// a directory of its own for temporary files, kept if the recipe fails
+	tmp, err := os.MkdirTemp("", "mk")
+	if err != nil {
+		mkPrintError(fmt.Sprintf("creating the temporary directory of %s: %v", target, err))
 		return false
 	}
+	vars["MKTMP"] = []string{tmp}
+	defer func() {
+		if succeeded {
+			os.RemoveAll(tmp)
+		} else {
+			mkPrintWarning(fmt.Sprintf("keeping %s, the temporary directory of %s", tmp, target))
+		}
+	}()
+
+	env := environ(vars, e.r.delimiter())
+
+	// the output captured into the target, renamed over it once complete
+	var captured *os.File
+	if e.r.attributes.capture && !e.r.attributes.virtual && batch == nil {
+		captured, err = os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target))
+		if err != nil {
+			mkPrintError(fmt.Sprintf("capturing the output of %s: %v", target, err))
+			return false
+		}
+		defer func() {
+			if captured != nil {
+				captured.Close()
+				os.Remove(captured.Name())
+			}
+		}()
+	}
 
+	// the output shown, up to --max-output-per-recipe
+	var limit *outputLimit
+	if maxRecipeOutput > 0 {
+		if limit, err = newOutputLimit(target); err != nil {
+			mkPrintError(fmt.Sprintf("keeping the output of %s: %v", target, err))
+			return false
+		}
+		defer limit.close()
+	}
+
+	scripts := []string{input}
+	if e.r.perLineShell() {
+		scripts = recipeLines(input)
+	}
+	var stdout, stderr bytes.Buffer // copies to look for problems in
+	if lookForProblems() {
+		defer func() {
+			collectProblems(target, output.Bytes())
+			collectProblems(target, errors.Bytes())
+			collectProblems(target, stdout.Bytes())
+			collectProblems(target, stderr.Bytes())
+		}()
+	}
+	// both, in the order they came, for the report of a failure
+	var both lockedBuffer
+	var traces []string // logs of strace, with --unused-prereqs
+	for _, script := range scripts {
+		cmd := exec.Command(sh, args...)
+		cmd.Env = env
+		cmd.Dir = e.r.dir
+		cmd.Stdin = strings.NewReader(script)
+		if stdin != "" {
+			// the shell reads the script from a file then
+			f, err := stdinScript(cmd, tmp, script, stdin)
+			if err != nil {
+				mkPrintError(fmt.Sprintf("recipe for %s: %v", target, err))
+				return false
+			}
+			defer f.Close()
+		}
+		cmd.Stdout = strippedWriter("terminal", maskedWriter(buildOutput))
+		cmd.Stderr = strippedWriter("terminal", maskedWriter(os.Stderr))
+		if failuresAtEnd {
+			cmd.Stdout = io.MultiWriter(&output, &both)
+			cmd.Stderr = io.MultiWriter(&errors, &both)
+		} else if synced {
+			cmd.Stdout = &output
+			cmd.Stderr = &errors
+		} else if lookForProblems() {
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, &stdout)
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+		}
+		if limit != nil {
+			cmd.Stdout = limit.writer(cmd.Stdout)
+			cmd.Stderr = limit.writer(cmd.Stderr)
+		}
+		if captured != nil {
+			cmd.Stdout = captured
+		}
+		if unusedPrereqs {
+			traces = append(traces, filepath.Join(tmp, fmt.Sprintf("trace.%d", len(traces))))
+			if err := traceReads(cmd, traces[len(traces)-1]); err != nil {
+				mkPrintError(fmt.Sprintf("recipe for %s: %v", target, err))
+				return false
+			}
+		}
+		started := time.Now()
+		err := runWithStatus(cmd, u, e.r.recipeUmask())
+		u.usage.add(cmd.ProcessState)
+		exitStatus = exitCode(err)
+		logCommand(target, u.seq, script, started, exitStatus)
+		if err != nil {
+			msg := fmt.Sprintf("recipe for %s failed: %v", target, err)
+			if e.r.owner != "" {
+				msg += fmt.Sprintf(" (target maintained by %s)", e.r.owner)
+			}
+			if e.r.comment != "" {
+				msg += "\n" + indentComment(e.r.comment, "  ")
+			}
+			flush()
+			mkPrintError(msg)
+			annotateFailure(e.r, fmt.Sprintf("recipe for %s failed: %v", target, err))
+			if failuresAtEnd {
+				holdFailure(recipeFailure{target, e.r.describe(), e.r.owner, exitStatus, both.Bytes()})
+			}
+			return false
+		}
+	}
+
+	if captured != nil {
+		err := captured.Chmod(0644)
+		if closeErr := captured.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(captured.Name(), target)
+		}
+		if err != nil {
+			mkPrintError(fmt.Sprintf("writing the output of %s: %v", target, err))
+			return false
+		}
+		captured = nil
+	}
+
+	if unusedPrereqs {
+		read := map[string]bool{}
+		for _, trace := range traces {
+			if err := readTrace(trace, e.r.dir, read); err != nil {
+				mkPrintWarning(fmt.Sprintf("reading the trace of %s: %v", target, err))
+			}
+		}
+		recordUnread(target, unreadPrereqs(u, e, read))
+	}
+
+	// the output of a recipe that succeeded is shown in one piece
+	if failuresAtEnd {
+		showOutput(buildOutput, output.Bytes())
+		showOutput(os.Stderr, errors.Bytes())
+	}
+	succeeded = true
+	flush()
 	return true
 }
+
+// Show the output of a recipe that was held back on w, in one piece.
+func showOutput(w io.Writer, output []byte) {
+	if len(output) == 0 {
+		return
+	}
+	mkMsgMutex.Lock()
+	clearProgress()
+	w.Write(stripFor("terminal", maskSecrets(output)))
+	drawProgress()
+	mkMsgMutex.Unlock()
+}
+
+// A buffer the standard output and error of a recipe are both written to,
+// from the goroutines copying each.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Bytes()
+}
+
+// The paths of files from the directory of a project, instead of the working
+// directory.
+func projectPaths(dir string, names []string) []string {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = name
+		if filepath.IsAbs(name) || strings.Contains(name, "://") {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, name); err == nil {
+			paths[i] = filepath.ToSlash(rel)
+		}
+	}
+	return paths
+}
+
+// Give a command the file of stdin= as its input, passing it the script as
+// an argument instead: as that of -c for a shell run with it, otherwise as a
+// file in the temporary directory of the recipe. The file opened has to be
+// closed once the command is done.
+func stdinScript(cmd *exec.Cmd, tmp, script, stdin string) (*os.File, error) {
+	arg := script
+	if len(cmd.Args) < 2 || cmd.Args[len(cmd.Args)-1] != "-c" {
+		arg = filepath.Join(tmp, "recipe")
+		if err := os.WriteFile(arg, []byte(script), 0600); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(stdin)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = append(cmd.Args, arg)
+	cmd.Stdin = f
+	return f, nil
+}
+
+// Split a recipe into its lines, to run each of them in its own shell. A line
+// ending in a backslash continues on the next one.
+func recipeLines(recipe string) []string {
+	var lines []string
+	var line strings.Builder
+	for s := range strings.Lines(recipe) {
+		line.WriteString(s)
+		if strings.HasSuffix(strings.TrimRight(s, "\r\n"), "\\") {
+			continue
+		}
+		if strings.TrimSpace(line.String()) != "" {
+			lines = append(lines, line.String())
+		}
+		line.Reset()
+	}
+	if strings.TrimSpace(line.String()) != "" {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnviron(t *testing.T) {
+	vars := map[string][]string{
+		"target": {"a"},
+		"prereq": {"b", "c"},
+		"CC":     {"cc"},
+		"stem":   {""},
+	}
+	want := []string{"CC=cc", "prereq=b\x01c", "stem=", "target=a"}
+
+	for i := range 10 {
+		got := environ(vars, "\x01")[len(os.Environ()):]
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestRecipeLines(t *testing.T) {
+	recipe := "cd src\n\n./configure \\\n\t--prefix=/usr\nmake\n"
+	want := []string{"cd src\n", "./configure \\\n\t--prefix=/usr\n", "make\n"}
+	if got := recipeLines(recipe); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRuleDelimiter(t *testing.T) {
+	defer func(sh string) { defaultShell = sh }(defaultShell)
+	defaultShell = "sh -c"
+
+	for _, test := range []struct {
+		shell []string
+		want  string
+	}{
+		{nil, ":"},
+		{[]string{"rc"}, "\x01"},
+		{[]string{"/usr/local/plan9/bin/rc", "-e"}, "\x01"},
+		{[]string{"bash"}, ":"},
+	} {
+		r := rule{shell: test.shell}
+		if got := r.delimiter(); got != test.want {
+			t.Errorf("shell %q: lists are joined with %q, want %q", test.shell, got, test.want)
+		}
+	}
+
+	// a value containing ':' survives in a list given to rc
+	got := environ(map[string][]string{"path": {"a:b", "c"}}, (&rule{shell: []string{"rc"}}).delimiter())
+	if last := got[len(got)-1]; last != "path=a:b\x01c" {
+		t.Errorf("got %q", last)
+	}
+}
@@ -0,0 +1,182 @@
+// Reading the mkfiles again while mk serve runs: every few seconds, and before
+// a build starts, the mkfile and its includes are checked for changes. Changed
+// ones are read again, the rules compared with those before, and the targets
+// whose rules changed, with those depending on them, reported as out of date.
+// The new rules are served from then on, without restarting mk serve. Rules
+// with a syntax error are reported, and the previous ones kept.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// Read the mkfiles again as main read them first, nil if mk did not
+	// read them from files.
+	readMkfiles func() (*ruleSet, error)
+
+	// Set while the mkfiles are read again, a syntax error is reported
+	// rather than ending mk then.
+	reparsing bool
+
+	// How often mk serve checks the mkfiles for changes.
+	reloadInterval = 2 * time.Second
+)
+
+// The modification time and size of a mkfile, to tell it changed.
+type mkfileStamp struct {
+	t    time.Time
+	size int64
+}
+
+// The stamps of the mkfiles a rule set was read from.
+func mkfileStamps(rs *ruleSet) map[string]mkfileStamp {
+	stamps := make(map[string]mkfileStamp)
+	for _, path := range rs.mkfiles {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = mkfileStamp{info.ModTime(), info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Read the mkfiles again, failing on a syntax error.
+func reparseMkfiles() (*ruleSet, error) {
+	errors := syntaxErrors
+	reparsing = true
+	defer func() { reparsing = false }()
+	rs, err := readMkfiles()
+	if err != nil {
+		return nil, err
+	}
+	if syntaxErrors > errors {
+		return nil, fmt.Errorf("the mkfiles have %d syntax errors, keeping the rules as they were", syntaxErrors-errors)
+	}
+	return rs, nil
+}
+
+// Read the mkfiles again if they changed since the rules served were, unless
+// a build is running, and serve the new rules. Return the targets that are
+// out of date because their rules changed, and whether the mkfiles were read.
+func (s *apiServer) reload() ([]string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if readMkfiles == nil || s.build != nil && s.build.State == "running" {
+		return nil, false, nil
+	}
+	stamps := mkfileStamps(s.rs)
+	if maps.Equal(stamps, s.stamps) {
+		return nil, false, nil
+	}
+	// a mkfile with an error is not read again until it changes
+	s.stamps = stamps
+	rs, err := reparseMkfiles()
+	if err != nil {
+		return nil, false, err
+	}
+	changed := changedTargets(s.rs, rs)
+	s.rs, s.stamps = rs, mkfileStamps(rs)
+	GlobalMkState = rs.vars
+	return changed, true, nil
+}
+
+// Check the mkfiles for changes until mk serve ends, reporting the targets
+// whose rules changed to the terminal and to the clients of the API.
+func (s *apiServer) watchMkfiles() {
+	for range time.Tick(reloadInterval) {
+		s.reportReload(s.reload())
+	}
+}
+
+// Report the mkfiles were read again, if they were.
+func (s *apiServer) reportReload(changed []string, reloaded bool, err error) {
+	if err != nil {
+		mkPrintError(err.Error())
+		return
+	}
+	if !reloaded {
+		return
+	}
+	if len(changed) == 0 {
+		fmt.Println("mk: read the mkfiles again, no rules changed")
+	} else {
+		fmt.Printf("mk: read the mkfiles again, out of date as their rules changed: %s\n", strings.Join(changed, " "))
+	}
+	publishEvent(apiEvent{Type: "reload", Targets: changed})
+}
+
+// The targets of the rules read again whose rules differ from before, or are
+// new, and those depending on them, sorted.
+func changedTargets(old, rs *ruleSet) []string {
+	before := make(map[string]string)
+	for name, u := range fullGraph(old).nodes {
+		before[name] = nodeFingerprint(u)
+	}
+
+	g := fullGraph(rs)
+	dependents := make(map[*node][]*node)
+	var changed []*node
+	for name, u := range g.nodes {
+		if name == "" {
+			continue
+		}
+		for _, e := range u.prereqs {
+			if e.v != nil {
+				dependents[e.v] = append(dependents[e.v], u)
+			}
+		}
+		if fp, ok := before[name]; !ok && len(u.prereqs) > 0 || ok && fp != nodeFingerprint(u) {
+			changed = append(changed, u)
+		}
+	}
+
+	dirty := make(map[string]bool)
+	for len(changed) > 0 {
+		u := changed[len(changed)-1]
+		changed = changed[:len(changed)-1]
+		if u.name == "" || dirty[u.name] {
+			continue
+		}
+		dirty[u.name] = true
+		changed = append(changed, dependents[u]...)
+	}
+	return slices.Sorted(maps.Keys(dirty))
+}
+
+// What makes a target: its prerequisites and the rules they come from, but
+// not where the rules are written.
+func nodeFingerprint(u *node) string {
+	var b strings.Builder
+	for _, e := range u.prereqs {
+		if e.v != nil {
+			fmt.Fprintf(&b, "%q ", e.v.name)
+		}
+		fmt.Fprintf(&b, "%s\x00", ruleFingerprint(e.r))
+	}
+	return b.String()
+}
+
+// Everything about a rule that changes what its recipe makes, but not its
+// location or documentation.
+func ruleFingerprint(r *rule) string {
+	var b strings.Builder
+	for _, p := range append(slices.Clone(r.targets), r.exclusions...) {
+		fmt.Fprintf(&b, "%q %v ", p.spat, p.issuffix)
+		if p.rpat != nil {
+			fmt.Fprintf(&b, "%q ", p.rpat.String())
+		}
+	}
+	fmt.Fprintf(&b, "%+v %q %q %q %q %q %q %q %q %q %q %q %q %q",
+		r.attributes, r.prereqs, r.shell, r.recipe, r.command, r.envdeps, r.contents,
+		r.umask, r.mode, r.expect, r.stdin, r.depfile, r.delegate, r.dir)
+	if r.dialect != nil {
+		fmt.Fprintf(&b, " %+v", *r.dialect)
+	}
+	return b.String()
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"time"
@@ -12,50 +11,60 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-// for files that are http(s) urls, use the Last-Modified header
-func updateHTTPTimestamp(u *node) {
-	resp, err := http.Head(u.name)
-	if err != nil {
-		log.Fatal(err)
-	}
-	lastModified := resp.Header.Get("Last-Modified")
-	if lastModified == "" {
-		// no Last-Modified header so lets assume that it
-		// is very old - but still exists
-		u.t = time.Unix(0, 0)
-		u.exists = true
-		u.flags |= nodeFlagProbable
-	} else {
-		tmptime, err := time.Parse(time.RFC1123, lastModified)
+// Files that are http(s) urls, use the Last-Modified header.
+type httpStat struct{}
+
+func (httpStat) stat(names []string) ([]fileStat, error) {
+	return statConcurrently(names, func(name string) (fileStat, error) {
+		resp, err := http.Head(name)
 		if err != nil {
-			log.Fatal(err)
+			return fileStat{}, err
 		}
-		u.t = tmptime
-		u.exists = true
-		u.flags |= nodeFlagProbable
-	}
+		resp.Body.Close()
+
+		lastModified := resp.Header.Get("Last-Modified")
+		st := fileStat{exists: true, version: resp.Header.Get("ETag")}
+		if st.version == "" {
+			st.version = lastModified
+		}
+		if lastModified == "" {
+			// no Last-Modified header so lets assume that it
+			// is very old - but still exists
+			st.t = time.Unix(0, 0)
+		} else {
+			st.t, err = time.Parse(time.RFC1123, lastModified)
+			if err != nil {
+				return fileStat{}, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return st, nil
+	})
 }
 
-func updateS3Timestamp(u *node, uri *url.URL) {
+// Objects in s3, all looked up in one session.
+type s3Stat struct{}
+
+func (s3Stat) stat(names []string) ([]fileStat, error) {
 	ses, err := session.NewSession()
 	if err != nil {
-		panic(fmt.Errorf("unable to create a session: %w", err))
+		return nil, fmt.Errorf("unable to create a session: %w", err)
 	}
 	svc := s3.New(ses)
-	input := &s3.HeadObjectInput{
-		Bucket: aws.String(uri.Host),
-		Key:    aws.String(uri.Path[1:]),
-	}
 
-	result, err := svc.HeadObject(input)
-	if err != nil {
-		u.t = time.Unix(0, 0)
-		u.exists = false
+	return statConcurrently(names, func(name string) (fileStat, error) {
+		uri, err := url.Parse(name)
+		if err != nil {
+			return fileStat{}, err
+		}
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(uri.Host),
+			Key:    aws.String(uri.Path[1:]),
+		}
 
-	} else {
-		u.t = *result.LastModified
-		u.exists = true
-	}
-	u.flags |= nodeFlagProbable
-	//fmt.Println(result)
+		result, err := svc.HeadObject(input)
+		if err != nil {
+			return missingStat, nil
+		}
+		return fileStat{t: *result.LastModified, exists: true}, nil
+	})
 }
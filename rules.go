@@ -7,6 +7,8 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -21,11 +23,102 @@ type attribSet struct {
 	update          bool // treat the targets as if they were updated
 	virtual         bool // rule is virtual (does not match files)
 	exclusive       bool // don't execute concurrently with any other rule
+	capture         bool // mk writes the output of the recipe to the target
+	batch           bool // one recipe makes all the targets that are out of date
+	parallel        bool // the recipe takes the free job slots, for tools running jobs of their own
+	keepgoing       bool // failures among the prerequisites don't stop the rest of them
+	setup           bool // made before any other recipe starts
+}
+
+// The attributes as they are written in a rule, by their letters.
+func (a attribSet) String() string {
+	var b strings.Builder
+	for _, attr := range []struct {
+		set    bool
+		letter byte
+	}{
+		{a.delFailed, 'D'},
+		{a.nonstop, 'E'},
+		{a.forcedTimestamp, 'N'},
+		{a.nonvirtual, 'n'},
+		{a.quiet, 'Q'},
+		{a.regex, 'R'},
+		{a.update, 'U'},
+		{a.virtual, 'V'},
+		{a.exclusive, 'X'},
+		{a.capture, 'C'},
+		{a.batch, 'B'},
+		{a.parallel, 'J'},
+		{a.keepgoing, 'K'},
+		{a.setup, 'I'},
+	} {
+		if attr.set {
+			b.WriteByte(attr.letter)
+		}
+	}
+	return b.String()
+}
+
+// The long names of the attributes, by which they can be written instead of
+// their letters.
+var attribNames = map[string]rune{
+	"delete":     'D',
+	"nonstop":    'E',
+	"touch":      'N',
+	"nonvirtual": 'n',
+	"quiet":      'Q',
+	"regex":      'R',
+	"update":     'U',
+	"virtual":    'V',
+	"exclusive":  'X',
+	"capture":    'C',
+	"batch":      'B',
+	"parallel":   'J',
+	"keepgoing":  'K',
+	"setup":      'I',
 }
 
 // Error parsing an attribute
 type attribError struct {
-	found rune
+	found      string // the unknown letter or name
+	suggestion string // a known attribute that was likely meant, or ""
+}
+
+// Set the attribute with the given letter, returning false if there is none.
+func (a *attribSet) set(c rune) bool {
+	switch c {
+	case 'D':
+		a.delFailed = true
+	case 'E':
+		a.nonstop = true
+	case 'N':
+		a.forcedTimestamp = true
+	case 'n':
+		a.nonvirtual = true
+	case 'Q':
+		a.quiet = true
+	case 'R':
+		a.regex = true
+	case 'U':
+		a.update = true
+	case 'V':
+		a.virtual = true
+	case 'X':
+		a.exclusive = true
+	case 'C':
+		a.capture = true
+	case 'B':
+		a.batch = true
+	case 'J':
+		a.parallel = true
+	case 'K':
+		a.keepgoing = true
+	case 'I':
+		a.setup = true
+	default:
+		return false
+	}
+	return true
 }
 
 // target and rereq patterns
@@ -35,6 +128,40 @@ type pattern struct {
 	rpat     *regexp.Regexp // non-nil if this is a regexp pattern
 }
 
+// Compile the pattern of a target in the namespace with the prefix: a regular
+// expression for the R attribute, or a name that may contain a '%'.
+func newPattern(prefix, s string, regex bool) (pattern, error) {
+	p := pattern{spat: prefix + s}
+	if regex {
+		rpat, err := regexp.Compile("^" + regexp.QuoteMeta(prefix) + s + "$")
+		if err != nil {
+			return p, fmt.Errorf("invalid regular expression: %q", err)
+		}
+		p.rpat = rpat
+		return p, nil
+	}
+
+	s = prefix + s
+	idx := strings.IndexRune(s, '%')
+	if idx < 0 {
+		return p, nil
+	}
+	var left, right string
+	if idx > 0 {
+		left = regexp.QuoteMeta(s[:idx])
+	}
+	if idx < len(s)-1 {
+		right = regexp.QuoteMeta(s[idx+1:])
+	}
+	rpat, err := regexp.Compile(fmt.Sprintf("^%s(.*)%s$", left, right))
+	if err != nil {
+		return p, fmt.Errorf("error compiling suffix rule. This is a bug. Error: %s", err)
+	}
+	p.rpat = rpat
+	p.issuffix = true
+	return p, nil
+}
+
 // Match a pattern, returning an array of submatches,
 // or nil if it doesn't match.
 func (p *pattern) match(target string) []string {
@@ -60,6 +187,26 @@ type rule struct {
 	ismeta     bool      // is this a meta rule
 	file       string    // file where the rule is defined
 	line       int       // line number on which the rule is defined
+	mkfile     string    // path of the mkfile defining the rule, $mkfile in its recipe
+	owner      string    // who maintains the targets, from owner=
+	doc        string    // description from '##' comments
+	comment    string    // the '#' comments right above the rule
+	envdeps    []string  // variables the targets depend on, from 'depends-env'
+	dialect    *dialect  // from 'set dialect=', nil for the one of the command line
+	contents   []string  // globs of the files counting in directory prerequisites
+	umask      string    // the recipe runs with, from umask= or 'set umask='
+	mode       string    // given to the targets, from mode= or 'set mode='
+	expect     []string  // what the targets are once made, from expect=
+	stdin      string    // file the recipe reads, from stdin=, expanded when it runs
+	depfile    string    // file of further prerequisites the recipe writes, from depfile=
+	delegate   string    // root of the project of the workspace whose mk makes the targets
+	dir        string    // directory of the project of the rule, the recipe runs in it
+	exclusions []pattern // targets a meta-rule does not make, from '!pattern' prerequisites
+}
+
+// Whether a target matching a meta-rule is excluded from it.
+func (r *rule) excluded(target string) bool {
+	return slices.ContainsFunc(r.exclusions, func(p pattern) bool { return p.match(target) != nil })
 }
 
 // Equivalent recipes.
@@ -87,32 +234,77 @@ type ruleSet struct {
 	rules []rule
 	// map a target to an array of indexes into rules
 	targetrules map[string][]int
+	// namespace blocks that are currently open, innermost last
+	namespaces []*namespace
+	// presets declared with 'preset name: targets'
+	presets map[string]*preset
+	// variables that assignments in the mkfile do not change
+	overrides map[string][]string
+	// settings of the mkfile being parsed, from 'set'
+	settings fileSettings
+	// absolute paths of the mkfiles being parsed, the outermost first
+	including []string
+	// absolute paths of every mkfile read, for mk serve to tell they changed
+	mkfiles []string
+	// directory of the project being parsed, from the working directory and
+	// with a trailing '/', empty for that of the mkfile
+	project string
+	// absolute directories of the projects read, or being read, the working
+	// directory being that of the mkfile
+	projects map[string]bool
+}
+
+// Settings made with 'set', which last until the end of the mkfile that
+// makes them and apply to the files it includes.
+type fileSettings struct {
+	shell   []string // shell of the rules without an S attribute
+	dialect *dialect // nil for the dialect of the command line
+	umask   string   // of the recipes of rules without umask=
+	mode    string   // of the targets of rules without mode=
 }
 
-// Read attributes for an array of strings, updating the rule.
+// A named set of targets and variables, selected with --preset.
+type preset struct {
+	targets []string
+	vars    map[string][]string
+}
+
+// A block opened with 'namespace name {'. Targets declared inside get the
+// prefix 'name/', and assignments inside are undone when the block is closed.
+type namespace struct {
+	prefix   string              // prefix including the enclosing namespaces
+	opener   *parser             // parser of the file that opened the block
+	first    int                 // index of the first rule in the block
+	declared map[string]bool     // targets declared in the block, without prefix
+	vars     map[string][]string // variables to restore on closing
+}
+
+// Return the prefix for targets declared at this point.
+func (rs *ruleSet) namespacePrefix() string {
+	if len(rs.namespaces) == 0 {
+		return rs.project
+	}
+	return rs.namespaces[len(rs.namespaces)-1].prefix
+}
+
+// Read attributes for an array of strings, updating the rule. A string is
+// either letters, or long names separated by commas.
 func (r *rule) parseAttribs(inputs []string) *attribError {
 	for i, input := range inputs {
+		if isAttribNames(input) {
+			for _, name := range strings.Split(input, ",") {
+				c, ok := attribNames[name]
+				if !ok {
+					return &attribError{name, suggestAttrib(name)}
+				}
+				r.attributes.set(c)
+			}
+			continue
+		}
+
 		for pos, c := range input {
 			w := utf8.RuneLen(c)
 			switch c {
-			case 'D':
-				r.attributes.delFailed = true
-			case 'E':
-				r.attributes.nonstop = true
-			case 'N':
-				r.attributes.forcedTimestamp = true
-			case 'n':
-				r.attributes.nonvirtual = true
-			case 'Q':
-				r.attributes.quiet = true
-			case 'R':
-				r.attributes.regex = true
-			case 'U':
-				r.attributes.update = true
-			case 'V':
-				r.attributes.virtual = true
-			case 'X':
-				r.attributes.exclusive = true
 			case 'P':
 				if pos+w < len(input) {
 					r.command = append(r.command, input[pos+w:])
@@ -128,7 +320,9 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 				return nil
 
 			default:
-				return &attribError{c}
+				if !r.attributes.set(c) {
+					return &attribError{string(c), suggestAttrib(string(c))}
+				}
 			}
 		}
 	}
@@ -136,6 +330,66 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 	return nil
 }
 
+// Whether attributes are written by their long names: a list separated by
+// commas, or a word in lower case, which can't be letters.
+func isAttribNames(input string) bool {
+	if strings.ContainsRune(input, ',') {
+		return true
+	}
+	if utf8.RuneCountInString(input) < 2 {
+		return false
+	}
+	for _, c := range input {
+		if !unicode.IsLower(c) && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Suggest the attribute that was likely meant by an unknown one: the letter
+// in the other case, or the closest long name.
+func suggestAttrib(found string) string {
+	if c, w := utf8.DecodeRuneInString(found); w == len(found) {
+		for _, other := range []rune{unicode.ToUpper(c), unicode.ToLower(c)} {
+			if other != c && (&attribSet{}).set(other) {
+				return string(other)
+			}
+		}
+		return ""
+	}
+
+	best, bestDist := "", 3
+	for name := range attribNames {
+		if d := editDistance(found, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// The Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range ra {
+		cur[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
 // Add a rule to the rule set.
 func (rs *ruleSet) add(r rule) {
 	rs.rules = append(rs.rules, r)
@@ -172,6 +426,10 @@ func (rs *ruleSet) executeAssignment(ts []token) *assignmentError {
 			fmt.Sprintf("target of assignment is not a valid variable name: \"%s\"", assignee),
 			ts[0]}
 	}
+	if _, ok := rs.overrides[assignee]; ok {
+		debugAssign(assignee, rs.vars[assignee], true, rs.vars[assignee], "set on the command line, ignored")
+		return nil
+	}
 
 	// interpret tokens in assignment context
 	var input []string
@@ -193,7 +451,21 @@ func (rs *ruleSet) executeAssignment(ts []token) *assignmentError {
 		vals = append(vals, expand(str, rs.vars, true)...)
 	}
 
+	old, had := rs.vars[assignee]
+	debugAssign(assignee, old, had, vals, "")
 	rs.vars[assignee] = vals
 
 	return nil
 }
+
+// Assign a variable imported with 'env <|', logging where it comes from with
+// --debug-vars.
+func (rs *ruleSet) importVar(name, value, origin string) {
+	if _, ok := rs.overrides[name]; ok {
+		debugAssign(name, rs.vars[name], true, rs.vars[name], "set on the command line, ignored")
+		return
+	}
+	old, had := rs.vars[name]
+	debugAssign(name, old, had, []string{value}, "from "+origin)
+	rs.vars[name] = []string{value}
+}
@@ -17,3 +17,33 @@ func TestMatchMetaRule(t *testing.T) {
 		t.Error("failed to match regular expression")
 	}
 }
+
+func TestParseAttribs(t *testing.T) {
+	for _, test := range []struct {
+		inputs     []string
+		want       string // the attributes by their letters
+		found      string
+		suggestion string
+	}{
+		{[]string{"VQ"}, "QV", "", ""},
+		{[]string{"virtual,quiet"}, "QV", "", ""},
+		{[]string{"nonvirtual"}, "n", "", ""},
+		{[]string{"Vq"}, "", "q", "Q"},
+		{[]string{"Vz"}, "", "z", ""},
+		{[]string{"Vk"}, "", "k", "K"},
+		{[]string{"virtaul,quiet"}, "", "virtaul", "virtual"},
+		{[]string{"quite"}, "", "quite", "quiet"},
+		{[]string{"bogus,quiet"}, "", "bogus", ""},
+	} {
+		var r rule
+		err := r.parseAttribs(test.inputs)
+		switch {
+		case test.found == "" && err != nil:
+			t.Errorf("%q: unexpected error for %q", test.inputs, err.found)
+		case test.found == "" && r.attributes.String() != test.want:
+			t.Errorf("%q: got attributes %q, want %q", test.inputs, r.attributes.String(), test.want)
+		case test.found != "" && (err == nil || err.found != test.found || err.suggestion != test.suggestion):
+			t.Errorf("%q: got error %+v, want %q suggesting %q", test.inputs, err, test.found, test.suggestion)
+		}
+	}
+}
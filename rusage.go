@@ -0,0 +1,70 @@
+// Resources used by recipes, as reported by the operating system once they
+// exited.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Resources used by a recipe, for all its shells.
+type resourceUsage struct {
+	user   time.Duration // CPU time in user mode
+	sys    time.Duration // CPU time in the kernel
+	maxRSS int64         // largest resident set size, in bytes
+}
+
+var (
+	// Resources used by all recipes of the build, with the largest
+	// resident set size of any of them.
+	totalUsage resourceUsage
+	usageMutex sync.Mutex
+
+	// Rules warned about using too much memory, by location.
+	memoryWarned = make(map[string]bool)
+)
+
+// Add the resources used by an exited process.
+func (ru *resourceUsage) add(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	ru.user += state.UserTime()
+	ru.sys += state.SystemTime()
+	ru.maxRSS = max(ru.maxRSS, maxRSS(state))
+}
+
+// Account for the resources used by a recipe. Warn, once per rule, if it
+// needs more memory than there is when as many run as -j allows.
+func recordUsage(r *rule, ru resourceUsage) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	totalUsage.user += ru.user
+	totalUsage.sys += ru.sys
+	totalUsage.maxRSS = max(totalUsage.maxRSS, ru.maxRSS)
+
+	total := totalMemory()
+	where := r.describe()
+	if total > 0 && ru.maxRSS*int64(subprocsAllowed) > total && !memoryWarned[where] {
+		memoryWarned[where] = true
+		mkPrintWarning(fmt.Sprintf("%s uses %s of memory, times -j %d exceeds the %s of memory",
+			where, formatBytes(ru.maxRSS), subprocsAllowed, formatBytes(total)))
+	}
+}
+
+// Format a size in bytes for humans.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// The largest resident set size is not known here.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,122 @@
+// mk script: the recipes of a build as a shell script, to replay it where
+// there is no mk.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Where the recipes go instead of being executed, while writing a script.
+var scriptOut io.Writer
+
+// The directory the script starts in, and the one it is in after the recipes
+// written so far.
+var scriptRoot, scriptDir string
+
+// Names sh accepts for exported variables.
+var shellVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Write a recipe to the script, run by the same shell with the same
+// variables. A failing recipe stops the script.
+func writeScriptRecipe(w io.Writer, r *rule, sh string, args []string, vars map[string][]string, input string) {
+	scripts := []string{input}
+	if r.perLineShell() {
+		scripts = recipeLines(input)
+	}
+
+	var command strings.Builder
+	command.WriteString("env")
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		command.WriteString(" " + shquote(k+"="+strings.Join(vars[k], r.delimiter())))
+	}
+	command.WriteString(" " + shquote(sh))
+	for _, arg := range args {
+		command.WriteString(" " + shquote(arg))
+	}
+
+	// secrets are not written, the script has to get them itself
+	commandLine := string(maskSecrets([]byte(command.String())))
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+	fmt.Fprintf(w, "\n# %s\n", r.describe())
+	// the recipe of another project runs in its directory
+	dir := scriptRoot
+	if r.dir != "" {
+		dir = r.dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(scriptRoot, dir)
+		}
+	}
+	if dir != scriptDir {
+		fmt.Fprintf(w, "cd %s || exit\n", shquote(dir))
+		scriptDir = dir
+	}
+	for _, script := range scripts {
+		script = string(maskSecrets([]byte(script)))
+		if !strings.HasSuffix(script, "\n") {
+			script += "\n"
+		}
+		delim := "MKEOF"
+		for strings.HasPrefix(script, delim+"\n") || strings.Contains(script, "\n"+delim+"\n") {
+			delim += "_"
+		}
+		fmt.Fprintf(w, "%s <<'%s' || exit\n%s%s\n", commandLine, delim, script, delim)
+	}
+}
+
+// mk script [target...]: print a POSIX shell script executing the recipes a
+// dry run would, in the same order.
+func cmdScript(rs *ruleSet, args []string) int {
+	targets := args
+	if len(targets) == 0 {
+		targets = defaultTargets(rs)
+	}
+	if len(targets) == 0 {
+		mkPrintError("nothing to mk")
+		return 1
+	}
+
+	root := rule{targets: []pattern{{spat: ""}}, prereqs: targets}
+	root.attributes.virtual = true
+	rs.add(root)
+	GlobalMkState = rs.vars
+
+	g := buildgraph(rs, "")
+	if !g.checkPrereqs() {
+		return 1
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	wd, _ := os.Getwd()
+	fmt.Fprintf(w, "#!/bin/sh\n# Generated by mk script, executes the recipes for: %s\n", strings.Join(targets, " "))
+	fmt.Fprintf(w, "cd %s || exit\n", shquote(wd))
+	scriptRoot, scriptDir = wd, wd
+
+	// the variables of the mkfile, those of the environment are inherited
+	for _, k := range slices.Sorted(maps.Keys(rs.vars)) {
+		value := strings.Join(rs.vars[k], shellDelimiter)
+		if env, ok := os.LookupEnv(k); (!ok || env != value) && shellVarName.MatchString(k) {
+			fmt.Fprintf(w, "export %s=%s\n", k, maskSecrets([]byte(shquote(value))))
+		}
+	}
+
+	scriptOut = w
+	mkNode(g, g.root, true, true)
+	if err := w.Flush(); err != nil {
+		mkPrintError(err.Error())
+		return 1
+	}
+	if g.root.status == nodeStatusFailed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+// mk serve: the dependency graph over HTTP, and with --ui a page rendering it
+// in the browser.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// Serve the page rendering the graph too, not just graph.json.
+	serveUI bool
+
+	// Address mk serve listens on.
+	listenAddr string
+)
+
+//go:embed serve.html
+var servePage []byte
+
+// A target as served in graph.json: as exported by --graph json, with its
+// state and the last time its recipe ran.
+type servedTarget struct {
+	exportedTarget
+	Exists    bool           `json:"exists"`
+	OutOfDate bool           `json:"out_of_date"`
+	Source    string         `json:"source,omitempty"` // the rule as written
+	Last      *explainRecord `json:"last,omitempty"`
+}
+
+// The graph of every target, as it is now.
+func servedGraph(rs *ruleSet) ([]servedTarget, error) {
+	forgetStats()
+	g := fullGraph(rs)
+
+	records, err := readExplainLog()
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[string]*explainRecord)
+	for i := range records {
+		last[records[i].Target] = &records[i]
+	}
+
+	outofdate := make(map[*node]bool)
+	var visit func(u *node) bool
+	visit = func(u *node) bool {
+		if stale, ok := outofdate[u]; ok {
+			return stale
+		}
+		outofdate[u] = false
+		stale, recipe := false, false
+		for _, e := range u.prereqs {
+			recipe = recipe || e.r.recipe != ""
+			if e.v != nil && (visit(e.v) || (!u.virtual && e.v.t.After(u.t))) {
+				stale = true
+			}
+		}
+		if recipe && !u.virtual && !u.exists {
+			stale = true
+		}
+		outofdate[u] = stale
+		return stale
+	}
+
+	var targets []servedTarget
+	for _, t := range exportGraph(g).Targets {
+		u := g.nodes[t.Name]
+		st := servedTarget{exportedTarget: t, Exists: u.exists, OutOfDate: visit(u), Last: last[t.Name]}
+		for _, e := range u.prereqs {
+			if e.r.file != "" {
+				st.Source = ruleSource(e.r)
+			}
+		}
+		targets = append(targets, st)
+	}
+	return targets, nil
+}
+
+// Read a rule as it is written in its mkfile: the line with its targets and
+// the indented lines following it. Rules that were not read from a file, from
+// a '<|' include for example, have no source.
+func ruleSource(r *rule) string {
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(data), "\n")
+	if r.line < 1 || r.line > len(lines) {
+		return ""
+	}
+
+	end := r.line
+	for end < len(lines) && (strings.HasPrefix(lines[end], " ") || strings.HasPrefix(lines[end], "\t") ||
+		strings.HasSuffix(lines[end-1], "\\")) {
+		end++
+	}
+	return strings.Join(lines[r.line-1:end], "\n") + "\n"
+}
+
+// The handler of mk serve. Stats and the explain log are shared with the rest
+// of mk, so requests for the graph are answered one at a time. Builds started
+// through the API report to it while they run.
+func serveHandler(rs *ruleSet, ui bool) http.Handler {
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	s := newAPIServer(rs)
+	s.routes(mux)
+	mux.HandleFunc("GET /graph.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		targets, err := servedGraph(s.rules())
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Targets []servedTarget `json:"targets"`
+		}{targets})
+	})
+	if ui {
+		mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(servePage)
+		})
+	}
+	return mux
+}
+
+// mk serve: serve the graph and the API until interrupted.
+func cmdServe(rs *ruleSet, args []string) int {
+	if !checkArgs("serve", args, 0, 0, "") {
+		return 2
+	}
+
+	// whoever can reach mk, a page in a browser on this machine too, can
+	// run the recipes, so every request needs the token
+	token := os.Getenv("MK_SERVE_TOKEN")
+	if token == "" {
+		token = newToken()
+		fmt.Printf("mk: the token for the API is %s\n", token)
+	}
+	handler := requireToken(token, checkOrigin(listenAddr, serveHandler(rs, serveUI)))
+
+	go api.watchMkfiles()
+
+	if serveUI {
+		fmt.Printf("mk: serving the graph on http://%s/?token=%s\n", listenAddr, token)
+	} else {
+		fmt.Printf("mk: serving the graph on http://%s/graph.json\n", listenAddr)
+	}
+	if err := http.ListenAndServe(listenAddr, handler); err != nil {
+		mkPrintError(err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeGraph(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	defer func(d string) { stateDir = d }(stateDir)
+	stateDir = filepath.Join(dir, ".mk")
+
+	mkfile := "prog: a.o\n\tcc -o prog a.o\n%.o: %.c\n\tcc -c $stem.c\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": "", "a.o": ""} {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes("a.o", later, later); err != nil {
+		t.Fatal(err)
+	}
+	rs := parse(strings.NewReader(mkfile), "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string))
+	handler := serveHandler(rs, false)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/graph.json", nil))
+	var g struct{ Targets []servedTarget }
+	if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil {
+		t.Fatalf("the graph is not JSON: %v\n%s", err, w.Body)
+	}
+	want := map[string]bool{"a.c": false, "a.o": false, "prog": true}
+	for _, target := range g.Targets {
+		if stale, ok := want[target.Name]; !ok || target.OutOfDate != stale {
+			t.Errorf("%s: out of date is %v", target.Name, target.OutOfDate)
+		}
+		if target.Name == "prog" && target.Source != "prog: a.o\n\tcc -o prog a.o\n" {
+			t.Errorf("the source of prog is %q", target.Source)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 404 {
+		t.Errorf("the page is served without --ui")
+	}
+}
+
+func TestServeAPI(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	defer func(d string) { stateDir = d }(stateDir)
+	stateDir = filepath.Join(dir, ".mk")
+	defer func() { api = nil }()
+	defer func(n int, sh string) { subprocsAllowed, defaultShell = n, sh }(subprocsAllowed, defaultShell)
+	subprocsAllowed, defaultShell = 1, "sh -c"
+
+	mkfile := "out:\n\techo built > out\nbad:V:\n\tfalse\n"
+	if err := os.WriteFile("mkfile", []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs := parse(strings.NewReader(mkfile), "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string))
+	handler := requireToken("secret", checkOrigin("localhost:8080", serveHandler(rs, false)))
+	request := func(method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.Host = "localhost:8080"
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request("GET", "/api/targets"))
+	if w.Code != 401 {
+		t.Errorf("a request without the token is answered with %d", w.Code)
+	}
+
+	// requests another site could make from a browser
+	for _, tc := range []struct {
+		name, host, origin, header string
+	}{
+		{"rebound host", "evil.example:8080", "", "1"},
+		{"foreign origin", "localhost:8080", "http://evil.example", "1"},
+		{"plain form", "localhost:8080", "", ""},
+	} {
+		r := request("POST", "/api/build?target=out&token=secret")
+		r.Host = tc.host
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.header != "" {
+			r.Header.Set("Mk-Request", tc.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != 403 {
+			t.Errorf("a request with a %s is answered with %d", tc.name, w.Code)
+		}
+	}
+	if _, err := os.Stat("out"); err == nil {
+		t.Fatal("a request of another site built out")
+	}
+
+	// build a target and wait for the build to finish
+	build := func(target string) apiBuild {
+		t.Helper()
+		r := request("POST", "/api/build?target="+target)
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Mk-Request", "1")
+		r.Header.Set("Origin", "http://127.0.0.1:8080")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != 202 {
+			t.Fatalf("starting a build: %d %s", w.Code, w.Body)
+		}
+		for range 100 {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request("GET", "/api/status?token=secret"))
+			var b apiBuild
+			if err := json.Unmarshal(w.Body.Bytes(), &b); err != nil {
+				t.Fatalf("the status is not JSON: %v\n%s", err, w.Body)
+			}
+			if b.State != "running" {
+				return b
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("the build of %s did not finish", target)
+		return apiBuild{}
+	}
+
+	if b := build("out"); b.State != "done" || b.ID != 1 {
+		t.Errorf("the build of out is %+v", b)
+	}
+	if _, err := os.Stat("out"); err != nil {
+		t.Errorf("out was not built: %v", err)
+	}
+	if b := build("bad"); b.State != "failed" || !slices.Equal(b.Failed, []string{"bad"}) {
+		t.Errorf("the build of bad is %+v", b)
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	defer func() { api, readMkfiles = nil, nil }()
+	defer func(n int) { syntaxErrors = n }(syntaxErrors)
+
+	mkfile := "prog: a.o b.o\n\tcc -o prog a.o b.o\n<rules.mk\n"
+	rules := "a.o: a.c\n\tcc -c a.c\nb.o: b.c\n\tcc -c b.c\n"
+	write := func(name, content string, age time.Duration) {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("mkfile", mkfile, time.Hour)
+	write("rules.mk", rules, time.Hour)
+	readMkfiles = func() (*ruleSet, error) {
+		input, err := os.Open("mkfile")
+		if err != nil {
+			return nil, err
+		}
+		defer input.Close()
+		return parse(input, "mkfile", filepath.Join(dir, "mkfile"), make(map[string][]string)), nil
+	}
+	rs, _ := readMkfiles()
+	s := newAPIServer(rs)
+
+	if _, reloaded, err := s.reload(); reloaded || err != nil {
+		t.Fatalf("the mkfiles are read again unchanged: %v", err)
+	}
+
+	// the recipe of a.o changes in the include, prog depends on it
+	write("rules.mk", strings.Replace(rules, "cc -c a.c", "cc -O2 -c a.c", 1), 0)
+	changed, reloaded, err := s.reload()
+	if !reloaded || err != nil {
+		t.Fatalf("the changed include is not read again: %v", err)
+	}
+	if strings.Join(changed, " ") != "a.o prog" {
+		t.Errorf("out of date as their rules changed: %v", changed)
+	}
+	if rs := s.rules(); !strings.Contains(rs.rules[rs.targetrules["a.o"][0]].recipe, "-O2") {
+		t.Errorf("the new rules are not served")
+	}
+
+	// only moving a rule changes nothing
+	write("mkfile", "\n"+mkfile, 0)
+	if changed, _, _ := s.reload(); len(changed) != 0 {
+		t.Errorf("moving a rule changed %v", changed)
+	}
+
+	// a syntax error keeps the rules
+	before := s.rules()
+	write("mkfile", "prog: a.o\n\tcc\n<\n", time.Minute)
+	if _, _, err := s.reload(); err == nil {
+		t.Errorf("no error for a syntax error")
+	}
+	if s.rules() != before {
+		t.Errorf("the rules with a syntax error are served")
+	}
+}
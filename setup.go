@@ -0,0 +1,34 @@
+// Setup rules, with the I attribute: their targets, such as a toolchain to
+// fetch or a header with the version, are made before any other recipe starts,
+// without being prerequisites of every rule.
+
+package main
+
+// Make the targets of the setup rules, in a build of their own before the
+// others. Returns false if one of them failed.
+func runSetup(rs *ruleSet, dryrun bool) bool {
+	var setup []string
+	for i := range rs.rules {
+		if r := &rs.rules[i]; r.attributes.setup && !r.ismeta {
+			for _, t := range r.targets {
+				setup = append(setup, t.spat)
+			}
+		}
+	}
+	if len(setup) == 0 {
+		return true
+	}
+
+	// the root depends on the setup targets for this build
+	root := &rs.rules[rs.targetrules[""][0]]
+	targets := root.prereqs
+	root.prereqs = setup
+	defer func() { root.prereqs = targets }()
+
+	g := buildgraph(rs, "")
+	if !g.checkPrereqs() {
+		return false
+	}
+	mkNode(g, g.root, dryrun, true)
+	return g.root.status != nodeStatusFailed
+}
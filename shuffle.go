@@ -0,0 +1,59 @@
+// Shuffling the order in which the prerequisites of a target are started,
+// with --shuffle, to shake out rules that depend on the order of others
+// without saying so.
+
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+)
+
+var (
+	// Shuffle the prerequisites.
+	shuffle bool
+
+	// The seed of the shuffle, printed so a failure can be reproduced.
+	shuffleSeed uint64
+)
+
+// The value of --shuffle: a seed, or random for a new one.
+type shuffleValue struct{}
+
+func (shuffleValue) String() string {
+	if !shuffle {
+		return ""
+	}
+	return strconv.FormatUint(shuffleSeed, 10)
+}
+
+func (shuffleValue) Set(s string) error {
+	shuffle = true
+	if s == "random" {
+		shuffleSeed = rand.Uint64()
+		return nil
+	}
+	seed, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	shuffleSeed = seed
+	return nil
+}
+
+func (shuffleValue) Type() string {
+	return "seed"
+}
+
+// The prerequisites of a target in the order of the seed. Each target has its
+// own order, so that it does not depend on when the others get theirs.
+func shuffled(target string, prereqs []*node) []*node {
+	h := fnv.New64a()
+	h.Write([]byte(target))
+	prereqs = slices.Clone(prereqs)
+	r := rand.New(rand.NewPCG(shuffleSeed, h.Sum64()))
+	r.Shuffle(len(prereqs), func(i, j int) { prereqs[i], prereqs[j] = prereqs[j], prereqs[i] })
+	return prereqs
+}
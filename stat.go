@@ -0,0 +1,254 @@
+// Looking up whether targets exist and when they were modified. Names with a
+// scheme, like s3://bucket/key, are looked up by the provider registered for
+// it, other names are local files.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a provider knows about a name.
+type fileStat struct {
+	t       time.Time // modification time, zero time if it does not exist
+	exists  bool
+	version string // identifies the contents, like an ETag, if known
+}
+
+// Looks up the stats of names, in batches so a provider can combine or
+// parallelize its requests.
+type statProvider interface {
+	stat(names []string) ([]fileStat, error)
+}
+
+// Providers by scheme, the empty scheme is local files.
+var statProviders = map[string]statProvider{
+	"":      localStat{},
+	"http":  httpStat{},
+	"https": httpStat{},
+	"s3":    s3Stat{},
+}
+
+var (
+	// Stats looked up, until a recipe makes the name or changes the
+	// directory holding it.
+	statCache      = make(map[string]fileStat)
+	statCacheMutex sync.Mutex
+)
+
+var (
+	// How symbolic links are looked up, the --symlinks option: "follow" to
+	// the file they point to, or as the "link" itself.
+	symlinkMode = "follow"
+
+	// Dangling links warned about.
+	danglingLinks sync.Map
+)
+
+// The time now, for the times mk gives targets. Tests replace it, along with
+// the provider of local files, to skew the clock against the files.
+var clock = time.Now
+
+// The stat of a missing name.
+var missingStat = fileStat{t: time.Unix(0, 0)}
+
+// The scheme of a name, empty for local files.
+func scheme(name string) string {
+	if i := strings.Index(name, "://"); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// Look up the stats of names that are not cached yet, in one batch per
+// provider.
+func statNames(names []string) error {
+	batches := make(map[string][]string)
+	statCacheMutex.Lock()
+	for _, name := range names {
+		if _, ok := statCache[name]; !ok {
+			batches[scheme(name)] = append(batches[scheme(name)], name)
+		}
+	}
+	statCacheMutex.Unlock()
+
+	for s, batch := range batches {
+		provider, ok := statProviders[s]
+		if !ok {
+			provider = statProviders[""]
+		}
+		stats, err := provider.stat(batch)
+		if err != nil {
+			return err
+		}
+		statCacheMutex.Lock()
+		for i := range batch {
+			statCache[batch[i]] = stats[i]
+		}
+		statCacheMutex.Unlock()
+	}
+	return nil
+}
+
+// Look up the stat of a name, from the cache if possible.
+func statName(name string) fileStat {
+	statCacheMutex.Lock()
+	st, ok := statCache[name]
+	statCacheMutex.Unlock()
+	if ok {
+		return st
+	}
+
+	if err := statNames([]string{name}); err != nil {
+		mkError(err.Error())
+	}
+	statCacheMutex.Lock()
+	defer statCacheMutex.Unlock()
+	return statCache[name]
+}
+
+// Forget the cached stats of the targets a recipe made, and of the
+// directories holding them, whose contents changed. Without targets, forget
+// them all, before a new build.
+func forgetStats(targets ...string) {
+	if len(targets) == 0 {
+		statCacheMutex.Lock()
+		clear(statCache)
+		statCacheMutex.Unlock()
+		forgetDirScans()
+		forgetTrees()
+		return
+	}
+
+	var dirs []string
+	statCacheMutex.Lock()
+	for _, name := range targets {
+		delete(statCache, name)
+		if scheme(name) != "" {
+			continue
+		}
+		// the files of a directory made as a whole
+		if isDirPrereq(name) {
+			for cached := range statCache {
+				if isWithin(cached, name) {
+					delete(statCache, cached)
+				}
+			}
+		}
+		for dir := filepath.Clean(name); ; {
+			delete(statCache, dir)
+			delete(statCache, dir+"/")
+			dirs = append(dirs, dir)
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	statCacheMutex.Unlock()
+	forgetDirScans(dirs...)
+	forgetTrees(targets...)
+}
+
+// Whether a name is a directory or inside it.
+func isWithin(name, dir string) bool {
+	name, dir = filepath.Clean(name), filepath.Clean(dir)
+	return name == dir || dir == "." && !filepath.IsAbs(name) ||
+		strings.HasPrefix(name, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// How many lookups statConcurrently runs at the same time.
+const statWorkers = 16
+
+// Run the lookups of names concurrently, for providers whose requests are
+// slow but cheap.
+func statConcurrently(names []string, lookup func(string) (fileStat, error)) ([]fileStat, error) {
+	stats := make([]fileStat, len(names))
+	errs := make([]error, len(names))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(statWorkers, len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				stats[i], errs[i] = lookup(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// Local files.
+type localStat struct{}
+
+func (localStat) stat(names []string) ([]fileStat, error) {
+	return statFiles(names)
+}
+
+// Stat a single local file. A symbolic link is as recent as the file it
+// points to, or as itself if it was made later: pointing it elsewhere
+// changes it, even to an older file. With --symlinks=link, only the link
+// itself counts.
+func statFile(name string) (fileStat, error) {
+	info, err := os.Lstat(name)
+	if _, ok := err.(*os.PathError); ok {
+		return missingStat, nil
+	} else if err != nil {
+		return fileStat{}, fmt.Errorf("%s: %v", name, err)
+	}
+	if isDirPrereq(name) && info.IsDir() {
+		if st, ok, err := treeStat(name); err != nil {
+			return fileStat{}, fmt.Errorf("%s: %v", name, err)
+		} else if ok {
+			return st, nil
+		}
+		t, err := scanDir(name, nil)
+		if err != nil {
+			return fileStat{}, fmt.Errorf("%s: %v", name, err)
+		}
+		return fileStat{t: t, exists: true}, nil
+	}
+	if info.Mode()&os.ModeSymlink == 0 || symlinkMode == "link" {
+		return fileStat{t: info.ModTime(), exists: true}, nil
+	}
+
+	target, err := os.Stat(name)
+	if _, ok := err.(*os.PathError); ok {
+		warnDangling(name)
+		return missingStat, nil
+	} else if err != nil {
+		return fileStat{}, fmt.Errorf("%s: %v", name, err)
+	}
+	t := target.ModTime()
+	if info.ModTime().After(t) {
+		t = info.ModTime()
+	}
+	return fileStat{t: t, exists: true}, nil
+}
+
+// Warn about a symbolic link pointing to nothing, once: it is taken for a
+// missing file.
+func warnDangling(name string) {
+	if _, warned := danglingLinks.LoadOrStore(name, true); warned {
+		return
+	}
+	dest, _ := os.Readlink(name)
+	mkPrintWarning(fmt.Sprintf("%s is a dangling symbolic link to %s, taking it for missing", name, dest))
+}
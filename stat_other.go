@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+// Stat local files one by one. Reading whole directories does not help here,
+// the entries do not carry the modification time.
+func statFiles(names []string) ([]fileStat, error) {
+	stats := make([]fileStat, len(names))
+	for i, name := range names {
+		st, err := statFile(name)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = st
+	}
+	return stats, nil
+}
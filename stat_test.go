@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A provider that records its batches.
+type recordingStat struct {
+	batches [][]string
+}
+
+func (p *recordingStat) stat(names []string) ([]fileStat, error) {
+	p.batches = append(p.batches, slices.Sorted(slices.Values(names)))
+	stats := make([]fileStat, len(names))
+	for i := range names {
+		stats[i] = fileStat{t: time.Unix(1000, 0), exists: true}
+	}
+	return stats, nil
+}
+
+// Local files by their modification times, standing in for the file system.
+type fakeFiles map[string]time.Time
+
+func (f fakeFiles) stat(names []string) ([]fileStat, error) {
+	stats := make([]fileStat, len(names))
+	for i, name := range names {
+		if t, ok := f[name]; ok {
+			stats[i] = fileStat{t: t, exists: true}
+		} else {
+			stats[i] = missingStat
+		}
+	}
+	return stats, nil
+}
+
+// Replace the local files and the clock until the end of the test.
+func fakeFileSystem(t *testing.T, files fakeFiles, now time.Time) {
+	provider, oldClock := statProviders[""], clock
+	statProviders[""] = files
+	clock = func() time.Time { return now }
+	forgetStats()
+	t.Cleanup(func() {
+		statProviders[""], clock = provider, oldClock
+		forgetStats()
+	})
+}
+
+// A clock behind the files, as on a network file system, leaves a target
+// touched by the N attribute older than its prerequisite.
+func TestClockSkew(t *testing.T) {
+	fakeFileSystem(t, fakeFiles{"src": time.Unix(2000, 0)}, time.Unix(1500, 0))
+
+	mkfileAsString := "all:V: gen\ngen:N: src\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+	g := buildgraph(rs, "all")
+	if u := g.nodes["gen"]; u.exists {
+		t.Fatalf("gen exists before it is made")
+	}
+
+	mkNode(g, g.root, false, true)
+	u := g.nodes["gen"]
+	if !u.t.Equal(time.Unix(1500, 0)) {
+		t.Errorf("gen was given the time %v, not that of the clock", u.t)
+	}
+	if !u.t.Before(g.nodes["src"].t) {
+		t.Errorf("gen is not older than src, with the clock behind it")
+	}
+}
+
+// Names with a scheme are looked up by its provider, in one batch, and
+// only once.
+func TestStatProvider(t *testing.T) {
+	provider := &recordingStat{}
+	statProviders["fake"] = provider
+	defer delete(statProviders, "fake")
+	defer forgetStats()
+
+	mkfileAsString := "'fake://out': 'fake://a' 'fake://b'\n\techo $target\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	g := buildgraph(rs, "fake://out")
+	want := [][]string{{"fake://a", "fake://b", "fake://out"}}
+	if !slices.EqualFunc(provider.batches, want, slices.Equal) {
+		t.Errorf("the batches are %v, expected %v", provider.batches, want)
+	}
+
+	u := g.nodes["fake://a"]
+	u.updateTimestamp()
+	if !u.exists || !u.t.Equal(time.Unix(1000, 0)) {
+		t.Errorf("fake://a was not stat'ed by the provider")
+	}
+	if len(provider.batches) != 1 {
+		t.Errorf("fake://a was looked up again, instead of from the cache")
+	}
+}
+
+// After a recipe, only the stats of its targets, the directories holding them
+// and the files of a directory it made are forgotten.
+func TestForgetStats(t *testing.T) {
+	defer forgetStats()
+	forgetStats()
+	for _, name := range []string{"a", "src", "src/", "src/b", "tree/x", "other/c"} {
+		statCache[name] = fileStat{exists: true}
+	}
+	forgetStats("src/b", "tree/")
+	for name, kept := range map[string]bool{"a": true, "src": false, "src/": false, "src/b": false, "tree/x": false, "other/c": true} {
+		if _, ok := statCache[name]; ok != kept {
+			t.Errorf("%s: kept %v, expected %v", name, ok, kept)
+		}
+	}
+}
+
+// Concurrent lookups are limited to statWorkers at a time.
+func TestStatConcurrently(t *testing.T) {
+	var running, most atomic.Int32
+	names := make([]string, 10*statWorkers)
+	for i := range names {
+		names[i] = fmt.Sprint(i)
+	}
+	stats, err := statConcurrently(names, func(name string) (fileStat, error) {
+		n := running.Add(1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		return fileStat{version: name}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range names {
+		if stats[i].version != names[i] {
+			t.Fatalf("the stat of %s is that of %s", names[i], stats[i].version)
+		}
+	}
+	if most.Load() > statWorkers {
+		t.Errorf("%d lookups ran at the same time, expected at most %d", most.Load(), statWorkers)
+	}
+}
+
+// A no-op build in a large tree stats every prereq, see stat_windows.go for
+// where reading directories pays off.
+func BenchmarkStatFiles(b *testing.B) {
+	const files = 50000
+	dir := b.TempDir()
+	names := make([]string, files)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("file%d.c", i))
+		if err := os.WriteFile(names[i], nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := statFiles(names); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A symbolic link pointed elsewhere is newer, even if the file it points to
+// is older. A dangling one is missing, unless links are taken by themselves.
+func TestStatSymlink(t *testing.T) {
+	defer func(mode string) { symlinkMode = mode }(symlinkMode)
+	dir := t.TempDir()
+	old, older := time.Now().Add(-time.Hour), time.Now().Add(-2*time.Hour)
+	for name, mtime := range map[string]time.Time{"a": old, "b": older} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("b", link); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+
+	st, err := statFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.exists || !st.t.After(old) {
+		t.Errorf("the link was made now, but its time is %v", st.t)
+	}
+
+	dangling := filepath.Join(dir, "dangling")
+	if err := os.Symlink("missing", dangling); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := statFile(dangling); st.exists {
+		t.Errorf("a dangling link exists")
+	}
+	symlinkMode = "link"
+	if st, _ := statFile(dangling); !st.exists {
+		t.Errorf("a dangling link is missing, although links are taken by themselves")
+	}
+}
@@ -0,0 +1,65 @@
+//go:build windows
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directories with at least this many names are read as a whole.
+const bulkStatMin = 16
+
+// Stat local files, reading the directories holding many of them at once:
+// on Windows the entries carry the modification time, so this saves a
+// request per file, which is slow on network filesystems.
+func statFiles(names []string) ([]fileStat, error) {
+	// names that are not an entry of a directory, like "." or "C:\", are
+	// under the empty directory and looked up by themselves
+	byDir := make(map[string][]int)
+	for i, name := range names {
+		dir := filepath.Dir(filepath.Clean(name))
+		switch filepath.Base(filepath.Clean(name)) {
+		case ".", "..", string(filepath.Separator):
+			dir = ""
+		}
+		byDir[dir] = append(byDir[dir], i)
+	}
+
+	stats := make([]fileStat, len(names))
+	for dir, indexes := range byDir {
+		var entries map[string]fs.DirEntry
+		if dir != "" && len(indexes) >= bulkStatMin {
+			if list, err := os.ReadDir(dir); err == nil {
+				entries = make(map[string]fs.DirEntry, len(list))
+				for _, entry := range list {
+					entries[entry.Name()] = entry
+				}
+			}
+		}
+
+		for _, i := range indexes {
+			if entries != nil && !isDirPrereq(names[i]) {
+				entry, ok := entries[filepath.Base(filepath.Clean(names[i]))]
+				if !ok {
+					stats[i] = missingStat
+					continue
+				}
+				// symbolic links are followed, like os.Stat does
+				if entry.Type()&fs.ModeSymlink == 0 {
+					if info, err := entry.Info(); err == nil {
+						stats[i] = fileStat{t: info.ModTime(), exists: true}
+						continue
+					}
+				}
+			}
+			st, err := statFile(names[i])
+			if err != nil {
+				return nil, err
+			}
+			stats[i] = st
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,107 @@
+// The state directory, .mk, in which mk keeps what it has to remember between
+// runs.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Location of the state directory, it lives next to the top-level mkfile.
+var stateDir = ".mk"
+
+// How old a temporary file has to be to be taken for the leftover of a run
+// that was killed while writing it, rather than one another run is writing.
+const staleTempAge = time.Minute
+
+// Return the path of a file in the state directory, creating the directories
+// leading up to it.
+func statePath(elem ...string) (string, error) {
+	if _, err := os.Stat(stateDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return "", err
+		}
+		// keep the state out of version control, whatever the project ignores
+		if err := os.WriteFile(filepath.Join(stateDir, ".gitignore"), []byte("*\n"), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(append([]string{stateDir}, elem...)...)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Write a file through a temporary file next to it, synced and renamed over
+// it, so that a crash leaves either the old contents or the new ones.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Remove the temporary files of writeFileAtomic that runs killed while
+// writing left behind, in the state directory and next to the lock file.
+func removeStaleTemps() {
+	for _, dir := range []string{stateDir, filepath.Dir(lock.path)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !isAtomicTemp(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < staleTempAge {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				mkPrintWarning(fmt.Sprintf("removing %s, left behind by a run that was killed: %v", path, err))
+			}
+		}
+	}
+}
+
+// Whether a name is that of a temporary file of writeFileAtomic, for the lock
+// file or a file of the state directory: a '.', the name of the file and the
+// digits os.CreateTemp adds.
+func isAtomicTemp(name string) bool {
+	for _, base := range []string{lockFileName, "graph.gob", envState.path, hashState.path,
+		fileState.path, dirState.path, treeState.path, depState.path} {
+		digits, ok := strings.CutPrefix(name, "."+filepath.Base(base))
+		if ok && digits != "" && strings.Trim(digits, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
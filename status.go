@@ -0,0 +1,81 @@
+// Status lines recipes report while they run: a recipe may write lines to the
+// file descriptor in $MK_STATUS_FD, mk shows them as they come and records
+// the last one in the explain log.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// The file descriptor status lines are written to in recipes.
+const statusFD = 3
+
+// Run a recipe command, showing the status lines it reports. The last one is
+// kept in the node.
+func runWithStatus(cmd *exec.Cmd, u *node, umask int) error {
+	if recipeGroups {
+		setProcessGroup(cmd)
+	}
+	// passing extra file descriptors is not supported on windows
+	if runtime.GOOS == "windows" {
+		if err := startWithUmask(cmd, umask); err != nil {
+			return err
+		}
+		defer trackProcess(cmd.Process)()
+		return cmd.Wait()
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MK_STATUS_FD=%d", statusFD))
+	if err := startWithUmask(cmd, umask); err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	w.Close()
+	defer trackProcess(cmd.Process)()
+
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			u.progress = line
+			mkPrintStatus(u.name, line)
+		}
+		r.Close()
+		close(done)
+	}()
+
+	err = cmd.Wait()
+	<-done
+	return err
+}
+
+// Show a status line of a target.
+func mkPrintStatus(target, line string) {
+	if statusLine {
+		progressStatus(target, line)
+		return
+	}
+	mkMsgMutex.Lock()
+	defer mkMsgMutex.Unlock()
+	if color {
+		fmt.Fprintf(buildOutput, "%s%s%s ⋯ %s\n", ansiTermMagenta, target, ansiTermDefault, line)
+	} else {
+		fmt.Fprintf(buildOutput, "%s: status: %s\n", target, line)
+	}
+}
@@ -0,0 +1,247 @@
+// Listing the targets of the mkfile, with --targets.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// A target in the listing.
+type listedTarget struct {
+	name string
+	doc  string
+	rule *rule
+}
+
+// Collect the targets of the rules that are not meta-rules, grouped by the
+// file of their rule, or by their directory. The groups are in the order of
+// their first target, the targets in the order of their rules.
+func groupTargets(rs *ruleSet, groupBy string) ([]string, map[string][]listedTarget) {
+	var keys []string
+	groups := make(map[string][]listedTarget)
+	seen := make(map[string]int) // index in its group
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.ismeta {
+			continue
+		}
+		for _, t := range r.targets {
+			key := r.file
+			if groupBy == "dir" {
+				key = filepath.Dir(t.spat)
+			}
+			if j, ok := seen[t.spat]; ok {
+				if groups[key][j].doc == "" {
+					groups[key][j].doc = r.doc
+				}
+				continue
+			}
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			seen[t.spat] = len(groups[key])
+			groups[key] = append(groups[key], listedTarget{t.spat, r.doc, r})
+		}
+	}
+	return keys, groups
+}
+
+// A target printed by --targets=all, meta or phony.
+type queryTarget struct {
+	Name    string `json:"name"`
+	Phony   bool   `json:"phony,omitempty"`
+	Meta    bool   `json:"meta,omitempty"`
+	Pattern string `json:"pattern,omitempty"` // of the meta-rule it was derived from
+	Rule    string `json:"rule"`
+	Owner   string `json:"owner,omitempty"` // from the owner= attribute of the rule
+	Doc     string `json:"doc,omitempty"`
+}
+
+// The targets of a kind, sorted: all those that can be made, the patterns of
+// the meta-rules, or the virtual targets. All of them includes the targets of
+// meta-rules with a '%' whose prerequisite matches existing files.
+func queryTargets(rs *ruleSet, kind string) ([]queryTarget, error) {
+	if kind != "all" && kind != "meta" && kind != "phony" {
+		return nil, fmt.Errorf("unknown kind %q for --targets, expected all, meta or phony", kind)
+	}
+	targets := []queryTarget{}
+	seen := make(map[string]bool)
+	add := func(t queryTarget) {
+		if !seen[t.Name] {
+			seen[t.Name] = true
+			targets = append(targets, t)
+		}
+	}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		for _, p := range r.targets {
+			switch {
+			case kind == "meta" && r.ismeta:
+				add(queryTarget{Name: p.spat, Meta: true, Rule: r.describe(), Owner: r.owner, Doc: r.doc})
+			case kind == "phony" && !r.ismeta && r.attributes.virtual,
+				kind == "all" && !r.ismeta:
+				add(queryTarget{Name: p.spat, Phony: r.attributes.virtual, Rule: r.describe(), Owner: r.owner, Doc: r.doc})
+			case kind == "all" && p.issuffix && !r.attributes.virtual:
+				for _, name := range metaTargets(r, p) {
+					add(queryTarget{Name: name, Pattern: p.spat, Rule: r.describe(), Owner: r.owner, Doc: r.doc})
+				}
+			}
+		}
+	}
+	slices.SortFunc(targets, func(a, b queryTarget) int { return strings.Compare(a.Name, b.Name) })
+	return targets, nil
+}
+
+// The targets of a '%' pattern of a meta-rule for the stems of the files that
+// match its first prerequisite with a '%'.
+func metaTargets(r *rule, p pattern) []string {
+	i := slices.IndexFunc(r.prereqs, func(prereq string) bool { return strings.Contains(prereq, "%") })
+	if i < 0 {
+		return nil
+	}
+	prereq, err := newPattern("", r.prereqs[i], false)
+	if err != nil {
+		return nil
+	}
+	files, _ := filepath.Glob(strings.Replace(r.prereqs[i], "%", "*", 1))
+	var names []string
+	for _, file := range files {
+		if m := prereq.match(file); len(m) > 1 {
+			names = append(names, strings.Replace(p.spat, "%", m[1], 1))
+		}
+	}
+	return names
+}
+
+// Print the targets of a kind one per line, or as JSON.
+func printTargets(w io.Writer, rs *ruleSet, kind string, asJSON bool) error {
+	targets, err := queryTargets(rs, kind)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(targets)
+	}
+	for _, t := range targets {
+		fmt.Fprintln(w, t.Name)
+	}
+	return nil
+}
+
+// Write the names in columns, filled top to bottom like ls(1).
+func writeColumns(w io.Writer, names []string, width int) {
+	colwidth := 0
+	for _, name := range names {
+		colwidth = max(colwidth, utf8.RuneCountInString(name)+2)
+	}
+	cols := max(1, (width-2)/colwidth)
+	rows := (len(names) + cols - 1) / cols
+	for row := range rows {
+		fmt.Fprint(w, "  ")
+		for col := range cols {
+			i := col*rows + row
+			if i >= len(names) {
+				break
+			}
+			name := names[i]
+			if col+1 < cols && i+rows < len(names) {
+				name += strings.Repeat(" ", colwidth-utf8.RuneCountInString(name))
+			}
+			fmt.Fprint(w, colorName(name))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Highlight a target name, keeping the padding.
+func colorName(name string) string {
+	if !color {
+		return name
+	}
+	trimmed := strings.TrimRight(name, " ")
+	return ansiTermBlue + ansiTermBright + trimmed + ansiTermDefault + name[len(trimmed):]
+}
+
+// Write the listing: per group, the documented targets with their
+// description, then the others in columns.
+func writeTargets(w io.Writer, rs *ruleSet, groupBy string, width int) {
+	keys, groups := groupTargets(rs, groupBy)
+	for k, key := range keys {
+		if k > 0 {
+			fmt.Fprintln(w)
+		}
+		if color {
+			fmt.Fprintf(w, "%s%s:%s\n", ansiTermUnderline, key, ansiTermDefault)
+		} else {
+			fmt.Fprintf(w, "%s:\n", key)
+		}
+
+		var plain []string
+		docwidth := 0
+		for _, t := range groups[key] {
+			if t.doc == "" {
+				plain = append(plain, t.name)
+			} else {
+				docwidth = max(docwidth, utf8.RuneCountInString(t.name))
+			}
+		}
+		for _, t := range groups[key] {
+			if t.doc != "" {
+				pad := strings.Repeat(" ", docwidth-utf8.RuneCountInString(t.name))
+				fmt.Fprintf(w, "  %s%s  %s\n", colorName(t.name), pad, t.doc)
+			}
+		}
+		if len(plain) > 0 {
+			writeColumns(w, plain, width)
+		}
+	}
+}
+
+// Print the targets, through $PAGER if they do not fit on the terminal.
+func listTargets(rs *ruleSet, groupBy string) error {
+	if groupBy != "file" && groupBy != "dir" {
+		return fmt.Errorf("unknown grouping %q, expected file or dir", groupBy)
+	}
+
+	width, height := 80, 0
+	fd := int(os.Stdout.Fd())
+	if term.IsTerminal(fd) {
+		if w, h, err := term.GetSize(fd); err == nil {
+			width, height = w, h
+		}
+	}
+
+	var b bytes.Buffer
+	writeTargets(&b, rs, groupBy, width)
+	if height == 0 || bytes.Count(b.Bytes(), []byte("\n")) < height {
+		_, err := os.Stdout.Write(b.Bytes())
+		return err
+	}
+	return runPager(&b)
+}
+
+// Show text through $PAGER, or less(1) if it is not set.
+func runPager(text io.Reader) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -R"
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = text
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
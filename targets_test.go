@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteTargets(t *testing.T) {
+	mkfileAsString := "## Build everything.\n" +
+		"all:V: prog\n" +
+		"prog: a.o b.o\n\tcc -o prog a.o b.o\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n" +
+		"a.o: a.h\n" +
+		"sub/x sub/y sub/z:\n\ttouch $target\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	var b strings.Builder
+	writeTargets(&b, rs, "dir", 20)
+	want := ".:\n" +
+		"  all  Build everything.\n" +
+		"  prog  a.o\n" +
+		"\n" +
+		"sub:\n" +
+		"  sub/x  sub/z\n" +
+		"  sub/y\n"
+	if b.String() != want {
+		t.Errorf("the listing is\n%s\nexpected\n%s", b.String(), want)
+	}
+}
+
+func TestQueryTargets(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"a.c", "b.c"} {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkfileAsString := "all:V: prog\n" +
+		"prog: a.o b.o\n\tcc -o prog a.o b.o\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n" +
+		"clean:V owner=ops:\n\trm -f *.o\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfileAsString), "mkfile", "/mkfile", env)
+
+	for kind, want := range map[string][]string{
+		"all":   {"a.o", "all", "b.o", "clean", "prog"},
+		"meta":  {"%.o"},
+		"phony": {"all", "clean"},
+	} {
+		targets, err := queryTargets(rs, kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("--targets=%s lists %q, expected %q", kind, names, want)
+		}
+	}
+	phony, _ := queryTargets(rs, "phony")
+	if phony[0].Owner != "" || phony[1].Owner != "ops" {
+		t.Errorf("the owners are %q and %q, expected none and ops", phony[0].Owner, phony[1].Owner)
+	}
+	if _, err := queryTargets(rs, "files"); err == nil {
+		t.Error("an unknown kind is accepted")
+	}
+}
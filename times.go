@@ -0,0 +1,61 @@
+// The slowest recipes of the build, with --times: how long each recipe took is
+// collected as it runs, and a table of the slowest ones is printed after the
+// build.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// Number of recipes to show, none if 0.
+	showTimes int
+
+	// The recipes executed so far, guarded by timesMutex.
+	recipeTimes []recipeTime
+	timesMutex  sync.Mutex
+)
+
+// How long the recipe of a target took, and how it exited: -1 if it could not
+// run or was killed.
+type recipeTime struct {
+	target   string
+	duration time.Duration
+	status   int
+}
+
+// Remember how long a recipe took.
+func recordTime(target string, duration time.Duration, status int) {
+	if showTimes <= 0 {
+		return
+	}
+	timesMutex.Lock()
+	recipeTimes = append(recipeTimes, recipeTime{target, duration, status})
+	timesMutex.Unlock()
+}
+
+// Print the slowest recipes, slowest first.
+func writeTimes(w io.Writer) {
+	timesMutex.Lock()
+	defer timesMutex.Unlock()
+	if len(recipeTimes) == 0 {
+		return
+	}
+	slices.SortFunc(recipeTimes, func(a, b recipeTime) int {
+		return cmp.Or(cmp.Compare(b.duration, a.duration), cmp.Compare(a.target, b.target))
+	})
+	fmt.Fprintf(w, "slowest recipes, of %d:\n", len(recipeTimes))
+	for _, t := range recipeTimes[:min(showTimes, len(recipeTimes))] {
+		fmt.Fprintf(w, "%8s  %s", t.duration.Round(time.Millisecond), t.target)
+		if t.status != 0 {
+			fmt.Fprintf(w, " (exit status %d)", t.status)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,86 @@
+// A trace of the build, with --trace: every recipe executed is an event with
+// its start, its duration and the job slot it ran in, written as a Chrome
+// trace that about:tracing and Perfetto show as a timeline, to see how well
+// the build used its jobs.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// File the trace is written to, none if empty.
+	traceFile string
+
+	// The events so far, and the number of slots they ran in, guarded by
+	// traceMutex.
+	traceMutex  sync.Mutex
+	traceEvents []traceEvent
+	traceSlots  int
+
+	// Timestamps of the trace count from here.
+	traceEpoch = time.Now()
+)
+
+// An event of the Chrome trace format. Times are in microseconds.
+type traceEvent struct {
+	Name string         `json:"name"`
+	Cat  string         `json:"cat,omitempty"`
+	Ph   string         `json:"ph"`
+	Ts   int64          `json:"ts"`
+	Dur  int64          `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// Record a recipe that ran in a process slot, $nproc, since start.
+func traceRecipe(slot int, target string, r *rule, seq string, start time.Time, failed bool) {
+	if traceFile == "" {
+		return
+	}
+	event := traceEvent{
+		Name: target,
+		Cat:  "recipe",
+		Ph:   "X",
+		Ts:   start.Sub(traceEpoch).Microseconds(),
+		Dur:  max(time.Since(start).Microseconds(), 1),
+		Pid:  1,
+		Tid:  slot + 1,
+		Args: map[string]any{"rule": r.describe(), "seq": seq},
+	}
+	if failed {
+		event.Args["failed"] = true
+	}
+	traceMutex.Lock()
+	traceEvents = append(traceEvents, event)
+	traceSlots = max(traceSlots, slot+1)
+	traceMutex.Unlock()
+}
+
+// Write the trace, naming the slots after the jobs.
+func writeTrace(w io.Writer) error {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	events := []traceEvent{{Name: "process_name", Ph: "M", Pid: 1, Args: map[string]any{"name": "mk " + buildID}}}
+	for slot := range traceSlots {
+		events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: 1, Tid: slot + 1,
+			Args: map[string]any{"name": fmt.Sprintf("job %d", slot+1)}})
+	}
+	events = append(events, traceEvents...)
+	enc := json.NewEncoder(w)
+	return enc.Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
+
+// Write the trace to the file of --trace.
+func saveTrace() error {
+	return writeFileAtomic(traceFile, writeTrace)
+}
@@ -0,0 +1,132 @@
+// Keeping the previous version of targets, so they can be restored.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+var (
+	// True if targets are copied to the trash before they are rebuilt.
+	trash bool
+
+	// Maximum size of the trash, in megabytes.
+	trashSize int64
+
+	// The trash is kept in bounds by concurrent recipes.
+	trashMutex sync.Mutex
+)
+
+// Path in the trash of the previous version of a target.
+func trashPath(target string) (string, error) {
+	return statePath("trash", url.PathEscape(target))
+}
+
+// Copy a target to the trash, before its recipe rewrites it. Only regular
+// files are kept, and the oldest are thrown away if the trash grows too big.
+func trashTarget(target string) error {
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > trashSize<<20 {
+		return nil
+	}
+
+	trashMutex.Lock()
+	defer trashMutex.Unlock()
+
+	path, err := trashPath(target)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return trimTrash(filepath.Dir(path), trashSize<<20)
+}
+
+// Remove the oldest files in the trash until it is at most limit bytes.
+func trimTrash(dir string, limit int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var infos []fs.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+
+	slices.SortFunc(infos, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range infos {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
+
+// Copy the file src to dst.
+func copyFile(dst, src string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// mk restore target...: put back the previous version of targets.
+func cmdRestore(rs *ruleSet, args []string) int {
+	if !checkArgs("restore", args, 1, -1, "target...") {
+		return 2
+	}
+
+	status := 0
+	for _, target := range args {
+		path, err := trashPath(target)
+		if err != nil {
+			mkPrintError(err.Error())
+			return 1
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			mkPrintError(fmt.Sprintf("no previous version of %s in the trash", target))
+			status = 1
+			continue
+		}
+		if err := copyFile(target, path, info.Mode().Perm()); err != nil {
+			mkPrintError(fmt.Sprintf("restoring %s: %v", target, err))
+			status = 1
+			continue
+		}
+		fmt.Printf("restored %s\n", target)
+	}
+	return status
+}
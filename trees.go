@@ -0,0 +1,181 @@
+// Directory trees as targets, written with a trailing slash like "dist/": a
+// tree is made as a whole. It is removed before its recipe runs, and once the
+// recipe succeeds a stamp with the hash of the tree is kept in the state
+// directory. A tree without a stamp, or that changed since, was not made, and
+// only a tree with a stamp is ever removed.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// The hash of every tree made, and when, by name.
+	treeState = &lockFile{
+		path:   "trees",
+		header: treesHeader("sha256"),
+		state:  true,
+	}
+
+	// Whether trees are as they were made, until a recipe makes something
+	// in them.
+	treesIntact      = make(map[string]bool)
+	treesIntactMutex sync.Mutex
+)
+
+func treesHeader(algorithm string) string {
+	return fmt.Sprintf("Generated by mk, the trees made, hashed with %s.", algorithm)
+}
+
+// Whether the rule makes the target as a tree.
+func isTreeTarget(name string, r *rule) bool {
+	return isDirPrereq(name) && !r.attributes.virtual && r.recipe != ""
+}
+
+// The stat of a tree that was made: as recent as its stamp. Returns false if
+// the tree has no stamp.
+func treeStat(name string) (fileStat, bool, error) {
+	stamp, ok, err := treeState.get(filepath.Clean(name))
+	if err != nil || !ok {
+		return fileStat{}, false, err
+	}
+	sum, made, _ := strings.Cut(stamp, " ")
+	ns, err := strconv.ParseInt(made, 10, 64)
+	if err != nil {
+		return fileStat{}, false, fmt.Errorf("invalid stamp %q", stamp)
+	}
+	current, err := hashes.hashDir(name)
+	if err != nil {
+		return fileStat{}, false, err
+	}
+	treesIntactMutex.Lock()
+	treesIntact[filepath.Clean(name)] = current == sum
+	treesIntactMutex.Unlock()
+	return fileStat{t: time.Unix(0, ns), exists: true}, true, nil
+}
+
+// Whether a tree was made, and not changed since.
+func treeStamped(name string) bool {
+	treesIntactMutex.Lock()
+	intact, ok := treesIntact[filepath.Clean(name)]
+	treesIntactMutex.Unlock()
+	if ok {
+		return intact
+	}
+	_, ok, err := treeStat(name)
+	if err != nil || !ok {
+		return false
+	}
+	treesIntactMutex.Lock()
+	defer treesIntactMutex.Unlock()
+	return treesIntact[filepath.Clean(name)]
+}
+
+// Forget whether the trees holding the targets a recipe made, or inside
+// them, are intact, or all of them without any.
+func forgetTrees(targets ...string) {
+	treesIntactMutex.Lock()
+	defer treesIntactMutex.Unlock()
+	if len(targets) == 0 {
+		clear(treesIntact)
+		return
+	}
+	for tree := range treesIntact {
+		for _, name := range targets {
+			if scheme(name) == "" && (isWithin(name, tree) || isWithin(tree, name)) {
+				delete(treesIntact, tree)
+				break
+			}
+		}
+	}
+}
+
+// Remove a tree before its recipe makes it again. Only a tree inside the
+// project that mk made, with a stamp, is removed: any other directory is kept
+// and the recipe is not run. The stamp is kept without a hash while the
+// recipe runs, so that a tree it leaves half made is still known as mk's.
+func clearTree(name string) error {
+	tree, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	project, err := filepath.Abs(filepath.Dir(stateDir))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(tree, project); err == nil && !strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("refusing to remove %s, which holds the mkfile", name)
+	}
+	if rel, err := filepath.Rel(project, tree); err != nil || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || rel == ".." {
+		return fmt.Errorf("refusing to remove %s, which is outside the project", name)
+	}
+
+	key := filepath.Clean(name)
+	_, stamped, err := treeState.get(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(name); err == nil && !stamped {
+		return fmt.Errorf("refusing to remove %s, which mk did not make; remove it to let the recipe make it", name)
+	}
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	if err := treeState.set(key, fmt.Sprintf("- %d", clock().UnixNano())); err != nil {
+		return err
+	}
+	// written now, so that a run that is killed still leaves it
+	if err := treeState.flush(); err != nil {
+		return err
+	}
+	return os.RemoveAll(name)
+}
+
+// Keep the stamp of a tree its recipe made.
+func stampTree(name string) error {
+	sum, err := hashes.hashDir(name)
+	if err != nil {
+		return err
+	}
+	// the state directory may not exist yet
+	if _, err := statePath(); err != nil {
+		return err
+	}
+	return treeState.set(filepath.Clean(name), fmt.Sprintf("%s %d", sum, clock().UnixNano()))
+}
+
+// Report targets made by a recipe inside a tree another recipe makes: the
+// tree is removed before it is made again, and the target with it.
+func (g *graph) conflictingTrees() []string {
+	made := make(map[string]*rule)
+	for name, u := range g.nodes {
+		for _, e := range u.prereqs {
+			if e.r != nil && e.r.recipe != "" && !e.r.attributes.virtual {
+				made[name] = e.r
+			}
+		}
+	}
+	var conflicts []string
+	for tree, r := range made {
+		if !isTreeTarget(tree, r) {
+			continue
+		}
+		for name, other := range made {
+			if name != tree && other != r && strings.HasPrefix(filepath.Clean(name), filepath.Clean(tree)+"/") {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%s:%d) is inside the tree %s (%s:%d)",
+					name, other.file, other.line, tree, r.file, r.line))
+			}
+		}
+	}
+	slices.Sort(conflicts)
+	return slices.Compact(conflicts)
+}
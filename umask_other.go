@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// There is no umask here.
+func startWithUmask(cmd *exec.Cmd, mask int) error {
+	return cmd.Start()
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Start a command with a umask, or with that of mk if it is negative. The
+// umask belongs to the process, so rather than changing that of mk while
+// other recipes start, the command is started by a shell setting it first.
+func startWithUmask(cmd *exec.Cmd, mask int) error {
+	if mask >= 0 {
+		script := fmt.Sprintf(`umask %04o && exec "$@"`, mask)
+		cmd.Args = append([]string{"sh", "-c", script, "sh", cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,152 @@
+// The prerequisites recipes never read, with --unused-prereqs: recipes run
+// under strace, which logs every file they open or execute, and after the
+// build the declared prerequisites of each target that its recipe did not
+// touch are listed, to prune those that only cause needless rebuilds.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Trace recipes and report the prerequisites they never read.
+	unusedPrereqs bool
+
+	// The prerequisites never read, by target, guarded by unusedMutex.
+	unusedReads = map[string][]string{}
+	unusedMutex sync.Mutex
+)
+
+var (
+	// A file opened, whose descriptor strace -y follows with its path, also
+	// when the call was interrupted by another process and resumed.
+	straceOpen = regexp.MustCompile(`\b(?:open|openat|openat2|creat)(?:\(| resumed>).* = \d+<(.*)>$`)
+
+	// A program executed.
+	straceExec = regexp.MustCompile(`\bexecve\(("(?:[^"\\]|\\.)*")`)
+)
+
+// Run a command under strace, logging the files it opens to the given file.
+func traceReads(cmd *exec.Cmd, log string) error {
+	strace, err := exec.LookPath("strace")
+	if err != nil {
+		return fmt.Errorf("--unused-prereqs needs strace: %v", err)
+	}
+	args := []string{strace, "-f", "-qq", "-y", "-e", "trace=open,openat,openat2,creat,execve", "-o", log, "--", cmd.Path}
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = strace
+	return nil
+}
+
+// Add the files a log of strace shows opened or executed to read, by their
+// absolute paths. Relative paths of programs are from dir.
+func readTrace(log, dir string, read map[string]bool) error {
+	f, err := os.Open(log)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseTrace(f, dir, read)
+}
+
+func parseTrace(r io.Reader, dir string, read map[string]bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := straceOpen.FindStringSubmatch(line); m != nil {
+			read[filepath.Clean(m[1])] = true
+		} else if m := straceExec.FindStringSubmatch(line); m != nil {
+			name, err := strconv.Unquote(m[1])
+			if err != nil {
+				continue
+			}
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			read[filepath.Clean(name)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// The prerequisites of a target none of the files read are, or are in, for
+// a directory. Virtual prerequisites are never read.
+func unreadPrereqs(u *node, e *edge, read map[string]bool) []string {
+	var unread []string
+	for _, p := range u.prereqs {
+		if p.r != e.r || p.v == nil || p.v.virtual || p.discovered || strings.Contains(p.v.name, "://") {
+			continue
+		}
+		if slices.Contains(unread, p.v.name) || wasRead(p.v.name, read) {
+			continue
+		}
+		unread = append(unread, p.v.name)
+	}
+	return unread
+}
+
+// Whether a file, or anything in a directory, was read.
+func wasRead(name string, read map[string]bool) bool {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return true
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	if read[path] {
+		return true
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		for f := range read {
+			if isWithin(f, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Record the prerequisites of a target its recipe never read.
+func recordUnread(target string, unread []string) {
+	if len(unread) == 0 {
+		return
+	}
+	unusedMutex.Lock()
+	unusedReads[target] = unread
+	unusedMutex.Unlock()
+}
+
+// Print the prerequisites never read, by target.
+func writeUnusedPrereqs(w io.Writer) {
+	unusedMutex.Lock()
+	defer unusedMutex.Unlock()
+	if len(unusedReads) == 0 {
+		return
+	}
+	targets := make([]string, 0, len(unusedReads))
+	for target := range unusedReads {
+		targets = append(targets, target)
+	}
+	slices.Sort(targets)
+	fmt.Fprintln(w, "prerequisites never read by the recipe:")
+	for _, target := range targets {
+		fmt.Fprintf(w, "  %s: %s\n", target, strings.Join(unusedReads[target], " "))
+	}
+}
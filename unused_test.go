@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The files opened and executed are read from the log, with interrupted
+// calls and relative programs, and failed opens left out.
+func TestParseTrace(t *testing.T) {
+	log := `412 execve("/bin/sh", ["sh", "-c", "cc -o prog main.c"], 0x7ffd /* 20 vars */) = 0
+412 openat(AT_FDCWD</work>, "/etc/ld.so.cache", O_RDONLY|O_CLOEXEC) = 3</etc/ld.so.cache>
+413 execve("./gen", ["./gen"], 0x55 /* 20 vars */) = 0
+413 openat(AT_FDCWD</work>, "main.c", O_RDONLY <unfinished ...>
+414 openat(AT_FDCWD</work>, "missing.h", O_RDONLY) = -1 ENOENT (No such file or directory)
+413 <... openat resumed>) = 4</work/main.c>
+414 open("include/a.h", O_RDONLY) = 5</work/include/a.h>
+`
+	read := map[string]bool{}
+	if err := parseTrace(strings.NewReader(log), "/work", read); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/bin/sh", "/etc/ld.so.cache", "/work/gen", "/work/main.c", "/work/include/a.h"} {
+		if !read[name] {
+			t.Errorf("%s is not read, got %v", name, read)
+		}
+	}
+	if read["/work/missing.h"] || len(read) != 5 {
+		t.Errorf("unexpected files read: %v", read)
+	}
+}
+
+// Only the prerequisites not read are listed; a directory counts as read if
+// anything in it is, and virtual prerequisites are left out.
+func TestUnreadPrereqs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.c", "b.c", "inc/x.h", "docs/index"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &rule{}
+	u := &node{name: filepath.Join(dir, "prog")}
+	for _, name := range []string{"a.c", "b.c", "inc", "docs", "all"} {
+		v := &node{name: filepath.Join(dir, name), virtual: name == "all"}
+		u.prereqs = append(u.prereqs, &edge{v: v, r: r})
+	}
+	read := map[string]bool{
+		filepath.Join(real, "a.c"):     true,
+		filepath.Join(real, "inc/x.h"): true,
+	}
+	unread := unreadPrereqs(u, u.prereqs[0], read)
+	want := []string{filepath.Join(dir, "b.c"), filepath.Join(dir, "docs")}
+	if strings.Join(unread, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", unread, want)
+	}
+}
+
+func TestUnusedPrereqs(t *testing.T) {
+	if _, err := exec.LookPath("strace"); err != nil {
+		t.Skip("strace is not installed")
+	}
+	dir := t.TempDir()
+	mkfile := "prog: a.c b.c\n\tcat a.c > prog\n"
+	for name, content := range map[string]string{"mkfile": mkfile, "a.c": "a\n", "b.c": "b\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, _, err := startMk("-C", dir, "--unused-prereqs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "  prog: b.c\n") {
+		t.Errorf("b.c is not reported unread:\n%s", out)
+	}
+}
@@ -0,0 +1,109 @@
+// Rule libraries fetched from git by the 'use' directive.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Directory in which fetched libraries are kept. It can be changed with
+// $MKCACHE.
+func libraryCacheDir() (string, error) {
+	if dir := os.Getenv("MKCACHE"); dir != "" {
+		return filepath.Join(dir, "use"), nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mk", "use"), nil
+}
+
+// The repository to clone for a module: a URL, an absolute path, or otherwise
+// a host and path reachable over https, like github.com/org/mkrules.
+func libraryURL(module string) string {
+	if strings.Contains(module, "://") || filepath.IsAbs(module) {
+		return module
+	}
+	return "https://" + module
+}
+
+// Run git, returning its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Return the directory holding version of a module, fetching it into the cache
+// if needed. The commit is pinned in the lock file the first time, later that
+// commit is checked out, and a tag that was moved since is noticed.
+func fetchLibrary(module, version string) (string, error) {
+	cache, err := libraryCacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := module + "@" + version
+	// the key is a path in the cache, which it must not leave
+	if slices.Contains(strings.Split(filepath.ToSlash(key), "/"), "..") {
+		return "", fmt.Errorf("%s: '..' is not allowed in a module or version", key)
+	}
+	dir := filepath.Join(cache, filepath.FromSlash(strings.ReplaceAll(key, "://", "/")))
+
+	pinned, locked, err := lock.get(key)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return "", err
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(dir), ".fetch")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+
+		if _, err := git(tmp, "clone", "--quiet", "--no-checkout", libraryURL(module), "."); err != nil {
+			return "", err
+		}
+		checkout := version
+		if locked {
+			checkout = pinned
+			if commit, err := git(tmp, "rev-parse", "--verify", "--quiet", version+"^{commit}"); err == nil && commit != pinned {
+				mkPrintWarning(fmt.Sprintf("%s is at commit %s now, using %s, which %s pins", key, commit, pinned, lock.path))
+			}
+		}
+		if _, err := git(tmp, "checkout", "--quiet", "--detach", checkout); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", err
+		}
+	}
+
+	commit, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if !locked {
+		return dir, lock.set(key, commit)
+	}
+	if commit != pinned {
+		return "", fmt.Errorf("%s is at commit %s, but %s pins %s", key, commit, lock.path, pinned)
+	}
+	return dir, nil
+}
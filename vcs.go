@@ -0,0 +1,148 @@
+// Knowledge about the version control system the mkfile lives in.
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Files tracked by git, as absolute paths. Empty if this is not a git
+	// repository.
+	gitTracked     map[string]bool
+	gitTrackedOnce sync.Once
+
+	// Files changed since the time or git ref given with --since, as
+	// absolute paths. Nil without --since.
+	changedFiles map[string]bool
+)
+
+// Formats of the time given with --since, anything else is a git ref.
+var sinceFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// List the files in the output of git, relative to the top level, as
+// absolute paths.
+func gitFiles(top string, args ...string) (map[string]bool, error) {
+	out, err := git(top, args...)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, file := range strings.Split(out, "\x00") {
+		if file = strings.TrimSpace(file); file != "" {
+			files[filepath.Join(top, filepath.FromSlash(file))] = true
+		}
+	}
+	return files, nil
+}
+
+// The absolute path of a file, as git reports it: with symbolic links
+// resolved.
+func gitPath(name string) (string, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		path = filepath.Join(dir, filepath.Base(path))
+	}
+	return path, nil
+}
+
+// Is the file tracked by git? This is the case for sources, but usually not
+// for files that are built.
+func isTrackedByGit(name string) bool {
+	loadGitTracked()
+	path, err := gitPath(name)
+	if err != nil {
+		return false
+	}
+	return gitTracked[path]
+}
+
+// Whether a rule names a target, listing it as generated, rather than only a
+// meta-rule matching it. The other targets of a batch are only known by the
+// rule making them.
+func listedAsGenerated(name string, u *node, e *edge) bool {
+	if !e.r.ismeta {
+		return true
+	}
+	return name == u.name && slices.ContainsFunc(u.prereqs, func(e *edge) bool { return !e.r.ismeta })
+}
+
+// Does the directory hold files tracked by git?
+func isTreeTrackedByGit(dir string) bool {
+	loadGitTracked()
+	path, err := gitPath(dir)
+	if err != nil {
+		return false
+	}
+	for file := range gitTracked {
+		if strings.HasPrefix(file, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// List the files tracked by git, once.
+func loadGitTracked() {
+	gitTrackedOnce.Do(func() {
+		gitTracked = make(map[string]bool)
+		top, err := git(".", "rev-parse", "--show-toplevel")
+		if err != nil {
+			return
+		}
+		if files, err := gitFiles(top, "ls-files", "-z"); err == nil {
+			gitTracked = files
+		}
+	})
+}
+
+// Collect the files changed since a time, according to the commits made
+// since then, or since a git ref, including changes not committed yet.
+func loadChangedFiles(since string) error {
+	top, err := git(".", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("--since needs a git repository: %v", err)
+	}
+
+	for _, format := range sinceFormats {
+		t, err := time.ParseInLocation(format, since, time.Local)
+		if err != nil {
+			continue
+		}
+		committed, err := gitFiles(top, "log", "--name-only", "-z", "--format=",
+			"--since="+t.Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		changedFiles, err = gitFiles(top, "diff", "--name-only", "-z", "HEAD")
+		if err != nil {
+			return err
+		}
+		maps.Copy(changedFiles, committed)
+		return nil
+	}
+
+	changedFiles, err = gitFiles(top, "diff", "--name-only", "-z", since)
+	return err
+}
+
+// Was the file changed since the time or git ref given with --since?
+func isChangedSince(name string) bool {
+	if changedFiles == nil {
+		return false
+	}
+	path, err := gitPath(name)
+	if err != nil {
+		return false
+	}
+	return changedFiles[path]
+}
@@ -0,0 +1,124 @@
+// mk version: what this mk is and what it supports.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+)
+
+// Print JSON rather than text, where supported.
+var jsonOutput bool
+
+// The defaults of a dialect, as reported by mk version.
+type dialectInfo struct {
+	Shell        string `json:"shell"`
+	Delimiter    string `json:"delimiter"`
+	RecipePrefix string `json:"recipeprefix"`
+	MakeVars     bool   `json:"make_vars"`
+	PerLineShell bool   `json:"per_line_shell"`
+	Attributes   string `json:"attributes,omitempty"`
+}
+
+// What mk version reports.
+type versionInfo struct {
+	Version     string                 `json:"version"`
+	Go          string                 `json:"go"`
+	OS          string                 `json:"os"`
+	Arch        string                 `json:"arch"`
+	Revision    string                 `json:"revision,omitempty"`
+	Time        string                 `json:"time,omitempty"`
+	Modified    bool                   `json:"modified,omitempty"`
+	Dialect     string                 `json:"dialect"`
+	Dialects    map[string]dialectInfo `json:"dialects"`
+	Directives  []string               `json:"directives"`
+	Functions   []string               `json:"functions"`
+	Schemes     []string               `json:"schemes"`
+	Subcommands []string               `json:"subcommands"`
+}
+
+// Collect the version, from the build information, and the features.
+func getVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:     "(devel)",
+		Go:          runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Dialect:     dialectName,
+		Dialects:    make(map[string]dialectInfo),
+		Directives:  slices.Sorted(maps.Keys(directives)),
+		Functions:   slices.Sorted(maps.Keys(builtinFuncs)),
+		Subcommands: slices.Sorted(maps.Keys(subcommands)),
+	}
+	// 'env <|' is parsed apart, so that 'env' can still be a target
+	info.Directives = append(info.Directives, "env")
+	slices.Sort(info.Directives)
+	for scheme := range statProviders {
+		if scheme != "" {
+			info.Schemes = append(info.Schemes, scheme)
+		}
+	}
+	slices.Sort(info.Schemes)
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Version != "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.Time = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	for name, d := range dialects {
+		prefix := string(d.recipeprefix)
+		switch d.recipeprefix {
+		case recipePrefixIndent:
+			prefix = "indent"
+		case recipePrefixTab:
+			prefix = "tab"
+		}
+		info.Dialects[name] = dialectInfo{d.shell, d.delimiter, prefix, d.makeVars, d.perLineShell, d.attributes}
+	}
+	return info
+}
+
+// mk version: print the version, or with --json everything mk version knows.
+func cmdVersion(rs *ruleSet, args []string) int {
+	if !checkArgs("version", args, 0, 0, "") {
+		return 2
+	}
+
+	info := getVersionInfo()
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			mkPrintError(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("mk %s %s/%s %s", info.Version, info.OS, info.Arch, info.Go)
+	if info.Revision != "" {
+		fmt.Printf(" (%s", info.Revision)
+		if info.Modified {
+			fmt.Print(", modified")
+		}
+		fmt.Print(")")
+	}
+	fmt.Println()
+	return 0
+}
@@ -0,0 +1,421 @@
+// Warm starts: reusing the rules and the graph of the previous run, instead of
+// reading the mkfiles and matching the rules against the targets again.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sync/atomic"
+)
+
+var (
+	// Reuse the rules and the graph of the previous run if they are still
+	// valid.
+	warmStart bool
+
+	// Set once reading the mkfiles ran a command, asked for a parameter,
+	// fetched a secret or matched files, none of which the hashes of the
+	// mkfiles cover: their rules are then not saved for a warm start.
+	volatileRules atomic.Bool
+)
+
+// A pattern of a saved rule, by its source.
+type savedPattern struct {
+	Suffix bool
+	Simple string
+	Regexp string // "" if not a regular expression
+}
+
+// A rule of a saved rule set, with its attributes by their letters and its
+// dialect by its name. There is a field for every one of a rule.
+type savedRule struct {
+	Targets    []savedPattern
+	Attributes string
+	Prereqs    []string
+	Shell      []string
+	Recipe     string
+	Command    []string
+	IsMeta     bool
+	File       string
+	Line       int
+	Mkfile     string
+	Owner      string
+	Doc        string
+	Comment    string
+	Envdeps    []string
+	Dialect    string
+	Contents   []string
+	Umask      string
+	Mode       string
+	Expect     []string
+	Stdin      string
+	Depfile    string
+	Delegate   string
+	Dir        string
+	Exclusions []savedPattern
+}
+
+// A preset of a saved rule set.
+type savedPreset struct {
+	Targets []string
+	Vars    map[string][]string
+}
+
+// A rule set saved by a previous run, valid while the mkfiles it was read from
+// have the same hashes, and the environment and options the same key.
+type savedRules struct {
+	Key     string
+	Mkfiles []string
+	Hashes  []string
+	Vars    map[string][]string
+	Rules   []savedRule
+	Presets map[string]savedPreset
+}
+
+// Hash what reading the mkfiles depends on besides the mkfiles: the platform,
+// the dialect, the shell and the environment.
+func rulesKey(env map[string][]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", runtime.GOOS, runtime.GOARCH, dialectName, defaultShell)
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		fmt.Fprintf(h, "%q\x00%q\x00", name, env[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Hash the contents of a mkfile.
+func hashMkfile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+}
+
+func savePatterns(ps []pattern) []savedPattern {
+	var saved []savedPattern
+	for _, p := range ps {
+		sp := savedPattern{Suffix: p.issuffix, Simple: p.spat}
+		if p.rpat != nil {
+			sp.Regexp = p.rpat.String()
+		}
+		saved = append(saved, sp)
+	}
+	return saved
+}
+
+func loadPatterns(saved []savedPattern) ([]pattern, error) {
+	var ps []pattern
+	for _, sp := range saved {
+		p := pattern{issuffix: sp.Suffix, spat: sp.Simple}
+		if sp.Regexp != "" {
+			rpat, err := regexp.Compile(sp.Regexp)
+			if err != nil {
+				return nil, err
+			}
+			p.rpat = rpat
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// The name of a dialect, "" for none.
+func nameOfDialect(d *dialect) string {
+	for name, other := range dialects {
+		if d != nil && *d == other {
+			return name
+		}
+	}
+	return ""
+}
+
+// Save a rule set with the hashes of the mkfiles it was read from.
+func saveRules(w io.Writer, rs *ruleSet, key string) error {
+	saved := savedRules{Key: key, Mkfiles: rs.mkfiles, Vars: rs.vars, Presets: make(map[string]savedPreset)}
+	for _, path := range rs.mkfiles {
+		hash, err := hashMkfile(path)
+		if err != nil {
+			return err
+		}
+		saved.Hashes = append(saved.Hashes, hash)
+	}
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		saved.Rules = append(saved.Rules, savedRule{
+			Targets: savePatterns(r.targets), Attributes: r.attributes.String(), Prereqs: r.prereqs,
+			Shell: r.shell, Recipe: r.recipe, Command: r.command, IsMeta: r.ismeta, File: r.file,
+			Line: r.line, Mkfile: r.mkfile, Owner: r.owner, Doc: r.doc, Comment: r.comment,
+			Envdeps: r.envdeps, Dialect: nameOfDialect(r.dialect), Contents: r.contents,
+			Umask: r.umask, Mode: r.mode, Expect: r.expect, Stdin: r.stdin, Depfile: r.depfile,
+			Delegate: r.delegate, Dir: r.dir, Exclusions: savePatterns(r.exclusions),
+		})
+	}
+	for name, pr := range rs.presets {
+		saved.Presets[name] = savedPreset{pr.targets, pr.vars}
+	}
+	return gob.NewEncoder(w).Encode(saved)
+}
+
+// Load a saved rule set, if it has the key and the mkfiles it was read from
+// have not changed. Returns nil otherwise.
+func loadRules(r io.Reader, key string) *ruleSet {
+	var saved savedRules
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return nil
+	}
+	if saved.Key != key || len(saved.Mkfiles) == 0 || len(saved.Hashes) != len(saved.Mkfiles) {
+		return nil
+	}
+	for i, path := range saved.Mkfiles {
+		if hash, err := hashMkfile(path); err != nil || hash != saved.Hashes[i] {
+			return nil
+		}
+	}
+
+	wd, _ := filepath.Abs(".")
+	rs := &ruleSet{vars: saved.Vars,
+		rules:       make([]rule, 0, len(saved.Rules)),
+		targetrules: make(map[string][]int),
+		presets:     make(map[string]*preset),
+		mkfiles:     saved.Mkfiles,
+		projects:    map[string]bool{wd: true}}
+	if rs.vars == nil {
+		rs.vars = make(map[string][]string)
+	}
+	for _, sr := range saved.Rules {
+		r := rule{prereqs: sr.Prereqs, shell: sr.Shell, recipe: sr.Recipe, command: sr.Command,
+			ismeta: sr.IsMeta, file: sr.File, line: sr.Line, mkfile: sr.Mkfile, owner: sr.Owner,
+			doc: sr.Doc, comment: sr.Comment, envdeps: sr.Envdeps, contents: sr.Contents,
+			umask: sr.Umask, mode: sr.Mode, expect: sr.Expect, stdin: sr.Stdin, depfile: sr.Depfile,
+			delegate: sr.Delegate, dir: sr.Dir}
+		var err error
+		if r.targets, err = loadPatterns(sr.Targets); err != nil {
+			return nil
+		}
+		if r.exclusions, err = loadPatterns(sr.Exclusions); err != nil {
+			return nil
+		}
+		for _, c := range sr.Attributes {
+			r.attributes.set(c)
+		}
+		if sr.Dialect != "" {
+			d, ok := dialects[sr.Dialect]
+			if !ok {
+				return nil
+			}
+			r.dialect = &d
+		}
+		rs.add(r)
+	}
+	for name, sp := range saved.Presets {
+		rs.presets[name] = &preset{sp.Targets, sp.Vars}
+	}
+	return rs
+}
+
+// Read the rules of the mkfile, or with --warm-start load those of the
+// previous run if they are still valid. Rules read are saved for the next
+// run, unless in a dry run, or if reading them ran commands or matched files.
+func parseOrLoadRules(input io.Reader, name, path string, dryrun bool) *ruleSet {
+	env := environVars()
+	// a workspace collects the targets of other projects while parsing
+	if !warmStart || parseOnly || len(debugVars) > 0 || ws != nil {
+		return parse(input, name, path, env)
+	}
+
+	key := rulesKey(env)
+	if f, err := os.Open(filepath.Join(stateDir, "rules.gob")); err == nil {
+		rs := loadRules(f, key)
+		f.Close()
+		if rs != nil {
+			return rs
+		}
+	}
+
+	volatileRules.Store(false)
+	rs := parse(input, name, path, env)
+	if dryrun || volatileRules.Load() {
+		return rs
+	}
+	file, err := statePath("rules.gob")
+	if err == nil {
+		err = writeFileAtomic(file, func(w io.Writer) error {
+			return saveRules(w, rs, key)
+		})
+	}
+	if err != nil {
+		mkPrintWarning(fmt.Sprintf("saving the rules for a warm start: %v", err))
+	}
+	return rs
+}
+
+// A node of a saved graph.
+type savedNode struct {
+	Name    string
+	Virtual bool
+	Exists  bool // whether it existed, as matching meta-rules depends on it
+	Edges   []savedEdge
+}
+
+// An edge of a saved graph, rules are indexes into the rule set.
+type savedEdge struct {
+	V          int // index of the node, -1 if none
+	Rule       int
+	Stem       string
+	Matches    []string
+	Discovered bool
+}
+
+// A graph saved by a previous run, valid for the rule set with the given
+// hash.
+type savedGraph struct {
+	Rules string
+	Root  int
+	Nodes []savedNode
+}
+
+// Hash everything about the rules that the graph depends on.
+func hashRules(rs *ruleSet) string {
+	h := sha256.New()
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		fmt.Fprintf(h, "%d\x00%q\x00%v\x00%s\x00", i, r.describe(), r.ismeta, ruleFingerprint(r))
+	}
+	// the prerequisites found in depfiles are part of the graph too
+	if deps, err := os.ReadFile(depState.path); err == nil {
+		h.Write(deps)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Save a graph, with the existence of every node as it is now.
+func saveGraph(w io.Writer, g *graph, rs *ruleSet) error {
+	rules := make(map[*rule]int)
+	for i := range rs.rules {
+		rules[&rs.rules[i]] = i
+	}
+
+	index := make(map[*node]int)
+	var nodes []*node
+	var names []string
+	for _, u := range g.nodes {
+		index[u] = len(nodes)
+		nodes = append(nodes, u)
+		if !u.virtual {
+			names = append(names, u.name)
+		}
+	}
+	forgetStats()
+	if err := statNames(names); err != nil {
+		return err
+	}
+
+	saved := savedGraph{Rules: hashRules(rs), Root: index[g.root]}
+	for _, u := range nodes {
+		su := savedNode{Name: u.name, Virtual: u.virtual}
+		if !u.virtual {
+			su.Exists = statName(u.name).exists
+		}
+		for _, e := range u.prereqs {
+			se := savedEdge{V: -1, Rule: rules[e.r], Stem: e.stem, Matches: e.matches, Discovered: e.discovered}
+			if e.v != nil {
+				se.V = index[e.v]
+			}
+			su.Edges = append(su.Edges, se)
+		}
+		saved.Nodes = append(saved.Nodes, su)
+	}
+	return gob.NewEncoder(w).Encode(saved)
+}
+
+// Load a saved graph, if the rules are the same and every node still exists,
+// or not, as it did at the end of the previous run. Returns nil otherwise.
+func loadGraph(r io.Reader, rs *ruleSet) *graph {
+	var saved savedGraph
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return nil
+	}
+	if saved.Rules != hashRules(rs) || saved.Root < 0 || saved.Root >= len(saved.Nodes) {
+		return nil
+	}
+
+	var names []string
+	for _, su := range saved.Nodes {
+		if !su.Virtual {
+			names = append(names, su.Name)
+		}
+	}
+	if err := statNames(names); err != nil {
+		return nil
+	}
+
+	g := &graph{nil, make(map[string]*node), nil, make(map[string]*rule)}
+	nodes := make([]*node, len(saved.Nodes))
+	for i, su := range saved.Nodes {
+		nodes[i] = g.newnode(su.Name, su.Virtual)
+	}
+	for i, su := range saved.Nodes {
+		u := nodes[i]
+		u.updateTimestamp()
+		if !u.virtual && u.exists != su.Exists {
+			return nil
+		}
+		for _, se := range su.Edges {
+			if se.Rule < 0 || se.Rule >= len(rs.rules) || se.V >= len(nodes) {
+				return nil
+			}
+			var v *node
+			if se.V >= 0 {
+				v = nodes[se.V]
+			}
+			e := u.newedge(v, &rs.rules[se.Rule])
+			e.stem = se.Stem
+			e.matches = se.Matches
+			e.discovered = se.Discovered
+		}
+	}
+	g.root = nodes[saved.Root]
+	return g
+}
+
+// Build the graph for the rule set, starting from the graph of the previous
+// run with --warm-start.
+func buildOrLoadGraph(rs *ruleSet) *graph {
+	if !warmStart {
+		return buildgraph(rs, "")
+	}
+
+	path, err := statePath("graph.gob")
+	if err != nil {
+		mkError(err.Error())
+	}
+	if f, err := os.Open(path); err == nil {
+		g := loadGraph(f, rs)
+		f.Close()
+		if g != nil {
+			return g
+		}
+	}
+	return buildgraph(rs, "")
+}
+
+// Save the graph at the end of a run, for the next one to start from.
+func saveWarmStart(g *graph, rs *ruleSet) error {
+	path, err := statePath("graph.gob")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return saveGraph(w, g, rs)
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The hash of the rules changes with any of their attributes, not only with
+// their targets, prerequisites and recipes.
+func TestHashRules(t *testing.T) {
+	hashes := make(map[string]string)
+	for _, mkfile := range []string{
+		"a.o: a.c\n\tcc -c a.c\n",
+		"a.o:E: a.c\n\tcc -c a.c\n",
+		"a.o:umask=022: a.c\n\tcc -c a.c\n",
+		"a.o:stdin=a.c: a.c\n\tcc -c a.c\n",
+		"a.o:contents=*.c: a.c\n\tcc -c a.c\n",
+		"depends-env CC\na.o: a.c\n\tcc -c a.c\n",
+		"set dialect=gnu\na.o: a.c\n\tcc -c a.c\n",
+	} {
+		env := make(map[string][]string)
+		rs := parse(strings.NewReader(mkfile), "mkfile", "/mkfile", env)
+		h := hashRules(rs)
+		if other, ok := hashes[h]; ok {
+			t.Errorf("%q and %q hash the same", mkfile, other)
+		}
+		hashes[h] = mkfile
+	}
+}
+
+// A saved graph is loaded as it was, unless the rules or the files changed.
+func TestWarmStart(t *testing.T) {
+	defer forgetStats()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.c"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mkfile := "DIR=" + dir + "\n" +
+		"all:V: $DIR/a.o\n" +
+		"%.o: %.c\n\tcc -c $stem.c\n" +
+		"%.o: %.s\n\tas $stem.s\n"
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfile), "mkfile", "/mkfile", env)
+	g := buildgraph(rs, "all")
+
+	var saved bytes.Buffer
+	if err := saveGraph(&saved, g, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := loadGraph(bytes.NewReader(saved.Bytes()), rs)
+	if loaded == nil {
+		t.Fatal("the saved graph was not loaded")
+	}
+	if got, want := exportGraph(loaded), exportGraph(g); !reflect.DeepEqual(got, want) {
+		t.Errorf("the loaded graph is %v, expected %v", got, want)
+	}
+
+	changed := parse(strings.NewReader(mkfile+"b.o: a.o\n"), "mkfile", "/mkfile", env)
+	if loadGraph(bytes.NewReader(saved.Bytes()), changed) != nil {
+		t.Errorf("the saved graph was loaded, although the rules changed")
+	}
+
+	// a.s may change which rule matches a.o
+	if err := os.WriteFile(filepath.Join(dir, "a.s"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	forgetStats()
+	if loadGraph(bytes.NewReader(saved.Bytes()), rs) != nil {
+		t.Errorf("the saved graph was loaded, although a.s was created")
+	}
+}
+
+// A saved rule set is loaded as it was, unless a mkfile or the key changed.
+func TestWarmStartRules(t *testing.T) {
+	if got, want := reflect.TypeOf(savedRule{}).NumField(), reflect.TypeOf(rule{}).NumField(); got != want {
+		t.Fatalf("a saved rule has %d fields, a rule %d", got, want)
+	}
+
+	dir := t.TempDir()
+	include := filepath.Join(dir, "cc.mk")
+	if err := os.WriteFile(include, []byte("%.o:E owner=cc: %.c !main.c\n\tcc -c $stem.c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mkfile := "CC = cc\n" +
+		"preset ci: prog MODE=release\n" +
+		"<" + include + "\n" +
+		"set dialect=plan9\n" +
+		"## Link the program.\n" +
+		"prog:Q: a.o\n\tcc -o prog a.o\n" +
+		"(.*)\\.txt:R: \\1.md\n\tpandoc $prereq\n"
+	path := filepath.Join(dir, "mkfile")
+	if err := os.WriteFile(path, []byte(mkfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string][]string)
+	rs := parse(strings.NewReader(mkfile), "mkfile", path, env)
+
+	var saved bytes.Buffer
+	if err := saveRules(&saved, rs, "key"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadRules(bytes.NewReader(saved.Bytes()), "key")
+	if loaded == nil {
+		t.Fatal("the saved rules were not loaded")
+	}
+	if len(loaded.rules) != len(rs.rules) {
+		t.Fatalf("%d rules were loaded, expected %d", len(loaded.rules), len(rs.rules))
+	}
+	for i := range rs.rules {
+		r, l := &rs.rules[i], &loaded.rules[i]
+		if ruleFingerprint(l) != ruleFingerprint(r) || l.describe() != r.describe() ||
+			l.doc != r.doc || l.owner != r.owner || l.ismeta != r.ismeta {
+			t.Errorf("%s was loaded as %s", ruleFingerprint(r), ruleFingerprint(l))
+		}
+	}
+	if !reflect.DeepEqual(loaded.targetrules, rs.targetrules) || !reflect.DeepEqual(loaded.vars, rs.vars) ||
+		!reflect.DeepEqual(loaded.presets, rs.presets) || !reflect.DeepEqual(loaded.mkfiles, rs.mkfiles) {
+		t.Errorf("the rule set was not loaded as it was")
+	}
+
+	if loadRules(bytes.NewReader(saved.Bytes()), "other") != nil {
+		t.Errorf("the saved rules were loaded with another key")
+	}
+	if err := os.WriteFile(include, []byte("%.o: %.c\n\tcc -c $stem.c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if loadRules(bytes.NewReader(saved.Bytes()), "key") != nil {
+		t.Errorf("the saved rules were loaded, although an include changed")
+	}
+}
+
+// A warm start reads the mkfiles only once they change, and not at all if they
+// run commands.
+func TestWarmStartParse(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mkfile": "reproducible <|sh gen.sh\n",
+		"gen.sh": "echo run >> runs\nprintf 'all:V:\\n\\techo all\\n'\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		if _, _, err := startMk("-C", dir, "--warm-start"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+	}
+	if runs, _ := os.ReadFile(filepath.Join(dir, "runs")); string(runs) != "run\n" {
+		t.Errorf("the mkfile was read %d times", strings.Count(string(runs), "run"))
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "mkfile"), []byte("<|sh gen.sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, _, err := startMk("-C", dir, "--warm-start"); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+	}
+	if runs, _ := os.ReadFile(filepath.Join(dir, "runs")); string(runs) != "run\nrun\nrun\n" {
+		t.Errorf("the mkfile running a command was read %d times, not every time", strings.Count(string(runs), "run")-1)
+	}
+}
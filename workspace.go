@@ -0,0 +1,244 @@
+// Targets of other projects. A prerequisite dir//target names a target of the
+// mkfile in another directory, which is read into the same graph. With -W, a
+// mkwork file names the roots of several projects, and their mkfiles refer to
+// each other's targets as //project:target; mk makes such a target by running
+// mk in its project, so that the project's own mkfile and variables decide
+// whether and how it is made.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Name of the file listing the projects of a workspace.
+const workspaceFileName = "mkwork"
+
+// The workspace of -W, nil without it.
+var ws *workspace
+
+type workspace struct {
+	root     string            // directory of the mkwork file
+	projects map[string]string // absolute root directory of each project
+	names    []string          // of the projects, in the order of the mkwork file
+
+	// targets of other projects the mkfiles refer to, by their path from
+	// the working directory
+	refs map[string]workspaceRef
+}
+
+// A target of another project.
+type workspaceRef struct {
+	dir    string // root of the project
+	target string // as the mkfile of the project names it
+}
+
+// Find the mkwork file in the working directory or the closest of its parents
+// and read it.
+func loadWorkspace() (*workspace, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		path := filepath.Join(dir, workspaceFileName)
+		if _, err := os.Stat(path); err == nil {
+			return readWorkspace(path)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, fmt.Errorf("no %s found in this directory or its parents", workspaceFileName)
+		}
+		dir = parent
+	}
+}
+
+// Read a mkwork file: a project on each line, its name and its directory
+// relative to the file, and comments starting with '#'.
+func readWorkspace(path string) (*workspace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := &workspace{
+		root:     filepath.Dir(path),
+		projects: make(map[string]string),
+		refs:     make(map[string]workspaceRef),
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) != 2:
+			return nil, fmt.Errorf("%s:%d: expected a project's name and its directory", path, line)
+		case strings.ContainsAny(fields[0], ":/"):
+			return nil, fmt.Errorf("%s:%d: project name %q contains ':' or '/'", path, line, fields[0])
+		}
+		if _, ok := w.projects[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: project %s is listed twice", path, line, fields[0])
+		}
+		dir := fields[1]
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(w.root, dir)
+		}
+		w.projects[fields[0]] = filepath.Clean(dir)
+		w.names = append(w.names, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Whether a word is the start of a reference to another project, up to the
+// colon before the target.
+func isProjectRef(word string) bool {
+	project, ok := strings.CutPrefix(word, "//")
+	return ok && project != "" && !strings.ContainsAny(project, "/:")
+}
+
+// Turn a reference //project:target into the path of the target from the
+// working directory, remembering it unless the project is the one mk runs in.
+// Other names are returned as they are.
+func (w *workspace) resolve(name string) (string, error) {
+	ref, ok := strings.CutPrefix(name, "//")
+	if !ok {
+		return name, nil
+	}
+	project, target, ok := strings.Cut(ref, ":")
+	if !ok || project == "" || target == "" {
+		return "", fmt.Errorf("%s: a reference to another project is //project:target", name)
+	}
+	dir, ok := w.projects[project]
+	if !ok {
+		return "", fmt.Errorf("%s: no project %s in %s, the projects are: %s",
+			name, project, filepath.Join(w.root, workspaceFileName), strings.Join(w.names, " "))
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if dir == wd {
+		return target, nil
+	}
+	path, err := filepath.Rel(wd, filepath.Join(dir, target))
+	if err != nil {
+		return "", err
+	}
+	w.refs[path] = workspaceRef{dir: dir, target: target}
+	return path, nil
+}
+
+// Add a rule making each target of another project, by running mk in the
+// project, unless the mkfiles have one already.
+func (w *workspace) addRules(rs *ruleSet) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	quote := shquote
+	if filepath.Base(strings.Fields(defaultShell)[0]) == "rc" {
+		quote = rcquote
+	}
+	for _, path := range slices.Sorted(maps.Keys(w.refs)) {
+		if len(rs.targetrules[path]) > 0 {
+			continue
+		}
+		ref := w.refs[path]
+		r := rule{}
+		r.targets = []pattern{{false, path, nil}}
+		r.recipe = strings.Join([]string{quote(exe), "-W", "-C", quote(ref.dir), quote(ref.target)}, " ") + "\n"
+		r.attributes.exclusive = true
+		r.delegate = ref.dir
+		r.file = filepath.Join(w.root, workspaceFileName)
+		rs.add(r)
+	}
+	return nil
+}
+
+// Expand the targets given at the root of a workspace, which has no mkfile of
+// its own, into those of every project.
+func (w *workspace) projectTargets(targets []string) []string {
+	var expanded []string
+	for _, target := range targets {
+		if strings.HasPrefix(target, "//") {
+			expanded = append(expanded, target)
+			continue
+		}
+		for _, name := range w.names {
+			expanded = append(expanded, "//"+name+":"+target)
+		}
+	}
+	return expanded
+}
+
+// Split a reference dir//target to a target of the mkfile in another
+// directory. URLs are not references.
+func cutDirRef(name string) (dir, target string, ok bool) {
+	dir, target, ok = strings.Cut(name, "//")
+	if !ok || dir == "" || target == "" || strings.HasSuffix(dir, ":") || strings.Contains(target, "//") {
+		return "", "", false
+	}
+	return dir, target, true
+}
+
+// Read the mkfile of the directory of a reference into the rules, once, and
+// return the path of its target from the working directory. The directory is
+// relative to the project of the mkfile referring to it. A project being read
+// is not read again, so projects may refer to each other; cycles between
+// their targets are found in the graph.
+func (p *parser) importProject(dir, target string, tok token) string {
+	dir = filepath.Join(p.rules.project, dir)
+	if filepath.IsAbs(dir) {
+		wd, err := os.Getwd()
+		if err != nil {
+			mkError(err.Error())
+		}
+		if rel, err := filepath.Rel(wd, dir); err == nil {
+			dir = rel
+		}
+	}
+	mkfile := filepath.Join(dir, "mkfile")
+	path, err := filepath.Abs(mkfile)
+	if err != nil {
+		mkError("unable to find mkfile's absolute path")
+	}
+
+	if root := filepath.Dir(path); !p.rules.projects[root] {
+		p.rules.projects[root] = true
+		input, err := os.Open(mkfile)
+		if err != nil {
+			p.basicErrorAtToken(fmt.Sprintf("%s//%s: cannot open %s", dir, target, mkfile), tok)
+		}
+		defer input.Close()
+
+		// the project has variables, settings and namespaces of its own
+		rs := p.rules
+		vars, settings, namespaces, project := rs.vars, rs.settings, rs.namespaces, rs.project
+		rs.vars = environVars()
+		maps.Copy(rs.vars, rs.overrides)
+		setBuiltinVars(rs.vars)
+		rs.settings, rs.namespaces, rs.project = fileSettings{}, nil, ""
+		if dir != "." {
+			rs.project = filepath.ToSlash(dir) + "/"
+		}
+		parseInto(input, mkfile, rs, path)
+		rs.vars, rs.settings, rs.namespaces, rs.project = vars, settings, namespaces, project
+	}
+
+	if dir == "." {
+		return target
+	}
+	return filepath.ToSlash(dir) + "/" + target
+}